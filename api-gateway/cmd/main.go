@@ -11,6 +11,7 @@ import (
 	"github.com/hero/microservice/api-gateway/internal/middleware"
 	"github.com/hero/microservice/api-gateway/internal/routes"
 	"github.com/hero/microservice/pkg/cache"
+	"github.com/hero/microservice/pkg/identity"
 )
 
 func main() {
@@ -20,6 +21,9 @@ func main() {
 		OrderServiceURL:        getEnv("ORDER_SERVICE_URL", "http://localhost:8003"),
 		NotificationServiceURL: getEnv("NOTIFICATION_SERVICE_URL", "http://localhost:8004"),
 	}
+	if getEnv("AUTH_MODE", "session") == "jwt" {
+		cfg.JWKSURL = getEnv("JWKS_URL", cfg.UserServiceURL+"/.well-known/jwks.json")
+	}
 
 	// Redis
 	rdb, err := cache.NewRedisClient(
@@ -42,10 +46,15 @@ func main() {
 		json.NewEncoder(w).Encode(map[string]string{"service": "api-gateway", "status": "running"})
 	})
 
-	routes.SetupRoutes(mux, cfg, rdb)
+	// Signs the identity assertion forwarded to downstream services
+	signer := identity.NewSigner(mustEnv("IDENTITY_SECRET"), time.Minute)
+
+	routes.SetupRoutes(mux, cfg, rdb, signer)
 
-	// Apply rate limiting to all routes
-	handler := middleware.RateLimitMiddleware(rdb, rateLimit, time.Duration(rateWindow)*time.Second)(mux)
+	// Apply rate limiting and identity header stripping to all routes
+	handler := middleware.RateLimitMiddleware(rdb, rateLimit, time.Duration(rateWindow)*time.Second)(
+		middleware.StripIdentityHeaders(mux),
+	)
 
 	port := getEnv("SERVER_PORT", "8080")
 	log.Printf("API Gateway starting on port %s", port)
@@ -60,3 +69,12 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+// mustEnv reads a setting that has no safe default, such as a secret.
+func mustEnv(key string) string {
+	val := os.Getenv(key)
+	if val == "" {
+		log.Fatalf("%s must be set", key)
+	}
+	return val
+}
@@ -3,6 +3,7 @@ module github.com/hero/microservice/api-gateway
 go 1.25.0
 
 require (
+	github.com/golang-jwt/jwt/v5 v5.3.1
 	github.com/hero/microservice/pkg v0.0.0
 	github.com/redis/go-redis/v9 v9.18.0
 )
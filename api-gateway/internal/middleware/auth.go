@@ -4,48 +4,112 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+	"strings"
 
+	"github.com/hero/microservice/pkg/identity"
 	"github.com/redis/go-redis/v9"
 )
 
-func AuthMiddleware(rdb *redis.Client) func(http.Handler) http.Handler {
+// StripIdentityHeaders drops client-supplied identity headers on every
+// route, public or not; only AuthMiddleware may set them.
+func StripIdentityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, h := range identity.Headers {
+			r.Header.Del(h)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AuthMiddleware accepts either an opaque Redis session token or, when a
+// verifier is configured, a JWT access token issued by user-service. The
+// authenticated identity is forwarded as a signed assertion.
+func AuthMiddleware(rdb *redis.Client, verifier *JWTVerifier, signer *identity.Signer) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Identity headers are only ever set by the gateway
+			for _, h := range identity.Headers {
+				r.Header.Del(h)
+			}
+
 			token := r.Header.Get("Authorization")
 			if len(token) > 7 && token[:7] == "Bearer " {
 				token = token[7:]
 			}
 
 			if token == "" {
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusUnauthorized)
-				json.NewEncoder(w).Encode(map[string]string{"error": "missing token"})
+				writeError(w, http.StatusUnauthorized, "missing token")
 				return
 			}
 
-			val, err := rdb.Get(context.Background(), "session:"+token).Result()
-			if err == redis.Nil {
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusUnauthorized)
-				json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired session"})
+			var userID string
+			var roles []string
+
+			if verifier != nil && looksLikeJWT(token) {
+				claims, err := verifier.Verify(token)
+				if err != nil {
+					writeError(w, http.StatusUnauthorized, "invalid or expired token")
+					return
+				}
+
+				revoked, err := rdb.Exists(context.Background(), "revoked_session:"+claims.SessionID).Result()
+				if err != nil {
+					writeError(w, http.StatusInternalServerError, "session validation failed")
+					return
+				}
+				if revoked > 0 {
+					writeError(w, http.StatusUnauthorized, "session revoked")
+					return
+				}
+
+				userID, roles = claims.Subject, claims.Roles
+			} else {
+				val, err := rdb.Get(context.Background(), "session:"+token).Result()
+				if err == redis.Nil {
+					writeError(w, http.StatusUnauthorized, "invalid or expired session")
+					return
+				}
+				if err != nil {
+					writeError(w, http.StatusInternalServerError, "session validation failed")
+					return
+				}
+
+				// Parse user from session
+				var user struct {
+					ID    string   `json:"id"`
+					Roles []string `json:"roles"`
+				}
+				if err := json.Unmarshal([]byte(val), &user); err == nil {
+					userID, roles = user.ID, user.Roles
+				}
+			}
+
+			if userID == "" {
+				writeError(w, http.StatusUnauthorized, "invalid or expired session")
 				return
 			}
+
+			assertion, err := signer.Sign(identity.Principal{UserID: userID, Roles: roles})
 			if err != nil {
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusInternalServerError)
-				json.NewEncoder(w).Encode(map[string]string{"error": "session validation failed"})
+				writeError(w, http.StatusInternalServerError, "failed to sign identity")
 				return
 			}
 
-			// Parse user from session and add user_id to header for downstream services
-			var user map[string]interface{}
-			if err := json.Unmarshal([]byte(val), &user); err == nil {
-				if id, ok := user["id"].(string); ok {
-					r.Header.Set("X-User-ID", id)
-				}
+			// Add identity headers for downstream services; only the signed
+			// assertion is trusted by them
+			r.Header.Set(identity.AssertionHeader, assertion)
+			r.Header.Set("X-User-ID", userID)
+			if len(roles) > 0 {
+				r.Header.Set("X-User-Roles", strings.Join(roles, ","))
 			}
 
 			next.ServeHTTP(w, r)
 		})
 	}
 }
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
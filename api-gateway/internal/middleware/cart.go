@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/hero/microservice/pkg/carttoken"
+)
+
+// GuestCart forwards the cart token cookie as carttoken.Header. With issue
+// set, requests without a valid cookie get a new token.
+func GuestCart(issue bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Header.Del(carttoken.Header)
+
+			token := ""
+			if cookie, err := r.Cookie(carttoken.CookieName); err == nil && carttoken.Valid(cookie.Value) {
+				token = cookie.Value
+			} else if issue {
+				var err error
+				if token, err = carttoken.New(); err != nil {
+					writeError(w, http.StatusInternalServerError, "failed to issue cart token")
+					return
+				}
+				http.SetCookie(w, &http.Cookie{
+					Name:     carttoken.CookieName,
+					Value:    token,
+					Path:     "/",
+					MaxAge:   int(carttoken.TTL.Seconds()),
+					HttpOnly: true,
+					Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+					SameSite: http.SameSiteLaxMode,
+				})
+			}
+
+			if token != "" {
+				r.Header.Set(carttoken.Header, token)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// GuestOrAuth runs auth for requests that carry credentials and treats the
+// rest as guests identified by their cart token.
+func GuestOrAuth(auth func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		authed := auth(next)
+		guest := GuestCart(true)(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "" {
+				r.Header.Del(carttoken.Header)
+				authed.ServeHTTP(w, r)
+				return
+			}
+			guest.ServeHTTP(w, r)
+		})
+	}
+}
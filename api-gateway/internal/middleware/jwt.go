@@ -0,0 +1,149 @@
+package middleware
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const jwtIssuer = "user-service"
+
+// minRefetchInterval throttles JWKS fetches triggered by unknown key ids so
+// garbage tokens cannot be used to hammer user-service.
+const minRefetchInterval = 30 * time.Second
+
+type AccessClaims struct {
+	Roles     []string `json:"roles"`
+	SessionID string   `json:"sid"`
+	jwt.RegisteredClaims
+}
+
+// JWTVerifier validates access tokens locally against the public keys
+// published by user-service at its JWKS endpoint.
+type JWTVerifier struct {
+	jwksURL string
+	client  *http.Client
+
+	mu          sync.RWMutex
+	keys        map[string]*rsa.PublicKey
+	lastFetched time.Time
+}
+
+func NewJWTVerifier(jwksURL string) *JWTVerifier {
+	v := &JWTVerifier{
+		jwksURL: jwksURL,
+		client:  &http.Client{Timeout: 5 * time.Second},
+		keys:    make(map[string]*rsa.PublicKey),
+	}
+	if err := v.refresh(); err != nil {
+		log.Printf("Initial JWKS fetch failed, will retry on demand: %v", err)
+	}
+	return v
+}
+
+func (v *JWTVerifier) Verify(raw string) (*AccessClaims, error) {
+	claims := &AccessClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, v.keyFunc,
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}),
+		jwt.WithIssuer(jwtIssuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" || claims.SessionID == "" {
+		return nil, errors.New("token is missing subject or session")
+	}
+	return claims, nil
+}
+
+func (v *JWTVerifier) keyFunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	if key := v.key(kid); key != nil {
+		return key, nil
+	}
+
+	// Unknown kid: user-service may have rotated its key
+	if err := v.refresh(); err != nil {
+		return nil, err
+	}
+	if key := v.key(kid); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (v *JWTVerifier) key(kid string) *rsa.PublicKey {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.keys[kid]
+}
+
+func (v *JWTVerifier) refresh() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if time.Since(v.lastFetched) < minRefetchInterval {
+		return nil
+	}
+	v.lastFetched = time.Now()
+
+	resp, err := v.client.Get(v.jwksURL)
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch JWKS: status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("failed to decode JWKS: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	v.keys = keys
+	log.Printf("Loaded %d JWKS signing key(s)", len(keys))
+	return nil
+}
+
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+)
+
+// RoutePolicy restricts a method + path to the listed roles. Path segments
+// starting with ":" match any single segment, e.g. "/api/users/:id".
+type RoutePolicy struct {
+	Method string
+	Path   string
+	Roles  []string
+}
+
+func (p RoutePolicy) matches(method, path string) bool {
+	if p.Method != method {
+		return false
+	}
+
+	want := strings.Split(strings.Trim(p.Path, "/"), "/")
+	got := strings.Split(strings.Trim(path, "/"), "/")
+	if len(want) != len(got) {
+		return false
+	}
+
+	for i, seg := range want {
+		if strings.HasPrefix(seg, ":") {
+			if got[i] == "" {
+				return false
+			}
+			continue
+		}
+		if seg != got[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// RBACMiddleware enforces policies against the X-User-Roles header set by
+// AuthMiddleware, so it must run after it. Requests that match no policy
+// only need to be authenticated.
+func RBACMiddleware(policies []RoutePolicy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, policy := range policies {
+				if !policy.matches(r.Method, r.URL.Path) {
+					continue
+				}
+
+				if !hasAnyRole(r.Header.Get("X-User-Roles"), policy.Roles) {
+					writeError(w, http.StatusForbidden, "insufficient permissions")
+					return
+				}
+				break
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func hasAnyRole(header string, allowed []string) bool {
+	for _, role := range strings.Split(header, ",") {
+		role = strings.TrimSpace(role)
+		for _, a := range allowed {
+			if role == a {
+				return true
+			}
+		}
+	}
+	return false
+}
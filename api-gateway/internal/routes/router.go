@@ -6,6 +6,7 @@ import (
 
 	"github.com/hero/microservice/api-gateway/internal/middleware"
 	"github.com/hero/microservice/api-gateway/internal/proxy"
+	"github.com/hero/microservice/pkg/identity"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -14,9 +15,39 @@ type ServiceConfig struct {
 	ProductServiceURL      string
 	OrderServiceURL        string
 	NotificationServiceURL string
+	// JWKSURL enables local verification of JWT access tokens when set
+	JWKSURL string
 }
 
-func SetupRoutes(mux *http.ServeMux, cfg ServiceConfig, rdb *redis.Client) {
+var adminOnly = []string{"admin"}
+
+// Policies lists the routes that need more than an authenticated session.
+var Policies = []middleware.RoutePolicy{
+	{Method: http.MethodPost, Path: "/api/products", Roles: adminOnly},
+	{Method: http.MethodPost, Path: "/api/products/import", Roles: adminOnly},
+	{Method: http.MethodGet, Path: "/api/products/export", Roles: adminOnly},
+	{Method: http.MethodPut, Path: "/api/products/:id", Roles: adminOnly},
+	{Method: http.MethodPut, Path: "/api/products/:id/stock", Roles: adminOnly},
+	{Method: http.MethodDelete, Path: "/api/products/:id", Roles: adminOnly},
+	{Method: http.MethodPost, Path: "/api/products/:id/variants", Roles: adminOnly},
+	{Method: http.MethodPut, Path: "/api/products/:id/variants/:variantId", Roles: adminOnly},
+	{Method: http.MethodPut, Path: "/api/products/:id/variants/:variantId/stock", Roles: adminOnly},
+	{Method: http.MethodGet, Path: "/api/products/:id/movements", Roles: adminOnly},
+	{Method: http.MethodPost, Path: "/api/categories", Roles: adminOnly},
+	{Method: http.MethodPut, Path: "/api/categories/:id", Roles: adminOnly},
+	{Method: http.MethodDelete, Path: "/api/categories/:id", Roles: adminOnly},
+	{Method: http.MethodGet, Path: "/api/orders", Roles: adminOnly},
+	{Method: http.MethodPut, Path: "/api/orders/:id/status", Roles: adminOnly},
+	{Method: http.MethodDelete, Path: "/api/users/:id", Roles: adminOnly},
+	{Method: http.MethodGet, Path: "/api/users/:id/roles", Roles: adminOnly},
+	{Method: http.MethodPost, Path: "/api/users/:id/roles", Roles: adminOnly},
+	{Method: http.MethodDelete, Path: "/api/users/:id/roles/:role", Roles: adminOnly},
+	{Method: http.MethodGet, Path: "/api/admin/dead-letters/:service", Roles: adminOnly},
+	{Method: http.MethodGet, Path: "/api/admin/dead-letters/:service/:id", Roles: adminOnly},
+	{Method: http.MethodPost, Path: "/api/admin/dead-letters/:service/:id/replay", Roles: adminOnly},
+}
+
+func SetupRoutes(mux *http.ServeMux, cfg ServiceConfig, rdb *redis.Client, signer *identity.Signer) {
 	userProxy, err := proxy.NewReverseProxy(cfg.UserServiceURL)
 	if err != nil {
 		log.Fatal("Failed to create user service proxy: ", err)
@@ -37,24 +68,58 @@ func SetupRoutes(mux *http.ServeMux, cfg ServiceConfig, rdb *redis.Client) {
 		log.Fatal("Failed to create notification service proxy: ", err)
 	}
 
-	auth := middleware.AuthMiddleware(rdb)
+	var verifier *middleware.JWTVerifier
+	if cfg.JWKSURL != "" {
+		verifier = middleware.NewJWTVerifier(cfg.JWKSURL)
+	}
+
+	auth := middleware.AuthMiddleware(rdb, verifier, signer)
+	rbac := middleware.RBACMiddleware(Policies)
+	protect := func(h http.Handler) http.Handler {
+		return auth(rbac(h))
+	}
 
 	// Public routes (no auth)
 	mux.Handle("/api/users/register", userProxy)
-	mux.Handle("/api/users/login", userProxy)
-	mux.Handle("/api/products/", productProxy)
-	mux.Handle("/api/products", productProxy)
+	// Login passes the guest cart token along so the cart can be merged
+	mux.Handle("/api/users/login", middleware.GuestCart(false)(userProxy))
+	mux.Handle("/api/users/refresh", userProxy)
+	// The export and the stock ledger are for admins, so they stay behind auth
+	mux.Handle("GET /api/products/export", protect(productProxy))
+	mux.Handle("GET /api/products/{id}/movements", protect(productProxy))
+	mux.Handle("GET /api/products/", productProxy)
+	mux.Handle("GET /api/products", productProxy)
+	mux.Handle("GET /api/categories/", productProxy)
+	mux.Handle("GET /api/categories", productProxy)
+	mux.Handle("POST /api/payments/webhook", orderProxy)
 
 	// Protected routes (require auth)
-	mux.Handle("/api/users/logout", auth(userProxy))
-	mux.Handle("/api/users/me", auth(userProxy))
-	mux.Handle("/api/users/", auth(userProxy))
+	mux.Handle("/api/products/", protect(productProxy))
+	mux.Handle("/api/products", protect(productProxy))
+	mux.Handle("/api/categories/", protect(productProxy))
+	mux.Handle("/api/categories", protect(productProxy))
+
+	mux.Handle("/api/users/logout", protect(userProxy))
+	mux.Handle("/api/users/me", protect(userProxy))
+	mux.Handle("/api/users/", protect(userProxy))
+
+	mux.Handle("/api/orders/", protect(orderProxy))
+	mux.Handle("/api/orders", protect(orderProxy))
+
+	mux.Handle("/api/payments/", protect(orderProxy))
 
-	mux.Handle("/api/orders/", auth(orderProxy))
-	mux.Handle("/api/orders", auth(orderProxy))
+	// Guests shop with a cart token cookie, signed-in users with their account
+	cart := middleware.GuestOrAuth(protect)
+	mux.Handle("/api/cart/", cart(orderProxy))
+	mux.Handle("/api/cart", cart(orderProxy))
 
-	mux.Handle("/api/cart/", auth(orderProxy))
-	mux.Handle("/api/cart", auth(orderProxy))
+	mux.Handle("/api/notifications/", protect(notifProxy))
 
-	mux.Handle("/api/notifications/", auth(notifProxy))
+	// Dead-letter inspection and replay, one prefix per consuming service
+	mux.Handle("/api/admin/dead-letters/product", protect(productProxy))
+	mux.Handle("/api/admin/dead-letters/product/", protect(productProxy))
+	mux.Handle("/api/admin/dead-letters/order", protect(orderProxy))
+	mux.Handle("/api/admin/dead-letters/order/", protect(orderProxy))
+	mux.Handle("/api/admin/dead-letters/notification", protect(notifProxy))
+	mux.Handle("/api/admin/dead-letters/notification/", protect(notifProxy))
 }
@@ -78,30 +78,160 @@ CREATE TABLE user_schema.user_roles (
     PRIMARY KEY (user_id, role_id)
 );
 
+-- Domain events written in the same transaction as the change, relayed to RabbitMQ
+CREATE TABLE user_schema.outbox (
+    id UUID PRIMARY KEY,
+    exchange VARCHAR(100) NOT NULL,
+    routing_key VARCHAR(100) NOT NULL,
+    payload JSONB NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    sent_at TIMESTAMP
+);
+
+CREATE INDEX idx_user_outbox_pending ON user_schema.outbox (next_attempt_at) WHERE sent_at IS NULL;
+
 -- ==================== product_schema ====================
 
 CREATE TABLE product_schema.categories (
     id SERIAL PRIMARY KEY,
-    name VARCHAR(100) UNIQUE NOT NULL
+    name VARCHAR(100) NOT NULL,
+    slug VARCHAR(120) UNIQUE NOT NULL,
+    parent_id INT REFERENCES product_schema.categories(id) ON DELETE RESTRICT,
+    created_at TIMESTAMP DEFAULT NOW(),
+    updated_at TIMESTAMP DEFAULT NOW(),
+    -- Names are unique among siblings, top-level categories included
+    UNIQUE NULLS NOT DISTINCT (parent_id, name)
 );
 
+CREATE INDEX idx_categories_parent ON product_schema.categories (parent_id);
+
 CREATE TABLE product_schema.products (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     name VARCHAR(200) NOT NULL,
     description TEXT,
     price DECIMAL(10, 2) NOT NULL,
     category_id INT REFERENCES product_schema.categories(id) ON DELETE SET NULL,
+    -- active, draft or archived; archived products are kept for order history
+    status VARCHAR(20) NOT NULL DEFAULT 'active',
+    deleted_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW(),
+    updated_at TIMESTAMP DEFAULT NOW(),
+    -- Catalog search; names weigh more than descriptions
+    search_vector TSVECTOR GENERATED ALWAYS AS (
+        setweight(to_tsvector('english', coalesce(name, '')), 'A') ||
+        setweight(to_tsvector('english', coalesce(description, '')), 'B')
+    ) STORED
+);
+
+CREATE INDEX idx_products_search ON product_schema.products USING GIN (search_vector);
+-- Keyset pagination in the catalog sort orders; only active products are listed.
+-- Price sorts by the default variant's price, which no index on products covers
+CREATE INDEX idx_products_created ON product_schema.products (created_at, id) WHERE status = 'active';
+CREATE INDEX idx_products_name ON product_schema.products (name, id) WHERE status = 'active';
+CREATE INDEX idx_products_category ON product_schema.products (category_id, created_at, id) WHERE status = 'active';
+
+-- Purchasable versions of a product (size, color, ...), each with its own
+-- SKU and inventory. Every product has exactly one default variant.
+CREATE TABLE product_schema.product_variants (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    product_id UUID NOT NULL REFERENCES product_schema.products(id) ON DELETE CASCADE,
+    sku VARCHAR(64) NOT NULL UNIQUE,
+    options JSONB NOT NULL DEFAULT '{}',
+    -- Overrides the product's price when set
+    price DECIMAL(10, 2),
+    is_default BOOLEAN NOT NULL DEFAULT FALSE,
     created_at TIMESTAMP DEFAULT NOW(),
     updated_at TIMESTAMP DEFAULT NOW()
 );
 
+CREATE INDEX idx_variants_product ON product_schema.product_variants (product_id);
+CREATE UNIQUE INDEX idx_variants_default ON product_schema.product_variants (product_id) WHERE is_default;
+
+-- One row per variant; product_id is kept to total stock per product
 CREATE TABLE product_schema.inventory (
     id SERIAL PRIMARY KEY,
-    product_id UUID UNIQUE REFERENCES product_schema.products(id) ON DELETE CASCADE,
+    product_id UUID REFERENCES product_schema.products(id) ON DELETE CASCADE,
+    variant_id UUID UNIQUE REFERENCES product_schema.product_variants(id) ON DELETE CASCADE,
     quantity INT NOT NULL DEFAULT 0,
     updated_at TIMESTAMP DEFAULT NOW()
 );
 
+CREATE INDEX idx_inventory_product ON product_schema.inventory (product_id);
+
+CREATE TABLE product_schema.stock_reservations (
+    id SERIAL PRIMARY KEY,
+    order_id UUID NOT NULL,
+    product_id UUID NOT NULL REFERENCES product_schema.products(id) ON DELETE CASCADE,
+    variant_id UUID REFERENCES product_schema.product_variants(id) ON DELETE CASCADE,
+    quantity INT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'reserved',
+    created_at TIMESTAMP DEFAULT NOW(),
+    updated_at TIMESTAMP DEFAULT NOW(),
+    UNIQUE (order_id, variant_id)
+);
+
+-- Append-only stock ledger, written in the same transaction as every change
+-- of inventory.quantity. A variant's deltas add up to its quantity.
+CREATE TABLE product_schema.inventory_movements (
+    id BIGSERIAL PRIMARY KEY,
+    product_id UUID NOT NULL REFERENCES product_schema.products(id) ON DELETE CASCADE,
+    variant_id UUID NOT NULL REFERENCES product_schema.product_variants(id) ON DELETE CASCADE,
+    delta INT NOT NULL,
+    quantity_after INT NOT NULL,
+    reason VARCHAR(20) NOT NULL CHECK (reason IN ('restock', 'order', 'cancel', 'adjustment')),
+    -- Order id for order and cancel, otherwise what the caller recorded
+    reference_id VARCHAR(100) NOT NULL DEFAULT '',
+    -- User id, or 'system' for changes made by the order saga
+    actor VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_movements_product ON product_schema.inventory_movements (product_id, id DESC);
+CREATE INDEX idx_movements_variant ON product_schema.inventory_movements (variant_id);
+
+-- Domain events written in the same transaction as the change, relayed to RabbitMQ
+CREATE TABLE product_schema.outbox (
+    id UUID PRIMARY KEY,
+    exchange VARCHAR(100) NOT NULL,
+    routing_key VARCHAR(100) NOT NULL,
+    payload JSONB NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    sent_at TIMESTAMP
+);
+
+CREATE INDEX idx_product_outbox_pending ON product_schema.outbox (next_attempt_at) WHERE sent_at IS NULL;
+
+-- Messages that exhausted their consumer retries, kept for inspection and replay
+CREATE TABLE product_schema.dead_letters (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    message_id VARCHAR(100),
+    queue VARCHAR(200) NOT NULL,
+    exchange VARCHAR(100),
+    routing_key VARCHAR(200),
+    error TEXT,
+    attempts INT NOT NULL DEFAULT 0,
+    headers JSONB,
+    payload TEXT NOT NULL,
+    replay_count INT NOT NULL DEFAULT 0,
+    replayed_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX idx_product_dead_letters_created ON product_schema.dead_letters (created_at DESC);
+
+-- Ids of consumed events, claimed in the same transaction as the handler's writes
+CREATE TABLE product_schema.processed_events (
+    event_id VARCHAR(100) PRIMARY KEY,
+    event_type VARCHAR(100) NOT NULL,
+    processed_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
 -- ==================== order_schema ====================
 
 CREATE TABLE order_schema.orders (
@@ -109,24 +239,105 @@ CREATE TABLE order_schema.orders (
     user_id UUID NOT NULL,
     status VARCHAR(50) NOT NULL DEFAULT 'pending',
     total_amount DECIMAL(10, 2) NOT NULL,
+    idempotency_key VARCHAR(100),
     created_at TIMESTAMP DEFAULT NOW(),
     updated_at TIMESTAMP DEFAULT NOW()
 );
 
+CREATE UNIQUE INDEX idx_orders_idempotency_key ON order_schema.orders (user_id, idempotency_key) WHERE idempotency_key IS NOT NULL;
+-- Keyset pagination: per-user and admin listings in each sort order
+CREATE INDEX idx_orders_user_created ON order_schema.orders (user_id, created_at, id);
+CREATE INDEX idx_orders_user_amount ON order_schema.orders (user_id, total_amount, id);
+CREATE INDEX idx_orders_created ON order_schema.orders (created_at, id);
+CREATE INDEX idx_orders_amount ON order_schema.orders (total_amount, id);
+CREATE INDEX idx_orders_status_created ON order_schema.orders (status, created_at, id);
+
 CREATE TABLE order_schema.order_items (
     id SERIAL PRIMARY KEY,
     order_id UUID REFERENCES order_schema.orders(id) ON DELETE CASCADE,
     product_id UUID NOT NULL,
+    -- NULL on items ordered before variants existed: the default variant
+    variant_id UUID,
+    sku VARCHAR(64) NOT NULL DEFAULT '',
+    product_name VARCHAR(200) NOT NULL DEFAULT '',
     quantity INT NOT NULL,
     price DECIMAL(10, 2) NOT NULL
 );
 
+-- Every status change with who made it and why
+CREATE TABLE order_schema.order_status_history (
+    id BIGSERIAL PRIMARY KEY,
+    order_id UUID NOT NULL REFERENCES order_schema.orders(id) ON DELETE CASCADE,
+    from_status VARCHAR(50) NOT NULL DEFAULT '',
+    to_status VARCHAR(50) NOT NULL,
+    actor VARCHAR(100) NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_order_status_history_order ON order_schema.order_status_history (order_id, created_at);
+
 CREATE TABLE order_schema.payments (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     order_id UUID REFERENCES order_schema.orders(id) ON DELETE CASCADE,
+    -- The order's owner, so idempotency keys are only unique per user
+    user_id UUID,
     method VARCHAR(50) NOT NULL,
     status VARCHAR(50) NOT NULL DEFAULT 'pending',
-    paid_at TIMESTAMP
+    amount DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    provider VARCHAR(50) NOT NULL DEFAULT '',
+    provider_ref VARCHAR(100),
+    idempotency_key VARCHAR(100),
+    failure_reason TEXT NOT NULL DEFAULT '',
+    paid_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW(),
+    updated_at TIMESTAMP DEFAULT NOW(),
+    UNIQUE (user_id, idempotency_key)
+);
+
+CREATE INDEX idx_payments_order ON order_schema.payments (order_id);
+-- An order is captured at most once
+CREATE UNIQUE INDEX idx_payments_order_completed ON order_schema.payments (order_id) WHERE status = 'completed';
+CREATE UNIQUE INDEX idx_payments_provider_ref ON order_schema.payments (provider, provider_ref) WHERE provider_ref IS NOT NULL;
+
+-- Domain events written in the same transaction as the change, relayed to RabbitMQ
+CREATE TABLE order_schema.outbox (
+    id UUID PRIMARY KEY,
+    exchange VARCHAR(100) NOT NULL,
+    routing_key VARCHAR(100) NOT NULL,
+    payload JSONB NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    sent_at TIMESTAMP
+);
+
+CREATE INDEX idx_order_outbox_pending ON order_schema.outbox (next_attempt_at) WHERE sent_at IS NULL;
+
+-- Messages that exhausted their consumer retries, kept for inspection and replay
+CREATE TABLE order_schema.dead_letters (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    message_id VARCHAR(100),
+    queue VARCHAR(200) NOT NULL,
+    exchange VARCHAR(100),
+    routing_key VARCHAR(200),
+    error TEXT,
+    attempts INT NOT NULL DEFAULT 0,
+    headers JSONB,
+    payload TEXT NOT NULL,
+    replay_count INT NOT NULL DEFAULT 0,
+    replayed_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX idx_order_dead_letters_created ON order_schema.dead_letters (created_at DESC);
+
+-- Ids of consumed events, claimed in the same transaction as the handler's writes
+CREATE TABLE order_schema.processed_events (
+    event_id VARCHAR(100) PRIMARY KEY,
+    event_type VARCHAR(100) NOT NULL,
+    processed_at TIMESTAMP NOT NULL DEFAULT NOW()
 );
 
 -- ==================== notification_schema ====================
@@ -148,6 +359,31 @@ CREATE TABLE notification_schema.notif_logs (
     sent_at TIMESTAMP DEFAULT NOW()
 );
 
+-- Messages that exhausted their consumer retries, kept for inspection and replay
+CREATE TABLE notification_schema.dead_letters (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    message_id VARCHAR(100),
+    queue VARCHAR(200) NOT NULL,
+    exchange VARCHAR(100),
+    routing_key VARCHAR(200),
+    error TEXT,
+    attempts INT NOT NULL DEFAULT 0,
+    headers JSONB,
+    payload TEXT NOT NULL,
+    replay_count INT NOT NULL DEFAULT 0,
+    replayed_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX idx_notif_dead_letters_created ON notification_schema.dead_letters (created_at DESC);
+
+-- Ids of consumed events, claimed in the same transaction as the handler's writes
+CREATE TABLE notification_schema.processed_events (
+    event_id VARCHAR(100) PRIMARY KEY,
+    event_type VARCHAR(100) NOT NULL,
+    processed_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
 -- ─── Step 5: Grant Privileges on Created Tables ─────────────
 -- (needed because tables were created by postgres user, not service users)
 
@@ -156,6 +392,8 @@ GRANT ALL PRIVILEGES ON ALL SEQUENCES IN SCHEMA user_schema TO svc_user;
 
 GRANT ALL PRIVILEGES ON ALL TABLES IN SCHEMA product_schema TO svc_product;
 GRANT ALL PRIVILEGES ON ALL SEQUENCES IN SCHEMA product_schema TO svc_product;
+-- The ledger is append-only for the service
+REVOKE UPDATE, DELETE, TRUNCATE ON product_schema.inventory_movements FROM svc_product;
 
 GRANT ALL PRIVILEGES ON ALL TABLES IN SCHEMA order_schema TO svc_order;
 GRANT ALL PRIVILEGES ON ALL SEQUENCES IN SCHEMA order_schema TO svc_order;
@@ -171,10 +409,10 @@ INSERT INTO user_schema.roles (name, description) VALUES
     ('user', 'Regular user');
 
 -- Default categories
-INSERT INTO product_schema.categories (name) VALUES
-    ('Electronics'),
-    ('Books'),
-    ('Clothing');
+INSERT INTO product_schema.categories (name, slug) VALUES
+    ('Electronics', 'electronics'),
+    ('Books', 'books'),
+    ('Clothing', 'clothing');
 
 -- Default notification templates
 INSERT INTO notification_schema.templates (name, body_template, type) VALUES
@@ -191,17 +429,17 @@ INSERT INTO user_schema.roles (name, description) VALUES
     ('support', 'Customer support agent');
 
 -- Additional categories
-INSERT INTO product_schema.categories (name) VALUES
-    ('Home & Garden'),
-    ('Sports'),
-    ('Toys'),
-    ('Automotive'),
-    ('Health'),
-    ('Food'),
-    ('Music'),
-    ('Office');
-
--- ── Users (password_hash = bcrypt of "password123") ──
+INSERT INTO product_schema.categories (name, slug) VALUES
+    ('Home & Garden', 'home-garden'),
+    ('Sports', 'sports'),
+    ('Toys', 'toys'),
+    ('Automotive', 'automotive'),
+    ('Health', 'health'),
+    ('Food', 'food'),
+    ('Music', 'music'),
+    ('Office', 'office');
+
+-- ── Users (legacy plaintext password_hash = "password123"; rehashed with bcrypt on first login) ──
 INSERT INTO user_schema.users (id, username, email, password_hash, created_at, updated_at) VALUES
     ('a0000001-0000-0000-0000-000000000001', 'alice',    'alice@example.com',    'password123', NOW() - INTERVAL '90 days', NOW() - INTERVAL '1 day'),
     ('a0000001-0000-0000-0000-000000000002', 'bob',      'bob@example.com',      'password123', NOW() - INTERVAL '85 days', NOW() - INTERVAL '2 days'),
@@ -319,7 +557,40 @@ INSERT INTO product_schema.inventory (product_id, quantity, updated_at) VALUES
     ('b0000001-0000-0000-0000-000000000029', 35,  NOW()),
     ('b0000001-0000-0000-0000-000000000030', 175, NOW());
 
+-- ── Default variants ──
+-- Products from before variants get a single default variant that takes
+-- over their inventory and reservations. Safe to run again.
+INSERT INTO product_schema.product_variants (product_id, sku, is_default, created_at, updated_at)
+SELECT p.id, 'SKU-' || upper(replace(p.id::text, '-', '')), TRUE, p.created_at, NOW()
+FROM product_schema.products p
+WHERE NOT EXISTS (
+    SELECT 1 FROM product_schema.product_variants v WHERE v.product_id = p.id AND v.is_default
+);
+
+UPDATE product_schema.inventory i SET variant_id = v.id
+FROM product_schema.product_variants v
+WHERE v.product_id = i.product_id AND v.is_default AND i.variant_id IS NULL;
+
+UPDATE product_schema.stock_reservations r SET variant_id = v.id
+FROM product_schema.product_variants v
+WHERE v.product_id = r.product_id AND v.is_default AND r.variant_id IS NULL;
+
+ALTER TABLE product_schema.inventory ALTER COLUMN variant_id SET NOT NULL;
+ALTER TABLE product_schema.stock_reservations ALTER COLUMN variant_id SET NOT NULL;
+
+-- ── Opening balances ──
+-- Stock from before the ledger is recorded as one adjustment per variant,
+-- so the ledger adds up to every quantity. Safe to run again.
+INSERT INTO product_schema.inventory_movements (product_id, variant_id, delta, quantity_after, reason, reference_id, actor)
+SELECT i.product_id, i.variant_id, i.quantity, i.quantity, 'adjustment', 'opening-balance', 'system'
+FROM product_schema.inventory i
+WHERE i.quantity <> 0 AND NOT EXISTS (
+    SELECT 1 FROM product_schema.inventory_movements m WHERE m.variant_id = i.variant_id
+);
+
 -- ── Orders ──
+-- Every seeded order sits on the lifecycle. Open orders are confirmed but
+-- hold no stock reservation, so cancelling one releases nothing.
 INSERT INTO order_schema.orders (id, user_id, status, total_amount, created_at, updated_at) VALUES
     ('c0000001-0000-0000-0000-000000000001', 'a0000001-0000-0000-0000-000000000001', 'completed',  102.98, NOW() - INTERVAL '80 days', NOW() - INTERVAL '78 days'),
     ('c0000001-0000-0000-0000-000000000002', 'a0000001-0000-0000-0000-000000000002', 'completed',  349.99, NOW() - INTERVAL '75 days', NOW() - INTERVAL '72 days'),
@@ -338,12 +609,12 @@ INSERT INTO order_schema.orders (id, user_id, status, total_amount, created_at,
     ('c0000001-0000-0000-0000-000000000015', 'a0000001-0000-0000-0000-000000000013', 'shipped',    199.99, NOW() - INTERVAL '15 days', NOW() - INTERVAL '13 days'),
     ('c0000001-0000-0000-0000-000000000016', 'a0000001-0000-0000-0000-000000000014', 'shipped',     94.98, NOW() - INTERVAL '12 days', NOW() - INTERVAL '10 days'),
     ('c0000001-0000-0000-0000-000000000017', 'a0000001-0000-0000-0000-000000000015', 'shipped',    349.99, NOW() - INTERVAL '10 days', NOW() - INTERVAL '8 days'),
-    ('c0000001-0000-0000-0000-000000000018', 'a0000001-0000-0000-0000-000000000003', 'processing', 109.98, NOW() - INTERVAL '7 days',  NOW() - INTERVAL '6 days'),
-    ('c0000001-0000-0000-0000-000000000019', 'a0000001-0000-0000-0000-000000000016', 'processing',  49.99, NOW() - INTERVAL '5 days',  NOW() - INTERVAL '4 days'),
-    ('c0000001-0000-0000-0000-000000000020', 'a0000001-0000-0000-0000-000000000017', 'pending',     22.99, NOW() - INTERVAL '3 days',  NOW() - INTERVAL '3 days'),
-    ('c0000001-0000-0000-0000-000000000021', 'a0000001-0000-0000-0000-000000000018', 'pending',    159.99, NOW() - INTERVAL '2 days',  NOW() - INTERVAL '2 days'),
-    ('c0000001-0000-0000-0000-000000000022', 'a0000001-0000-0000-0000-000000000019', 'pending',     34.99, NOW() - INTERVAL '1 day',   NOW() - INTERVAL '1 day'),
-    ('c0000001-0000-0000-0000-000000000023', 'a0000001-0000-0000-0000-000000000020', 'pending',     79.99, NOW() - INTERVAL '1 day',   NOW()),
+    ('c0000001-0000-0000-0000-000000000018', 'a0000001-0000-0000-0000-000000000003', 'paid',       109.98, NOW() - INTERVAL '7 days',  NOW() - INTERVAL '6 days'),
+    ('c0000001-0000-0000-0000-000000000019', 'a0000001-0000-0000-0000-000000000016', 'confirmed',   49.99, NOW() - INTERVAL '5 days',  NOW() - INTERVAL '4 days'),
+    ('c0000001-0000-0000-0000-000000000020', 'a0000001-0000-0000-0000-000000000017', 'confirmed',   22.99, NOW() - INTERVAL '3 days',  NOW() - INTERVAL '3 days'),
+    ('c0000001-0000-0000-0000-000000000021', 'a0000001-0000-0000-0000-000000000018', 'confirmed',  159.99, NOW() - INTERVAL '2 days',  NOW() - INTERVAL '2 days'),
+    ('c0000001-0000-0000-0000-000000000022', 'a0000001-0000-0000-0000-000000000019', 'confirmed',   34.99, NOW() - INTERVAL '1 day',   NOW() - INTERVAL '1 day'),
+    ('c0000001-0000-0000-0000-000000000023', 'a0000001-0000-0000-0000-000000000020', 'confirmed',   79.99, NOW() - INTERVAL '1 day',   NOW()),
     ('c0000001-0000-0000-0000-000000000024', 'a0000001-0000-0000-0000-000000000001', 'cancelled',   29.99, NOW() - INTERVAL '20 days', NOW() - INTERVAL '19 days'),
     ('c0000001-0000-0000-0000-000000000025', 'a0000001-0000-0000-0000-000000000004', 'cancelled',   39.99, NOW() - INTERVAL '15 days', NOW() - INTERVAL '14 days');
 
@@ -410,6 +681,14 @@ INSERT INTO order_schema.payments (id, order_id, method, status, paid_at) VALUES
     ('d0000001-0000-0000-0000-000000000024', 'c0000001-0000-0000-0000-000000000024', 'credit_card', 'refunded',  NOW() - INTERVAL '19 days'),
     ('d0000001-0000-0000-0000-000000000025', 'c0000001-0000-0000-0000-000000000025', 'debit_card',  'refunded',  NOW() - INTERVAL '14 days');
 
+-- Seeded payments cover their order in full
+UPDATE order_schema.payments p SET amount = o.total_amount, user_id = o.user_id
+FROM order_schema.orders o WHERE o.id = p.order_id;
+
+-- Seeded orders start their history at their current status
+INSERT INTO order_schema.order_status_history (order_id, to_status, actor, reason, created_at)
+SELECT id, status, 'system', 'seed', updated_at FROM order_schema.orders;
+
 -- ── Notification Logs ──
 INSERT INTO notification_schema.notif_logs (user_id, type, subject, body, status, sent_at) VALUES
     ('a0000001-0000-0000-0000-000000000001', 'email', 'Welcome!',                    'Welcome to our platform, alice!',                         'sent',   NOW() - INTERVAL '90 days'),
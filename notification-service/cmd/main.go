@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/hero/microservice/notification-service/internal/handler"
@@ -11,6 +12,11 @@ import (
 	"github.com/hero/microservice/notification-service/internal/repository"
 	"github.com/hero/microservice/notification-service/internal/service"
 	"github.com/hero/microservice/pkg/cache"
+	"github.com/hero/microservice/pkg/deadletter"
+	"github.com/hero/microservice/pkg/ginauth"
+	"github.com/hero/microservice/pkg/idempotency"
+	"github.com/hero/microservice/pkg/identity"
+	"github.com/hero/microservice/pkg/messaging"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
@@ -42,21 +48,37 @@ func main() {
 	}
 	defer rdb.Close()
 
-	// RabbitMQ consumer (with Redis for deduplication)
-	consumer, err := rabbitmq.NewConsumer(
+	// RabbitMQ
+	mq, err := messaging.Dial(messaging.URL(
 		getEnv("RABBITMQ_HOST", "localhost"),
 		getEnv("RABBITMQ_PORT", "5672"),
 		getEnv("RABBITMQ_USER", "guest"),
 		getEnv("RABBITMQ_PASSWORD", "guest"),
-		rdb,
-	)
+	))
 	if err != nil {
 		log.Fatal("Failed to connect to RabbitMQ: ", err)
 	}
-	defer consumer.Close()
+	defer mq.Close()
+
+	// Messages that exhaust their retries are kept in dead_letters for replay
+	deadLetters := deadletter.NewStore(db, getEnv("DB_SCHEMA", "notification_schema"))
+	deadLetterQueue, err := mq.DeclareDeadLetters("notification")
+	if err != nil {
+		log.Fatal("Failed to declare dead-letter queue: ", err)
+	}
+	if err := mq.Consume(deadLetterQueue, deadLetters.Record); err != nil {
+		log.Fatal("Failed to start consumer: ", err)
+	}
+
+	// Consumed event ids, so redelivered messages notify once
+	processed := idempotency.NewStore(getEnv("DB_SCHEMA", "notification_schema"), rdb)
+	consumer, err := rabbitmq.NewConsumer(mq, processed)
+	if err != nil {
+		log.Fatal("Failed to declare RabbitMQ topology: ", err)
+	}
 
 	// Wire layers
-	notifRepo := repository.NewNotificationRepository(db)
+	notifRepo := repository.NewNotificationRepository(db, processed)
 	notifService := service.NewNotificationService(notifRepo)
 	notifHandler := handler.NewNotificationHandler(notifService)
 
@@ -71,11 +93,16 @@ func main() {
 	// Gin router
 	r := gin.Default()
 
+	// Trust only the identity asserted and signed by the gateway
+	signer := identity.NewSigner(mustEnv("IDENTITY_SECRET"), time.Minute)
+	r.Use(ginauth.Identity(signer))
+
 	r.GET("/health", func(c *gin.Context) {
 		c.JSON(200, gin.H{"service": "notification-service", "status": "running"})
 	})
 
 	notifHandler.RegisterRoutes(r)
+	deadletter.NewHandler(deadLetters, mq).RegisterRoutes(r, "notification")
 
 	port := getEnv("SERVER_PORT", "8004")
 	log.Printf("Notification Service starting on port %s", port)
@@ -90,3 +117,12 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+// mustEnv reads a setting that has no safe default, such as a secret.
+func mustEnv(key string) string {
+	val := os.Getenv(key)
+	if val == "" {
+		log.Fatalf("%s must be set", key)
+	}
+	return val
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/hero/microservice/notification-service/internal/service"
+	"github.com/hero/microservice/pkg/ginauth"
 )
 
 type NotificationHandler struct {
@@ -23,6 +24,13 @@ func (h *NotificationHandler) GetUserNotifications(c *gin.Context) {
 		return
 	}
 
+	// Only allow users to read their own notifications
+	p, _ := ginauth.Principal(c)
+	if !p.IsAdmin() && p.UserID != userID.String() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return
+	}
+
 	logs, err := h.service.GetUserNotifications(userID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -33,7 +41,7 @@ func (h *NotificationHandler) GetUserNotifications(c *gin.Context) {
 }
 
 func (h *NotificationHandler) RegisterRoutes(r *gin.Engine) {
-	notifications := r.Group("/api/notifications")
+	notifications := r.Group("/api/notifications", ginauth.RequireUser())
 	{
 		notifications.GET("/user/:userId", h.GetUserNotifications)
 	}
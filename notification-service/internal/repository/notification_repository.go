@@ -3,6 +3,7 @@ package repository
 import (
 	"github.com/google/uuid"
 	"github.com/hero/microservice/notification-service/internal/model"
+	"github.com/hero/microservice/pkg/idempotency"
 	"gorm.io/gorm"
 )
 
@@ -10,14 +11,17 @@ type NotificationRepository interface {
 	SaveLog(log *model.NotifLog) error
 	GetByUserID(userID uuid.UUID) ([]model.NotifLog, error)
 	GetTemplate(name string) (*model.Template, error)
+	ClaimEvent(eventID, eventType string) (bool, error)
+	Transaction(fn func(repo NotificationRepository) error) error
 }
 
 type notificationRepository struct {
-	db *gorm.DB
+	db        *gorm.DB
+	processed *idempotency.Store
 }
 
-func NewNotificationRepository(db *gorm.DB) NotificationRepository {
-	return &notificationRepository{db: db}
+func NewNotificationRepository(db *gorm.DB, processed *idempotency.Store) NotificationRepository {
+	return &notificationRepository{db: db, processed: processed}
 }
 
 func (r *notificationRepository) SaveLog(notifLog *model.NotifLog) error {
@@ -38,3 +42,15 @@ func (r *notificationRepository) GetTemplate(name string) (*model.Template, erro
 	}
 	return &tmpl, nil
 }
+
+// ClaimEvent records a consumed event and reports false if it was already
+// processed. Call it inside Transaction with the handler's writes.
+func (r *notificationRepository) ClaimEvent(eventID, eventType string) (bool, error) {
+	return r.processed.Claim(r.db, eventID, eventType)
+}
+
+func (r *notificationRepository) Transaction(fn func(repo NotificationRepository) error) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		return fn(&notificationRepository{db: tx, processed: r.processed})
+	})
+}
@@ -1,18 +1,20 @@
 package service
 
 import (
+	"errors"
 	"log"
 
 	"github.com/google/uuid"
 	"github.com/hero/microservice/notification-service/internal/model"
 	"github.com/hero/microservice/notification-service/internal/repository"
+	"github.com/hero/microservice/pkg/events"
 )
 
 type NotificationService interface {
-	HandleUserRegistered(userID, username, email string)
-	HandleOrderCreated(orderID, userID string)
-	HandleOrderCompleted(orderID, userID string)
-	HandleProductOutOfStock(productID, productName string)
+	HandleUserRegistered(eventID, userID, username, email string) error
+	HandleOrderCreated(eventID, orderID, userID string) error
+	HandleOrderCompleted(eventID, orderID, userID string) error
+	HandleProductOutOfStock(eventID, productID, productName, sku string) error
 	GetUserNotifications(userID uuid.UUID) ([]model.NotifLog, error)
 }
 
@@ -24,11 +26,10 @@ func NewNotificationService(repo repository.NotificationRepository) Notification
 	return &notificationService{repo: repo}
 }
 
-func (s *notificationService) HandleUserRegistered(userID, username, email string) {
+func (s *notificationService) HandleUserRegistered(eventID, userID, username, email string) error {
 	uid, err := uuid.Parse(userID)
 	if err != nil {
-		log.Printf("Invalid user_id in user.registered: %s", userID)
-		return
+		return errors.New("invalid user_id in user.registered: " + userID)
 	}
 
 	notifLog := &model.NotifLog{
@@ -40,18 +41,19 @@ func (s *notificationService) HandleUserRegistered(userID, username, email strin
 		Status:  "sent",
 	}
 
-	if err := s.repo.SaveLog(notifLog); err != nil {
-		log.Printf("Failed to save notification log: %v", err)
+	sent, err := s.saveLog(eventID, events.TypeUserRegistered, notifLog)
+	if err != nil || !sent {
+		return err
 	}
 
 	log.Printf("Welcome email sent to user %s (%s)", username, email)
+	return nil
 }
 
-func (s *notificationService) HandleOrderCreated(orderID, userID string) {
+func (s *notificationService) HandleOrderCreated(eventID, orderID, userID string) error {
 	uid, err := uuid.Parse(userID)
 	if err != nil {
-		log.Printf("Invalid user_id in order.created: %s", userID)
-		return
+		return errors.New("invalid user_id in order.created: " + userID)
 	}
 
 	notifLog := &model.NotifLog{
@@ -63,18 +65,19 @@ func (s *notificationService) HandleOrderCreated(orderID, userID string) {
 		Status:  "sent",
 	}
 
-	if err := s.repo.SaveLog(notifLog); err != nil {
-		log.Printf("Failed to save notification log: %v", err)
+	sent, err := s.saveLog(eventID, events.TypeOrderCreated, notifLog)
+	if err != nil || !sent {
+		return err
 	}
 
 	log.Printf("Order confirmation sent for order %s", orderID)
+	return nil
 }
 
-func (s *notificationService) HandleOrderCompleted(orderID, userID string) {
+func (s *notificationService) HandleOrderCompleted(eventID, orderID, userID string) error {
 	uid, err := uuid.Parse(userID)
 	if err != nil {
-		log.Printf("Invalid user_id in order.completed: %s", userID)
-		return
+		return errors.New("invalid user_id in order.completed: " + userID)
 	}
 
 	notifLog := &model.NotifLog{
@@ -86,14 +89,18 @@ func (s *notificationService) HandleOrderCompleted(orderID, userID string) {
 		Status:  "sent",
 	}
 
-	if err := s.repo.SaveLog(notifLog); err != nil {
-		log.Printf("Failed to save notification log: %v", err)
+	sent, err := s.saveLog(eventID, events.TypeOrderCompleted, notifLog)
+	if err != nil || !sent {
+		return err
 	}
 
 	log.Printf("Order completed notification sent for order %s", orderID)
+	return nil
 }
 
-func (s *notificationService) HandleProductOutOfStock(productID, productName string) {
+// HandleProductOutOfStock alerts about one variant running out; sku is
+// empty for alerts published before products had variants.
+func (s *notificationService) HandleProductOutOfStock(eventID, productID, productName, sku string) error {
 	// Use a placeholder admin UUID for admin notifications
 	adminUID := uuid.MustParse("00000000-0000-0000-0000-000000000001")
 
@@ -105,12 +112,39 @@ func (s *notificationService) HandleProductOutOfStock(productID, productName str
 		Body:    "Product " + productName + " (ID: " + productID + ") is out of stock.",
 		Status:  "sent",
 	}
+	if sku != "" {
+		notifLog.Subject += " (" + sku + ")"
+		notifLog.Body = "Product " + productName + " (ID: " + productID + ", SKU: " + sku + ") is out of stock."
+	}
 
-	if err := s.repo.SaveLog(notifLog); err != nil {
-		log.Printf("Failed to save notification log: %v", err)
+	sent, err := s.saveLog(eventID, events.TypeProductOutOfStock, notifLog)
+	if err != nil || !sent {
+		return err
 	}
 
 	log.Printf("Stock alert sent for product %s (%s)", productName, productID)
+	return nil
+}
+
+// saveLog stores the notification together with the event claim, so a
+// redelivered event does not notify twice. It reports false for duplicates.
+func (s *notificationService) saveLog(eventID, eventType string, notifLog *model.NotifLog) (bool, error) {
+	var fresh bool
+	err := s.repo.Transaction(func(repo repository.NotificationRepository) error {
+		var err error
+		fresh, err = repo.ClaimEvent(eventID, eventType)
+		if err != nil || !fresh {
+			return err
+		}
+		return repo.SaveLog(notifLog)
+	})
+	if err != nil {
+		return false, errors.New("failed to save notification log: " + err.Error())
+	}
+	if !fresh {
+		log.Printf("Skipping already processed %s event %s", eventType, eventID)
+	}
+	return fresh, nil
 }
 
 func (s *notificationService) GetUserNotifications(userID uuid.UUID) ([]model.NotifLog, error) {
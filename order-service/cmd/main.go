@@ -1,16 +1,27 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/hero/microservice/order-service/internal/client"
 	"github.com/hero/microservice/order-service/internal/handler"
+	"github.com/hero/microservice/order-service/internal/payment"
 	"github.com/hero/microservice/order-service/internal/rabbitmq"
 	"github.com/hero/microservice/order-service/internal/repository"
 	"github.com/hero/microservice/order-service/internal/service"
 	"github.com/hero/microservice/pkg/cache"
+	"github.com/hero/microservice/pkg/deadletter"
+	"github.com/hero/microservice/pkg/events"
+	"github.com/hero/microservice/pkg/ginauth"
+	"github.com/hero/microservice/pkg/idempotency"
+	"github.com/hero/microservice/pkg/identity"
+	"github.com/hero/microservice/pkg/messaging"
+	"github.com/hero/microservice/pkg/outbox"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
@@ -32,29 +43,31 @@ func main() {
 	}
 	log.Println("Database connected")
 
-	// RabbitMQ publisher
-	publisher, err := rabbitmq.NewPublisher(
+	// RabbitMQ
+	mq, err := messaging.Dial(messaging.URL(
 		getEnv("RABBITMQ_HOST", "localhost"),
 		getEnv("RABBITMQ_PORT", "5672"),
 		getEnv("RABBITMQ_USER", "guest"),
 		getEnv("RABBITMQ_PASSWORD", "guest"),
-	)
+	))
 	if err != nil {
 		log.Fatal("Failed to connect to RabbitMQ: ", err)
 	}
-	defer publisher.Close()
+	defer mq.Close()
 
-	// RabbitMQ consumer
-	consumer, err := rabbitmq.NewConsumer(
-		getEnv("RABBITMQ_HOST", "localhost"),
-		getEnv("RABBITMQ_PORT", "5672"),
-		getEnv("RABBITMQ_USER", "guest"),
-		getEnv("RABBITMQ_PASSWORD", "guest"),
-	)
+	// Messages that exhaust their retries are kept in dead_letters for replay
+	deadLetters := deadletter.NewStore(db, getEnv("DB_SCHEMA", "order_schema"))
+	deadLetterQueue, err := mq.DeclareDeadLetters("order")
 	if err != nil {
-		log.Fatal("Failed to connect RabbitMQ consumer: ", err)
+		log.Fatal("Failed to declare dead-letter queue: ", err)
+	}
+	if err := mq.Consume(deadLetterQueue, deadLetters.Record); err != nil {
+		log.Fatal("Failed to start consumer: ", err)
+	}
+
+	if err := mq.DeclareExchange("order.exchange"); err != nil {
+		log.Fatal("Failed to declare RabbitMQ topology: ", err)
 	}
-	defer consumer.Close()
 
 	// Redis
 	rdb, err := cache.NewRedisClient(
@@ -66,30 +79,101 @@ func main() {
 	}
 	defer rdb.Close()
 
+	// Consumed event ids, so redelivered messages are handled once
+	processed := idempotency.NewStore(getEnv("DB_SCHEMA", "order_schema"), rdb)
+	consumer, err := rabbitmq.NewConsumer(mq, processed)
+	if err != nil {
+		log.Fatal("Failed to declare RabbitMQ topology: ", err)
+	}
+
+	// Product service client for authoritative prices and stock
+	productTimeout, err := time.ParseDuration(getEnv("PRODUCT_SERVICE_TIMEOUT", "3s"))
+	if err != nil {
+		log.Fatal("Invalid PRODUCT_SERVICE_TIMEOUT: ", err)
+	}
+	productClient := client.NewProductClient(getEnv("PRODUCT_SERVICE_URL", "http://localhost:8002"), productTimeout)
+
+	// Events are written to the outbox with each change and relayed to RabbitMQ
+	eventOutbox := outbox.New(getEnv("DB_SCHEMA", "order_schema"), "order.exchange", "order-service")
+	go outbox.NewRelay(db, eventOutbox, mq).Run(context.Background())
+
 	// Wire layers
-	orderRepo := repository.NewOrderRepository(db)
-	orderService := service.NewOrderService(orderRepo, publisher)
+	orderRepo := repository.NewOrderRepository(db, eventOutbox, processed)
+	orderService := service.NewOrderService(orderRepo, productClient)
 	orderHandler := handler.NewOrderHandler(orderService)
 
-	cartService := service.NewCartService(rdb)
-	cartHandler := handler.NewCartHandler(cartService)
+	// Payments settle through the configured provider
+	var provider payment.PaymentProvider
+	switch name := getEnv("PAYMENT_PROVIDER", "fake"); name {
+	case "fake":
+		provider = payment.NewFakeProvider()
+	default:
+		log.Fatal("Unsupported PAYMENT_PROVIDER: ", name)
+	}
+	paymentRepo := repository.NewPaymentRepository(db, eventOutbox, processed)
+	paymentService := service.NewPaymentService(paymentRepo, orderRepo, provider)
+	paymentHandler := handler.NewPaymentHandler(paymentService, orderService, mustEnv("PAYMENT_WEBHOOK_SECRET"))
+
+	// How a guest cart merges into the user's cart at login
+	mergeRules, err := service.NewMergeRules(
+		getEnv("CART_MERGE_QUANTITY", service.MergeQuantitySum),
+		getEnv("CART_MERGE_PRICE", service.MergePriceLatest),
+	)
+	if err != nil {
+		log.Fatal("Invalid cart merge rules: ", err)
+	}
+	cartService := service.NewCartService(rdb, mergeRules, productClient)
+	checkoutService := service.NewCheckoutService(cartService, orderService)
+	cartHandler := handler.NewCartHandler(cartService, checkoutService)
 
 	// Start consuming inventory.updated events
-	consumer.ConsumeInventoryUpdated(func(data rabbitmq.InventoryUpdatedData) {
+	err = consumer.ConsumeInventoryUpdated(func(data events.InventoryUpdated) {
 		if data.IsLowStock {
 			log.Printf("Low stock alert for product %s: %d remaining", data.ProductID, data.QuantityRemaining)
 		}
 	})
+	if err != nil {
+		log.Fatal("Failed to start consumer: ", err)
+	}
+
+	// Stock reservation saga replies from product-service
+	if err := consumer.ConsumeInventoryReserved(orderService.ConfirmOrder); err != nil {
+		log.Fatal("Failed to start consumer: ", err)
+	}
+	if err := consumer.ConsumeReservationFailed(orderService.RejectOrder); err != nil {
+		log.Fatal("Failed to start consumer: ", err)
+	}
+
+	// Captured payments move the order to paid
+	if err := consumer.ConsumePaymentSucceeded(orderService.MarkPaid); err != nil {
+		log.Fatal("Failed to start consumer: ", err)
+	}
+
+	// Carts holding a repriced product are flagged
+	if err := consumer.ConsumePriceChanged(cartService.FlagPriceChange); err != nil {
+		log.Fatal("Failed to start consumer: ", err)
+	}
+
+	// Guest carts merge into the user's cart at login
+	if err := consumer.ConsumeUserLoggedIn(cartService.MergeGuestCart); err != nil {
+		log.Fatal("Failed to start consumer: ", err)
+	}
 
 	// Gin router
 	r := gin.Default()
 
+	// Trust only the identity asserted and signed by the gateway
+	signer := identity.NewSigner(mustEnv("IDENTITY_SECRET"), time.Minute)
+	r.Use(ginauth.Identity(signer))
+
 	r.GET("/health", func(c *gin.Context) {
 		c.JSON(200, gin.H{"service": "order-service", "status": "running"})
 	})
 
 	orderHandler.RegisterRoutes(r)
+	paymentHandler.RegisterRoutes(r)
 	cartHandler.RegisterRoutes(r)
+	deadletter.NewHandler(deadLetters, mq).RegisterRoutes(r, "order")
 
 	port := getEnv("SERVER_PORT", "8003")
 	log.Printf("Order Service starting on port %s", port)
@@ -104,3 +188,12 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+// mustEnv reads a setting that has no safe default, such as a secret.
+func mustEnv(key string) string {
+	val := os.Getenv(key)
+	if val == "" {
+		log.Fatalf("%s must be set", key)
+	}
+	return val
+}
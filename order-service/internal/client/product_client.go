@@ -0,0 +1,107 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrProductServiceUnavailable = errors.New("product service unavailable")
+
+// ProductStatusActive is the status of products that are on sale
+const ProductStatusActive = "active"
+
+// ProductInfo is the authoritative view of a product as reported by
+// product-service at the time of the call.
+type ProductInfo struct {
+	ID       uuid.UUID     `json:"id"`
+	Name     string        `json:"name"`
+	Price    float64       `json:"price"`
+	Quantity int           `json:"quantity"`
+	Status   string        `json:"status"`
+	Variants []VariantInfo `json:"variants"`
+}
+
+// VariantInfo is one variant of a product with the price it sells at and
+// its own stock.
+type VariantInfo struct {
+	ID        uuid.UUID         `json:"id"`
+	SKU       string            `json:"sku"`
+	Options   map[string]string `json:"options"`
+	Price     float64           `json:"price"`
+	Quantity  int               `json:"quantity"`
+	IsDefault bool              `json:"is_default"`
+}
+
+// Variant finds a variant of the product; uuid.Nil finds the default one.
+func (p ProductInfo) Variant(id uuid.UUID) (VariantInfo, bool) {
+	for _, v := range p.Variants {
+		if v.ID == id || (id == uuid.Nil && v.IsDefault) {
+			return v, true
+		}
+	}
+	return VariantInfo{}, false
+}
+
+type ProductClient interface {
+	GetProducts(ctx context.Context, ids []uuid.UUID) (map[uuid.UUID]ProductInfo, error)
+}
+
+type productClient struct {
+	baseURL string
+	http    *http.Client
+}
+
+func NewProductClient(baseURL string, timeout time.Duration) ProductClient {
+	return &productClient{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		http:    &http.Client{Timeout: timeout},
+	}
+}
+
+func (c *productClient) GetProducts(ctx context.Context, ids []uuid.UUID) (map[uuid.UUID]ProductInfo, error) {
+	result := make(map[uuid.UUID]ProductInfo, len(ids))
+	if len(ids) == 0 {
+		return result, nil
+	}
+
+	raw := make([]string, len(ids))
+	for i, id := range ids {
+		raw[i] = id.String()
+	}
+	endpoint := c.baseURL + "/internal/products?ids=" + url.QueryEscape(strings.Join(raw, ","))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrProductServiceUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: status %d", ErrProductServiceUnavailable, resp.StatusCode)
+	}
+
+	var body struct {
+		Products []ProductInfo `json:"products"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode product lookup: %w", err)
+	}
+
+	for _, p := range body.Products {
+		result[p.ID] = p
+	}
+	return result, nil
+}
@@ -1,79 +1,138 @@
 package handler
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 	"github.com/hero/microservice/order-service/internal/service"
+	"github.com/hero/microservice/pkg/carttoken"
+	"github.com/hero/microservice/pkg/ginauth"
 )
 
 type CartHandler struct {
-	cartService service.CartService
+	cartService     service.CartService
+	checkoutService service.CheckoutService
 }
 
-func NewCartHandler(cartService service.CartService) *CartHandler {
-	return &CartHandler{cartService: cartService}
+func NewCartHandler(cartService service.CartService, checkoutService service.CheckoutService) *CartHandler {
+	return &CartHandler{cartService: cartService, checkoutService: checkoutService}
 }
 
 func (h *CartHandler) getUserID(c *gin.Context) string {
-	return c.GetHeader("X-User-ID")
+	if p, ok := ginauth.Principal(c); ok {
+		return p.UserID
+	}
+	return ""
+}
+
+// cartOwner identifies the cart a request addresses: the signed-in user's,
+// or for guests the one behind the cart token the gateway forwarded.
+func (h *CartHandler) cartOwner(c *gin.Context) string {
+	if userID := h.getUserID(c); userID != "" {
+		return userID
+	}
+	if token := c.GetHeader(carttoken.Header); carttoken.Valid(token) {
+		return service.GuestCartOwner(token)
+	}
+	return ""
 }
 
 func (h *CartHandler) GetCart(c *gin.Context) {
-	userID := h.getUserID(c)
+	userID := h.cartOwner(c)
 	if userID == "" {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 		return
 	}
 
-	items, err := h.cartService.GetCart(userID)
+	cart, err := h.cartService.GetPricedCart(userID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"cart": items})
+	c.JSON(http.StatusOK, gin.H{
+		"cart":          cart.Items,
+		"subtotal":      cart.Subtotal,
+		"price_changed": cart.PriceChanged,
+	})
 }
 
 func (h *CartHandler) AddToCart(c *gin.Context) {
-	userID := h.getUserID(c)
+	userID := h.cartOwner(c)
 	if userID == "" {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 		return
 	}
 
-	var item service.CartItem
-	if err := c.ShouldBindJSON(&item); err != nil {
+	var input service.AddToCartInput
+	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	items, err := h.cartService.AddToCart(userID, item)
+	items, err := h.cartService.AddToCart(userID, input)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		cartError(c, err)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"cart": items})
 }
 
-func (h *CartHandler) RemoveFromCart(c *gin.Context) {
-	userID := h.getUserID(c)
+func (h *CartHandler) SetQuantity(c *gin.Context) {
+	userID := h.cartOwner(c)
 	if userID == "" {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 		return
 	}
 
-	productID := c.Param("productId")
+	var input service.SetQuantityInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	items, err := h.cartService.RemoveFromCart(userID, productID)
+	items, err := h.cartService.SetQuantity(userID, c.Param("productId"), c.Query("variant_id"), input.Quantity)
 	if err != nil {
+		cartError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"cart": items})
+}
+
+func cartError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrInvalidProductID), errors.Is(err, service.ErrInvalidVariantID),
+		errors.Is(err, service.ErrInvalidQuantity):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrProductNotFound), errors.Is(err, service.ErrVariantNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrCartFull), errors.Is(err, service.ErrQuantityLimit),
+		errors.Is(err, service.ErrNotForSale):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrProductServiceUnavailable):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	default:
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func (h *CartHandler) RemoveFromCart(c *gin.Context) {
+	userID := h.cartOwner(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	items, err := h.cartService.RemoveFromCart(userID, c.Param("productId"), c.Query("variant_id"))
+	if err != nil {
+		cartError(c, err)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"cart": items})
 }
 
 func (h *CartHandler) ClearCart(c *gin.Context) {
-	userID := h.getUserID(c)
+	userID := h.cartOwner(c)
 	if userID == "" {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 		return
@@ -86,11 +145,50 @@ func (h *CartHandler) ClearCart(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "cart cleared"})
 }
 
+// Checkout turns the cart into an order. The Idempotency-Key header is
+// required so a double submit returns the first order instead of a second.
+func (h *CartHandler) Checkout(c *gin.Context) {
+	userID := h.getUserID(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	key, ok := idempotencyKey(c)
+	if !ok {
+		return
+	}
+	if key == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": IdempotencyKeyHeader + " header is required"})
+		return
+	}
+
+	order, created, err := h.checkoutService.Checkout(userID, key)
+	if err != nil {
+		if errors.Is(err, service.ErrCartEmpty) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+		placeOrderError(c, err)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	c.JSON(status, gin.H{"order": order})
+}
+
+// Lines for a variant other than the default are addressed with a
+// variant_id query parameter on PUT and DELETE /:productId.
 func (h *CartHandler) RegisterRoutes(r *gin.Engine) {
 	cart := r.Group("/api/cart")
 	{
 		cart.GET("", h.GetCart)
 		cart.POST("", h.AddToCart)
+		cart.POST("/checkout", h.Checkout)
+		cart.PUT("/:productId", h.SetQuantity)
 		cart.DELETE("/:productId", h.RemoveFromCart)
 		cart.DELETE("", h.ClearCart)
 	}
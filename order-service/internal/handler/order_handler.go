@@ -1,12 +1,24 @@
 package handler
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/hero/microservice/order-service/internal/model"
 	"github.com/hero/microservice/order-service/internal/service"
+	"github.com/hero/microservice/pkg/ginauth"
+	"github.com/hero/microservice/pkg/identity"
+)
+
+const (
+	defaultOrderLimit = 20
+	maxOrderLimit     = 100
 )
 
 type OrderHandler struct {
@@ -17,13 +29,20 @@ func NewOrderHandler(service service.OrderService) *OrderHandler {
 	return &OrderHandler{service: service}
 }
 
+// principal returns the caller verified by ginauth.Identity; RequireUser
+// on the route group guarantees it is present.
+func (h *OrderHandler) principal(c *gin.Context) *identity.Principal {
+	p, _ := ginauth.Principal(c)
+	return p
+}
+
+func (h *OrderHandler) canAccess(p *identity.Principal, order *model.Order) bool {
+	return p.IsAdmin() || order.UserID.String() == p.UserID
+}
+
 func (h *OrderHandler) PlaceOrder(c *gin.Context) {
-	// Use authenticated user from session (set by gateway auth middleware)
-	userID := c.GetHeader("X-User-ID")
-	if userID == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
-		return
-	}
+	// Use authenticated user from the gateway-signed identity
+	userID := h.principal(c).UserID
 
 	var input model.PlaceOrderInput
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -31,16 +50,38 @@ func (h *OrderHandler) PlaceOrder(c *gin.Context) {
 		return
 	}
 
+	key, ok := idempotencyKey(c)
+	if !ok {
+		return
+	}
+
 	// Override user_id with the authenticated user
 	input.UserID = userID
+	input.IdempotencyKey = key
 
-	order, err := h.service.PlaceOrder(input)
+	order, created, err := h.service.PlaceOrder(input)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		placeOrderError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{"order": order})
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	c.JSON(status, gin.H{"order": order})
+}
+
+func placeOrderError(c *gin.Context, err error) {
+	var validationErr *service.OrderValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": validationErr.Error(), "details": validationErr.Items})
+	case errors.Is(err, service.ErrProductServiceUnavailable):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
 }
 
 func (h *OrderHandler) GetOrder(c *gin.Context) {
@@ -57,8 +98,7 @@ func (h *OrderHandler) GetOrder(c *gin.Context) {
 	}
 
 	// Only allow the owner to view their order
-	userID := c.GetHeader("X-User-ID")
-	if userID != "" && order.UserID.String() != userID {
+	if !h.canAccess(h.principal(c), order) {
 		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
 		return
 	}
@@ -67,25 +107,18 @@ func (h *OrderHandler) GetOrder(c *gin.Context) {
 }
 
 func (h *OrderHandler) GetMyOrders(c *gin.Context) {
-	userID := c.GetHeader("X-User-ID")
-	if userID == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
-		return
-	}
-
-	uid, err := uuid.Parse(userID)
+	uid, err := uuid.Parse(h.principal(c).UserID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
 		return
 	}
 
-	orders, err := h.service.GetUserOrders(uid)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	query, ok := h.listQuery(c)
+	if !ok {
 		return
 	}
-
-	c.JSON(http.StatusOK, gin.H{"orders": orders})
+	query.Filter.UserID = &uid
+	h.listOrders(c, query)
 }
 
 func (h *OrderHandler) GetUserOrders(c *gin.Context) {
@@ -96,19 +129,153 @@ func (h *OrderHandler) GetUserOrders(c *gin.Context) {
 	}
 
 	// Only allow users to view their own orders
-	authUserID := c.GetHeader("X-User-ID")
-	if authUserID != "" && userID.String() != authUserID {
+	p := h.principal(c)
+	if !p.IsAdmin() && userID.String() != p.UserID {
 		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
 		return
 	}
 
-	orders, err := h.service.GetUserOrders(userID)
+	query, ok := h.listQuery(c)
+	if !ok {
+		return
+	}
+	query.Filter.UserID = &userID
+	h.listOrders(c, query)
+}
+
+// ListOrders lists orders across all users, optionally for one user_id.
+func (h *OrderHandler) ListOrders(c *gin.Context) {
+	query, ok := h.listQuery(c)
+	if !ok {
+		return
+	}
+	if v := c.Query("user_id"); v != "" {
+		userID, err := uuid.Parse(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user_id"})
+			return
+		}
+		query.Filter.UserID = &userID
+	}
+	h.listOrders(c, query)
+}
+
+// listQuery reads the parameters shared by the order listings:
+//
+//	limit        page size, 1 to maxOrderLimit
+//	sort         created_at or total_amount, "-" prefix for descending
+//	status       one or more statuses, repeated or comma separated
+//	from, to     RFC 3339 timestamps or dates; a date for to includes that day
+//	min_amount, max_amount
+//
+// It writes a 400 response and returns false when one is malformed.
+func (h *OrderHandler) listQuery(c *gin.Context) (model.OrderListQuery, bool) {
+	query := model.OrderListQuery{Sort: model.OrderSortCreatedAt, Desc: true, Limit: defaultOrderLimit}
+	invalid := func(msg string) (model.OrderListQuery, bool) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return query, false
+	}
+
+	if v := c.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxOrderLimit {
+			return invalid(fmt.Sprintf("limit must be between 1 and %d", maxOrderLimit))
+		}
+		query.Limit = limit
+	}
+
+	if v := c.Query("sort"); v != "" {
+		query.Desc = strings.HasPrefix(v, "-")
+		query.Sort = strings.TrimPrefix(v, "-")
+	}
+
+	for _, v := range c.QueryArray("status") {
+		for _, status := range strings.Split(v, ",") {
+			if status = strings.TrimSpace(status); status != "" {
+				query.Filter.Statuses = append(query.Filter.Statuses, status)
+			}
+		}
+	}
+
+	if v := c.Query("from"); v != "" {
+		from, _, err := parseTimeParam(v)
+		if err != nil {
+			return invalid("from must be an RFC 3339 timestamp or a YYYY-MM-DD date")
+		}
+		query.Filter.CreatedFrom = &from
+	}
+	if v := c.Query("to"); v != "" {
+		to, isDate, err := parseTimeParam(v)
+		if err != nil {
+			return invalid("to must be an RFC 3339 timestamp or a YYYY-MM-DD date")
+		}
+		if isDate {
+			to = to.AddDate(0, 0, 1)
+		}
+		query.Filter.CreatedBefore = &to
+	}
+
+	for param, dst := range map[string]**float64{
+		"min_amount": &query.Filter.MinAmount,
+		"max_amount": &query.Filter.MaxAmount,
+	} {
+		if v := c.Query(param); v != "" {
+			amount, err := strconv.ParseFloat(v, 64)
+			if err != nil || amount < 0 {
+				return invalid(param + " must be a non-negative number")
+			}
+			*dst = &amount
+		}
+	}
+	if f := query.Filter; f.MinAmount != nil && f.MaxAmount != nil && *f.MinAmount > *f.MaxAmount {
+		return invalid("min_amount cannot exceed max_amount")
+	}
+
+	return query, true
+}
+
+// parseTimeParam accepts an RFC 3339 timestamp or a date, in UTC, and
+// reports which it was.
+func parseTimeParam(v string) (time.Time, bool, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t.UTC(), false, nil
+	}
+	t, err := time.Parse(time.DateOnly, v)
+	return t, true, err
+}
+
+// listOrders writes one page of orders. When more follow, the response
+// carries next_cursor and a Link header pointing at the next page.
+func (h *OrderHandler) listOrders(c *gin.Context, query model.OrderListQuery) {
+	page, err := h.service.ListOrders(query, c.Query("cursor"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		switch {
+		case errors.Is(err, service.ErrInvalidSort),
+			errors.Is(err, service.ErrInvalidCursor),
+			errors.Is(err, service.ErrUnknownStatus):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"orders": orders})
+	var nextCursor *string
+	if page.NextCursor != "" {
+		nextCursor = &page.NextCursor
+		next := *c.Request.URL
+		params := next.Query()
+		params.Set("cursor", page.NextCursor)
+		next.RawQuery = params.Encode()
+		c.Header("Link", fmt.Sprintf(`<%s>; rel="next"`, next.RequestURI()))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"orders":      page.Orders,
+		"total":       page.Total,
+		"limit":       query.Limit,
+		"next_cursor": nextCursor,
+	})
 }
 
 func (h *OrderHandler) CancelOrder(c *gin.Context) {
@@ -119,34 +286,97 @@ func (h *OrderHandler) CancelOrder(c *gin.Context) {
 	}
 
 	// Verify ownership before cancelling
-	userID := c.GetHeader("X-User-ID")
-	if userID != "" {
-		order, err := h.service.GetOrder(id)
-		if err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
-			return
-		}
-		if order.UserID.String() != userID {
-			c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
-			return
-		}
+	order, err := h.service.GetOrder(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if !h.canAccess(h.principal(c), order) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return
 	}
 
-	if err := h.service.CancelOrder(id); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if err := h.service.CancelOrder(id, h.principal(c).UserID); err != nil {
+		h.lifecycleError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "order cancelled"})
 }
 
+// UpdateStatus lets admins move an order through its lifecycle.
+func (h *OrderHandler) UpdateStatus(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order id"})
+		return
+	}
+
+	var input model.UpdateStatusInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	order, err := h.service.UpdateStatus(id, input, h.principal(c).UserID)
+	if err != nil {
+		h.lifecycleError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"order": order})
+}
+
+func (h *OrderHandler) GetStatusHistory(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order id"})
+		return
+	}
+
+	order, err := h.service.GetOrder(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if !h.canAccess(h.principal(c), order) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return
+	}
+
+	history, err := h.service.GetStatusHistory(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": order.Status, "history": history})
+}
+
+func (h *OrderHandler) lifecycleError(c *gin.Context, err error) {
+	var transitionErr *service.TransitionError
+	switch {
+	case errors.Is(err, service.ErrOrderNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrUnknownStatus):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.As(err, &transitionErr):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "from": transitionErr.From, "to": transitionErr.To})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
 func (h *OrderHandler) RegisterRoutes(r *gin.Engine) {
-	orders := r.Group("/api/orders")
+	orders := r.Group("/api/orders", ginauth.RequireUser())
 	{
 		orders.POST("", h.PlaceOrder)
+		orders.GET("", ginauth.RequireRole("admin"), h.ListOrders)
 		orders.GET("/me", h.GetMyOrders)
 		orders.GET("/:id", h.GetOrder)
 		orders.GET("/user/:userId", h.GetUserOrders)
+		orders.GET("/:id/history", h.GetStatusHistory)
 		orders.PUT("/:id/cancel", h.CancelOrder)
+		orders.PUT("/:id/status", ginauth.RequireRole("admin"), h.UpdateStatus)
 	}
 }
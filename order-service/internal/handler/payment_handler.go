@@ -0,0 +1,234 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/hero/microservice/order-service/internal/model"
+	"github.com/hero/microservice/order-service/internal/payment"
+	"github.com/hero/microservice/order-service/internal/service"
+	"github.com/hero/microservice/pkg/ginauth"
+	"github.com/hero/microservice/pkg/identity"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	maxIdempotencyKeyLen = 100
+	maxWebhookBody       = 1 << 20
+)
+
+type PaymentHandler struct {
+	payments      service.PaymentService
+	orders        service.OrderService
+	webhookSecret []byte
+}
+
+func NewPaymentHandler(payments service.PaymentService, orders service.OrderService, webhookSecret string) *PaymentHandler {
+	return &PaymentHandler{payments: payments, orders: orders, webhookSecret: []byte(webhookSecret)}
+}
+
+func (h *PaymentHandler) principal(c *gin.Context) *identity.Principal {
+	p, _ := ginauth.Principal(c)
+	return p
+}
+
+// order loads the order and checks the caller may pay for it, writing the
+// error response when not.
+func (h *PaymentHandler) order(c *gin.Context, id uuid.UUID) (*model.Order, bool) {
+	order, err := h.orders.GetOrder(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	p := h.principal(c)
+	if !p.IsAdmin() && order.UserID.String() != p.UserID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return nil, false
+	}
+	return order, true
+}
+
+func idempotencyKey(c *gin.Context) (string, bool) {
+	key := c.GetHeader(IdempotencyKeyHeader)
+	if len(key) > maxIdempotencyKeyLen {
+		c.JSON(http.StatusBadRequest, gin.H{"error": IdempotencyKeyHeader + " header is too long"})
+		return "", false
+	}
+	return key, true
+}
+
+func (h *PaymentHandler) Initiate(c *gin.Context) {
+	orderID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order id"})
+		return
+	}
+
+	key, ok := idempotencyKey(c)
+	if !ok {
+		return
+	}
+	if key == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": IdempotencyKeyHeader + " header is required"})
+		return
+	}
+
+	var input model.InitiatePaymentInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, ok := h.order(c, orderID); !ok {
+		return
+	}
+
+	p, created, err := h.payments.Initiate(orderID, input, key)
+	if err != nil {
+		h.paymentError(c, err)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	c.JSON(status, gin.H{"payment": p})
+}
+
+func (h *PaymentHandler) Capture(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payment id"})
+		return
+	}
+
+	key, ok := idempotencyKey(c)
+	if !ok {
+		return
+	}
+
+	p, err := h.payments.GetPayment(id)
+	if err != nil {
+		h.paymentError(c, err)
+		return
+	}
+	if _, ok := h.order(c, p.OrderID); !ok {
+		return
+	}
+
+	p, err = h.payments.Capture(id, key)
+	if err != nil {
+		h.paymentError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"payment": p})
+}
+
+func (h *PaymentHandler) GetPayment(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payment id"})
+		return
+	}
+
+	p, err := h.payments.GetPayment(id)
+	if err != nil {
+		h.paymentError(c, err)
+		return
+	}
+	if _, ok := h.order(c, p.OrderID); !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"payment": p})
+}
+
+func (h *PaymentHandler) GetOrderPayments(c *gin.Context) {
+	orderID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order id"})
+		return
+	}
+
+	if _, ok := h.order(c, orderID); !ok {
+		return
+	}
+
+	payments, err := h.payments.GetOrderPayments(orderID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"payments": payments})
+}
+
+// Webhook receives asynchronous outcomes from the payment provider. It is
+// not behind user auth; the signature proves the sender. Non-2xx responses
+// make the provider retry.
+func (h *PaymentHandler) Webhook(c *gin.Context) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxWebhookBody))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read body"})
+		return
+	}
+
+	if err := payment.VerifySignature(h.webhookSecret, c.GetHeader(payment.SignatureHeader), body, time.Now()); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	var event payment.WebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil || event.ID == "" || event.ProviderRef == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid webhook payload"})
+		return
+	}
+
+	if err := h.payments.HandleWebhook(event); err != nil {
+		h.paymentError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"received": true})
+}
+
+func (h *PaymentHandler) paymentError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrPaymentNotFound), errors.Is(err, service.ErrOrderNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrIdempotencyKeyReused):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrOrderNotPayable),
+		errors.Is(err, service.ErrOrderAlreadyPaid),
+		errors.Is(err, service.ErrPaymentNotCapturable):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrPaymentProvider):
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func (h *PaymentHandler) RegisterRoutes(r *gin.Engine) {
+	r.POST("/api/payments/webhook", h.Webhook)
+
+	orders := r.Group("/api/orders", ginauth.RequireUser())
+	{
+		orders.POST("/:id/payments", h.Initiate)
+		orders.GET("/:id/payments", h.GetOrderPayments)
+	}
+
+	payments := r.Group("/api/payments", ginauth.RequireUser())
+	{
+		payments.GET("/:id", h.GetPayment)
+		payments.POST("/:id/capture", h.Capture)
+	}
+}
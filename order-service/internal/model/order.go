@@ -6,51 +6,192 @@ import (
 	"github.com/google/uuid"
 )
 
+const (
+	OrderStatusPending   = "pending"
+	OrderStatusConfirmed = "confirmed"
+	OrderStatusPaid      = "paid"
+	OrderStatusShipped   = "shipped"
+	OrderStatusDelivered = "delivered"
+	OrderStatusCompleted = "completed"
+	OrderStatusRejected  = "rejected"
+	OrderStatusCancelled = "cancelled"
+	OrderStatusRefunded  = "refunded"
+)
+
+// ActorSystem is recorded in the status history for changes driven by
+// events rather than by a user.
+const ActorSystem = "system"
+
+// orderTransitions is the order lifecycle: the statuses each status may move
+// to. Rejected, cancelled, completed and refunded orders are final.
+var orderTransitions = map[string][]string{
+	OrderStatusPending:   {OrderStatusConfirmed, OrderStatusRejected, OrderStatusCancelled},
+	OrderStatusConfirmed: {OrderStatusPaid, OrderStatusCancelled},
+	OrderStatusPaid:      {OrderStatusShipped, OrderStatusRefunded},
+	OrderStatusShipped:   {OrderStatusDelivered},
+	OrderStatusDelivered: {OrderStatusCompleted, OrderStatusRefunded},
+	OrderStatusCompleted: {},
+	OrderStatusRejected:  {},
+	OrderStatusCancelled: {},
+	OrderStatusRefunded:  {},
+}
+
+func IsOrderStatus(status string) bool {
+	_, ok := orderTransitions[status]
+	return ok
+}
+
+func CanTransition(from, to string) bool {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// CanTransitionManually reports whether a user may move an order from one
+// status to another. Pending orders are confirmed or rejected only by the
+// stock reservation saga, which would otherwise be left holding stock for
+// an order that no longer waits for it.
+func CanTransitionManually(from, to string) bool {
+	if from == OrderStatusPending && to != OrderStatusCancelled {
+		return false
+	}
+	return CanTransition(from, to)
+}
+
 type Order struct {
-	ID          uuid.UUID   `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
-	UserID      uuid.UUID   `gorm:"type:uuid;not null" json:"user_id"`
-	Status      string      `gorm:"type:varchar(50);not null;default:'pending'" json:"status"`
-	TotalAmount float64     `gorm:"type:decimal(10,2);not null" json:"total_amount"`
-	Items       []OrderItem `gorm:"foreignKey:OrderID" json:"items,omitempty"`
-	CreatedAt   time.Time   `gorm:"default:now()" json:"created_at"`
-	UpdatedAt   time.Time   `gorm:"default:now()" json:"updated_at"`
+	ID             uuid.UUID   `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
+	UserID         uuid.UUID   `gorm:"type:uuid;not null" json:"user_id"`
+	Status         string      `gorm:"type:varchar(50);not null;default:'pending'" json:"status"`
+	TotalAmount    float64     `gorm:"type:decimal(10,2);not null" json:"total_amount"`
+	Items          []OrderItem `gorm:"foreignKey:OrderID" json:"items,omitempty"`
+	IdempotencyKey *string     `gorm:"type:varchar(100)" json:"-"`
+	CreatedAt      time.Time   `gorm:"default:now()" json:"created_at"`
+	UpdatedAt      time.Time   `gorm:"default:now()" json:"updated_at"`
 }
 
 func (Order) TableName() string {
 	return "order_schema.orders"
 }
 
+// OrderStatusChange is one row of an order's status history. FromStatus is
+// empty for the row written when the order is placed.
+type OrderStatusChange struct {
+	ID         int64     `gorm:"primaryKey" json:"id"`
+	OrderID    uuid.UUID `gorm:"type:uuid;not null" json:"order_id"`
+	FromStatus string    `gorm:"type:varchar(50);not null;default:''" json:"from_status"`
+	ToStatus   string    `gorm:"type:varchar(50);not null" json:"to_status"`
+	Actor      string    `gorm:"type:varchar(100);not null" json:"actor"`
+	Reason     string    `gorm:"type:text;not null;default:''" json:"reason,omitempty"`
+	CreatedAt  time.Time `gorm:"default:now()" json:"created_at"`
+}
+
+func (OrderStatusChange) TableName() string {
+	return "order_schema.order_status_history"
+}
+
+// OrderItem.VariantID is nil on items ordered before products had
+// variants; those were the product's default variant.
 type OrderItem struct {
-	ID        int       `gorm:"primaryKey" json:"id"`
-	OrderID   uuid.UUID `gorm:"type:uuid" json:"order_id"`
-	ProductID uuid.UUID `gorm:"type:uuid;not null" json:"product_id"`
-	Quantity  int       `gorm:"not null" json:"quantity"`
-	Price     float64   `gorm:"type:decimal(10,2);not null" json:"price"`
+	ID          int        `gorm:"primaryKey" json:"id"`
+	OrderID     uuid.UUID  `gorm:"type:uuid" json:"order_id"`
+	ProductID   uuid.UUID  `gorm:"type:uuid;not null" json:"product_id"`
+	VariantID   *uuid.UUID `gorm:"type:uuid" json:"variant_id,omitempty"`
+	SKU         string     `gorm:"column:sku;type:varchar(64);not null;default:''" json:"sku,omitempty"`
+	ProductName string     `gorm:"type:varchar(200);not null;default:''" json:"product_name"`
+	Quantity    int        `gorm:"not null" json:"quantity"`
+	Price       float64    `gorm:"type:decimal(10,2);not null" json:"price"`
 }
 
 func (OrderItem) TableName() string {
 	return "order_schema.order_items"
 }
 
+const (
+	PaymentStatusPending    = "pending"
+	PaymentStatusAuthorized = "authorized"
+	PaymentStatusCompleted  = "completed"
+	PaymentStatusFailed     = "failed"
+	PaymentStatusRefunded   = "refunded"
+)
+
 type Payment struct {
-	ID      uuid.UUID  `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
-	OrderID uuid.UUID  `gorm:"type:uuid" json:"order_id"`
-	Method  string     `gorm:"type:varchar(50);not null" json:"method"`
-	Status  string     `gorm:"type:varchar(50);not null;default:'pending'" json:"status"`
-	PaidAt  *time.Time `json:"paid_at"`
+	ID             uuid.UUID  `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
+	OrderID        uuid.UUID  `gorm:"type:uuid" json:"order_id"`
+	UserID         uuid.UUID  `gorm:"type:uuid" json:"-"`
+	Method         string     `gorm:"type:varchar(50);not null" json:"method"`
+	Status         string     `gorm:"type:varchar(50);not null;default:'pending'" json:"status"`
+	Amount         float64    `gorm:"type:decimal(10,2);not null" json:"amount"`
+	Provider       string     `gorm:"type:varchar(50);not null;default:''" json:"provider"`
+	ProviderRef    *string    `gorm:"type:varchar(100)" json:"provider_ref,omitempty"`
+	IdempotencyKey *string    `gorm:"type:varchar(100)" json:"-"`
+	FailureReason  string     `gorm:"type:text;not null;default:''" json:"failure_reason,omitempty"`
+	PaidAt         *time.Time `json:"paid_at"`
+	CreatedAt      time.Time  `gorm:"default:now()" json:"created_at"`
+	UpdatedAt      time.Time  `gorm:"default:now()" json:"updated_at"`
 }
 
 func (Payment) TableName() string {
 	return "order_schema.payments"
 }
 
+// OrderItemInput carries no price: unit prices are always resolved from
+// product-service when the order is placed. Without a VariantID the
+// product's default variant is ordered.
 type OrderItemInput struct {
-	ProductID string  `json:"product_id" binding:"required"`
-	Quantity  int     `json:"quantity" binding:"required,min=1"`
-	Price     float64 `json:"price" binding:"required,gt=0"`
+	ProductID string `json:"product_id" binding:"required"`
+	VariantID string `json:"variant_id"`
+	Quantity  int    `json:"quantity" binding:"required,min=1"`
 }
 
 type PlaceOrderInput struct {
-	UserID string           `json:"user_id"`
-	Items  []OrderItemInput `json:"items" binding:"required,min=1"`
+	UserID         string           `json:"user_id"`
+	Items          []OrderItemInput `json:"items" binding:"required,min=1,dive"`
+	IdempotencyKey string           `json:"-"`
+}
+
+type UpdateStatusInput struct {
+	Status string `json:"status" binding:"required"`
+	Reason string `json:"reason"`
+}
+
+type InitiatePaymentInput struct {
+	Method string `json:"method" binding:"required"`
+}
+
+// Columns an order listing can be sorted by. Ties are broken by id.
+const (
+	OrderSortCreatedAt   = "created_at"
+	OrderSortTotalAmount = "total_amount"
+)
+
+// OrderFilter narrows an order listing; nil and empty fields match all.
+// CreatedBefore is exclusive.
+type OrderFilter struct {
+	UserID        *uuid.UUID
+	Statuses      []string
+	CreatedFrom   *time.Time
+	CreatedBefore *time.Time
+	MinAmount     *float64
+	MaxAmount     *float64
+}
+
+// OrderCursor is the position of the last order on a page, in the sort the
+// page was listed in. The next page starts after it.
+type OrderCursor struct {
+	Sort        string    `json:"s"`
+	Desc        bool      `json:"d"`
+	CreatedAt   time.Time `json:"c"`
+	TotalAmount float64   `json:"a"`
+	ID          uuid.UUID `json:"id"`
+}
+
+type OrderListQuery struct {
+	Filter OrderFilter
+	Sort   string
+	Desc   bool
+	Limit  int
+	After  *OrderCursor
 }
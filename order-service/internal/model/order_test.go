@@ -0,0 +1,98 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/gin-gonic/gin/binding"
+)
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{OrderStatusPending, OrderStatusConfirmed, true},
+		{OrderStatusPending, OrderStatusRejected, true},
+		{OrderStatusPending, OrderStatusCancelled, true},
+		{OrderStatusPending, OrderStatusPaid, false},
+		{OrderStatusConfirmed, OrderStatusPaid, true},
+		{OrderStatusConfirmed, OrderStatusCancelled, true},
+		{OrderStatusConfirmed, OrderStatusShipped, false},
+		{OrderStatusPaid, OrderStatusShipped, true},
+		{OrderStatusPaid, OrderStatusRefunded, true},
+		{OrderStatusPaid, OrderStatusCancelled, false},
+		{OrderStatusShipped, OrderStatusDelivered, true},
+		{OrderStatusShipped, OrderStatusRefunded, false},
+		{OrderStatusDelivered, OrderStatusCompleted, true},
+		{OrderStatusDelivered, OrderStatusRefunded, true},
+		{OrderStatusCompleted, OrderStatusRefunded, false},
+		{OrderStatusRejected, OrderStatusPending, false},
+		{OrderStatusCancelled, OrderStatusConfirmed, false},
+		{OrderStatusRefunded, OrderStatusPaid, false},
+		{OrderStatusPending, OrderStatusPending, false},
+		{"unknown", OrderStatusConfirmed, false},
+		{OrderStatusPending, "unknown", false},
+	}
+	for _, tt := range tests {
+		if got := CanTransition(tt.from, tt.to); got != tt.want {
+			t.Errorf("CanTransition(%q, %q) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestCanTransitionManually(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		// Only the saga takes an order out of pending, except to cancel it
+		{OrderStatusPending, OrderStatusConfirmed, false},
+		{OrderStatusPending, OrderStatusRejected, false},
+		{OrderStatusPending, OrderStatusCancelled, true},
+		{OrderStatusConfirmed, OrderStatusPaid, true},
+		{OrderStatusConfirmed, OrderStatusCancelled, true},
+		{OrderStatusPaid, OrderStatusShipped, true},
+		{OrderStatusPaid, OrderStatusRefunded, true},
+		{OrderStatusShipped, OrderStatusDelivered, true},
+		{OrderStatusDelivered, OrderStatusCompleted, true},
+		{OrderStatusDelivered, OrderStatusRefunded, true},
+		{OrderStatusCancelled, OrderStatusConfirmed, false},
+		{OrderStatusShipped, OrderStatusCancelled, false},
+	}
+	for _, tt := range tests {
+		if got := CanTransitionManually(tt.from, tt.to); got != tt.want {
+			t.Errorf("CanTransitionManually(%q, %q) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestOrderStatusesKnown(t *testing.T) {
+	for status, next := range orderTransitions {
+		for _, to := range next {
+			if !IsOrderStatus(to) {
+				t.Errorf("%s moves to unknown status %q", status, to)
+			}
+		}
+	}
+	if IsOrderStatus("unknown") {
+		t.Error(`IsOrderStatus("unknown") = true, want false`)
+	}
+}
+
+func TestPlaceOrderInputValidatesItems(t *testing.T) {
+	tests := []struct {
+		name  string
+		input PlaceOrderInput
+		ok    bool
+	}{
+		{"valid", PlaceOrderInput{Items: []OrderItemInput{{ProductID: "p", Quantity: 1}}}, true},
+		{"no items", PlaceOrderInput{}, false},
+		{"negative quantity", PlaceOrderInput{Items: []OrderItemInput{{ProductID: "p", Quantity: -5}}}, false},
+		{"missing product", PlaceOrderInput{Items: []OrderItemInput{{Quantity: 1}}}, false},
+	}
+	for _, tt := range tests {
+		if err := binding.Validator.ValidateStruct(tt.input); (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
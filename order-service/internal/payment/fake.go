@@ -0,0 +1,69 @@
+package payment
+
+import (
+	"context"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Methods the fake provider treats specially; any other method succeeds.
+const (
+	FakeMethodDecline = "fake_decline"
+	FakeMethodAsync   = "fake_async"
+)
+
+// FakeProvider approves every payment without talking to anyone, for local
+// development and tests. Use FakeMethodDecline to simulate a declined card
+// and FakeMethodAsync to leave the payment pending until a signed webhook
+// settles it.
+type FakeProvider struct {
+	mu   sync.Mutex
+	seen map[string]*Result
+}
+
+func NewFakeProvider() *FakeProvider {
+	return &FakeProvider{seen: make(map[string]*Result)}
+}
+
+func (p *FakeProvider) Name() string {
+	return "fake"
+}
+
+func (p *FakeProvider) Authorize(ctx context.Context, req AuthorizeRequest) (*Result, error) {
+	return p.once(req.IdempotencyKey, func() *Result {
+		result := &Result{ProviderRef: "fake_" + uuid.NewString(), Status: ResultAuthorized}
+		switch req.Method {
+		case FakeMethodDecline:
+			result.Status = ResultFailed
+			result.FailureReason = "card_declined"
+		case FakeMethodAsync:
+			result.Status = ResultPending
+		}
+		return result
+	}), nil
+}
+
+func (p *FakeProvider) Capture(ctx context.Context, req CaptureRequest) (*Result, error) {
+	return p.once(req.IdempotencyKey, func() *Result {
+		return &Result{ProviderRef: req.ProviderRef, Status: ResultCaptured}
+	}), nil
+}
+
+// once replays the first result for a repeated idempotency key, as real
+// providers do.
+func (p *FakeProvider) once(key string, fn func() *Result) *Result {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if result, ok := p.seen[key]; ok && key != "" {
+		copied := *result
+		return &copied
+	}
+	result := fn()
+	if key != "" {
+		copied := *result
+		p.seen[key] = &copied
+	}
+	return result
+}
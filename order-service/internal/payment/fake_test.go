@@ -0,0 +1,66 @@
+package payment
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestFakeProviderAuthorize(t *testing.T) {
+	tests := []struct {
+		method string
+		status string
+		reason string
+	}{
+		{"card", ResultAuthorized, ""},
+		{FakeMethodDecline, ResultFailed, "card_declined"},
+		{FakeMethodAsync, ResultPending, ""},
+	}
+	p := NewFakeProvider()
+	for _, tt := range tests {
+		result, err := p.Authorize(context.Background(), AuthorizeRequest{PaymentID: uuid.New(), Method: tt.method, IdempotencyKey: uuid.NewString()})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.method, err)
+		}
+		if result.Status != tt.status || result.FailureReason != tt.reason || result.ProviderRef == "" {
+			t.Errorf("%s: result = %+v, want status %s reason %q", tt.method, result, tt.status, tt.reason)
+		}
+	}
+}
+
+func TestFakeProviderReplaysIdempotencyKey(t *testing.T) {
+	p := NewFakeProvider()
+	ctx := context.Background()
+
+	first, _ := p.Authorize(ctx, AuthorizeRequest{Method: "card", IdempotencyKey: "key-1"})
+	again, _ := p.Authorize(ctx, AuthorizeRequest{Method: FakeMethodDecline, IdempotencyKey: "key-1"})
+	if *again != *first {
+		t.Errorf("repeated key: result = %+v, want the first %+v", again, first)
+	}
+
+	// Callers cannot change a stored result through the returned copy
+	again.Status = ResultFailed
+	if replay, _ := p.Authorize(ctx, AuthorizeRequest{IdempotencyKey: "key-1"}); replay.Status != ResultAuthorized {
+		t.Errorf("stored result changed to %s", replay.Status)
+	}
+
+	a, _ := p.Authorize(ctx, AuthorizeRequest{Method: "card"})
+	b, _ := p.Authorize(ctx, AuthorizeRequest{Method: "card"})
+	if a.ProviderRef == b.ProviderRef {
+		t.Error("calls without a key were replayed")
+	}
+}
+
+func TestFakeProviderCapture(t *testing.T) {
+	p := NewFakeProvider()
+	ctx := context.Background()
+
+	result, err := p.Capture(ctx, CaptureRequest{ProviderRef: "fake_1", Amount: 10, IdempotencyKey: "capture-1"})
+	if err != nil || result.Status != ResultCaptured || result.ProviderRef != "fake_1" {
+		t.Fatalf("Capture = %+v, %v", result, err)
+	}
+	if again, _ := p.Capture(ctx, CaptureRequest{ProviderRef: "fake_2", IdempotencyKey: "capture-1"}); again.ProviderRef != "fake_1" {
+		t.Errorf("repeated capture = %+v, want the first result", again)
+	}
+}
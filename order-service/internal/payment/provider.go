@@ -0,0 +1,76 @@
+package payment
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+)
+
+// Outcomes reported by a provider, both from API calls and from webhooks.
+const (
+	ResultPending    = "pending"
+	ResultAuthorized = "authorized"
+	ResultCaptured   = "captured"
+	ResultFailed     = "failed"
+)
+
+type AuthorizeRequest struct {
+	PaymentID uuid.UUID
+	OrderID   uuid.UUID
+	Amount    float64
+	Method    string
+	// IdempotencyKey is forwarded so a retried call never charges twice
+	IdempotencyKey string
+}
+
+type CaptureRequest struct {
+	ProviderRef    string
+	Amount         float64
+	IdempotencyKey string
+}
+
+// Result is the provider's view of a payment after a call. Pending means
+// the outcome arrives later through the webhook.
+type Result struct {
+	ProviderRef   string
+	Status        string
+	FailureReason string
+}
+
+// PaymentProvider is the boundary to a payment processor. Payments are
+// authorized first and captured separately.
+type PaymentProvider interface {
+	Name() string
+	Authorize(ctx context.Context, req AuthorizeRequest) (*Result, error)
+	Capture(ctx context.Context, req CaptureRequest) (*Result, error)
+}
+
+// WebhookEvent is the body the provider posts to /api/payments/webhook.
+type WebhookEvent struct {
+	ID            string `json:"id"`
+	Type          string `json:"type"`
+	ProviderRef   string `json:"provider_ref"`
+	FailureReason string `json:"failure_reason,omitempty"`
+}
+
+// Webhook event types, mapped onto the matching Result status.
+const (
+	WebhookAuthorized = "payment.authorized"
+	WebhookCaptured   = "payment.captured"
+	WebhookFailed     = "payment.failed"
+)
+
+func (e WebhookEvent) Result() (*Result, bool) {
+	var status string
+	switch e.Type {
+	case WebhookAuthorized:
+		status = ResultAuthorized
+	case WebhookCaptured:
+		status = ResultCaptured
+	case WebhookFailed:
+		status = ResultFailed
+	default:
+		return nil, false
+	}
+	return &Result{ProviderRef: e.ProviderRef, Status: status, FailureReason: e.FailureReason}, true
+}
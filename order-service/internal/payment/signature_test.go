@@ -0,0 +1,42 @@
+package payment
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestVerifySignature(t *testing.T) {
+	secret := []byte("whsec_test")
+	body := []byte(`{"id":"evt_1","type":"payment.captured","provider_ref":"fake_1"}`)
+	now := time.Unix(1_700_000_000, 0)
+	valid := Sign(secret, now, body)
+
+	tests := []struct {
+		name   string
+		secret []byte
+		header string
+		body   []byte
+		now    time.Time
+		want   error
+	}{
+		{"valid", secret, valid, body, now, nil},
+		{"valid within tolerance", secret, valid, body, now.Add(SignatureTolerance), nil},
+		{"wrong secret", []byte("other"), valid, body, now, ErrInvalidSignature},
+		{"tampered body", secret, valid, []byte(`{"id":"evt_1","type":"payment.captured","provider_ref":"fake_2"}`), now, ErrInvalidSignature},
+		{"tampered timestamp", secret, "t=1700000001," + valid[len("t=1700000000,"):], body, now, ErrInvalidSignature},
+		{"signature not hex", secret, "t=1700000000,v1=zz", body, now, ErrInvalidSignature},
+		{"missing signature", secret, "t=1700000000", body, now, ErrInvalidSignature},
+		{"missing timestamp", secret, valid[len("t=1700000000,"):], body, now, ErrInvalidSignature},
+		{"timestamp not a number", secret, "t=soon,v1=00", body, now, ErrInvalidSignature},
+		{"empty header", secret, "", body, now, ErrInvalidSignature},
+		// A captured request replayed later is refused once it goes stale
+		{"replayed after tolerance", secret, valid, body, now.Add(SignatureTolerance + time.Second), ErrSignatureExpired},
+		{"timestamp in the future", secret, Sign(secret, now.Add(SignatureTolerance+time.Minute), body), body, now, ErrSignatureExpired},
+	}
+	for _, tt := range tests {
+		if err := VerifySignature(tt.secret, tt.header, tt.body, tt.now); !errors.Is(err, tt.want) {
+			t.Errorf("%s: VerifySignature = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
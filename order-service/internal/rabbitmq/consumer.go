@@ -1,100 +1,199 @@
 package rabbitmq
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"log"
 
+	"github.com/google/uuid"
+	"github.com/hero/microservice/pkg/events"
+	"github.com/hero/microservice/pkg/idempotency"
+	"github.com/hero/microservice/pkg/messaging"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-type InventoryUpdatedData struct {
-	ProductID         string `json:"product_id"`
-	QuantityRemaining int    `json:"quantity_remaining"`
-	IsLowStock        bool   `json:"is_low_stock"`
-}
+type InventoryHandler func(data events.InventoryUpdated)
 
-type InventoryEvent struct {
-	Event string               `json:"event"`
-	Data  InventoryUpdatedData `json:"data"`
-}
+type ReservedHandler func(eventID, correlationID string, orderID uuid.UUID) error
+
+type ReservationFailedHandler func(eventID, correlationID string, orderID uuid.UUID, reason string) error
 
-type InventoryHandler func(data InventoryUpdatedData)
+type PaymentSucceededHandler func(eventID, correlationID string, orderID uuid.UUID, paymentID string) error
+
+type LoggedInHandler func(cartToken, userID string) (int, error)
+
+type PriceChangedHandler func(productID, variantID string, defaultVariant bool, price float64) (int, error)
 
 type Consumer struct {
-	conn    *amqp.Connection
-	channel *amqp.Channel
+	mq        *messaging.Client
+	processed *idempotency.Store
 }
 
-func NewConsumer(host, port, user, password string) (*Consumer, error) {
-	url := fmt.Sprintf("amqp://%s:%s@%s:%s/", user, password, host, port)
-
-	conn, err := amqp.Dial(url)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to RabbitMQ: %w", err)
+func NewConsumer(mq *messaging.Client, processed *idempotency.Store) (*Consumer, error) {
+	queues := []messaging.Queue{
+		{Name: "inventory.updated.order", Exchange: "product.exchange", RoutingKey: events.TypeInventoryUpdated},
+		{Name: "inventory.reserved.order", Exchange: "product.exchange", RoutingKey: events.TypeInventoryReserved},
+		{Name: "inventory.reservation_failed.order", Exchange: "product.exchange", RoutingKey: events.TypeReservationFailed},
+		{Name: "product.price_changed.order", Exchange: "product.exchange", RoutingKey: events.TypeProductPriceChanged},
+		{Name: "payment.succeeded.order", Exchange: "order.exchange", RoutingKey: events.TypePaymentSucceeded},
+		{Name: "user.logged_in.order", Exchange: "user.exchange", RoutingKey: events.TypeUserLoggedIn},
 	}
 
-	ch, err := conn.Channel()
-	if err != nil {
-		conn.Close()
-		return nil, fmt.Errorf("failed to open channel: %w", err)
+	for _, q := range queues {
+		if err := mq.DeclareQueue(q); err != nil {
+			return nil, err
+		}
 	}
 
-	err = ch.ExchangeDeclare("product.exchange", "topic", true, false, false, false, nil)
-	if err != nil {
-		ch.Close()
-		conn.Close()
-		return nil, fmt.Errorf("failed to declare exchange: %w", err)
-	}
+	return &Consumer{mq: mq, processed: processed}, nil
+}
 
-	_, err = ch.QueueDeclare("inventory.updated.order", true, false, false, false, nil)
-	if err != nil {
-		ch.Close()
-		conn.Close()
-		return nil, fmt.Errorf("failed to declare queue: %w", err)
+// once skips events already known as processed and remembers the ones fn
+// handles. Handlers with side effects also claim the event id in their
+// transaction, which is what guarantees exactly once.
+func (c *Consumer) once(env *events.Envelope, fn func() error) error {
+	ctx := context.Background()
+	if c.processed.Seen(ctx, env.ID) {
+		log.Printf("Skipping already processed %s event %s", env.Type, env.ID)
+		return nil
 	}
-
-	err = ch.QueueBind("inventory.updated.order", "inventory.updated", "product.exchange", false, nil)
-	if err != nil {
-		ch.Close()
-		conn.Close()
-		return nil, fmt.Errorf("failed to bind queue: %w", err)
+	if err := fn(); err != nil {
+		return err
 	}
-
-	log.Println("RabbitMQ consumer connected")
-	return &Consumer{conn: conn, channel: ch}, nil
+	c.processed.Remember(ctx, env.ID)
+	return nil
 }
 
-func (c *Consumer) ConsumeInventoryUpdated(handler InventoryHandler) {
-	msgs, err := c.channel.Consume("inventory.updated.order", "", true, false, false, false, nil)
+// decode parses the envelope and payload. Malformed messages will never
+// succeed, so they skip the retries.
+func decode(msg amqp.Delivery, v interface{}) (*events.Envelope, error) {
+	env, err := events.Decode(msg.Body)
 	if err != nil {
-		log.Printf("Failed to consume: %v", err)
-		return
+		return nil, messaging.Permanent(err)
+	}
+	if err := env.DecodeData(v); err != nil {
+		return nil, messaging.Permanent(err)
 	}
+	return env, nil
+}
 
-	go func() {
-		for msg := range msgs {
-			var event InventoryEvent
-			if err := json.Unmarshal(msg.Body, &event); err != nil {
-				log.Printf("Failed to unmarshal inventory event: %v", err)
-				continue
-			}
+func (c *Consumer) ConsumeInventoryUpdated(handler InventoryHandler) error {
+	return c.mq.Consume("inventory.updated.order", func(msg amqp.Delivery) error {
+		var data events.InventoryUpdated
+		env, err := decode(msg, &data)
+		if err != nil {
+			return err
+		}
 
+		return c.once(env, func() error {
 			log.Printf("Received inventory.updated: product_id=%s, remaining=%d, low_stock=%v",
-				event.Data.ProductID, event.Data.QuantityRemaining, event.Data.IsLowStock)
+				data.ProductID, data.QuantityRemaining, data.IsLowStock)
 
-			handler(event.Data)
+			handler(data)
+			return nil
+		})
+	})
+}
+
+func (c *Consumer) ConsumeInventoryReserved(handler ReservedHandler) error {
+	return c.mq.Consume("inventory.reserved.order", func(msg amqp.Delivery) error {
+		var data events.InventoryReserved
+		env, err := decode(msg, &data)
+		if err != nil {
+			return err
 		}
-	}()
+		return c.handleOrderEvent(env, data.OrderID, func(orderID uuid.UUID) error {
+			return handler(env.ID, env.CorrelationID, orderID)
+		})
+	})
+}
 
-	log.Println("Consuming inventory.updated events...")
+func (c *Consumer) ConsumeReservationFailed(handler ReservationFailedHandler) error {
+	return c.mq.Consume("inventory.reservation_failed.order", func(msg amqp.Delivery) error {
+		var data events.ReservationFailed
+		env, err := decode(msg, &data)
+		if err != nil {
+			return err
+		}
+		return c.handleOrderEvent(env, data.OrderID, func(orderID uuid.UUID) error {
+			return handler(env.ID, env.CorrelationID, orderID, data.Reason)
+		})
+	})
 }
 
-func (c *Consumer) Close() {
-	if c.channel != nil {
-		c.channel.Close()
-	}
-	if c.conn != nil {
-		c.conn.Close()
+func (c *Consumer) ConsumePaymentSucceeded(handler PaymentSucceededHandler) error {
+	return c.mq.Consume("payment.succeeded.order", func(msg amqp.Delivery) error {
+		var data events.PaymentSucceeded
+		env, err := decode(msg, &data)
+		if err != nil {
+			return err
+		}
+		return c.handleOrderEvent(env, data.OrderID, func(orderID uuid.UUID) error {
+			return handler(env.ID, env.CorrelationID, orderID, data.PaymentID)
+		})
+	})
+}
+
+// ConsumeUserLoggedIn merges the guest cart a user shopped with before
+// signing in.
+func (c *Consumer) ConsumeUserLoggedIn(handler LoggedInHandler) error {
+	return c.mq.Consume("user.logged_in.order", func(msg amqp.Delivery) error {
+		var data events.UserLoggedIn
+		env, err := decode(msg, &data)
+		if err != nil {
+			return err
+		}
+		if data.CartToken == "" {
+			return nil
+		}
+
+		return c.once(env, func() error {
+			merged, err := handler(data.CartToken, data.UserID)
+			if err != nil {
+				return fmt.Errorf("failed to merge guest cart for user %s: %w", data.UserID, err)
+			}
+			if merged > 0 {
+				log.Printf("Merged %d guest cart lines into cart of user %s", merged, data.UserID)
+			}
+			return nil
+		})
+	})
+}
+
+// ConsumePriceChanged flags the carts that hold a repriced product.
+func (c *Consumer) ConsumePriceChanged(handler PriceChangedHandler) error {
+	return c.mq.Consume("product.price_changed.order", func(msg amqp.Delivery) error {
+		var data events.ProductPriceChanged
+		env, err := decode(msg, &data)
+		if err != nil {
+			return err
+		}
+
+		return c.once(env, func() error {
+			flagged, err := handler(data.ProductID, data.VariantID, data.DefaultVariant, data.NewPrice)
+			if err != nil {
+				return fmt.Errorf("failed to flag carts for product %s: %w", data.ProductID, err)
+			}
+			if flagged > 0 {
+				log.Printf("Flagged %d carts after price of product %s changed to %.2f", flagged, data.ProductID, data.NewPrice)
+			}
+			return nil
+		})
+	})
+}
+
+func (c *Consumer) handleOrderEvent(env *events.Envelope, rawOrderID string, handler func(uuid.UUID) error) error {
+	log.Printf("Received %s: order_id=%s", env.Type, rawOrderID)
+
+	orderID, err := uuid.Parse(rawOrderID)
+	if err != nil {
+		return messaging.Permanent(fmt.Errorf("invalid order_id: %s", rawOrderID))
 	}
+
+	return c.once(env, func() error {
+		if err := handler(orderID); err != nil {
+			return fmt.Errorf("failed to handle %s for order %s: %w", env.Type, rawOrderID, err)
+		}
+		return nil
+	})
 }
@@ -1,24 +1,39 @@
 package repository
 
 import (
+	"fmt"
+
 	"github.com/google/uuid"
 	"github.com/hero/microservice/order-service/internal/model"
+	"github.com/hero/microservice/pkg/events"
+	"github.com/hero/microservice/pkg/idempotency"
+	"github.com/hero/microservice/pkg/outbox"
 	"gorm.io/gorm"
 )
 
 type OrderRepository interface {
 	Create(order *model.Order) error
 	GetByID(id uuid.UUID) (*model.Order, error)
-	GetByUserID(userID uuid.UUID) ([]model.Order, error)
+	List(query model.OrderListQuery) ([]model.Order, int64, error)
+	GetByIdempotencyKey(userID uuid.UUID, key string) (*model.Order, error)
+	LockIdempotencyKey(userID uuid.UUID, key string) error
 	UpdateStatus(id uuid.UUID, status string) error
+	TransitionStatus(id uuid.UUID, from []string, to string) (bool, error)
+	AddStatusChange(change *model.OrderStatusChange) error
+	GetStatusHistory(orderID uuid.UUID) ([]model.OrderStatusChange, error)
+	AddEvent(eventType string, data interface{}, opts ...events.Option) error
+	ClaimEvent(eventID, eventType string) (bool, error)
+	Transaction(fn func(repo OrderRepository) error) error
 }
 
 type orderRepository struct {
-	db *gorm.DB
+	db        *gorm.DB
+	events    *outbox.Outbox
+	processed *idempotency.Store
 }
 
-func NewOrderRepository(db *gorm.DB) OrderRepository {
-	return &orderRepository{db: db}
+func NewOrderRepository(db *gorm.DB, events *outbox.Outbox, processed *idempotency.Store) OrderRepository {
+	return &orderRepository{db: db, events: events, processed: processed}
 }
 
 func (r *orderRepository) Create(order *model.Order) error {
@@ -34,13 +49,108 @@ func (r *orderRepository) GetByID(id uuid.UUID) (*model.Order, error) {
 	return &order, nil
 }
 
-func (r *orderRepository) GetByUserID(userID uuid.UUID) ([]model.Order, error) {
-	var orders []model.Order
-	err := r.db.Preload("Items").Where("user_id = ?", userID).
-		Order("created_at DESC").Find(&orders).Error
-	return orders, err
+// List returns up to query.Limit orders matching the filter, in sort order
+// after query.After, and the number of orders matching the filter overall.
+// query.Sort must be one of the OrderSort columns.
+func (r *orderRepository) List(query model.OrderListQuery) ([]model.Order, int64, error) {
+	db := r.db.Model(&model.Order{})
+	f := query.Filter
+	if f.UserID != nil {
+		db = db.Where("user_id = ?", *f.UserID)
+	}
+	if len(f.Statuses) > 0 {
+		db = db.Where("status IN ?", f.Statuses)
+	}
+	if f.CreatedFrom != nil {
+		db = db.Where("created_at >= ?", *f.CreatedFrom)
+	}
+	if f.CreatedBefore != nil {
+		db = db.Where("created_at < ?", *f.CreatedBefore)
+	}
+	if f.MinAmount != nil {
+		db = db.Where("total_amount >= ?", *f.MinAmount)
+	}
+	if f.MaxAmount != nil {
+		db = db.Where("total_amount <= ?", *f.MaxAmount)
+	}
+
+	var total int64
+	if err := db.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	dir, cmp := "ASC", ">"
+	if query.Desc {
+		dir, cmp = "DESC", "<"
+	}
+	if after := query.After; after != nil {
+		var key interface{} = after.CreatedAt
+		if query.Sort == model.OrderSortTotalAmount {
+			key = after.TotalAmount
+		}
+		db = db.Where(fmt.Sprintf("(%s, id) %s (?, ?)", query.Sort, cmp), key, after.ID)
+	}
+
+	orders := []model.Order{}
+	err := db.Preload("Items").
+		Order(fmt.Sprintf("%s %s, id %s", query.Sort, dir, dir)).
+		Limit(query.Limit).Find(&orders).Error
+	return orders, total, err
+}
+
+func (r *orderRepository) GetByIdempotencyKey(userID uuid.UUID, key string) (*model.Order, error) {
+	var order model.Order
+	err := r.db.Preload("Items").Where("user_id = ? AND idempotency_key = ?", userID, key).First(&order).Error
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// LockIdempotencyKey serialises requests carrying the same key until the
+// surrounding transaction ends, so only the first one creates an order.
+func (r *orderRepository) LockIdempotencyKey(userID uuid.UUID, key string) error {
+	return r.db.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "order:"+userID.String()+":"+key).Error
 }
 
 func (r *orderRepository) UpdateStatus(id uuid.UUID, status string) error {
 	return r.db.Model(&model.Order{}).Where("id = ?", id).Update("status", status).Error
 }
+
+// TransitionStatus moves the order to status to only if it is currently in
+// one of the from statuses, so concurrent transitions cannot overwrite
+// each other. It reports whether the order was updated.
+func (r *orderRepository) TransitionStatus(id uuid.UUID, from []string, to string) (bool, error) {
+	result := r.db.Model(&model.Order{}).
+		Where("id = ? AND status IN ?", id, from).
+		Updates(map[string]interface{}{"status": to, "updated_at": gorm.Expr("NOW()")})
+	return result.RowsAffected > 0, result.Error
+}
+
+func (r *orderRepository) AddStatusChange(change *model.OrderStatusChange) error {
+	return r.db.Create(change).Error
+}
+
+func (r *orderRepository) GetStatusHistory(orderID uuid.UUID) ([]model.OrderStatusChange, error) {
+	var history []model.OrderStatusChange
+	err := r.db.Where("order_id = ?", orderID).Order("created_at, id").Find(&history).Error
+	return history, err
+}
+
+// AddEvent queues an event in the outbox; inside Transaction it commits
+// atomically with the rest of the writes.
+func (r *orderRepository) AddEvent(eventType string, data interface{}, opts ...events.Option) error {
+	return r.events.Add(r.db, eventType, data, opts...)
+}
+
+// ClaimEvent records a consumed event and reports false if it was already
+// processed. Call it inside Transaction with the handler's writes.
+func (r *orderRepository) ClaimEvent(eventID, eventType string) (bool, error) {
+	return r.processed.Claim(r.db, eventID, eventType)
+}
+
+func (r *orderRepository) Transaction(fn func(repo OrderRepository) error) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		return fn(&orderRepository{db: tx, events: r.events, processed: r.processed})
+	})
+}
@@ -0,0 +1,123 @@
+package repository
+
+import (
+	"github.com/google/uuid"
+	"github.com/hero/microservice/order-service/internal/model"
+	"github.com/hero/microservice/pkg/events"
+	"github.com/hero/microservice/pkg/idempotency"
+	"github.com/hero/microservice/pkg/outbox"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type PaymentRepository interface {
+	Create(payment *model.Payment) (bool, error)
+	GetByID(id uuid.UUID) (*model.Payment, error)
+	GetByIdempotencyKey(userID uuid.UUID, key string) (*model.Payment, error)
+	GetByProviderRef(provider, ref string) (*model.Payment, error)
+	GetByOrderID(orderID uuid.UUID) ([]model.Payment, error)
+	HasCompleted(orderID uuid.UUID) (bool, error)
+	LockOrder(orderID uuid.UUID) (*model.Order, error)
+	TransitionStatus(id uuid.UUID, from []string, to string, updates map[string]interface{}) (bool, error)
+	AddEvent(eventType string, data interface{}, opts ...events.Option) error
+	ClaimEvent(eventID, eventType string) (bool, error)
+	Transaction(fn func(repo PaymentRepository) error) error
+}
+
+type paymentRepository struct {
+	db        *gorm.DB
+	events    *outbox.Outbox
+	processed *idempotency.Store
+}
+
+func NewPaymentRepository(db *gorm.DB, events *outbox.Outbox, processed *idempotency.Store) PaymentRepository {
+	return &paymentRepository{db: db, events: events, processed: processed}
+}
+
+// Create inserts the payment unless its user already used its idempotency
+// key, and reports whether it was inserted.
+func (r *paymentRepository) Create(payment *model.Payment) (bool, error) {
+	result := r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "idempotency_key"}},
+		DoNothing: true,
+	}).Create(payment)
+	return result.RowsAffected > 0, result.Error
+}
+
+func (r *paymentRepository) GetByID(id uuid.UUID) (*model.Payment, error) {
+	var payment model.Payment
+	if err := r.db.Where("id = ?", id).First(&payment).Error; err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
+func (r *paymentRepository) GetByIdempotencyKey(userID uuid.UUID, key string) (*model.Payment, error) {
+	var payment model.Payment
+	if err := r.db.Where("user_id = ? AND idempotency_key = ?", userID, key).First(&payment).Error; err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
+func (r *paymentRepository) GetByProviderRef(provider, ref string) (*model.Payment, error) {
+	var payment model.Payment
+	err := r.db.Where("provider = ? AND provider_ref = ?", provider, ref).First(&payment).Error
+	if err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
+func (r *paymentRepository) GetByOrderID(orderID uuid.UUID) ([]model.Payment, error) {
+	var payments []model.Payment
+	err := r.db.Where("order_id = ?", orderID).Order("created_at DESC").Find(&payments).Error
+	return payments, err
+}
+
+func (r *paymentRepository) HasCompleted(orderID uuid.UUID) (bool, error) {
+	var count int64
+	err := r.db.Model(&model.Payment{}).
+		Where("order_id = ? AND status = ?", orderID, model.PaymentStatusCompleted).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// LockOrder locks the order's row until the surrounding transaction ends,
+// serialising captures of its payments.
+func (r *paymentRepository) LockOrder(orderID uuid.UUID) (*model.Order, error) {
+	var order model.Order
+	err := r.db.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", orderID).First(&order).Error
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// TransitionStatus moves the payment to status to, applying updates, only
+// if it is currently in one of the from statuses. It reports whether the
+// payment was updated.
+func (r *paymentRepository) TransitionStatus(id uuid.UUID, from []string, to string, updates map[string]interface{}) (bool, error) {
+	values := map[string]interface{}{"status": to, "updated_at": gorm.Expr("NOW()")}
+	for k, v := range updates {
+		values[k] = v
+	}
+	result := r.db.Model(&model.Payment{}).
+		Where("id = ? AND status IN ?", id, from).
+		Updates(values)
+	return result.RowsAffected > 0, result.Error
+}
+
+func (r *paymentRepository) AddEvent(eventType string, data interface{}, opts ...events.Option) error {
+	return r.events.Add(r.db, eventType, data, opts...)
+}
+
+func (r *paymentRepository) ClaimEvent(eventID, eventType string) (bool, error) {
+	return r.processed.Claim(r.db, eventID, eventType)
+}
+
+func (r *paymentRepository) Transaction(fn func(repo PaymentRepository) error) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		return fn(&paymentRepository{db: tx, events: r.events, processed: r.processed})
+	})
+}
@@ -3,105 +3,643 @@ package service
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/hero/microservice/order-service/internal/client"
 	"github.com/redis/go-redis/v9"
 )
 
-const cartTTL = 7 * 24 * time.Hour // 7 days
+const (
+	cartTTL = 7 * 24 * time.Hour // 7 days
 
+	// MaxCartItems caps the distinct products in one cart
+	MaxCartItems = 50
+	// MaxItemQuantity caps the quantity of a single cart line
+	MaxItemQuantity = 99
+)
+
+var (
+	ErrInvalidProductID = errors.New("invalid product_id")
+	ErrInvalidVariantID = errors.New("invalid variant_id")
+	ErrInvalidQuantity  = errors.New("quantity must be at least 1")
+	ErrCartFull         = fmt.Errorf("cart cannot hold more than %d products", MaxCartItems)
+	ErrQuantityLimit    = fmt.Errorf("quantity cannot exceed %d per product", MaxItemQuantity)
+	ErrProductNotFound  = errors.New("product not found")
+	ErrVariantNotFound  = errors.New("variant not found")
+	ErrNotForSale       = errors.New("product is not for sale")
+)
+
+// CartItem without a VariantID is for the product's default variant.
 type CartItem struct {
 	ProductID string  `json:"product_id"`
+	VariantID string  `json:"variant_id,omitempty"`
 	Quantity  int     `json:"quantity"`
 	Price     float64 `json:"price"`
+
+	// flaggedPrice is the price announced by product.price_changed since
+	// the line was added, if it differs from Price
+	flaggedPrice *float64
+}
+
+// PricedCartItem is a cart line next to the product's current price.
+// Price is what the shopper saw when adding it.
+type PricedCartItem struct {
+	ProductID    string  `json:"product_id"`
+	VariantID    string  `json:"variant_id,omitempty"`
+	SKU          string  `json:"sku,omitempty"`
+	Quantity     int     `json:"quantity"`
+	Price        float64 `json:"price"`
+	CurrentPrice float64 `json:"current_price"`
+	PriceChanged bool    `json:"price_changed"`
+	Subtotal     float64 `json:"subtotal"`
+}
+
+// PricedCart totals the cart at current prices.
+type PricedCart struct {
+	Items        []PricedCartItem `json:"items"`
+	Subtotal     float64          `json:"subtotal"`
+	PriceChanged bool             `json:"price_changed"`
+}
+
+// AddToCartInput names the line to add. The price stored with it is the
+// current one from product-service, never the client's.
+type AddToCartInput struct {
+	ProductID string `json:"product_id" binding:"required"`
+	VariantID string `json:"variant_id"`
+	Quantity  int    `json:"quantity" binding:"required"`
+}
+
+type SetQuantityInput struct {
+	Quantity int `json:"quantity" binding:"required"`
+}
+
+// How a guest cart line is combined with the same product already in the
+// user's cart.
+const (
+	MergeQuantitySum   = "sum"   // add both quantities
+	MergeQuantityMax   = "max"   // keep the larger quantity
+	MergeQuantityUser  = "user"  // keep the user's quantity
+	MergeQuantityGuest = "guest" // take the guest quantity
+
+	MergePriceLatest = "latest" // price of the most recently added line
+	MergePriceUser   = "user"
+	MergePriceGuest  = "guest"
+)
+
+type MergeRules struct {
+	Quantity string
+	Price    string
+}
+
+// NewMergeRules validates the configured rules.
+func NewMergeRules(quantity, price string) (MergeRules, error) {
+	switch quantity {
+	case MergeQuantitySum, MergeQuantityMax, MergeQuantityUser, MergeQuantityGuest:
+	default:
+		return MergeRules{}, errors.New("unknown cart merge quantity rule: " + quantity)
+	}
+	switch price {
+	case MergePriceLatest, MergePriceUser, MergePriceGuest:
+	default:
+		return MergeRules{}, errors.New("unknown cart merge price rule: " + price)
+	}
+	return MergeRules{Quantity: quantity, Price: price}, nil
+}
+
+// GuestCartOwner is the cart owner for an anonymous shopper's cart token.
+// Every other method takes it in place of a user id.
+func GuestCartOwner(token string) string {
+	return "guest:" + token
 }
 
 type CartService interface {
 	GetCart(userID string) ([]CartItem, error)
-	AddToCart(userID string, item CartItem) ([]CartItem, error)
-	RemoveFromCart(userID string, productID string) ([]CartItem, error)
+	GetPricedCart(userID string) (*PricedCart, error)
+	AddToCart(userID string, input AddToCartInput) ([]CartItem, error)
+	SetQuantity(userID, productID, variantID string, quantity int) ([]CartItem, error)
+	RemoveFromCart(userID, productID, variantID string) ([]CartItem, error)
 	ClearCart(userID string) error
+	RemoveOrdered(userID string, ordered []CartItem) error
+	MergeGuestCart(token, userID string) (int, error)
+	FlagPriceChange(productID, variantID string, defaultVariant bool, price float64) (int, error)
 }
 
 type cartService struct {
-	rdb *redis.Client
+	rdb      *redis.Client
+	rules    MergeRules
+	products client.ProductClient
 }
 
-func NewCartService(rdb *redis.Client) CartService {
-	return &cartService{rdb: rdb}
+func NewCartService(rdb *redis.Client, rules MergeRules, products client.ProductClient) CartService {
+	return &cartService{rdb: rdb, rules: rules, products: products}
+}
+
+// The cart is a hash of line key -> JSON line, see lineKey. Every operation
+// runs as a single script so concurrent requests cannot lose each other's
+// updates.
+// Carts written before the hash layout were a JSON array under the same key;
+// cartPrelude converts them in place on first touch.
+const cartPrelude = `
+local key = KEYS[1]
+if redis.call('TYPE', key).ok == 'string' then
+	local legacy = cjson.decode(redis.call('GET', key))
+	redis.call('DEL', key)
+	if type(legacy) == 'table' then
+		for i, item in ipairs(legacy) do
+			redis.call('HSET', key, item.product_id, cjson.encode({quantity = item.quantity, price = item.price, added_at = i}))
+		end
+		redis.call('EXPIRE', key, ARGV[1])
+	end
+end
+`
+
+// ARGV: ttl, line key, quantity, price, mode, max items, max quantity,
+// now (ms). Mode "add" increments the line and takes the new price, "set"
+// replaces the quantity and keeps the stored price and any price flag.
+var upsertScript = redis.NewScript(cartPrelude + `
+local line = redis.call('HGET', key, ARGV[2])
+local quantity = tonumber(ARGV[3])
+local price = tonumber(ARGV[4])
+local addedAt = tonumber(ARGV[8])
+local currentPrice = nil
+if line then
+	local current = cjson.decode(line)
+	addedAt = current.added_at
+	if ARGV[5] == 'add' then
+		quantity = quantity + current.quantity
+	else
+		price = current.price
+		currentPrice = current.current_price
+	end
+elseif redis.call('HLEN', key) >= tonumber(ARGV[6]) then
+	return redis.error_reply('CART_FULL')
+end
+if quantity > tonumber(ARGV[7]) then
+	return redis.error_reply('QUANTITY_LIMIT')
+end
+redis.call('HSET', key, ARGV[2], cjson.encode({quantity = quantity, price = price, added_at = addedAt, current_price = currentPrice}))
+redis.call('EXPIRE', key, ARGV[1])
+return redis.call('HGETALL', key)
+`)
+
+// ARGV: ttl, line keys
+var removeScript = redis.NewScript(cartPrelude + `
+for i = 2, #ARGV do
+	redis.call('HDEL', key, ARGV[i])
+end
+return redis.call('HGETALL', key)
+`)
+
+// ARGV: ttl, then line key and quantity pairs. Takes each quantity off its
+// line, dropping lines that reach zero; lines added since are left alone.
+var takeScript = redis.NewScript(cartPrelude + `
+for i = 2, #ARGV, 2 do
+	local line = redis.call('HGET', key, ARGV[i])
+	if line then
+		local current = cjson.decode(line)
+		current.quantity = current.quantity - tonumber(ARGV[i + 1])
+		if current.quantity > 0 then
+			redis.call('HSET', key, ARGV[i], cjson.encode(current))
+		else
+			redis.call('HDEL', key, ARGV[i])
+		end
+	end
+end
+return redis.call('HGETALL', key)
+`)
+
+// ARGV: ttl
+var readScript = redis.NewScript(cartPrelude + `
+return redis.call('HGETALL', key)
+`)
+
+// KEYS: user cart, guest cart. ARGV: ttl, quantity rule, price rule, max
+// items, max quantity. Lines beyond the item limit are dropped, quantities
+// are capped. Returns the number of guest lines; the guest cart is deleted.
+var mergeScript = redis.NewScript(cartPrelude + `
+local guest = redis.call('HGETALL', KEYS[2])
+for i = 1, #guest, 2 do
+	local lineKey = guest[i]
+	local line = cjson.decode(guest[i + 1])
+	local existing = redis.call('HGET', key, lineKey)
+	if existing then
+		local current = cjson.decode(existing)
+		local quantity = current.quantity
+		if ARGV[2] == 'sum' then
+			quantity = current.quantity + line.quantity
+		elseif ARGV[2] == 'max' then
+			quantity = math.max(current.quantity, line.quantity)
+		elseif ARGV[2] == 'guest' then
+			quantity = line.quantity
+		end
+		if ARGV[3] == 'guest' or (ARGV[3] == 'latest' and line.added_at > current.added_at) then
+			current.price = line.price
+			current.current_price = line.current_price
+		end
+		current.quantity = math.min(quantity, tonumber(ARGV[5]))
+		redis.call('HSET', key, lineKey, cjson.encode(current))
+	elseif redis.call('HLEN', key) < tonumber(ARGV[4]) then
+		redis.call('HSET', key, lineKey, guest[i + 1])
+	end
+end
+if #guest > 0 then
+	redis.call('DEL', KEYS[2])
+	redis.call('EXPIRE', key, ARGV[1])
+end
+return #guest / 2
+`)
+
+// ARGV: ttl, price, line keys. Records the new price on each line unless it
+// matches the stored one. Returns how many of the lines the cart holds.
+var flagScript = redis.NewScript(cartPrelude + `
+local price = tonumber(ARGV[2])
+local held = 0
+for i = 3, #ARGV do
+	local line = redis.call('HGET', key, ARGV[i])
+	if line then
+		local current = cjson.decode(line)
+		if current.price == price then
+			current.current_price = nil
+		else
+			current.current_price = price
+		end
+		redis.call('HSET', key, ARGV[i], cjson.encode(current))
+		held = held + 1
+	end
+end
+return held
+`)
+
+type cartLine struct {
+	Quantity     int      `json:"quantity"`
+	Price        float64  `json:"price"`
+	AddedAt      int64    `json:"added_at"`
+	CurrentPrice *float64 `json:"current_price"`
 }
 
 func (s *cartService) cartKey(userID string) string {
 	return fmt.Sprintf("cart:%s", userID)
 }
 
-func (s *cartService) GetCart(userID string) ([]CartItem, error) {
-	val, err := s.rdb.Get(context.Background(), s.cartKey(userID)).Result()
-	if err == redis.Nil {
-		return []CartItem{}, nil
+// lineKey is the hash field of a cart line: the product id for the default
+// variant, as in carts from before variants, else "<product_id>:<variant_id>".
+// resolveLine decides which applies.
+func lineKey(productID, variantID string) string {
+	if variantID == "" {
+		return productID
+	}
+	return productID + ":" + variantID
+}
+
+// productCartsKey is the set of cart owners that have held the product. It
+// may list carts that dropped the product since; FlagPriceChange prunes
+// those.
+func (s *cartService) productCartsKey(productID string) string {
+	return fmt.Sprintf("cart:product:%s", productID)
+}
+
+func (s *cartService) index(userID string, items []CartItem) {
+	if len(items) == 0 {
+		return
+	}
+	ctx := context.Background()
+	_, err := s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, item := range items {
+			key := s.productCartsKey(item.ProductID)
+			pipe.SAdd(ctx, key, userID)
+			pipe.Expire(ctx, key, cartTTL)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to index cart of %s by product: %v", userID, err)
 	}
+}
+
+func (s *cartService) run(script *redis.Script, userID string, args ...interface{}) ([]CartItem, error) {
+	argv := append([]interface{}{int(cartTTL.Seconds())}, args...)
+	res, err := script.Run(context.Background(), s.rdb, []string{s.cartKey(userID)}, argv...).StringSlice()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get cart: %w", err)
+		switch {
+		case strings.HasPrefix(err.Error(), "CART_FULL"):
+			return nil, ErrCartFull
+		case strings.HasPrefix(err.Error(), "QUANTITY_LIMIT"):
+			return nil, ErrQuantityLimit
+		}
+		return nil, fmt.Errorf("failed to access cart: %w", err)
+	}
+	return parseCart(res)
+}
+
+// parseCart turns HGETALL output into cart items, oldest first.
+func parseCart(fields []string) ([]CartItem, error) {
+	type entry struct {
+		item    CartItem
+		addedAt int64
 	}
+	entries := make([]entry, 0, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		var line cartLine
+		if err := json.Unmarshal([]byte(fields[i+1]), &line); err != nil {
+			return nil, fmt.Errorf("failed to parse cart: %w", err)
+		}
+		productID, variantID, _ := strings.Cut(fields[i], ":")
+		entries = append(entries, entry{
+			item: CartItem{
+				ProductID:    productID,
+				VariantID:    variantID,
+				Quantity:     line.Quantity,
+				Price:        line.Price,
+				flaggedPrice: line.CurrentPrice,
+			},
+			addedAt: line.AddedAt,
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].addedAt != entries[j].addedAt {
+			return entries[i].addedAt < entries[j].addedAt
+		}
+		a, b := entries[i].item, entries[j].item
+		return lineKey(a.ProductID, a.VariantID) < lineKey(b.ProductID, b.VariantID)
+	})
 
-	var items []CartItem
-	if err := json.Unmarshal([]byte(val), &items); err != nil {
-		return nil, fmt.Errorf("failed to parse cart: %w", err)
+	items := make([]CartItem, len(entries))
+	for i, e := range entries {
+		items[i] = e.item
 	}
 	return items, nil
 }
 
-func (s *cartService) AddToCart(userID string, item CartItem) ([]CartItem, error) {
+func validateLine(productID, variantID string, quantity int) error {
+	if _, err := uuid.Parse(productID); err != nil {
+		return ErrInvalidProductID
+	}
+	if variantID != "" {
+		if _, err := uuid.Parse(variantID); err != nil {
+			return ErrInvalidVariantID
+		}
+	}
+	if quantity < 1 {
+		return ErrInvalidQuantity
+	}
+	if quantity > MaxItemQuantity {
+		return ErrQuantityLimit
+	}
+	return nil
+}
+
+func (s *cartService) GetCart(userID string) ([]CartItem, error) {
+	return s.run(readScript, userID)
+}
+
+// GetPricedCart returns the cart with current prices from product-service.
+// When product-service cannot be reached it falls back to the prices
+// announced by product.price_changed, then to the stored ones.
+func (s *cartService) GetPricedCart(userID string) (*PricedCart, error) {
 	items, err := s.GetCart(userID)
 	if err != nil {
 		return nil, err
 	}
 
-	// Update quantity if product already in cart
-	found := false
-	for i, existing := range items {
-		if existing.ProductID == item.ProductID {
-			items[i].Quantity += item.Quantity
-			items[i].Price = item.Price
-			found = true
-			break
+	ids := make([]uuid.UUID, 0, len(items))
+	for _, item := range items {
+		if id, err := uuid.Parse(item.ProductID); err == nil {
+			ids = append(ids, id)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	products, err := s.products.GetProducts(ctx, ids)
+	if err != nil {
+		log.Printf("Failed to look up current prices for cart of %s: %v", userID, err)
+	}
+
+	cart := &PricedCart{Items: make([]PricedCartItem, len(items))}
+	for i, item := range items {
+		current := item.Price
+		if item.flaggedPrice != nil {
+			current = *item.flaggedPrice
+		}
+		sku := ""
+		if id, err := uuid.Parse(item.ProductID); err == nil {
+			if product, ok := products[id]; ok {
+				variantID, _ := uuid.Parse(item.VariantID)
+				if variant, ok := product.Variant(variantID); ok {
+					current, sku = variant.Price, variant.SKU
+				} else {
+					current = product.Price
+				}
+			}
+		}
+
+		line := PricedCartItem{
+			ProductID:    item.ProductID,
+			VariantID:    item.VariantID,
+			SKU:          sku,
+			Quantity:     item.Quantity,
+			Price:        item.Price,
+			CurrentPrice: current,
+			PriceChanged: current != item.Price,
+			Subtotal:     current * float64(item.Quantity),
 		}
+		cart.Items[i] = line
+		cart.Subtotal += line.Subtotal
+		cart.PriceChanged = cart.PriceChanged || line.PriceChanged
+	}
+	return cart, nil
+}
+
+// resolvedLine is a cart line checked against product-service.
+type resolvedLine struct {
+	key     string
+	price   float64
+	forSale bool
+}
+
+// resolveLine looks up the variant of a line; an empty variantID stands
+// for the default variant. The default variant is always keyed by the bare
+// product id, however it was named, so it has one line per cart.
+func (s *cartService) resolveLine(productID, variantID string) (resolvedLine, error) {
+	id := uuid.MustParse(productID)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	products, err := s.products.GetProducts(ctx, []uuid.UUID{id})
+	if err != nil {
+		return resolvedLine{}, err
+	}
+
+	product, ok := products[id]
+	if !ok {
+		return resolvedLine{}, ErrProductNotFound
 	}
-	if !found {
-		items = append(items, item)
+	line := resolvedLine{
+		key:     productID,
+		price:   product.Price,
+		forSale: product.Status == client.ProductStatusActive,
 	}
+	vid, _ := uuid.Parse(variantID)
+	variant, ok := product.Variant(vid)
+	switch {
+	case ok:
+		line.price = variant.Price
+		if !variant.IsDefault {
+			line.key = lineKey(productID, variant.ID.String())
+		}
+	case variantID != "":
+		return resolvedLine{}, ErrVariantNotFound
+	}
+	// Products listed before variants have none and sell at their own price
+	return line, nil
+}
 
-	data, _ := json.Marshal(items)
-	s.rdb.Set(context.Background(), s.cartKey(userID), data, cartTTL)
+// saleLine resolves a line that is being added to or changed.
+func (s *cartService) saleLine(productID, variantID string) (resolvedLine, error) {
+	line, err := s.resolveLine(productID, variantID)
+	if err == nil && !line.forSale {
+		err = ErrNotForSale
+	}
+	return line, err
+}
 
+// AddToCart adds quantity to the variant's line, creating it if needed.
+// The line takes the variant's current price.
+func (s *cartService) AddToCart(userID string, input AddToCartInput) ([]CartItem, error) {
+	if err := validateLine(input.ProductID, input.VariantID, input.Quantity); err != nil {
+		return nil, err
+	}
+	line, err := s.saleLine(input.ProductID, input.VariantID)
+	if err != nil {
+		return nil, err
+	}
+	items, err := s.run(upsertScript, userID, line.key, input.Quantity, line.price, "add",
+		MaxCartItems, MaxItemQuantity, time.Now().UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	s.index(userID, []CartItem{{ProductID: input.ProductID}})
 	return items, nil
 }
 
-func (s *cartService) RemoveFromCart(userID string, productID string) ([]CartItem, error) {
-	items, err := s.GetCart(userID)
+// SetQuantity replaces the quantity of the variant's line, creating it at
+// the current price if needed. An existing line keeps its price.
+func (s *cartService) SetQuantity(userID, productID, variantID string, quantity int) ([]CartItem, error) {
+	if err := validateLine(productID, variantID, quantity); err != nil {
+		return nil, err
+	}
+	line, err := s.saleLine(productID, variantID)
 	if err != nil {
 		return nil, err
 	}
+	items, err := s.run(upsertScript, userID, line.key, quantity, line.price, "set",
+		MaxCartItems, MaxItemQuantity, time.Now().UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	s.index(userID, []CartItem{{ProductID: productID}})
+	return items, nil
+}
 
-	var updated []CartItem
-	for _, item := range items {
-		if item.ProductID != productID {
-			updated = append(updated, item)
+// RemoveFromCart drops the variant's line. A line for the default variant
+// named by its id is removed too, since carts from before lines were
+// resolved may hold one; the product need not be for sale any more.
+func (s *cartService) RemoveFromCart(userID, productID, variantID string) ([]CartItem, error) {
+	keys := []interface{}{lineKey(productID, variantID)}
+	if variantID != "" {
+		if _, err := uuid.Parse(productID); err != nil {
+			return nil, ErrInvalidProductID
+		}
+		if line, err := s.resolveLine(productID, variantID); err == nil && line.key != keys[0] {
+			keys = append(keys, line.key)
+		}
+	}
+	return s.run(removeScript, userID, keys...)
+}
+
+func (s *cartService) ClearCart(userID string) error {
+	return s.rdb.Del(context.Background(), s.cartKey(userID)).Err()
+}
+
+// RemoveOrdered takes lines read from the cart back out of it once they
+// are ordered. Quantities added to a line in the meantime stay in the cart.
+func (s *cartService) RemoveOrdered(userID string, ordered []CartItem) error {
+	if len(ordered) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, 2*len(ordered))
+	for _, item := range ordered {
+		args = append(args, lineKey(item.ProductID, item.VariantID), item.Quantity)
+	}
+	_, err := s.run(takeScript, userID, args...)
+	return err
+}
+
+// MergeGuestCart moves the guest cart into the user's cart following the
+// configured rules and reports how many guest lines it held. Merging an
+// already merged cart does nothing.
+func (s *cartService) MergeGuestCart(token, userID string) (int, error) {
+	keys := []string{s.cartKey(userID), s.cartKey(GuestCartOwner(token))}
+	merged, err := mergeScript.Run(context.Background(), s.rdb, keys,
+		int(cartTTL.Seconds()), s.rules.Quantity, s.rules.Price, MaxCartItems, MaxItemQuantity).Int()
+	if err != nil {
+		return 0, fmt.Errorf("failed to merge guest cart: %w", err)
+	}
+	if merged > 0 {
+		if items, err := s.GetCart(userID); err == nil {
+			s.index(userID, items)
 		}
 	}
+	return merged, nil
+}
 
-	if len(updated) == 0 {
-		s.rdb.Del(context.Background(), s.cartKey(userID))
-		return []CartItem{}, nil
+// FlagPriceChange marks the variant's lines in every cart holding it with
+// the new price and reports how many carts were flagged. Lines that name no
+// variant are flagged for changes to the default variant, and for changes
+// published before variants existed.
+func (s *cartService) FlagPriceChange(productID, variantID string, defaultVariant bool, price float64) (int, error) {
+	lines := []interface{}{lineKey(productID, variantID)}
+	if variantID != "" && defaultVariant {
+		lines = append(lines, lineKey(productID, ""))
 	}
 
-	data, _ := json.Marshal(updated)
-	s.rdb.Set(context.Background(), s.cartKey(userID), data, cartTTL)
+	ctx := context.Background()
+	indexKey := s.productCartsKey(productID)
+	owners, err := s.rdb.SMembers(ctx, indexKey).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to find carts holding product %s: %w", productID, err)
+	}
 
-	return updated, nil
+	flagged := 0
+	for _, owner := range owners {
+		args := append([]interface{}{int(cartTTL.Seconds()), price}, lines...)
+		held, err := flagScript.Run(ctx, s.rdb, []string{s.cartKey(owner)}, args...).Int()
+		if err != nil {
+			return flagged, fmt.Errorf("failed to flag cart of %s: %w", owner, err)
+		}
+		if held == 0 {
+			// The cart may still hold other variants of the product
+			if items, err := s.GetCart(owner); err == nil && !holdsProduct(items, productID) {
+				s.rdb.SRem(ctx, indexKey, owner)
+			}
+			continue
+		}
+		flagged++
+	}
+	return flagged, nil
 }
 
-func (s *cartService) ClearCart(userID string) error {
-	return s.rdb.Del(context.Background(), s.cartKey(userID)).Err()
+func holdsProduct(items []CartItem, productID string) bool {
+	for _, item := range items {
+		if item.ProductID == productID {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,75 @@
+package service
+
+import (
+	"errors"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/hero/microservice/order-service/internal/model"
+)
+
+var ErrCartEmpty = errors.New("cart is empty")
+
+type CheckoutService interface {
+	Checkout(userID, idempotencyKey string) (*model.Order, bool, error)
+}
+
+type checkoutService struct {
+	carts  CartService
+	orders OrderService
+}
+
+func NewCheckoutService(carts CartService, orders OrderService) CheckoutService {
+	return &checkoutService{carts: carts, orders: orders}
+}
+
+// Checkout places an order for the contents of the user's cart, with prices
+// and stock validated by PlaceOrder. The ordered lines leave the cart only
+// after the order is stored; anything added meanwhile stays. Retrying with the same idempotency key returns the
+// original order, even though the cart is empty by then; the bool reports
+// whether this call created the order.
+func (s *checkoutService) Checkout(userID, idempotencyKey string) (*model.Order, bool, error) {
+	uid, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, false, errors.New("invalid user_id")
+	}
+
+	existing, err := s.orders.GetByIdempotencyKey(uid, idempotencyKey)
+	if err == nil {
+		return existing, false, nil
+	}
+	if !errors.Is(err, ErrOrderNotFound) {
+		return nil, false, err
+	}
+
+	cart, err := s.carts.GetCart(userID)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(cart) == 0 {
+		return nil, false, ErrCartEmpty
+	}
+
+	items := make([]model.OrderItemInput, len(cart))
+	for i, item := range cart {
+		items[i] = model.OrderItemInput{ProductID: item.ProductID, VariantID: item.VariantID, Quantity: item.Quantity}
+	}
+
+	order, created, err := s.orders.PlaceOrder(model.PlaceOrderInput{
+		UserID:         userID,
+		Items:          items,
+		IdempotencyKey: idempotencyKey,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	if created {
+		// The order stands even if this fails; the cart just keeps its items
+		if err := s.carts.RemoveOrdered(userID, cart); err != nil {
+			log.Printf("Failed to empty cart for user %s after order %s: %v", userID, order.ID, err)
+		}
+	}
+
+	return order, created, nil
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/hero/microservice/order-service/internal/model"
+)
+
+type fakeCarts struct {
+	CartService
+	items   []CartItem
+	removed []CartItem
+	cleared bool
+}
+
+func (c *fakeCarts) GetCart(userID string) ([]CartItem, error) { return c.items, nil }
+
+func (c *fakeCarts) RemoveOrdered(userID string, ordered []CartItem) error {
+	c.removed = ordered
+	return nil
+}
+
+func (c *fakeCarts) ClearCart(userID string) error {
+	c.cleared = true
+	return nil
+}
+
+type fakeOrders struct {
+	OrderService
+	placed *model.PlaceOrderInput
+}
+
+func (o *fakeOrders) GetByIdempotencyKey(userID uuid.UUID, key string) (*model.Order, error) {
+	return nil, ErrOrderNotFound
+}
+
+func (o *fakeOrders) PlaceOrder(input model.PlaceOrderInput) (*model.Order, bool, error) {
+	o.placed = &input
+	return &model.Order{ID: uuid.New()}, true, nil
+}
+
+func TestCheckoutRemovesOnlyOrderedLines(t *testing.T) {
+	productID := uuid.NewString()
+	carts := &fakeCarts{items: []CartItem{{ProductID: productID, Quantity: 2, Price: 5}}}
+	orders := &fakeOrders{}
+
+	_, created, err := NewCheckoutService(carts, orders).Checkout(uuid.NewString(), "key-1")
+	if err != nil || !created {
+		t.Fatalf("Checkout = %v, created %v", err, created)
+	}
+	if carts.cleared {
+		t.Error("Checkout cleared the whole cart")
+	}
+	if len(carts.removed) != 1 || carts.removed[0].ProductID != productID || carts.removed[0].Quantity != 2 {
+		t.Errorf("removed = %+v, want the snapshotted line", carts.removed)
+	}
+	if items := orders.placed.Items; len(items) != 1 || items[0].Quantity != 2 {
+		t.Errorf("ordered = %+v", items)
+	}
+}
@@ -1,122 +1,614 @@
 package service
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
 
 	"github.com/google/uuid"
+	"github.com/hero/microservice/order-service/internal/client"
 	"github.com/hero/microservice/order-service/internal/model"
-	"github.com/hero/microservice/order-service/internal/rabbitmq"
 	"github.com/hero/microservice/order-service/internal/repository"
+	"github.com/hero/microservice/pkg/events"
 	"gorm.io/gorm"
 )
 
+const (
+	ItemErrInvalidProductID   = "invalid_product_id"
+	ItemErrInvalidVariantID   = "invalid_variant_id"
+	ItemErrInvalidQuantity    = "invalid_quantity"
+	ItemErrProductNotFound    = "product_not_found"
+	ItemErrVariantNotFound    = "variant_not_found"
+	ItemErrProductUnavailable = "product_unavailable"
+	ItemErrInsufficientStock  = "insufficient_stock"
+)
+
+var (
+	ErrProductServiceUnavailable = client.ErrProductServiceUnavailable
+	ErrOrderNotFound             = errors.New("order not found")
+	ErrUnknownStatus             = errors.New("unknown order status")
+	ErrInvalidSort               = errors.New("sort must be created_at or total_amount, optionally prefixed with -")
+	ErrInvalidCursor             = errors.New("invalid cursor")
+)
+
+// OrderPage is one page of an order listing. NextCursor is empty on the
+// last page; Total counts every order matching the filter.
+type OrderPage struct {
+	Orders     []model.Order
+	Total      int64
+	NextCursor string
+}
+
+// TransitionError reports a status change the order lifecycle does not
+// allow from the order's current status.
+type TransitionError struct {
+	From string
+	To   string
+}
+
+func (e *TransitionError) Error() string {
+	return "order cannot move from " + e.From + " to " + e.To
+}
+
+// ItemError describes why a single order line was rejected.
+type ItemError struct {
+	ProductID string `json:"product_id"`
+	VariantID string `json:"variant_id,omitempty"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Requested int    `json:"requested,omitempty"`
+	Available *int   `json:"available,omitempty"`
+}
+
+type OrderValidationError struct {
+	Items []ItemError
+}
+
+func (e *OrderValidationError) Error() string {
+	return "order validation failed"
+}
+
 type OrderService interface {
-	PlaceOrder(input model.PlaceOrderInput) (*model.Order, error)
+	PlaceOrder(input model.PlaceOrderInput) (*model.Order, bool, error)
 	GetOrder(id uuid.UUID) (*model.Order, error)
-	GetUserOrders(userID uuid.UUID) ([]model.Order, error)
-	CancelOrder(id uuid.UUID) error
+	GetByIdempotencyKey(userID uuid.UUID, key string) (*model.Order, error)
+	ListOrders(query model.OrderListQuery, cursor string) (*OrderPage, error)
+	GetStatusHistory(id uuid.UUID) ([]model.OrderStatusChange, error)
+	CancelOrder(id uuid.UUID, actor string) error
+	UpdateStatus(id uuid.UUID, input model.UpdateStatusInput, actor string) (*model.Order, error)
+	ConfirmOrder(eventID, correlationID string, id uuid.UUID) error
+	RejectOrder(eventID, correlationID string, id uuid.UUID, reason string) error
+	MarkPaid(eventID, correlationID string, id uuid.UUID, paymentID string) error
 }
 
 type orderService struct {
-	repo      repository.OrderRepository
-	publisher *rabbitmq.Publisher
+	repo     repository.OrderRepository
+	products client.ProductClient
 }
 
-func NewOrderService(repo repository.OrderRepository, publisher *rabbitmq.Publisher) OrderService {
-	return &orderService{repo: repo, publisher: publisher}
+func NewOrderService(repo repository.OrderRepository, products client.ProductClient) OrderService {
+	return &orderService{repo: repo, products: products}
 }
 
-func (s *orderService) PlaceOrder(input model.PlaceOrderInput) (*model.Order, error) {
+// PlaceOrder validates and stores a new order. With an idempotency key, a
+// repeated request returns the order the first one created; the bool
+// reports whether this call created it.
+func (s *orderService) PlaceOrder(input model.PlaceOrderInput) (*model.Order, bool, error) {
 	userID, err := uuid.Parse(input.UserID)
 	if err != nil {
-		return nil, errors.New("invalid user_id")
+		return nil, false, errors.New("invalid user_id")
 	}
 
-	var totalAmount float64
-	var items []model.OrderItem
-
-	for _, item := range input.Items {
-		productID, err := uuid.Parse(item.ProductID)
-		if err != nil {
-			return nil, errors.New("invalid product_id: " + item.ProductID)
+	if input.IdempotencyKey != "" {
+		existing, err := s.GetByIdempotencyKey(userID, input.IdempotencyKey)
+		if err == nil {
+			return existing, false, nil
+		}
+		if !errors.Is(err, ErrOrderNotFound) {
+			return nil, false, err
 		}
+	}
 
-		items = append(items, model.OrderItem{
-			ProductID: productID,
-			Quantity:  item.Quantity,
-			Price:     item.Price,
-		})
+	items, err := s.resolveItems(input.Items)
+	if err != nil {
+		return nil, false, err
+	}
 
+	var totalAmount float64
+	for _, item := range items {
 		totalAmount += item.Price * float64(item.Quantity)
 	}
 
 	order := &model.Order{
 		ID:          uuid.New(),
 		UserID:      userID,
-		Status:      "pending",
+		Status:      model.OrderStatusPending,
 		TotalAmount: totalAmount,
 		Items:       items,
 	}
-
-	if err := s.repo.Create(order); err != nil {
-		return nil, errors.New("failed to create order: " + err.Error())
+	if input.IdempotencyKey != "" {
+		order.IdempotencyKey = &input.IdempotencyKey
 	}
 
 	// Build event items
-	eventItems := make([]map[string]interface{}, len(input.Items))
-	for i, item := range input.Items {
-		eventItems[i] = map[string]interface{}{
-			"product_id": item.ProductID,
-			"quantity":   item.Quantity,
+	eventItems := make([]events.StockItem, len(items))
+	for i, item := range items {
+		eventItems[i] = events.StockItem{ProductID: item.ProductID.String(), Quantity: item.Quantity}
+		if item.VariantID != nil {
+			eventItems[i].VariantID = item.VariantID.String()
 		}
 	}
 
-	s.publisher.Publish("order.created", map[string]interface{}{
-		"order_id":     order.ID.String(),
-		"user_id":      order.UserID.String(),
-		"items":        eventItems,
-		"total_amount": order.TotalAmount,
+	var replayed *model.Order
+	err = s.repo.Transaction(func(repo repository.OrderRepository) error {
+		if order.IdempotencyKey != nil {
+			// A concurrent request with the same key may have won the race
+			if err := repo.LockIdempotencyKey(userID, input.IdempotencyKey); err != nil {
+				return err
+			}
+			existing, err := repo.GetByIdempotencyKey(userID, input.IdempotencyKey)
+			if err == nil {
+				replayed = existing
+				return nil
+			}
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+		}
+
+		if err := repo.Create(order); err != nil {
+			return err
+		}
+		err := repo.AddStatusChange(&model.OrderStatusChange{
+			OrderID:  order.ID,
+			ToStatus: order.Status,
+			Actor:    input.UserID,
+		})
+		if err != nil {
+			return err
+		}
+		return repo.AddEvent(events.TypeOrderCreated, events.OrderCreated{
+			OrderID:     order.ID.String(),
+			UserID:      order.UserID.String(),
+			Items:       eventItems,
+			TotalAmount: order.TotalAmount,
+		})
 	})
+	if err != nil {
+		return nil, false, errors.New("failed to create order: " + err.Error())
+	}
+	if replayed != nil {
+		return replayed, false, nil
+	}
 
-	return order, nil
+	return order, true, nil
+}
+
+// resolveItems validates the requested lines against product-service and
+// snapshots the authoritative name, SKU and unit price into each order item.
+func (s *orderService) resolveItems(inputs []model.OrderItemInput) ([]model.OrderItem, error) {
+	var itemErrs []ItemError
+
+	type line struct {
+		productID uuid.UUID
+		variantID uuid.UUID // uuid.Nil for the default variant
+		quantity  int
+	}
+	lines := make([]line, 0, len(inputs))
+	var productIDs []uuid.UUID
+	seen := make(map[uuid.UUID]bool)
+	for _, item := range inputs {
+		productID, err := uuid.Parse(item.ProductID)
+		if err != nil {
+			itemErrs = append(itemErrs, ItemError{
+				ProductID: item.ProductID,
+				Code:      ItemErrInvalidProductID,
+				Message:   "invalid product id",
+			})
+			continue
+		}
+		var variantID uuid.UUID
+		if item.VariantID != "" {
+			if variantID, err = uuid.Parse(item.VariantID); err != nil {
+				itemErrs = append(itemErrs, ItemError{
+					ProductID: item.ProductID,
+					VariantID: item.VariantID,
+					Code:      ItemErrInvalidVariantID,
+					Message:   "invalid variant id",
+				})
+				continue
+			}
+		}
+		// Binding checks this for requests, but not for checkout
+		if item.Quantity <= 0 {
+			itemErrs = append(itemErrs, ItemError{
+				ProductID: item.ProductID,
+				VariantID: item.VariantID,
+				Code:      ItemErrInvalidQuantity,
+				Message:   "quantity must be at least 1",
+				Requested: item.Quantity,
+			})
+			continue
+		}
+		if !seen[productID] {
+			seen[productID] = true
+			productIDs = append(productIDs, productID)
+		}
+		lines = append(lines, line{productID: productID, variantID: variantID, quantity: item.Quantity})
+	}
+	if len(itemErrs) > 0 {
+		return nil, &OrderValidationError{Items: itemErrs}
+	}
+
+	products, err := s.products.GetProducts(context.Background(), productIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Merge lines for the same variant so stock is checked against the
+	// total requested
+	type resolved struct {
+		product  client.ProductInfo
+		variant  client.VariantInfo
+		quantity int
+	}
+	var variantIDs []uuid.UUID
+	merged := make(map[uuid.UUID]*resolved)
+	rejected := make(map[uuid.UUID]bool)
+	for _, l := range lines {
+		if rejected[l.productID] {
+			continue
+		}
+
+		product, ok := products[l.productID]
+		if !ok {
+			rejected[l.productID] = true
+			itemErrs = append(itemErrs, ItemError{
+				ProductID: l.productID.String(),
+				Code:      ItemErrProductNotFound,
+				Message:   "product does not exist",
+			})
+			continue
+		}
+
+		// Drafts and archived products cannot be ordered, nor can products
+		// whose status was not reported; orders placed earlier keep their items
+		if product.Status != client.ProductStatusActive {
+			rejected[l.productID] = true
+			itemErrs = append(itemErrs, ItemError{
+				ProductID: l.productID.String(),
+				Code:      ItemErrProductUnavailable,
+				Message:   product.Name + " is no longer available",
+			})
+			continue
+		}
+
+		variant, ok := product.Variant(l.variantID)
+		if !ok {
+			itemErrs = append(itemErrs, ItemError{
+				ProductID: l.productID.String(),
+				VariantID: l.variantID.String(),
+				Code:      ItemErrVariantNotFound,
+				Message:   "variant does not exist for " + product.Name,
+			})
+			continue
+		}
+
+		if r, ok := merged[variant.ID]; ok {
+			r.quantity += l.quantity
+			continue
+		}
+		merged[variant.ID] = &resolved{product: product, variant: variant, quantity: l.quantity}
+		variantIDs = append(variantIDs, variant.ID)
+	}
+
+	items := make([]model.OrderItem, 0, len(variantIDs))
+	for _, variantID := range variantIDs {
+		r := merged[variantID]
+
+		if r.variant.Quantity < r.quantity {
+			available := r.variant.Quantity
+			itemErrs = append(itemErrs, ItemError{
+				ProductID: r.product.ID.String(),
+				VariantID: variantID.String(),
+				Code:      ItemErrInsufficientStock,
+				Message:   "not enough stock for " + r.product.Name + " (" + r.variant.SKU + ")",
+				Requested: r.quantity,
+				Available: &available,
+			})
+			continue
+		}
+
+		id := variantID
+		items = append(items, model.OrderItem{
+			ProductID:   r.product.ID,
+			VariantID:   &id,
+			SKU:         r.variant.SKU,
+			ProductName: r.product.Name,
+			Quantity:    r.quantity,
+			Price:       r.variant.Price,
+		})
+	}
+	if len(itemErrs) > 0 {
+		return nil, &OrderValidationError{Items: itemErrs}
+	}
+
+	return items, nil
 }
 
 func (s *orderService) GetOrder(id uuid.UUID) (*model.Order, error) {
 	order, err := s.repo.GetByID(id)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, errors.New("order not found")
+			return nil, ErrOrderNotFound
 		}
 		return nil, err
 	}
 	return order, nil
 }
 
-func (s *orderService) GetUserOrders(userID uuid.UUID) ([]model.Order, error) {
-	return s.repo.GetByUserID(userID)
+func (s *orderService) GetByIdempotencyKey(userID uuid.UUID, key string) (*model.Order, error) {
+	order, err := s.repo.GetByIdempotencyKey(userID, key)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrOrderNotFound
+		}
+		return nil, err
+	}
+	return order, nil
 }
 
-func (s *orderService) CancelOrder(id uuid.UUID) error {
-	order, err := s.repo.GetByID(id)
+// ListOrders returns the page of orders after cursor, which must come from
+// a listing with the same sort.
+func (s *orderService) ListOrders(query model.OrderListQuery, cursor string) (*OrderPage, error) {
+	if query.Sort != model.OrderSortCreatedAt && query.Sort != model.OrderSortTotalAmount {
+		return nil, ErrInvalidSort
+	}
+	for _, status := range query.Filter.Statuses {
+		if !model.IsOrderStatus(status) {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownStatus, status)
+		}
+	}
+	if cursor != "" {
+		after, err := decodeCursor(cursor)
+		if err != nil || after.Sort != query.Sort || after.Desc != query.Desc {
+			return nil, ErrInvalidCursor
+		}
+		query.After = after
+	}
+
+	// One extra row tells whether another page follows
+	limit := query.Limit
+	query.Limit++
+	orders, total, err := s.repo.List(query)
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return errors.New("order not found")
+		return nil, errors.New("failed to list orders: " + err.Error())
+	}
+
+	page := &OrderPage{Orders: orders, Total: total}
+	if len(orders) > limit {
+		page.Orders = orders[:limit]
+		last := page.Orders[limit-1]
+		page.NextCursor = encodeCursor(model.OrderCursor{
+			Sort:        query.Sort,
+			Desc:        query.Desc,
+			CreatedAt:   last.CreatedAt,
+			TotalAmount: last.TotalAmount,
+			ID:          last.ID,
+		})
+	}
+	return page, nil
+}
+
+func encodeCursor(c model.OrderCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (*model.OrderCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var c model.OrderCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s *orderService) GetStatusHistory(id uuid.UUID) ([]model.OrderStatusChange, error) {
+	return s.repo.GetStatusHistory(id)
+}
+
+func (s *orderService) CancelOrder(id uuid.UUID, actor string) error {
+	err := s.repo.Transaction(func(repo repository.OrderRepository) error {
+		order, err := getOrder(repo, id)
+		if err != nil {
+			return err
+		}
+		// The order.cancelled event makes product-service release the stock
+		return transition(repo, order, model.OrderStatusCancelled, actor, "")
+	})
+	return lifecycleError("failed to cancel order", err)
+}
+
+// UpdateStatus is the admin path through the lifecycle, e.g. marking an
+// order shipped or refunded. Pending orders can only be cancelled here.
+func (s *orderService) UpdateStatus(id uuid.UUID, input model.UpdateStatusInput, actor string) (*model.Order, error) {
+	if !model.IsOrderStatus(input.Status) {
+		return nil, ErrUnknownStatus
+	}
+
+	var order *model.Order
+	err := s.repo.Transaction(func(repo repository.OrderRepository) error {
+		var err error
+		order, err = getOrder(repo, id)
+		if err != nil {
+			return err
 		}
+		if !model.CanTransitionManually(order.Status, input.Status) {
+			return &TransitionError{From: order.Status, To: input.Status}
+		}
+		return transition(repo, order, input.Status, actor, input.Reason)
+	})
+	if err := lifecycleError("failed to update order status", err); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// ConfirmOrder handles inventory.reserved from the stock reservation saga.
+// Like the other saga handlers, the events it queues carry correlationID.
+func (s *orderService) ConfirmOrder(eventID, correlationID string, id uuid.UUID) error {
+	return s.repo.Transaction(func(repo repository.OrderRepository) error {
+		fresh, err := repo.ClaimEvent(eventID, events.TypeInventoryReserved)
+		if err != nil || !fresh {
+			return err
+		}
+
+		order, err := repo.GetByID(id)
+		if err != nil {
+			return err
+		}
+
+		switch order.Status {
+		case model.OrderStatusPending:
+			return transition(repo, order, model.OrderStatusConfirmed, model.ActorSystem, "stock reserved", events.WithCorrelationID(correlationID))
+		case model.OrderStatusCancelled:
+			// Cancelled before the reservation landed: ask for the stock back
+			return repo.AddEvent(events.TypeOrderCancelled, events.OrderCancelled{
+				OrderID: id.String(),
+				UserID:  order.UserID.String(),
+			}, events.WithCorrelationID(correlationID))
+		}
+		return nil
+	})
+}
+
+// RejectOrder handles inventory.reservation_failed from the saga.
+func (s *orderService) RejectOrder(eventID, correlationID string, id uuid.UUID, reason string) error {
+	return s.repo.Transaction(func(repo repository.OrderRepository) error {
+		fresh, err := repo.ClaimEvent(eventID, events.TypeReservationFailed)
+		if err != nil || !fresh {
+			return err
+		}
+
+		order, err := repo.GetByID(id)
+		if err != nil {
+			return err
+		}
+		if order.Status != model.OrderStatusPending {
+			return nil
+		}
+		return transition(repo, order, model.OrderStatusRejected, model.ActorSystem, reason, events.WithCorrelationID(correlationID))
+	})
+}
+
+// MarkPaid handles payment.succeeded from the payment module.
+func (s *orderService) MarkPaid(eventID, correlationID string, id uuid.UUID, paymentID string) error {
+	return s.repo.Transaction(func(repo repository.OrderRepository) error {
+		fresh, err := repo.ClaimEvent(eventID, events.TypePaymentSucceeded)
+		if err != nil || !fresh {
+			return err
+		}
+
+		order, err := repo.GetByID(id)
+		if err != nil {
+			return err
+		}
+		if order.Status != model.OrderStatusConfirmed {
+			// Needs a refund by hand, e.g. the order was cancelled mid-payment
+			log.Printf("Payment %s captured for order %s in status %s", paymentID, id, order.Status)
+			return nil
+		}
+		return transition(repo, order, model.OrderStatusPaid, model.ActorSystem, "payment "+paymentID+" captured", events.WithCorrelationID(correlationID))
+	})
+}
+
+func getOrder(repo repository.OrderRepository, id uuid.UUID) (*model.Order, error) {
+	order, err := repo.GetByID(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrOrderNotFound
+	}
+	return order, err
+}
+
+// lifecycleError passes the typed lifecycle errors through and wraps the rest.
+func lifecycleError(msg string, err error) error {
+	var transitionErr *TransitionError
+	if err == nil || errors.Is(err, ErrOrderNotFound) || errors.As(err, &transitionErr) {
 		return err
 	}
+	return errors.New(msg + ": " + err.Error())
+}
 
-	if order.Status == "cancelled" {
-		return errors.New("order already cancelled")
+// transition moves the order to status to, recording the change in the
+// status history and queueing the matching event. It must run inside
+// Transaction.
+func transition(repo repository.OrderRepository, order *model.Order, to, actor, reason string, opts ...events.Option) error {
+	from := order.Status
+	if !model.CanTransition(from, to) {
+		return &TransitionError{From: from, To: to}
 	}
 
-	if err := s.repo.UpdateStatus(id, "cancelled"); err != nil {
-		return errors.New("failed to cancel order: " + err.Error())
+	ok, err := repo.TransitionStatus(order.ID, []string{from}, to)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// Someone else moved the order since it was read
+		current, err := repo.GetByID(order.ID)
+		if err != nil {
+			return err
+		}
+		return &TransitionError{From: current.Status, To: to}
 	}
+	order.Status = to
 
-	s.publisher.Publish("order.cancelled", map[string]interface{}{
-		"order_id": id.String(),
-		"user_id":  order.UserID.String(),
+	err = repo.AddStatusChange(&model.OrderStatusChange{
+		OrderID:    order.ID,
+		FromStatus: from,
+		ToStatus:   to,
+		Actor:      actor,
+		Reason:     reason,
 	})
+	if err != nil {
+		return err
+	}
+
+	eventType, data, err := statusEvent(order, reason)
+	if err != nil {
+		return err
+	}
+	return repo.AddEvent(eventType, data, opts...)
+}
 
-	return nil
+// statusEvent builds the event announcing that order entered its current
+// status.
+func statusEvent(order *model.Order, reason string) (string, interface{}, error) {
+	orderID, userID := order.ID.String(), order.UserID.String()
+
+	switch order.Status {
+	case model.OrderStatusConfirmed:
+		return events.TypeOrderConfirmed, events.OrderConfirmed{OrderID: orderID, UserID: userID}, nil
+	case model.OrderStatusPaid:
+		return events.TypeOrderPaid, events.OrderPaid{OrderID: orderID, UserID: userID, TotalAmount: order.TotalAmount}, nil
+	case model.OrderStatusShipped:
+		return events.TypeOrderShipped, events.OrderShipped{OrderID: orderID, UserID: userID}, nil
+	case model.OrderStatusDelivered:
+		return events.TypeOrderDelivered, events.OrderDelivered{OrderID: orderID, UserID: userID}, nil
+	case model.OrderStatusCompleted:
+		return events.TypeOrderCompleted, events.OrderCompleted{OrderID: orderID, UserID: userID}, nil
+	case model.OrderStatusRejected:
+		return events.TypeOrderRejected, events.OrderRejected{OrderID: orderID, UserID: userID, Reason: reason}, nil
+	case model.OrderStatusCancelled:
+		return events.TypeOrderCancelled, events.OrderCancelled{OrderID: orderID, UserID: userID, Reason: reason}, nil
+	case model.OrderStatusRefunded:
+		return events.TypeOrderRefunded, events.OrderRefunded{OrderID: orderID, UserID: userID, TotalAmount: order.TotalAmount, Reason: reason}, nil
+	}
+	return "", nil, fmt.Errorf("no event for order status %s", order.Status)
 }
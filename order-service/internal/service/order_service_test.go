@@ -0,0 +1,246 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/hero/microservice/order-service/internal/model"
+	"github.com/hero/microservice/order-service/internal/repository"
+	"github.com/hero/microservice/pkg/events"
+	"gorm.io/gorm"
+)
+
+type queuedEvent struct {
+	eventType     string
+	data          interface{}
+	correlationID string
+}
+
+// fakeOrderRepo keeps orders in memory. Methods the tests do not use panic
+// through the nil embedded interface.
+type fakeOrderRepo struct {
+	repository.OrderRepository
+	orders  map[uuid.UUID]*model.Order
+	history []model.OrderStatusChange
+	events  []queuedEvent
+	claimed map[string]bool
+}
+
+func newFakeOrderRepo(orders ...*model.Order) *fakeOrderRepo {
+	repo := &fakeOrderRepo{orders: map[uuid.UUID]*model.Order{}, claimed: map[string]bool{}}
+	for _, order := range orders {
+		repo.orders[order.ID] = order
+	}
+	return repo
+}
+
+func (r *fakeOrderRepo) GetByID(id uuid.UUID) (*model.Order, error) {
+	order, ok := r.orders[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	copied := *order
+	return &copied, nil
+}
+
+func (r *fakeOrderRepo) TransitionStatus(id uuid.UUID, from []string, to string) (bool, error) {
+	order, ok := r.orders[id]
+	if !ok {
+		return false, nil
+	}
+	for _, status := range from {
+		if order.Status == status {
+			order.Status = to
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *fakeOrderRepo) AddStatusChange(change *model.OrderStatusChange) error {
+	r.history = append(r.history, *change)
+	return nil
+}
+
+func (r *fakeOrderRepo) AddEvent(eventType string, data interface{}, opts ...events.Option) error {
+	var env events.Envelope
+	for _, opt := range opts {
+		opt(&env)
+	}
+	r.events = append(r.events, queuedEvent{eventType: eventType, data: data, correlationID: env.CorrelationID})
+	return nil
+}
+
+func (r *fakeOrderRepo) ClaimEvent(eventID, eventType string) (bool, error) {
+	if r.claimed[eventID] {
+		return false, nil
+	}
+	r.claimed[eventID] = true
+	return true, nil
+}
+
+func (r *fakeOrderRepo) Transaction(fn func(repo repository.OrderRepository) error) error {
+	return fn(r)
+}
+
+func newOrder(status string) *model.Order {
+	return &model.Order{ID: uuid.New(), UserID: uuid.New(), Status: status, TotalAmount: 42}
+}
+
+func TestTransitionRecordsHistoryAndEvent(t *testing.T) {
+	tests := []struct {
+		from, to  string
+		eventType string
+	}{
+		{model.OrderStatusPending, model.OrderStatusConfirmed, events.TypeOrderConfirmed},
+		{model.OrderStatusPending, model.OrderStatusRejected, events.TypeOrderRejected},
+		{model.OrderStatusPending, model.OrderStatusCancelled, events.TypeOrderCancelled},
+		{model.OrderStatusConfirmed, model.OrderStatusPaid, events.TypeOrderPaid},
+		{model.OrderStatusPaid, model.OrderStatusShipped, events.TypeOrderShipped},
+		{model.OrderStatusPaid, model.OrderStatusRefunded, events.TypeOrderRefunded},
+		{model.OrderStatusShipped, model.OrderStatusDelivered, events.TypeOrderDelivered},
+		{model.OrderStatusDelivered, model.OrderStatusCompleted, events.TypeOrderCompleted},
+	}
+	for _, tt := range tests {
+		order := newOrder(tt.from)
+		repo := newFakeOrderRepo(order)
+
+		if err := transition(repo, order, tt.to, "admin-1", "because"); err != nil {
+			t.Errorf("%s -> %s: %v", tt.from, tt.to, err)
+			continue
+		}
+		if order.Status != tt.to || repo.orders[order.ID].Status != tt.to {
+			t.Errorf("%s -> %s: status = %s", tt.from, tt.to, repo.orders[order.ID].Status)
+		}
+
+		want := model.OrderStatusChange{OrderID: order.ID, FromStatus: tt.from, ToStatus: tt.to, Actor: "admin-1", Reason: "because"}
+		if len(repo.history) != 1 || repo.history[0] != want {
+			t.Errorf("%s -> %s: history = %+v, want %+v", tt.from, tt.to, repo.history, want)
+		}
+		if len(repo.events) != 1 || repo.events[0].eventType != tt.eventType {
+			t.Errorf("%s -> %s: events = %+v, want one %s", tt.from, tt.to, repo.events, tt.eventType)
+		}
+	}
+}
+
+func TestTransitionRejectsDisallowedMove(t *testing.T) {
+	order := newOrder(model.OrderStatusShipped)
+	repo := newFakeOrderRepo(order)
+
+	err := transition(repo, order, model.OrderStatusCancelled, "admin-1", "")
+	var transitionErr *TransitionError
+	if !errors.As(err, &transitionErr) {
+		t.Fatalf("err = %v, want *TransitionError", err)
+	}
+	if len(repo.history) != 0 || len(repo.events) != 0 {
+		t.Errorf("history = %+v, events = %+v, want nothing recorded", repo.history, repo.events)
+	}
+}
+
+func TestTransitionLosesRace(t *testing.T) {
+	order := newOrder(model.OrderStatusConfirmed)
+	repo := newFakeOrderRepo(order)
+	// Another request cancelled the order after it was read
+	repo.orders[order.ID].Status = model.OrderStatusCancelled
+
+	err := transition(repo, order, model.OrderStatusPaid, model.ActorSystem, "")
+	var transitionErr *TransitionError
+	if !errors.As(err, &transitionErr) || transitionErr.From != model.OrderStatusCancelled {
+		t.Fatalf("err = %v, want a TransitionError from cancelled", err)
+	}
+	if len(repo.history) != 0 {
+		t.Errorf("history = %+v, want none", repo.history)
+	}
+}
+
+func TestStatusEventPayloads(t *testing.T) {
+	order := newOrder(model.OrderStatusRefunded)
+	eventType, data, err := statusEvent(order, "damaged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refunded, ok := data.(events.OrderRefunded)
+	if eventType != events.TypeOrderRefunded || !ok {
+		t.Fatalf("statusEvent = %s %T, want %s", eventType, data, events.TypeOrderRefunded)
+	}
+	if refunded.OrderID != order.ID.String() || refunded.UserID != order.UserID.String() ||
+		refunded.TotalAmount != order.TotalAmount || refunded.Reason != "damaged" {
+		t.Errorf("payload = %+v", refunded)
+	}
+
+	if _, _, err := statusEvent(newOrder(model.OrderStatusPending), ""); err == nil {
+		t.Error("statusEvent(pending) succeeded, want an error: orders are created, not moved, into pending")
+	}
+}
+
+func TestUpdateStatusLeavesPendingToTheSaga(t *testing.T) {
+	tests := []struct {
+		to string
+		ok bool
+	}{
+		{model.OrderStatusConfirmed, false},
+		{model.OrderStatusRejected, false},
+		{model.OrderStatusCancelled, true},
+	}
+	for _, tt := range tests {
+		order := newOrder(model.OrderStatusPending)
+		repo := newFakeOrderRepo(order)
+		svc := NewOrderService(repo, nil)
+
+		_, err := svc.UpdateStatus(order.ID, model.UpdateStatusInput{Status: tt.to}, "admin-1")
+		var transitionErr *TransitionError
+		switch {
+		case tt.ok && err != nil:
+			t.Errorf("pending -> %s: %v", tt.to, err)
+		case !tt.ok && !errors.As(err, &transitionErr):
+			t.Errorf("pending -> %s: err = %v, want *TransitionError", tt.to, err)
+		case !tt.ok && repo.orders[order.ID].Status != model.OrderStatusPending:
+			t.Errorf("pending -> %s: status = %s, want pending", tt.to, repo.orders[order.ID].Status)
+		}
+	}
+}
+
+func TestSagaConfirmsPendingOrder(t *testing.T) {
+	order := newOrder(model.OrderStatusPending)
+	repo := newFakeOrderRepo(order)
+	svc := NewOrderService(repo, nil)
+
+	if err := svc.ConfirmOrder("evt-1", "corr-1", order.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := repo.orders[order.ID].Status; got != model.OrderStatusConfirmed {
+		t.Fatalf("status = %s, want confirmed", got)
+	}
+	if h := repo.history; len(h) != 1 || h[0].Actor != model.ActorSystem {
+		t.Errorf("history = %+v, want one change by %s", h, model.ActorSystem)
+	}
+	if e := repo.events; len(e) != 1 || e[0].eventType != events.TypeOrderConfirmed || e[0].correlationID != "corr-1" {
+		t.Errorf("events = %+v, want order.confirmed correlated with corr-1", e)
+	}
+
+	// A redelivery changes nothing
+	if err := svc.ConfirmOrder("evt-1", "corr-1", order.ID); err != nil || len(repo.history) != 1 {
+		t.Errorf("redelivery: err = %v, history = %+v", err, repo.history)
+	}
+}
+
+func TestPlaceOrderRejectsNonPositiveQuantity(t *testing.T) {
+	repo := newFakeOrderRepo()
+	// Without a product client, reaching product-service would panic
+	svc := NewOrderService(repo, nil)
+
+	for _, quantity := range []int{0, -5} {
+		_, _, err := svc.PlaceOrder(model.PlaceOrderInput{
+			UserID: uuid.NewString(),
+			Items:  []model.OrderItemInput{{ProductID: uuid.NewString(), Quantity: quantity}},
+		})
+		var validationErr *OrderValidationError
+		if !errors.As(err, &validationErr) || len(validationErr.Items) != 1 || validationErr.Items[0].Code != ItemErrInvalidQuantity {
+			t.Errorf("quantity %d: err = %v, want an %s item error", quantity, err, ItemErrInvalidQuantity)
+		}
+	}
+	if len(repo.orders) != 0 || len(repo.events) != 0 {
+		t.Errorf("orders = %d, events = %+v, want none", len(repo.orders), repo.events)
+	}
+}
@@ -0,0 +1,335 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hero/microservice/order-service/internal/model"
+	"github.com/hero/microservice/order-service/internal/payment"
+	"github.com/hero/microservice/order-service/internal/repository"
+	"github.com/hero/microservice/pkg/events"
+	"gorm.io/gorm"
+)
+
+const providerTimeout = 10 * time.Second
+
+var (
+	ErrPaymentNotFound      = errors.New("payment not found")
+	ErrIdempotencyKeyReused = errors.New("idempotency key was already used for another order")
+	ErrOrderNotPayable      = errors.New("order is not awaiting payment")
+	ErrOrderAlreadyPaid     = errors.New("order is already paid")
+	ErrPaymentNotCapturable = errors.New("payment is not authorized")
+	ErrPaymentProvider      = errors.New("payment provider unavailable")
+)
+
+type PaymentService interface {
+	Initiate(orderID uuid.UUID, input model.InitiatePaymentInput, idempotencyKey string) (*model.Payment, bool, error)
+	Capture(id uuid.UUID, idempotencyKey string) (*model.Payment, error)
+	GetPayment(id uuid.UUID) (*model.Payment, error)
+	GetOrderPayments(orderID uuid.UUID) ([]model.Payment, error)
+	HandleWebhook(event payment.WebhookEvent) error
+}
+
+type paymentService struct {
+	repo     repository.PaymentRepository
+	orders   repository.OrderRepository
+	provider payment.PaymentProvider
+}
+
+// NewPaymentService settles payments through provider. A captured payment
+// publishes payment.succeeded, which moves the order to paid. A failed one
+// publishes payment.failed but leaves the order confirmed with its stock
+// reserved, so the customer can pay again, e.g. with another card, or
+// cancel the order to release the stock.
+func NewPaymentService(repo repository.PaymentRepository, orders repository.OrderRepository, provider payment.PaymentProvider) PaymentService {
+	return &paymentService{repo: repo, orders: orders, provider: provider}
+}
+
+// Initiate authorizes payment of a confirmed order. Repeating the call with
+// the same idempotency key returns the original payment, resuming the
+// authorization if it never reached the provider. It reports whether a new
+// payment was created.
+func (s *paymentService) Initiate(orderID uuid.UUID, input model.InitiatePaymentInput, idempotencyKey string) (*model.Payment, bool, error) {
+	order, err := getOrder(s.orders, orderID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	p, err := s.byIdempotencyKey(order, idempotencyKey)
+	if err != nil {
+		return nil, false, err
+	}
+
+	created := false
+	if p == nil {
+		if err := s.checkPayable(order); err != nil {
+			return nil, false, err
+		}
+
+		p = &model.Payment{
+			ID:             uuid.New(),
+			OrderID:        order.ID,
+			UserID:         order.UserID,
+			Method:         input.Method,
+			Status:         model.PaymentStatusPending,
+			Amount:         order.TotalAmount,
+			Provider:       s.provider.Name(),
+			IdempotencyKey: &idempotencyKey,
+		}
+		created, err = s.repo.Create(p)
+		if err != nil {
+			return nil, false, errors.New("failed to create payment: " + err.Error())
+		}
+		if !created {
+			// A concurrent request with the same key won the insert
+			if p, err = s.byIdempotencyKey(order, idempotencyKey); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+
+	if p.Status != model.PaymentStatusPending || p.ProviderRef != nil {
+		return p, created, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), providerTimeout)
+	defer cancel()
+
+	result, err := s.provider.Authorize(ctx, payment.AuthorizeRequest{
+		PaymentID:      p.ID,
+		OrderID:        order.ID,
+		Amount:         p.Amount,
+		Method:         p.Method,
+		IdempotencyKey: idempotencyKey,
+	})
+	if err != nil {
+		log.Printf("Authorize failed for payment %s: %v", p.ID, err)
+		return nil, false, ErrPaymentProvider
+	}
+
+	p, err = s.settle(order, p, result)
+	return p, created, err
+}
+
+// byIdempotencyKey returns the payment the order's user created with key,
+// if any. Keys are scoped per user, like those of orders.
+func (s *paymentService) byIdempotencyKey(order *model.Order, key string) (*model.Payment, error) {
+	p, err := s.repo.GetByIdempotencyKey(order.UserID, key)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.OrderID != order.ID {
+		return nil, ErrIdempotencyKeyReused
+	}
+	return p, nil
+}
+
+func (s *paymentService) checkPayable(order *model.Order) error {
+	paid, err := s.repo.HasCompleted(order.ID)
+	if err != nil {
+		return err
+	}
+	if paid {
+		return ErrOrderAlreadyPaid
+	}
+	if order.Status != model.OrderStatusConfirmed {
+		return ErrOrderNotPayable
+	}
+	return nil
+}
+
+// Capture collects an authorized payment. Capturing a completed payment
+// again returns it unchanged. Without an idempotency key the payment id is
+// used, so the provider never captures twice either way. The order stays
+// locked from the check that it is unpaid until the capture is settled, so
+// two of its payments cannot both be captured.
+func (s *paymentService) Capture(id uuid.UUID, idempotencyKey string) (*model.Payment, error) {
+	p, err := s.GetPayment(id)
+	if err != nil {
+		return nil, err
+	}
+
+	switch p.Status {
+	case model.PaymentStatusCompleted:
+		return p, nil
+	case model.PaymentStatusAuthorized:
+	default:
+		return nil, ErrPaymentNotCapturable
+	}
+
+	if idempotencyKey == "" {
+		idempotencyKey = "capture:" + p.ID.String()
+	}
+
+	err = s.repo.Transaction(func(repo repository.PaymentRepository) error {
+		order, err := repo.LockOrder(p.OrderID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrOrderNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		// A concurrent capture may have won the lock first
+		current, err := repo.GetByID(p.ID)
+		if err != nil {
+			return err
+		}
+		switch current.Status {
+		case model.PaymentStatusCompleted:
+			return nil
+		case model.PaymentStatusAuthorized:
+		default:
+			return ErrPaymentNotCapturable
+		}
+		paid, err := repo.HasCompleted(p.OrderID)
+		if err != nil {
+			return err
+		}
+		if paid {
+			return ErrOrderAlreadyPaid
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), providerTimeout)
+		defer cancel()
+
+		result, err := s.provider.Capture(ctx, payment.CaptureRequest{
+			ProviderRef:    *current.ProviderRef,
+			Amount:         current.Amount,
+			IdempotencyKey: idempotencyKey,
+		})
+		if err != nil {
+			log.Printf("Capture failed for payment %s: %v", p.ID, err)
+			return ErrPaymentProvider
+		}
+
+		return settle(repo, order, current, result)
+	})
+	switch {
+	case errors.Is(err, ErrOrderNotFound), errors.Is(err, ErrPaymentNotCapturable),
+		errors.Is(err, ErrOrderAlreadyPaid), errors.Is(err, ErrPaymentProvider):
+		return nil, err
+	case err != nil:
+		return nil, errors.New("failed to capture payment: " + err.Error())
+	}
+	return s.GetPayment(p.ID)
+}
+
+func (s *paymentService) GetPayment(id uuid.UUID) (*model.Payment, error) {
+	p, err := s.repo.GetByID(id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrPaymentNotFound
+		}
+		return nil, err
+	}
+	return p, nil
+}
+
+func (s *paymentService) GetOrderPayments(orderID uuid.UUID) ([]model.Payment, error) {
+	return s.repo.GetByOrderID(orderID)
+}
+
+// HandleWebhook applies an asynchronous outcome reported by the provider.
+// Each webhook event id is processed once.
+func (s *paymentService) HandleWebhook(event payment.WebhookEvent) error {
+	result, ok := event.Result()
+	if !ok {
+		log.Printf("Ignoring payment webhook %s of type %s", event.ID, event.Type)
+		return nil
+	}
+
+	p, err := s.repo.GetByProviderRef(s.provider.Name(), event.ProviderRef)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrPaymentNotFound
+		}
+		return err
+	}
+
+	order, err := getOrder(s.orders, p.OrderID)
+	if err != nil {
+		return err
+	}
+
+	return s.repo.Transaction(func(repo repository.PaymentRepository) error {
+		fresh, err := repo.ClaimEvent(event.ID, event.Type)
+		if err != nil || !fresh {
+			return err
+		}
+		return settle(repo, order, p, result)
+	})
+}
+
+// settle applies result in its own transaction and returns the payment as
+// stored afterwards.
+func (s *paymentService) settle(order *model.Order, p *model.Payment, result *payment.Result) (*model.Payment, error) {
+	err := s.repo.Transaction(func(repo repository.PaymentRepository) error {
+		return settle(repo, order, p, result)
+	})
+	if err != nil {
+		return nil, errors.New("failed to update payment: " + err.Error())
+	}
+	return s.GetPayment(p.ID)
+}
+
+// settle moves the payment to the status the provider reported, publishing
+// payment.succeeded or payment.failed once it reaches either. Results that
+// arrive out of order or twice change nothing.
+func settle(repo repository.PaymentRepository, order *model.Order, p *model.Payment, result *payment.Result) error {
+	updates := map[string]interface{}{}
+	if result.ProviderRef != "" {
+		updates["provider_ref"] = result.ProviderRef
+	}
+
+	var from []string
+	var to string
+	switch result.Status {
+	case payment.ResultPending:
+		from, to = []string{model.PaymentStatusPending}, model.PaymentStatusPending
+	case payment.ResultAuthorized:
+		from, to = []string{model.PaymentStatusPending}, model.PaymentStatusAuthorized
+	case payment.ResultCaptured:
+		from, to = []string{model.PaymentStatusPending, model.PaymentStatusAuthorized}, model.PaymentStatusCompleted
+		updates["paid_at"] = gorm.Expr("NOW()")
+	case payment.ResultFailed:
+		from, to = []string{model.PaymentStatusPending, model.PaymentStatusAuthorized}, model.PaymentStatusFailed
+		updates["failure_reason"] = result.FailureReason
+	default:
+		return errors.New("unknown payment result " + result.Status)
+	}
+
+	ok, err := repo.TransitionStatus(p.ID, from, to, updates)
+	if err != nil || !ok {
+		return err
+	}
+
+	switch to {
+	case model.PaymentStatusCompleted:
+		return repo.AddEvent(events.TypePaymentSucceeded, events.PaymentSucceeded{
+			PaymentID: p.ID.String(),
+			OrderID:   order.ID.String(),
+			UserID:    order.UserID.String(),
+			Amount:    p.Amount,
+			Method:    p.Method,
+			Provider:  p.Provider,
+		})
+	case model.PaymentStatusFailed:
+		return repo.AddEvent(events.TypePaymentFailed, events.PaymentFailed{
+			PaymentID: p.ID.String(),
+			OrderID:   order.ID.String(),
+			UserID:    order.UserID.String(),
+			Amount:    p.Amount,
+			Method:    p.Method,
+			Provider:  p.Provider,
+			Reason:    result.FailureReason,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/hero/microservice/order-service/internal/model"
+	"github.com/hero/microservice/order-service/internal/payment"
+	"github.com/hero/microservice/order-service/internal/repository"
+	"github.com/hero/microservice/pkg/events"
+	"gorm.io/gorm"
+)
+
+type fakePaymentRepo struct {
+	repository.PaymentRepository
+	payments map[uuid.UUID]*model.Payment
+	orders   map[uuid.UUID]*model.Order
+	locked   []uuid.UUID
+	events   []queuedEvent
+	claimed  map[string]bool
+}
+
+func newFakePaymentRepo(payments ...*model.Payment) *fakePaymentRepo {
+	repo := &fakePaymentRepo{payments: map[uuid.UUID]*model.Payment{}, orders: map[uuid.UUID]*model.Order{}, claimed: map[string]bool{}}
+	for _, p := range payments {
+		repo.payments[p.ID] = p
+	}
+	return repo
+}
+
+func (r *fakePaymentRepo) Create(p *model.Payment) (bool, error) {
+	if existing, err := r.GetByIdempotencyKey(p.UserID, *p.IdempotencyKey); err == nil && existing != nil {
+		return false, nil
+	}
+	copied := *p
+	r.payments[p.ID] = &copied
+	return true, nil
+}
+
+func (r *fakePaymentRepo) GetByIdempotencyKey(userID uuid.UUID, key string) (*model.Payment, error) {
+	for _, p := range r.payments {
+		if p.UserID == userID && p.IdempotencyKey != nil && *p.IdempotencyKey == key {
+			copied := *p
+			return &copied, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *fakePaymentRepo) HasCompleted(orderID uuid.UUID) (bool, error) {
+	for _, p := range r.payments {
+		if p.OrderID == orderID && p.Status == model.PaymentStatusCompleted {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *fakePaymentRepo) LockOrder(orderID uuid.UUID) (*model.Order, error) {
+	order, ok := r.orders[orderID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	r.locked = append(r.locked, orderID)
+	copied := *order
+	return &copied, nil
+}
+
+func (r *fakePaymentRepo) GetByID(id uuid.UUID) (*model.Payment, error) {
+	p, ok := r.payments[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	copied := *p
+	return &copied, nil
+}
+
+func (r *fakePaymentRepo) GetByProviderRef(provider, ref string) (*model.Payment, error) {
+	for _, p := range r.payments {
+		if p.Provider == provider && p.ProviderRef != nil && *p.ProviderRef == ref {
+			copied := *p
+			return &copied, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *fakePaymentRepo) TransitionStatus(id uuid.UUID, from []string, to string, updates map[string]interface{}) (bool, error) {
+	p, ok := r.payments[id]
+	if !ok {
+		return false, nil
+	}
+	for _, status := range from {
+		if p.Status == status {
+			p.Status = to
+			if ref, ok := updates["provider_ref"].(string); ok {
+				p.ProviderRef = &ref
+			}
+			if reason, ok := updates["failure_reason"].(string); ok {
+				p.FailureReason = reason
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *fakePaymentRepo) AddEvent(eventType string, data interface{}, opts ...events.Option) error {
+	r.events = append(r.events, queuedEvent{eventType: eventType, data: data})
+	return nil
+}
+
+func (r *fakePaymentRepo) ClaimEvent(eventID, eventType string) (bool, error) {
+	if r.claimed[eventID] {
+		return false, nil
+	}
+	r.claimed[eventID] = true
+	return true, nil
+}
+
+func (r *fakePaymentRepo) Transaction(fn func(repo repository.PaymentRepository) error) error {
+	return fn(r)
+}
+
+func newPayment(order *model.Order, status string) *model.Payment {
+	ref := "fake_" + uuid.NewString()
+	return &model.Payment{ID: uuid.New(), OrderID: order.ID, UserID: order.UserID, Method: "card", Status: status, Amount: order.TotalAmount, Provider: "fake", ProviderRef: &ref}
+}
+
+func TestSettle(t *testing.T) {
+	tests := []struct {
+		name    string
+		from    string
+		results []string
+		status  string
+		events  []string
+	}{
+		{"authorized", model.PaymentStatusPending, []string{payment.ResultAuthorized}, model.PaymentStatusAuthorized, nil},
+		{"still pending", model.PaymentStatusPending, []string{payment.ResultPending}, model.PaymentStatusPending, nil},
+		{"captured", model.PaymentStatusAuthorized, []string{payment.ResultCaptured}, model.PaymentStatusCompleted, []string{events.TypePaymentSucceeded}},
+		{"captured without authorization", model.PaymentStatusPending, []string{payment.ResultCaptured}, model.PaymentStatusCompleted, []string{events.TypePaymentSucceeded}},
+		{"failed", model.PaymentStatusAuthorized, []string{payment.ResultFailed}, model.PaymentStatusFailed, []string{events.TypePaymentFailed}},
+		{"duplicate capture", model.PaymentStatusAuthorized, []string{payment.ResultCaptured, payment.ResultCaptured}, model.PaymentStatusCompleted, []string{events.TypePaymentSucceeded}},
+		{"capture after failure", model.PaymentStatusAuthorized, []string{payment.ResultFailed, payment.ResultCaptured}, model.PaymentStatusFailed, []string{events.TypePaymentFailed}},
+		{"failure after capture", model.PaymentStatusAuthorized, []string{payment.ResultCaptured, payment.ResultFailed}, model.PaymentStatusCompleted, []string{events.TypePaymentSucceeded}},
+		{"authorization after capture", model.PaymentStatusAuthorized, []string{payment.ResultCaptured, payment.ResultAuthorized}, model.PaymentStatusCompleted, []string{events.TypePaymentSucceeded}},
+	}
+	for _, tt := range tests {
+		order := newOrder(model.OrderStatusConfirmed)
+		p := newPayment(order, tt.from)
+		repo := newFakePaymentRepo(p)
+
+		for _, status := range tt.results {
+			if err := settle(repo, order, p, &payment.Result{Status: status, FailureReason: "card_declined"}); err != nil {
+				t.Fatalf("%s: settle(%s) = %v", tt.name, status, err)
+			}
+		}
+		if got := repo.payments[p.ID].Status; got != tt.status {
+			t.Errorf("%s: status = %s, want %s", tt.name, got, tt.status)
+		}
+		var got []string
+		for _, e := range repo.events {
+			got = append(got, e.eventType)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.events) {
+			t.Errorf("%s: events = %v, want %v", tt.name, got, tt.events)
+		}
+	}
+}
+
+func TestSettleRejectsUnknownResult(t *testing.T) {
+	order := newOrder(model.OrderStatusConfirmed)
+	p := newPayment(order, model.PaymentStatusPending)
+	repo := newFakePaymentRepo(p)
+
+	if err := settle(repo, order, p, &payment.Result{Status: "refunded"}); err == nil {
+		t.Error("settle(refunded) succeeded, want an error")
+	}
+	if repo.payments[p.ID].Status != model.PaymentStatusPending {
+		t.Errorf("status = %s, want pending", repo.payments[p.ID].Status)
+	}
+}
+
+func TestHandleWebhookOnce(t *testing.T) {
+	order := newOrder(model.OrderStatusConfirmed)
+	p := newPayment(order, model.PaymentStatusAuthorized)
+	repo := newFakePaymentRepo(p)
+	svc := NewPaymentService(repo, newFakeOrderRepo(order), payment.NewFakeProvider())
+
+	event := payment.WebhookEvent{ID: "evt_1", Type: payment.WebhookCaptured, ProviderRef: *p.ProviderRef}
+	for i := 0; i < 2; i++ {
+		if err := svc.HandleWebhook(event); err != nil {
+			t.Fatalf("delivery %d: %v", i+1, err)
+		}
+	}
+	if len(repo.events) != 1 || repo.events[0].eventType != events.TypePaymentSucceeded {
+		t.Errorf("events = %+v, want one %s", repo.events, events.TypePaymentSucceeded)
+	}
+
+	unknown := payment.WebhookEvent{ID: "evt_2", Type: payment.WebhookCaptured, ProviderRef: "fake_unknown"}
+	if err := svc.HandleWebhook(unknown); err != ErrPaymentNotFound {
+		t.Errorf("unknown provider_ref: err = %v, want ErrPaymentNotFound", err)
+	}
+}
+
+func TestPaymentFailedLeavesOrderPayable(t *testing.T) {
+	order := newOrder(model.OrderStatusConfirmed)
+	p := newPayment(order, model.PaymentStatusAuthorized)
+	repo := newFakePaymentRepo(p)
+	orders := newFakeOrderRepo(order)
+	svc := NewPaymentService(repo, orders, payment.NewFakeProvider())
+
+	event := payment.WebhookEvent{ID: "evt_1", Type: payment.WebhookFailed, ProviderRef: *p.ProviderRef, FailureReason: "card_declined"}
+	if err := svc.HandleWebhook(event); err != nil {
+		t.Fatal(err)
+	}
+	if got := orders.orders[order.ID].Status; got != model.OrderStatusConfirmed {
+		t.Errorf("order status = %s, want confirmed", got)
+	}
+	if r := repo.payments[p.ID].FailureReason; r != "card_declined" {
+		t.Errorf("failure_reason = %q, want card_declined", r)
+	}
+}
+
+func TestCaptureOncePerOrder(t *testing.T) {
+	order := newOrder(model.OrderStatusConfirmed)
+	first, second := newPayment(order, model.PaymentStatusAuthorized), newPayment(order, model.PaymentStatusAuthorized)
+	repo := newFakePaymentRepo(first, second)
+	repo.orders[order.ID] = order
+	svc := NewPaymentService(repo, newFakeOrderRepo(order), payment.NewFakeProvider())
+
+	p, err := svc.Capture(first.ID, "")
+	if err != nil || p.Status != model.PaymentStatusCompleted {
+		t.Fatalf("first capture = %+v, %v, want completed", p, err)
+	}
+	if _, err := svc.Capture(second.ID, ""); err != ErrOrderAlreadyPaid {
+		t.Errorf("second capture: err = %v, want ErrOrderAlreadyPaid", err)
+	}
+	if got := repo.payments[second.ID].Status; got != model.PaymentStatusAuthorized {
+		t.Errorf("second payment status = %s, want authorized", got)
+	}
+	if len(repo.locked) != 2 || repo.locked[0] != order.ID || repo.locked[1] != order.ID {
+		t.Errorf("locked = %v, want the order locked for both captures", repo.locked)
+	}
+
+	// Capturing the completed payment again returns it without another event
+	if p, err := svc.Capture(first.ID, ""); err != nil || p.Status != model.PaymentStatusCompleted {
+		t.Errorf("repeated capture = %+v, %v", p, err)
+	}
+	if len(repo.events) != 1 || repo.events[0].eventType != events.TypePaymentSucceeded {
+		t.Errorf("events = %+v, want one %s", repo.events, events.TypePaymentSucceeded)
+	}
+}
+
+func TestPaymentIdempotencyKeysArePerUser(t *testing.T) {
+	mine, theirs := newOrder(model.OrderStatusConfirmed), newOrder(model.OrderStatusConfirmed)
+	other := newOrder(model.OrderStatusConfirmed)
+	other.UserID = mine.UserID
+	repo := newFakePaymentRepo()
+	svc := NewPaymentService(repo, newFakeOrderRepo(mine, theirs, other), payment.NewFakeProvider())
+	input := model.InitiatePaymentInput{Method: "card"}
+
+	for _, order := range []*model.Order{mine, theirs} {
+		p, created, err := svc.Initiate(order.ID, input, "key-1")
+		if err != nil || !created || p.OrderID != order.ID {
+			t.Fatalf("order %s: Initiate = %+v, %v, %v, want a new payment", order.ID, p, created, err)
+		}
+	}
+	if p, created, err := svc.Initiate(mine.ID, input, "key-1"); err != nil || created || p.OrderID != mine.ID {
+		t.Errorf("retry: Initiate = %+v, %v, %v, want the original payment", p, created, err)
+	}
+	if _, _, err := svc.Initiate(other.ID, input, "key-1"); err != ErrIdempotencyKeyReused {
+		t.Errorf("another order of the same user: err = %v, want ErrIdempotencyKeyReused", err)
+	}
+	if len(repo.payments) != 2 {
+		t.Errorf("payments = %d, want 2", len(repo.payments))
+	}
+}
@@ -0,0 +1,35 @@
+package carttoken
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"time"
+)
+
+const (
+	// CookieName is the cookie the gateway issues to anonymous shoppers
+	CookieName = "cart_token"
+	// Header forwards the cookie's token to downstream services. The gateway
+	// replaces any client-supplied value.
+	Header = "X-Cart-Token"
+	// TTL matches how long an untouched cart is kept
+	TTL = 7 * 24 * time.Hour
+)
+
+const tokenBytes = 32
+
+// New returns a random, URL-safe token. Holding it is what grants access
+// to the guest cart, so it must stay unguessable.
+func New() (string, error) {
+	b := make([]byte, tokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Valid reports whether token has the shape New produces.
+func Valid(token string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	return err == nil && len(b) == tokenBytes
+}
@@ -0,0 +1,117 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hero/microservice/pkg/messaging"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"gorm.io/gorm"
+)
+
+// DeadLetter is a message that exhausted its retries, kept for inspection
+// and replay.
+type DeadLetter struct {
+	ID          uuid.UUID       `gorm:"type:uuid;primaryKey" json:"id"`
+	MessageID   string          `json:"message_id"`
+	Queue       string          `json:"queue"`
+	Exchange    string          `json:"exchange"`
+	RoutingKey  string          `json:"routing_key"`
+	Error       string          `json:"error"`
+	Attempts    int             `json:"attempts"`
+	Headers     json.RawMessage `gorm:"type:jsonb" json:"headers,omitempty"`
+	Payload     string          `json:"payload"`
+	ReplayCount int             `json:"replay_count"`
+	ReplayedAt  *time.Time      `json:"replayed_at,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+}
+
+type Filter struct {
+	Queue    string
+	Replayed *bool
+	Limit    int
+	Offset   int
+}
+
+// Store persists dead letters into <schema>.dead_letters.
+type Store struct {
+	db    *gorm.DB
+	table string
+}
+
+func NewStore(db *gorm.DB, schema string) *Store {
+	return &Store{db: db, table: schema + ".dead_letters"}
+}
+
+// Record is a messaging.Handler for the service's dead-letter queue.
+func (s *Store) Record(msg amqp.Delivery) error {
+	headers := make(map[string]string, len(msg.Headers))
+	for k, v := range msg.Headers {
+		headers[k] = fmt.Sprint(v)
+	}
+	headerJSON, _ := json.Marshal(headers)
+
+	attempts := 0
+	fmt.Sscan(headers[messaging.HeaderRetryCount], &attempts)
+
+	dl := DeadLetter{
+		ID:         uuid.New(),
+		MessageID:  msg.MessageId,
+		Queue:      headers[messaging.HeaderQueue],
+		Exchange:   headers[messaging.HeaderExchange],
+		RoutingKey: headers[messaging.HeaderRoutingKey],
+		Error:      headers[messaging.HeaderError],
+		Attempts:   attempts,
+		Headers:    headerJSON,
+		Payload:    string(msg.Body),
+	}
+	if dl.Queue == "" {
+		dl.Queue = msg.RoutingKey
+	}
+
+	if err := s.db.Table(s.table).Omit("ReplayedAt", "CreatedAt").Create(&dl).Error; err != nil {
+		return fmt.Errorf("failed to store dead letter: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) List(f Filter) ([]DeadLetter, int64, error) {
+	query := s.db.Table(s.table)
+	if f.Queue != "" {
+		query = query.Where("queue = ?", f.Queue)
+	}
+	if f.Replayed != nil {
+		if *f.Replayed {
+			query = query.Where("replayed_at IS NOT NULL")
+		} else {
+			query = query.Where("replayed_at IS NULL")
+		}
+	}
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	letters := []DeadLetter{}
+	err := query.Omit("headers").Order("created_at DESC").
+		Limit(f.Limit).Offset(f.Offset).Find(&letters).Error
+	return letters, total, err
+}
+
+func (s *Store) Get(id uuid.UUID) (*DeadLetter, error) {
+	var dl DeadLetter
+	if err := s.db.Table(s.table).Where("id = ?", id).First(&dl).Error; err != nil {
+		return nil, err
+	}
+	return &dl, nil
+}
+
+func (s *Store) MarkReplayed(id uuid.UUID) error {
+	return s.db.Table(s.table).Where("id = ?", id).Updates(map[string]interface{}{
+		"replayed_at":  gorm.Expr("NOW()"),
+		"replay_count": gorm.Expr("replay_count + 1"),
+	}).Error
+}
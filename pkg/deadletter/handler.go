@@ -0,0 +1,121 @@
+package deadletter
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/hero/microservice/pkg/ginauth"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultLimit = 50
+	maxLimit     = 200
+)
+
+// Replayer puts a message back on the queue it originally failed on.
+type Replayer interface {
+	PublishToQueue(ctx context.Context, queue, messageID string, body []byte) error
+}
+
+type Handler struct {
+	store *Store
+	mq    Replayer
+}
+
+func NewHandler(store *Store, mq Replayer) *Handler {
+	return &Handler{store: store, mq: mq}
+}
+
+func (h *Handler) List(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultLimit)))
+	if limit <= 0 || limit > maxLimit {
+		limit = defaultLimit
+	}
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	filter := Filter{Queue: c.Query("queue"), Limit: limit, Offset: offset}
+	if v := c.Query("replayed"); v != "" {
+		replayed, err := strconv.ParseBool(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "replayed must be true or false"})
+			return
+		}
+		filter.Replayed = &replayed
+	}
+
+	letters, total, err := h.store.List(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"dead_letters": letters, "total": total, "limit": limit, "offset": offset})
+}
+
+func (h *Handler) Get(c *gin.Context) {
+	dl, ok := h.lookup(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, dl)
+}
+
+func (h *Handler) Replay(c *gin.Context) {
+	dl, ok := h.lookup(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+	defer cancel()
+
+	// The replayed copy starts with a fresh retry budget
+	if err := h.mq.PublishToQueue(ctx, dl.Queue, dl.MessageID, []byte(dl.Payload)); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "failed to replay message: " + err.Error()})
+		return
+	}
+	if err := h.store.MarkReplayed(dl.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "message replayed", "queue": dl.Queue})
+}
+
+func (h *Handler) lookup(c *gin.Context) (*DeadLetter, bool) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid dead letter id"})
+		return nil, false
+	}
+
+	dl, err := h.store.Get(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "dead letter not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return dl, true
+}
+
+// RegisterRoutes mounts the admin API under /api/admin/dead-letters/<service>.
+func (h *Handler) RegisterRoutes(r *gin.Engine, service string) {
+	admin := r.Group("/api/admin/dead-letters/"+service, ginauth.RequireRole("admin"))
+	{
+		admin.GET("", h.List)
+		admin.GET("/:id", h.Get)
+		admin.POST("/:id/replay", h.Replay)
+	}
+}
@@ -0,0 +1,119 @@
+package events
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrUnknownType        = errors.New("unknown event type")
+	ErrUnsupportedVersion = errors.New("unsupported event version")
+)
+
+// Envelope wraps every event published on the bus. Data holds the payload
+// struct registered for Type at Version.
+type Envelope struct {
+	ID            string          `json:"id"`
+	Type          string          `json:"type"`
+	Version       int             `json:"version"`
+	OccurredAt    time.Time       `json:"occurred_at"`
+	CorrelationID string          `json:"correlation_id"`
+	Producer      string          `json:"producer"`
+	Data          json.RawMessage `json:"data"`
+}
+
+type Option func(*Envelope)
+
+// WithCorrelationID ties the event to the request or event chain that
+// caused it. Without it an event starts a new chain with its own id.
+func WithCorrelationID(id string) Option {
+	return func(e *Envelope) {
+		if id != "" {
+			e.CorrelationID = id
+		}
+	}
+}
+
+// New builds an envelope for a registered event type at its current
+// version.
+func New(eventType, producer string, data interface{}, opts ...Option) (*Envelope, error) {
+	def, ok := Lookup(eventType)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownType, eventType)
+	}
+
+	body, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s payload: %w", eventType, err)
+	}
+
+	id := uuid.New().String()
+	env := &Envelope{
+		ID:            id,
+		Type:          eventType,
+		Version:       def.Version,
+		OccurredAt:    time.Now().UTC(),
+		CorrelationID: id,
+		Producer:      producer,
+		Data:          body,
+	}
+	for _, opt := range opts {
+		opt(env)
+	}
+	return env, nil
+}
+
+// legacyEnvelope is the {event, timestamp, data} shape published before
+// envelopes were versioned, still accepted while old messages drain.
+type legacyEnvelope struct {
+	Event     string          `json:"event"`
+	Timestamp time.Time       `json:"timestamp"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// Decode parses a message body. Events of a known type with a newer
+// version than this build understands are rejected.
+func Decode(body []byte) (*Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal(body, &env); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal event: %w", err)
+	}
+
+	if env.Type == "" {
+		var legacy legacyEnvelope
+		if err := json.Unmarshal(body, &legacy); err != nil || legacy.Event == "" {
+			return nil, errors.New("event has no type")
+		}
+		// Legacy events carried no id, derive a stable one from the body
+		sum := sha256.Sum256(body)
+		env = Envelope{
+			ID:         "legacy-" + hex.EncodeToString(sum[:16]),
+			Type:       legacy.Event,
+			Version:    1,
+			OccurredAt: legacy.Timestamp,
+			Data:       legacy.Data,
+		}
+	}
+
+	if env.ID == "" {
+		return nil, errors.New("event has no id")
+	}
+	if def, ok := Lookup(env.Type); ok && env.Version > def.Version {
+		return nil, fmt.Errorf("%w: %s v%d", ErrUnsupportedVersion, env.Type, env.Version)
+	}
+	return &env, nil
+}
+
+// DecodeData unmarshals the payload into v.
+func (e *Envelope) DecodeData(v interface{}) error {
+	if err := json.Unmarshal(e.Data, v); err != nil {
+		return fmt.Errorf("failed to unmarshal %s payload: %w", e.Type, err)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+// Command schemagen writes the JSON Schema of every registered event
+// version that has none yet. A committed schema is never overwritten: it
+// is the contract consumers were built against, and the compatibility
+// tests check later definitions of the version against it.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/hero/microservice/pkg/events"
+)
+
+func main() {
+	out := flag.String("out", "schemas", "output directory")
+	flag.Parse()
+
+	if err := os.MkdirAll(*out, 0o755); err != nil {
+		log.Fatal(err)
+	}
+
+	for _, def := range events.All() {
+		data, err := json.MarshalIndent(events.SchemaFor(def), "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		path := filepath.Join(*out, events.FileName(def.Type, def.Version))
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		_, err = f.Write(append(data, '\n'))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("wrote %s", path)
+	}
+}
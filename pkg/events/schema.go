@@ -0,0 +1,161 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+//go:generate go run ./internal/schemagen -out schemas
+
+// Schema is the subset of JSON Schema needed to describe event payloads.
+type Schema struct {
+	Draft      string             `json:"$schema,omitempty"`
+	ID         string             `json:"$id,omitempty"`
+	Title      string             `json:"title,omitempty"`
+	Type       string             `json:"type,omitempty"`
+	Format     string             `json:"format,omitempty"`
+	Const      interface{}        `json:"const,omitempty"`
+	Properties map[string]*Schema `json:"properties,omitempty"`
+	Required   []string           `json:"required,omitempty"`
+	Items      *Schema            `json:"items,omitempty"`
+}
+
+// FileName is where the schema for a type and version is kept.
+func FileName(eventType string, version int) string {
+	return fmt.Sprintf("%s.v%d.json", eventType, version)
+}
+
+// SchemaFor describes the full envelope of an event, with data narrowed to
+// its payload struct.
+func SchemaFor(def Definition) *Schema {
+	s := schemaOf(reflect.TypeOf(Envelope{}))
+	s.Draft = "https://json-schema.org/draft/2020-12/schema"
+	s.ID = FileName(def.Type, def.Version)
+	s.Title = def.Type
+
+	s.Properties["type"].Const = def.Type
+	s.Properties["version"].Const = def.Version
+	s.Properties["data"] = schemaOf(def.Payload)
+	return s
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	rawType  = reflect.TypeOf(json.RawMessage{})
+)
+
+func schemaOf(t reflect.Type) *Schema {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t == rawType:
+		return &Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: schemaOf(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object"}
+	case reflect.Struct:
+		s := &Schema{Type: "object", Properties: map[string]*Schema{}}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			s.Properties[name] = schemaOf(f.Type)
+			if !strings.Contains(opts, "omitempty") {
+				s.Required = append(s.Required, name)
+			}
+		}
+		return s
+	}
+	return &Schema{}
+}
+
+// Compatible lists the ways next breaks consumers written against prev:
+// removed or retyped fields, fields that are no longer required, and new
+// fields that are required. Adding optional fields is always allowed.
+func Compatible(prev, next *Schema) []string {
+	var problems []string
+	compare("", prev, next, &problems)
+	return problems
+}
+
+func compare(path string, prev, next *Schema, problems *[]string) {
+	name := path
+	if name == "" {
+		name = "(root)"
+	}
+
+	if prev.Type != next.Type {
+		*problems = append(*problems, fmt.Sprintf("%s: type changed from %q to %q", name, prev.Type, next.Type))
+		return
+	}
+	if prev.Const != nil && fmt.Sprint(prev.Const) != fmt.Sprint(next.Const) {
+		*problems = append(*problems, fmt.Sprintf("%s: const changed from %v to %v", name, prev.Const, next.Const))
+	}
+
+	for field, prevField := range prev.Properties {
+		nextField, ok := next.Properties[field]
+		if !ok {
+			*problems = append(*problems, fmt.Sprintf("%s.%s: field removed", name, field))
+			continue
+		}
+		compare(strings.TrimPrefix(path+"."+field, "."), prevField, nextField, problems)
+	}
+
+	for _, field := range prev.Required {
+		if _, ok := next.Properties[field]; !ok {
+			// Already reported as removed
+			continue
+		}
+		if !contains(next.Required, field) {
+			*problems = append(*problems, fmt.Sprintf("%s.%s: no longer required", name, field))
+		}
+	}
+
+	// Messages published before the field existed do not carry it
+	for _, field := range next.Required {
+		if _, ok := prev.Properties[field]; !ok && prev.Type == "object" {
+			*problems = append(*problems, fmt.Sprintf("%s.%s: new field must be optional (omitempty)", name, field))
+		}
+	}
+
+	if prev.Items != nil && next.Items != nil {
+		compare(path+"[]", prev.Items, next.Items, problems)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
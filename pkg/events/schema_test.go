@@ -0,0 +1,222 @@
+package events
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+var schemaFile = regexp.MustCompile(`^(.+)\.v(\d+)\.json$`)
+
+func loadSchema(t *testing.T, path string) *Schema {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+	var s Schema
+	if err := json.Unmarshal(data, &s); err != nil {
+		t.Fatalf("failed to parse %s: %v", path, err)
+	}
+	return &s
+}
+
+// roundTrip normalises a generated schema the way it looks once loaded
+// from disk, so it can be compared with a golden file.
+func roundTrip(t *testing.T, s *Schema) *Schema {
+	t.Helper()
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out Schema
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	return &out
+}
+
+// TestSchemasCompatible checks every committed schema against the current
+// definition of the same version. Committed schemas are never regenerated,
+// so the current definition may only add optional fields to them. A
+// failure means consumers built against that schema would break: restore
+// the field or bump the event version.
+func TestSchemasCompatible(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("schemas", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no committed schemas found, run go generate ./...")
+	}
+
+	for _, path := range files {
+		m := schemaFile.FindStringSubmatch(filepath.Base(path))
+		if m == nil {
+			t.Errorf("unexpected file %s in schemas", path)
+			continue
+		}
+		eventType := m[1]
+		version, _ := strconv.Atoi(m[2])
+
+		def, ok := Lookup(eventType)
+		if !ok {
+			t.Errorf("%s: event type %s is no longer registered", path, eventType)
+			continue
+		}
+		if version > def.Version {
+			t.Errorf("%s: committed version %d is newer than registered version %d", path, version, def.Version)
+			continue
+		}
+		if version < def.Version {
+			// Superseded versions are kept for reference only
+			continue
+		}
+
+		golden := loadSchema(t, path)
+		current := roundTrip(t, SchemaFor(def))
+
+		for _, problem := range Compatible(golden, current) {
+			t.Errorf("%s v%d breaks existing consumers: %s", eventType, version, problem)
+		}
+	}
+}
+
+// TestSchemasCommitted makes sure every registered event has a schema on
+// disk, so later changes are checked against it.
+func TestSchemasCommitted(t *testing.T) {
+	for _, def := range All() {
+		path := filepath.Join("schemas", FileName(def.Type, def.Version))
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("missing schema %s, run go generate ./...", path)
+		}
+	}
+}
+
+func TestCompatibleDetectsBreakingChanges(t *testing.T) {
+	prev := SchemaFor(Definition{Type: "test.event", Version: 1, Payload: reflect.TypeOf(struct {
+		ID    string  `json:"id"`
+		Count int     `json:"count"`
+		Note  string  `json:"note,omitempty"`
+		Tags  []int   `json:"tags"`
+		Price float64 `json:"price"`
+	}{})})
+
+	tests := []struct {
+		name     string
+		payload  interface{}
+		breaking bool
+	}{
+		{"unchanged", struct {
+			ID    string  `json:"id"`
+			Count int     `json:"count"`
+			Note  string  `json:"note,omitempty"`
+			Tags  []int   `json:"tags"`
+			Price float64 `json:"price"`
+		}{}, false},
+		{"field added", struct {
+			ID    string  `json:"id"`
+			Count int     `json:"count"`
+			Note  string  `json:"note,omitempty"`
+			Tags  []int   `json:"tags"`
+			Price float64 `json:"price"`
+			Extra string  `json:"extra,omitempty"`
+		}{}, false},
+		{"required field added", struct {
+			ID    string  `json:"id"`
+			Count int     `json:"count"`
+			Note  string  `json:"note,omitempty"`
+			Tags  []int   `json:"tags"`
+			Price float64 `json:"price"`
+			Extra string  `json:"extra"`
+		}{}, true},
+		{"field removed", struct {
+			ID    string  `json:"id"`
+			Note  string  `json:"note,omitempty"`
+			Tags  []int   `json:"tags"`
+			Price float64 `json:"price"`
+		}{}, true},
+		{"type changed", struct {
+			ID    string  `json:"id"`
+			Count string  `json:"count"`
+			Note  string  `json:"note,omitempty"`
+			Tags  []int   `json:"tags"`
+			Price float64 `json:"price"`
+		}{}, true},
+		{"item type changed", struct {
+			ID    string   `json:"id"`
+			Count int      `json:"count"`
+			Note  string   `json:"note,omitempty"`
+			Tags  []string `json:"tags"`
+			Price float64  `json:"price"`
+		}{}, true},
+		{"made optional", struct {
+			ID    string  `json:"id"`
+			Count int     `json:"count,omitempty"`
+			Note  string  `json:"note,omitempty"`
+			Tags  []int   `json:"tags"`
+			Price float64 `json:"price"`
+		}{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := SchemaFor(Definition{Type: "test.event", Version: 1, Payload: reflect.TypeOf(tt.payload)})
+			problems := Compatible(prev, next)
+			if tt.breaking && len(problems) == 0 {
+				t.Error("expected a breaking change to be reported")
+			}
+			if !tt.breaking && len(problems) > 0 {
+				t.Errorf("unexpected problems: %v", problems)
+			}
+		})
+	}
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	env, err := New(TypeOrderCancelled, "order-service", OrderCancelled{OrderID: "o1", UserID: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.CorrelationID != env.ID {
+		t.Errorf("correlation id = %q, want event id %q", env.CorrelationID, env.ID)
+	}
+
+	body, _ := json.Marshal(env)
+	decoded, err := Decode(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var data OrderCancelled
+	if err := decoded.DecodeData(&data); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Type != TypeOrderCancelled || decoded.Version != 1 || data.OrderID != "o1" {
+		t.Errorf("unexpected decoded event: %+v %+v", decoded, data)
+	}
+}
+
+func TestDecodeRejectsNewerVersion(t *testing.T) {
+	body := []byte(`{"id":"1","type":"order.cancelled","version":99,"data":{}}`)
+	if _, err := Decode(body); err == nil {
+		t.Error("expected newer version to be rejected")
+	}
+}
+
+func TestDecodeLegacyEnvelope(t *testing.T) {
+	body := []byte(`{"event":"user.deleted","timestamp":"2024-01-01T00:00:00Z","data":{"user_id":"u1"}}`)
+	env, err := Decode(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Type != TypeUserDeleted || env.Version != 1 {
+		t.Errorf("unexpected legacy decode: %+v", env)
+	}
+}
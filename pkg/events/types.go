@@ -0,0 +1,261 @@
+package events
+
+import (
+	"reflect"
+	"sort"
+)
+
+// Routing keys. The routing key doubles as the envelope type.
+const (
+	TypeUserRegistered = "user.registered"
+	TypeUserUpdated    = "user.updated"
+	TypeUserDeleted    = "user.deleted"
+	TypeRoleGranted    = "user.role_granted"
+	TypeRoleRevoked    = "user.role_revoked"
+	TypeUserLoggedIn   = "user.logged_in"
+
+	TypeProductCreated      = "product.created"
+	TypeProductOutOfStock   = "product.out_of_stock"
+	TypeProductPriceChanged = "product.price_changed"
+	TypeProductArchived     = "product.archived"
+	TypeInventoryUpdated    = "inventory.updated"
+	TypeInventoryReserved   = "inventory.reserved"
+	TypeReservationFailed   = "inventory.reservation_failed"
+
+	TypeOrderCreated   = "order.created"
+	TypeOrderConfirmed = "order.confirmed"
+	TypeOrderPaid      = "order.paid"
+	TypeOrderShipped   = "order.shipped"
+	TypeOrderDelivered = "order.delivered"
+	TypeOrderCompleted = "order.completed"
+	TypeOrderRejected  = "order.rejected"
+	TypeOrderCancelled = "order.cancelled"
+	TypeOrderRefunded  = "order.refunded"
+
+	TypePaymentSucceeded = "payment.succeeded"
+	TypePaymentFailed    = "payment.failed"
+)
+
+type UserRegistered struct {
+	UserID   string `json:"user_id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+type UserUpdated struct {
+	UserID   string `json:"user_id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+type UserDeleted struct {
+	UserID string `json:"user_id"`
+}
+
+// UserLoggedIn carries the guest cart token presented at login, if any, so
+// the guest cart can be merged into the user's.
+type UserLoggedIn struct {
+	UserID    string `json:"user_id"`
+	CartToken string `json:"cart_token,omitempty"`
+}
+
+// RoleChanged is the payload of both user.role_granted and
+// user.role_revoked. Roles is the full set after the change.
+type RoleChanged struct {
+	UserID string   `json:"user_id"`
+	Role   string   `json:"role"`
+	Roles  []string `json:"roles"`
+}
+
+type ProductCreated struct {
+	ProductID   string  `json:"product_id"`
+	ProductName string  `json:"product_name"`
+	Price       float64 `json:"price"`
+}
+
+type ProductOutOfStock struct {
+	ProductID   string `json:"product_id"`
+	ProductName string `json:"product_name"`
+	VariantID   string `json:"variant_id,omitempty"`
+	SKU         string `json:"sku,omitempty"`
+}
+
+// ProductPriceChanged is published per variant whose effective price
+// changed. DefaultVariant marks the variant used by lines that name none.
+type ProductPriceChanged struct {
+	ProductID      string  `json:"product_id"`
+	ProductName    string  `json:"product_name"`
+	OldPrice       float64 `json:"old_price"`
+	NewPrice       float64 `json:"new_price"`
+	VariantID      string  `json:"variant_id,omitempty"`
+	DefaultVariant bool    `json:"default_variant,omitempty"`
+}
+
+type ProductArchived struct {
+	ProductID   string `json:"product_id"`
+	ProductName string `json:"product_name"`
+}
+
+type InventoryUpdated struct {
+	ProductID         string `json:"product_id"`
+	QuantityRemaining int    `json:"quantity_remaining"`
+	IsLowStock        bool   `json:"is_low_stock"`
+	VariantID         string `json:"variant_id,omitempty"`
+}
+
+// StockItem without a VariantID refers to the product's default variant.
+type StockItem struct {
+	ProductID string `json:"product_id"`
+	Quantity  int    `json:"quantity"`
+	VariantID string `json:"variant_id,omitempty"`
+}
+
+type InventoryReserved struct {
+	OrderID string      `json:"order_id"`
+	Items   []StockItem `json:"items"`
+}
+
+type ReservationFailed struct {
+	OrderID   string `json:"order_id"`
+	ProductID string `json:"product_id"`
+	Requested int    `json:"requested"`
+	Available int    `json:"available"`
+	Reason    string `json:"reason"`
+	VariantID string `json:"variant_id,omitempty"`
+}
+
+type OrderCreated struct {
+	OrderID     string      `json:"order_id"`
+	UserID      string      `json:"user_id"`
+	Items       []StockItem `json:"items"`
+	TotalAmount float64     `json:"total_amount"`
+}
+
+type OrderConfirmed struct {
+	OrderID string `json:"order_id"`
+	UserID  string `json:"user_id"`
+}
+
+type OrderRejected struct {
+	OrderID string `json:"order_id"`
+	UserID  string `json:"user_id"`
+	Reason  string `json:"reason"`
+}
+
+type OrderCancelled struct {
+	OrderID string `json:"order_id"`
+	UserID  string `json:"user_id"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+type OrderPaid struct {
+	OrderID     string  `json:"order_id"`
+	UserID      string  `json:"user_id"`
+	TotalAmount float64 `json:"total_amount"`
+}
+
+type OrderShipped struct {
+	OrderID string `json:"order_id"`
+	UserID  string `json:"user_id"`
+}
+
+type OrderDelivered struct {
+	OrderID string `json:"order_id"`
+	UserID  string `json:"user_id"`
+}
+
+type OrderCompleted struct {
+	OrderID string `json:"order_id"`
+	UserID  string `json:"user_id"`
+}
+
+type OrderRefunded struct {
+	OrderID     string  `json:"order_id"`
+	UserID      string  `json:"user_id"`
+	TotalAmount float64 `json:"total_amount"`
+	Reason      string  `json:"reason,omitempty"`
+}
+
+type PaymentSucceeded struct {
+	PaymentID string  `json:"payment_id"`
+	OrderID   string  `json:"order_id"`
+	UserID    string  `json:"user_id"`
+	Amount    float64 `json:"amount"`
+	Method    string  `json:"method"`
+	Provider  string  `json:"provider"`
+}
+
+type PaymentFailed struct {
+	PaymentID string  `json:"payment_id"`
+	OrderID   string  `json:"order_id"`
+	UserID    string  `json:"user_id"`
+	Amount    float64 `json:"amount"`
+	Method    string  `json:"method"`
+	Provider  string  `json:"provider"`
+	Reason    string  `json:"reason"`
+}
+
+// Definition describes the current contract for one event type. Bump
+// Version for changes that existing consumers cannot read.
+type Definition struct {
+	Type     string
+	Version  int
+	Producer string
+	Payload  reflect.Type
+}
+
+var registry = map[string]Definition{}
+
+func register(eventType string, version int, producer string, payload interface{}) {
+	registry[eventType] = Definition{
+		Type:     eventType,
+		Version:  version,
+		Producer: producer,
+		Payload:  reflect.TypeOf(payload),
+	}
+}
+
+func init() {
+	register(TypeUserRegistered, 1, "user-service", UserRegistered{})
+	register(TypeUserUpdated, 1, "user-service", UserUpdated{})
+	register(TypeUserDeleted, 1, "user-service", UserDeleted{})
+	register(TypeRoleGranted, 1, "user-service", RoleChanged{})
+	register(TypeRoleRevoked, 1, "user-service", RoleChanged{})
+	register(TypeUserLoggedIn, 1, "user-service", UserLoggedIn{})
+
+	register(TypeProductCreated, 1, "product-service", ProductCreated{})
+	register(TypeProductOutOfStock, 1, "product-service", ProductOutOfStock{})
+	register(TypeProductPriceChanged, 1, "product-service", ProductPriceChanged{})
+	register(TypeProductArchived, 1, "product-service", ProductArchived{})
+	register(TypeInventoryUpdated, 1, "product-service", InventoryUpdated{})
+	register(TypeInventoryReserved, 1, "product-service", InventoryReserved{})
+	register(TypeReservationFailed, 1, "product-service", ReservationFailed{})
+
+	register(TypeOrderCreated, 1, "order-service", OrderCreated{})
+	register(TypeOrderConfirmed, 1, "order-service", OrderConfirmed{})
+	register(TypeOrderPaid, 1, "order-service", OrderPaid{})
+	register(TypeOrderShipped, 1, "order-service", OrderShipped{})
+	register(TypeOrderDelivered, 1, "order-service", OrderDelivered{})
+	register(TypeOrderCompleted, 1, "order-service", OrderCompleted{})
+	register(TypeOrderRejected, 1, "order-service", OrderRejected{})
+	register(TypeOrderCancelled, 1, "order-service", OrderCancelled{})
+	register(TypeOrderRefunded, 1, "order-service", OrderRefunded{})
+
+	register(TypePaymentSucceeded, 1, "order-service", PaymentSucceeded{})
+	register(TypePaymentFailed, 1, "order-service", PaymentFailed{})
+}
+
+func Lookup(eventType string) (Definition, bool) {
+	def, ok := registry[eventType]
+	return def, ok
+}
+
+// All returns every registered definition ordered by type.
+func All() []Definition {
+	defs := make([]Definition, 0, len(registry))
+	for _, def := range registry {
+		defs = append(defs, def)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Type < defs[j].Type })
+	return defs
+}
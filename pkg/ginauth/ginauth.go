@@ -0,0 +1,73 @@
+package ginauth
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hero/microservice/pkg/identity"
+)
+
+const principalKey = "identity.principal"
+
+// Identity verifies the gateway-signed assertion and stores the principal
+// in the context. Raw identity headers are removed so handlers cannot fall
+// back to trusting them. Requests without an assertion stay anonymous.
+func Identity(signer *identity.Signer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		assertion := c.GetHeader(identity.AssertionHeader)
+		for _, h := range identity.Headers {
+			c.Request.Header.Del(h)
+		}
+
+		if assertion == "" {
+			c.Next()
+			return
+		}
+
+		principal, err := signer.Verify(assertion)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Set(principalKey, principal)
+		c.Next()
+	}
+}
+
+// Principal returns the verified caller, if any.
+func Principal(c *gin.Context) (*identity.Principal, bool) {
+	val, ok := c.Get(principalKey)
+	if !ok {
+		return nil, false
+	}
+	p, ok := val.(*identity.Principal)
+	return p, ok
+}
+
+// RequireUser rejects anonymous requests.
+func RequireUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := Principal(c); !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireRole rejects callers that do not hold role.
+func RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p, ok := Principal(c)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		if !p.HasRole(role) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "insufficient permissions"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,68 @@
+package idempotency
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const rememberTTL = 24 * time.Hour
+
+type processedEvent struct {
+	EventID   string `gorm:"primaryKey"`
+	EventType string
+}
+
+// Store records which events a service has already handled. The Postgres
+// table <schema>.processed_events is authoritative: Claim must run in the
+// same transaction as the handler's writes so the claim and the side
+// effects commit together. Redis, when configured, only lets consumers
+// skip known duplicates without opening a transaction.
+type Store struct {
+	table string
+	rdb   *redis.Client
+}
+
+func NewStore(schema string, rdb *redis.Client) *Store {
+	return &Store{table: schema + ".processed_events", rdb: rdb}
+}
+
+// Claim marks the event processed within tx. It reports false when the
+// event was already processed, in which case the caller should skip its
+// side effects. A concurrent claim of the same event blocks until the
+// first transaction finishes.
+func (s *Store) Claim(tx *gorm.DB, eventID, eventType string) (bool, error) {
+	result := tx.Table(s.table).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&processedEvent{EventID: eventID, EventType: eventType})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// Seen is the Redis fast path. It never reports an unprocessed event as
+// seen, but may miss processed ones; Claim still catches those.
+func (s *Store) Seen(ctx context.Context, eventID string) bool {
+	if s.rdb == nil {
+		return false
+	}
+	n, err := s.rdb.Exists(ctx, s.key(eventID)).Result()
+	return err == nil && n > 0
+}
+
+// Remember caches a processed event in Redis once its transaction has
+// committed.
+func (s *Store) Remember(ctx context.Context, eventID string) {
+	if s.rdb == nil {
+		return
+	}
+	s.rdb.Set(ctx, s.key(eventID), "1", rememberTTL)
+}
+
+func (s *Store) key(eventID string) string {
+	return "processed:" + s.table + ":" + eventID
+}
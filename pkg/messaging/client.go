@@ -0,0 +1,336 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	maxIdleChannels  = 8
+	reconnectBackoff = time.Second
+	maxReconnectWait = 30 * time.Second
+)
+
+var ErrNotConnected = errors.New("rabbitmq connection is not available")
+
+// Queue is a durable queue bound to a topic exchange. Queues without an
+// Exchange are declared unbound, e.g. retry queues.
+type Queue struct {
+	Name       string
+	Exchange   string
+	RoutingKey string
+	Args       amqp.Table
+}
+
+// Client owns one AMQP connection. It redials when the broker goes away,
+// re-declares every exchange and queue it has seen and restarts consumers,
+// so callers never handle a dead connection themselves.
+type Client struct {
+	url string
+
+	mu        sync.Mutex
+	conn      *amqp.Connection
+	idle      []*amqp.Channel
+	exchanges []string
+	queues    []Queue
+	consumers []*consumer
+	dlx       string
+	dlq       string
+
+	done chan struct{}
+}
+
+func URL(host, port, user, password string) string {
+	return fmt.Sprintf("amqp://%s:%s@%s:%s/", user, password, host, port)
+}
+
+func Dial(url string) (*Client, error) {
+	c := &Client{url: url, done: make(chan struct{})}
+
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to RabbitMQ: %w", err)
+	}
+	c.conn = conn
+
+	go c.watch(conn)
+
+	log.Println("RabbitMQ connected")
+	return c, nil
+}
+
+// DeclareExchange declares a durable topic exchange now and after every
+// reconnect.
+func (c *Client) DeclareExchange(name string) error {
+	c.mu.Lock()
+	c.exchanges = append(c.exchanges, name)
+	c.mu.Unlock()
+
+	return c.withChannel(func(ch *amqp.Channel) error {
+		return declareExchange(ch, name)
+	})
+}
+
+// DeclareQueue declares the queue and its exchange binding now and after
+// every reconnect.
+func (c *Client) DeclareQueue(q Queue) error {
+	c.mu.Lock()
+	c.queues = append(c.queues, q)
+	c.mu.Unlock()
+
+	return c.withChannel(func(ch *amqp.Channel) error {
+		return declareQueue(ch, q)
+	})
+}
+
+// Publish sends a persistent JSON message and waits for the broker to
+// confirm it.
+func (c *Client) Publish(ctx context.Context, exchange, routingKey, messageID string, body []byte) error {
+	err := c.publish(ctx, exchange, routingKey, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    messageID,
+		Body:         body,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Published event: %s", routingKey)
+	return nil
+}
+
+// PublishToQueue delivers straight to one queue through the default
+// exchange, so no other subscriber of the original event sees it again.
+func (c *Client) PublishToQueue(ctx context.Context, queue, messageID string, body []byte) error {
+	return c.publish(ctx, "", queue, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    messageID,
+		Body:         body,
+	})
+}
+
+func (c *Client) publish(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	ch, err := c.getChannel()
+	if err != nil {
+		return err
+	}
+
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx, exchange, routingKey, false, false, msg)
+	if err != nil {
+		ch.Close()
+		return fmt.Errorf("failed to publish message: %w", err)
+	}
+
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		ch.Close()
+		return fmt.Errorf("failed to confirm message: %w", err)
+	}
+	c.putChannel(ch)
+
+	if !acked {
+		return fmt.Errorf("broker rejected message %s", msg.MessageId)
+	}
+	return nil
+}
+
+func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return
+	default:
+		close(c.done)
+	}
+
+	for _, ch := range c.idle {
+		ch.Close()
+	}
+	c.idle = nil
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// getChannel hands out a confirm-mode channel for exclusive use. amqp
+// channels are not safe for concurrent publishing, so each publish holds
+// one until putChannel returns it.
+func (c *Client) getChannel() (*amqp.Channel, error) {
+	c.mu.Lock()
+	for len(c.idle) > 0 {
+		ch := c.idle[len(c.idle)-1]
+		c.idle = c.idle[:len(c.idle)-1]
+		if !ch.IsClosed() {
+			c.mu.Unlock()
+			return ch, nil
+		}
+	}
+	conn := c.conn
+	c.mu.Unlock()
+
+	if conn == nil || conn.IsClosed() {
+		return nil, ErrNotConnected
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open channel: %w", err)
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+	return ch, nil
+}
+
+func (c *Client) putChannel(ch *amqp.Channel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ch.IsClosed() || len(c.idle) >= maxIdleChannels {
+		ch.Close()
+		return
+	}
+	c.idle = append(c.idle, ch)
+}
+
+// withChannel runs fn on a short-lived channel, used for declarations.
+func (c *Client) withChannel(fn func(ch *amqp.Channel) error) error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	if conn == nil || conn.IsClosed() {
+		return ErrNotConnected
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open channel: %w", err)
+	}
+	defer ch.Close()
+
+	return fn(ch)
+}
+
+// watch waits for the connection to drop and redials with backoff.
+func (c *Client) watch(conn *amqp.Connection) {
+	for {
+		closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+		select {
+		case <-c.done:
+			return
+		case amqpErr := <-closed:
+			select {
+			case <-c.done:
+				return
+			default:
+			}
+			log.Printf("RabbitMQ connection lost: %v", amqpErr)
+		}
+
+		conn = c.reconnect()
+		if conn == nil {
+			return
+		}
+	}
+}
+
+func (c *Client) reconnect() *amqp.Connection {
+	delay := reconnectBackoff
+	for {
+		select {
+		case <-c.done:
+			return nil
+		case <-time.After(delay):
+		}
+
+		conn, err := amqp.Dial(c.url)
+		if err == nil {
+			if err = c.restore(conn); err == nil {
+				log.Println("RabbitMQ reconnected")
+				return conn
+			}
+			conn.Close()
+		}
+
+		log.Printf("RabbitMQ reconnect failed, retrying in %s: %v", delay, err)
+		delay *= 2
+		if delay > maxReconnectWait {
+			delay = maxReconnectWait
+		}
+	}
+}
+
+// restore re-declares the topology on a fresh connection and resumes the
+// registered consumers.
+func (c *Client) restore(conn *amqp.Connection) error {
+	c.mu.Lock()
+	exchanges := append([]string(nil), c.exchanges...)
+	queues := append([]Queue(nil), c.queues...)
+	consumers := append([]*consumer(nil), c.consumers...)
+	c.mu.Unlock()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open channel: %w", err)
+	}
+	defer ch.Close()
+
+	for _, name := range exchanges {
+		if err := declareExchange(ch, name); err != nil {
+			return err
+		}
+	}
+	for _, q := range queues {
+		if err := declareQueue(ch, q); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	c.conn = conn
+	c.idle = nil
+	c.mu.Unlock()
+
+	for _, cons := range consumers {
+		if err := cons.start(conn); err != nil {
+			log.Printf("Failed to resume consumer on %s: %v", cons.queue, err)
+		}
+	}
+	return nil
+}
+
+func declareExchange(ch *amqp.Channel, name string) error {
+	if err := ch.ExchangeDeclare(name, "topic", true, false, false, false, nil); err != nil {
+		return fmt.Errorf("failed to declare exchange %s: %w", name, err)
+	}
+	return nil
+}
+
+func declareQueue(ch *amqp.Channel, q Queue) error {
+	if _, err := ch.QueueDeclare(q.Name, true, false, false, false, q.Args); err != nil {
+		return fmt.Errorf("failed to declare queue %s: %w", q.Name, err)
+	}
+	if q.Exchange == "" {
+		return nil
+	}
+	if err := declareExchange(ch, q.Exchange); err != nil {
+		return err
+	}
+	if err := ch.QueueBind(q.Name, q.RoutingKey, q.Exchange, false, nil); err != nil {
+		return fmt.Errorf("failed to bind queue %s: %w", q.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// MaxAttempts counts the first delivery; after that many failures the
+	// message goes to the dead-letter exchange.
+	MaxAttempts = 5
+	retryDelay  = 2 * time.Second
+	prefetch    = 10
+
+	HeaderRetryCount   = "x-retry-count"
+	HeaderQueue        = "x-original-queue"
+	HeaderExchange     = "x-original-exchange"
+	HeaderRoutingKey   = "x-original-routing-key"
+	HeaderError        = "x-error"
+	HeaderDeadLettered = "x-dead-lettered-at"
+)
+
+// Handler processes one delivery. The message is acked when it returns
+// nil and retried with backoff otherwise.
+type Handler func(msg amqp.Delivery) error
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks a failure that retrying cannot fix, such as a malformed
+// body. The message is dead-lettered straight away.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+type consumer struct {
+	client  *Client
+	queue   string
+	handler Handler
+}
+
+// DeclareDeadLetters sets up <service>.dlx and the <service>.dead_letters
+// queue behind it. Messages that exhaust their retries on any queue this
+// client consumes are published there. It returns the queue name.
+func (c *Client) DeclareDeadLetters(service string) (string, error) {
+	exchange := service + ".dlx"
+	queue := service + ".dead_letters"
+
+	if err := c.DeclareQueue(Queue{Name: queue, Exchange: exchange, RoutingKey: "#"}); err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	c.dlx = exchange
+	c.dlq = queue
+	c.mu.Unlock()
+	return queue, nil
+}
+
+// Consume starts delivering messages from queue to handler on its own
+// channel and keeps doing so across reconnects. It also declares the retry
+// queues for queue: <queue>.retry.<n> hold a failed message for an
+// exponentially growing TTL and then dead-letter it back onto queue.
+func (c *Client) Consume(queue string, handler Handler) error {
+	for attempt := 1; attempt < MaxAttempts; attempt++ {
+		err := c.DeclareQueue(Queue{
+			Name: retryQueue(queue, attempt),
+			Args: amqp.Table{
+				"x-message-ttl":             int64(backoff(attempt) / time.Millisecond),
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": queue,
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	cons := &consumer{client: c, queue: queue, handler: handler}
+
+	c.mu.Lock()
+	c.consumers = append(c.consumers, cons)
+	conn := c.conn
+	c.mu.Unlock()
+
+	if conn == nil || conn.IsClosed() {
+		// Picked up by restore once the connection is back
+		return ErrNotConnected
+	}
+	if err := cons.start(conn); err != nil {
+		return err
+	}
+
+	log.Printf("Consuming from %s...", queue)
+	return nil
+}
+
+func (cons *consumer) start(conn *amqp.Connection) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open channel: %w", err)
+	}
+	if err := ch.Qos(prefetch, 0, false); err != nil {
+		ch.Close()
+		return fmt.Errorf("failed to set prefetch: %w", err)
+	}
+
+	msgs, err := ch.Consume(cons.queue, "", false, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return fmt.Errorf("failed to consume from %s: %w", cons.queue, err)
+	}
+
+	// The delivery channel closes with the connection; restore starts a
+	// new loop after reconnecting. Unacked messages are redelivered.
+	go func() {
+		for msg := range msgs {
+			cons.deliver(msg)
+		}
+	}()
+	return nil
+}
+
+func (cons *consumer) deliver(msg amqp.Delivery) {
+	err := cons.handler(msg)
+	if err == nil {
+		msg.Ack(false)
+		return
+	}
+
+	attempt := retryCount(msg) + 1
+	log.Printf("Failed to handle message from %s (attempt %d/%d): %v", cons.queue, attempt, MaxAttempts, err)
+
+	if pubErr := cons.fail(msg, attempt, err); pubErr != nil {
+		// Could not park the message anywhere, let the broker redeliver it
+		log.Printf("Failed to schedule retry for message from %s: %v", cons.queue, pubErr)
+		time.Sleep(retryDelay)
+		msg.Nack(false, true)
+		return
+	}
+	msg.Ack(false)
+}
+
+// fail moves a failed message to the next retry queue, or to the
+// dead-letter exchange once it is out of attempts.
+func (cons *consumer) fail(msg amqp.Delivery, attempt int, handlerErr error) error {
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[HeaderRetryCount] = int32(attempt)
+	headers[HeaderError] = handlerErr.Error()
+	if _, ok := headers[HeaderExchange]; !ok {
+		headers[HeaderExchange] = msg.Exchange
+		headers[HeaderRoutingKey] = msg.RoutingKey
+	}
+	headers[HeaderQueue] = cons.queue
+
+	out := amqp.Publishing{
+		Headers:      headers,
+		ContentType:  msg.ContentType,
+		DeliveryMode: amqp.Persistent,
+		MessageId:    msg.MessageId,
+		Body:         msg.Body,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var permanent *permanentError
+	if attempt < MaxAttempts && !errors.As(handlerErr, &permanent) {
+		return cons.client.publish(ctx, "", retryQueue(cons.queue, attempt), out)
+	}
+
+	cons.client.mu.Lock()
+	dlx, dlq := cons.client.dlx, cons.client.dlq
+	cons.client.mu.Unlock()
+	if cons.queue == dlq {
+		// Never dead-letter the dead letters, keep them queued instead
+		return handlerErr
+	}
+	if dlx == "" {
+		log.Printf("Dropping message from %s after %d attempts, no dead-letter exchange", cons.queue, attempt)
+		return nil
+	}
+
+	headers[HeaderDeadLettered] = time.Now().UTC().Format(time.RFC3339)
+	log.Printf("Dead-lettering message from %s after %d attempts", cons.queue, attempt)
+	return cons.client.publish(ctx, dlx, cons.queue, out)
+}
+
+func retryQueue(queue string, attempt int) string {
+	return fmt.Sprintf("%s.retry.%d", queue, attempt)
+}
+
+func backoff(attempt int) time.Duration {
+	return retryDelay << (attempt - 1)
+}
+
+func retryCount(msg amqp.Delivery) int {
+	switch v := msg.Headers[HeaderRetryCount].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
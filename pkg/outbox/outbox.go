@@ -0,0 +1,65 @@
+package outbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hero/microservice/pkg/events"
+	"gorm.io/gorm"
+)
+
+// Message is a domain event waiting in a service's outbox table.
+type Message struct {
+	ID            uuid.UUID       `gorm:"type:uuid;primaryKey"`
+	Exchange      string          `gorm:"type:varchar(100);not null"`
+	RoutingKey    string          `gorm:"type:varchar(100);not null"`
+	Payload       json.RawMessage `gorm:"type:jsonb;not null"`
+	Attempts      int             `gorm:"not null;default:0"`
+	LastError     string          `gorm:"type:text"`
+	NextAttemptAt time.Time       `gorm:"default:now()"`
+	CreatedAt     time.Time       `gorm:"default:now()"`
+	SentAt        *time.Time
+}
+
+// Outbox writes events into <schema>.outbox. Add must be given the same
+// *gorm.DB transaction as the business write so both commit or neither.
+type Outbox struct {
+	table    string
+	exchange string
+	producer string
+}
+
+func New(schema, exchange, producer string) *Outbox {
+	return &Outbox{table: schema + ".outbox", exchange: exchange, producer: producer}
+}
+
+func (o *Outbox) Table() string {
+	return o.table
+}
+
+// Add wraps data in a versioned envelope and stores it. The event type is
+// also the routing key, and the envelope id becomes the message id.
+func (o *Outbox) Add(tx *gorm.DB, eventType string, data interface{}, opts ...events.Option) error {
+	env, err := events.New(eventType, o.producer, data, opts...)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(env)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	msg := Message{
+		ID:         uuid.MustParse(env.ID),
+		Exchange:   o.exchange,
+		RoutingKey: eventType,
+		Payload:    body,
+	}
+	if err := tx.Table(o.table).Omit("SentAt", "NextAttemptAt", "CreatedAt").Create(&msg).Error; err != nil {
+		return fmt.Errorf("failed to store outbox event: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package outbox
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	batchSize    = 100
+	pollInterval = time.Second
+	baseBackoff  = time.Second
+	maxBackoff   = 5 * time.Minute
+	retention    = 7 * 24 * time.Hour
+)
+
+// Publisher delivers a message and returns only once the broker has
+// confirmed it.
+type Publisher interface {
+	Publish(ctx context.Context, exchange, routingKey, messageID string, body []byte) error
+}
+
+// Relay moves committed outbox rows to the broker. Rows are claimed with
+// FOR UPDATE SKIP LOCKED, so several replicas can run a relay safely.
+type Relay struct {
+	db        *gorm.DB
+	box       *Outbox
+	publisher Publisher
+}
+
+func NewRelay(db *gorm.DB, box *Outbox, publisher Publisher) *Relay {
+	return &Relay{db: db, box: box, publisher: publisher}
+}
+
+// Run polls until ctx is cancelled.
+func (r *Relay) Run(ctx context.Context) {
+	log.Printf("Outbox relay started for %s", r.box.Table())
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	lastCleanup := time.Time{}
+	for {
+		// Drain full batches straight away, otherwise wait for the next tick
+		n, err := r.relayBatch(ctx)
+		if err != nil {
+			log.Printf("Outbox relay error: %v", err)
+		}
+
+		if time.Since(lastCleanup) > time.Hour {
+			r.cleanup()
+			lastCleanup = time.Now()
+		}
+
+		if n == batchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Relay) relayBatch(ctx context.Context) (int, error) {
+	var count int
+
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var msgs []Message
+		err := tx.Table(r.box.Table()).
+			Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("sent_at IS NULL AND next_attempt_at <= NOW()").
+			Order("created_at").
+			Limit(batchSize).
+			Find(&msgs).Error
+		if err != nil {
+			return err
+		}
+		count = len(msgs)
+
+		for _, msg := range msgs {
+			pubErr := r.publisher.Publish(ctx, msg.Exchange, msg.RoutingKey, msg.ID.String(), msg.Payload)
+			if pubErr == nil {
+				if err := tx.Table(r.box.Table()).Where("id = ?", msg.ID).
+					Update("sent_at", gorm.Expr("NOW()")).Error; err != nil {
+					return err
+				}
+				continue
+			}
+
+			delay := backoff(msg.Attempts + 1)
+			log.Printf("Failed to relay %s (attempt %d, retry in %s): %v", msg.RoutingKey, msg.Attempts+1, delay, pubErr)
+
+			if err := tx.Table(r.box.Table()).Where("id = ?", msg.ID).Updates(map[string]interface{}{
+				"attempts":        gorm.Expr("attempts + 1"),
+				"last_error":      pubErr.Error(),
+				"next_attempt_at": gorm.Expr("NOW() + make_interval(secs => ?)", delay.Seconds()),
+			}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return count, err
+}
+
+func (r *Relay) cleanup() {
+	err := r.db.Table(r.box.Table()).
+		Where("sent_at < NOW() - make_interval(secs => ?)", retention.Seconds()).
+		Delete(&Message{}).Error
+	if err != nil {
+		log.Printf("Outbox cleanup failed: %v", err)
+	}
+}
+
+func backoff(attempt int) time.Duration {
+	d := baseBackoff << (attempt - 1)
+	if d <= 0 || d > maxBackoff {
+		return maxBackoff
+	}
+	return d
+}
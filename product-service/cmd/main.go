@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 	"github.com/hero/microservice/pkg/cache"
+	"github.com/hero/microservice/pkg/deadletter"
+	"github.com/hero/microservice/pkg/ginauth"
+	"github.com/hero/microservice/pkg/idempotency"
+	"github.com/hero/microservice/pkg/identity"
+	"github.com/hero/microservice/pkg/messaging"
+	"github.com/hero/microservice/pkg/outbox"
 	"github.com/hero/microservice/product-service/internal/handler"
 	"github.com/hero/microservice/product-service/internal/rabbitmq"
 	"github.com/hero/microservice/product-service/internal/repository"
@@ -33,29 +40,31 @@ func main() {
 	}
 	log.Println("Database connected")
 
-	// RabbitMQ publisher
-	publisher, err := rabbitmq.NewPublisher(
+	// RabbitMQ
+	mq, err := messaging.Dial(messaging.URL(
 		getEnv("RABBITMQ_HOST", "localhost"),
 		getEnv("RABBITMQ_PORT", "5672"),
 		getEnv("RABBITMQ_USER", "guest"),
 		getEnv("RABBITMQ_PASSWORD", "guest"),
-	)
+	))
 	if err != nil {
 		log.Fatal("Failed to connect to RabbitMQ: ", err)
 	}
-	defer publisher.Close()
+	defer mq.Close()
 
-	// RabbitMQ consumer
-	consumer, err := rabbitmq.NewConsumer(
-		getEnv("RABBITMQ_HOST", "localhost"),
-		getEnv("RABBITMQ_PORT", "5672"),
-		getEnv("RABBITMQ_USER", "guest"),
-		getEnv("RABBITMQ_PASSWORD", "guest"),
-	)
+	// Messages that exhaust their retries are kept in dead_letters for replay
+	deadLetters := deadletter.NewStore(db, getEnv("DB_SCHEMA", "product_schema"))
+	deadLetterQueue, err := mq.DeclareDeadLetters("product")
 	if err != nil {
-		log.Fatal("Failed to connect RabbitMQ consumer: ", err)
+		log.Fatal("Failed to declare dead-letter queue: ", err)
+	}
+	if err := mq.Consume(deadLetterQueue, deadLetters.Record); err != nil {
+		log.Fatal("Failed to start consumer: ", err)
+	}
+
+	if err := mq.DeclareExchange("product.exchange"); err != nil {
+		log.Fatal("Failed to declare RabbitMQ topology: ", err)
 	}
-	defer consumer.Close()
 
 	// Redis
 	rdb, err := cache.NewRedisClient(
@@ -67,24 +76,45 @@ func main() {
 	}
 	defer rdb.Close()
 
+	// Consumed event ids, so redelivered messages are handled once
+	processed := idempotency.NewStore(getEnv("DB_SCHEMA", "product_schema"), rdb)
+	consumer, err := rabbitmq.NewConsumer(mq, processed)
+	if err != nil {
+		log.Fatal("Failed to declare RabbitMQ topology: ", err)
+	}
+
+	// Events are written to the outbox with each change and relayed to RabbitMQ
+	eventOutbox := outbox.New(getEnv("DB_SCHEMA", "product_schema"), "product.exchange", "product-service")
+	go outbox.NewRelay(db, eventOutbox, mq).Run(context.Background())
+
 	// Wire layers
-	productRepo := repository.NewProductRepository(db)
-	productService := service.NewProductService(productRepo, publisher, rdb)
+	productRepo := repository.NewProductRepository(db, eventOutbox, processed)
+	productService := service.NewProductService(productRepo, rdb)
 	productHandler := handler.NewProductHandler(productService)
+	categoryHandler := handler.NewCategoryHandler(service.NewCategoryService(repository.NewCategoryRepository(db)))
 
-	// Start consuming order.created events
-	consumer.ConsumeOrderCreated(func(productID uuid.UUID, quantity int) error {
-		return productService.DecrementStock(productID, quantity)
-	})
+	// Order saga: reserve stock on order.created, release it on order.cancelled
+	if err := consumer.ConsumeOrderCreated(productService.ReserveStock); err != nil {
+		log.Fatal("Failed to start consumer: ", err)
+	}
+	if err := consumer.ConsumeOrderCancelled(productService.ReleaseStock); err != nil {
+		log.Fatal("Failed to start consumer: ", err)
+	}
 
 	// Gin router
 	r := gin.Default()
 
+	// Trust only the identity asserted and signed by the gateway
+	signer := identity.NewSigner(mustEnv("IDENTITY_SECRET"), time.Minute)
+	r.Use(ginauth.Identity(signer))
+
 	r.GET("/health", func(c *gin.Context) {
 		c.JSON(200, gin.H{"service": "product-service", "status": "running"})
 	})
 
 	productHandler.RegisterRoutes(r)
+	categoryHandler.RegisterRoutes(r)
+	deadletter.NewHandler(deadLetters, mq).RegisterRoutes(r, "product")
 
 	port := getEnv("SERVER_PORT", "8002")
 	log.Printf("Product Service starting on port %s", port)
@@ -99,3 +129,12 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+// mustEnv reads a setting that has no safe default, such as a secret.
+func mustEnv(key string) string {
+	val := os.Getenv(key)
+	if val == "" {
+		log.Fatalf("%s must be set", key)
+	}
+	return val
+}
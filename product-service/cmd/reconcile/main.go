@@ -0,0 +1,86 @@
+// Command reconcile recomputes every variant's stock from the inventory
+// ledger and reports where the stored quantity has drifted from it. It
+// exits with status 1 when drift is found, unless -fix reset the
+// quantities to the ledger.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/hero/microservice/pkg/cache"
+	"github.com/hero/microservice/pkg/idempotency"
+	"github.com/hero/microservice/pkg/outbox"
+	"github.com/hero/microservice/product-service/internal/repository"
+	"github.com/hero/microservice/product-service/internal/service"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func main() {
+	fix := flag.Bool("fix", false, "reset drifted quantities to the ledger")
+	flag.Parse()
+
+	dsn := fmt.Sprintf(
+		"host=%s port=%s user=%s password=%s dbname=%s search_path=%s sslmode=disable",
+		getEnv("DB_HOST", "localhost"),
+		getEnv("DB_PORT", "5432"),
+		getEnv("DB_USER", "svc_product"),
+		getEnv("DB_PASSWORD", "svc_product_pass"),
+		getEnv("DB_NAME", "microservice_db"),
+		getEnv("DB_SCHEMA", "product_schema"),
+	)
+
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Warn)})
+	if err != nil {
+		log.Fatal("Failed to connect to database: ", err)
+	}
+
+	// Fixes invalidate cached products like the service does
+	rdb, err := cache.NewRedisClient(
+		getEnv("REDIS_HOST", "localhost"),
+		getEnv("REDIS_PORT", "6379"),
+	)
+	if err != nil {
+		log.Fatal("Failed to connect to Redis: ", err)
+	}
+	defer rdb.Close()
+
+	// Events from fixes go through the outbox the running service relays
+	schema := getEnv("DB_SCHEMA", "product_schema")
+	repo := repository.NewProductRepository(db, outbox.New(schema, "product.exchange", "product-service"), idempotency.NewStore(schema, rdb))
+	drift, err := service.NewProductService(repo, rdb).ReconcileStock(*fix)
+	if len(drift) > 0 {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "PRODUCT\tVARIANT\tSKU\tQUANTITY\tLEDGER\tDRIFT")
+		for _, d := range drift {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%+d\n",
+				d.ProductID, d.VariantID, d.SKU, d.Quantity, d.LedgerQuantity, d.Quantity-d.LedgerQuantity)
+		}
+		w.Flush()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch {
+	case len(drift) == 0:
+		log.Println("Stock matches the ledger")
+	case *fix:
+		log.Printf("Reset %d variants to the ledger", len(drift))
+	default:
+		log.Printf("%d variants have drifted from the ledger; run with -fix to reset them", len(drift))
+		os.Exit(1)
+	}
+}
+
+func getEnv(key, fallback string) string {
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+	return fallback
+}
@@ -0,0 +1,337 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hero/microservice/product-service/internal/model"
+	"github.com/hero/microservice/product-service/internal/service"
+)
+
+const (
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+
+	// maxNDJSONLine bounds one JSON Lines row
+	maxNDJSONLine = 1 << 20
+)
+
+// catalogFormat picks CSV or JSON Lines from the format query parameter,
+// else from contentType.
+func catalogFormat(c *gin.Context, contentType string) (string, bool) {
+	if format := c.Query("format"); format != "" {
+		return format, format == formatCSV || format == formatNDJSON
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/csv":
+		return formatCSV, true
+	case "application/x-ndjson", "application/jsonl", "application/json-lines":
+		return formatNDJSON, true
+	}
+	return "", false
+}
+
+// ImportProducts upserts products and variants by SKU from a CSV or JSON
+// Lines body, read row by row. The format comes from the format query
+// parameter or the Content-Type. With dry_run=true every row is applied
+// and rolled back, so the response shows what the import would do.
+//
+// CSV files start with a header naming any of model.CatalogColumns; sku is
+// required and options is a JSON object. Cells the export escaped against
+// formula injection are unescaped.
+func (h *ProductHandler) ImportProducts(c *gin.Context) {
+	format, ok := catalogFormat(c, c.ContentType())
+	if !ok {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "body must be text/csv or application/x-ndjson"})
+		return
+	}
+	dryRun := false
+	if v := c.Query("dry_run"); v != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "dry_run must be true or false"})
+			return
+		}
+	}
+
+	next := ndjsonRows(c.Request.Body)
+	if format == formatCSV {
+		var err error
+		if next, err = csvRows(c.Request.Body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	result, err := h.service.ImportCatalog(next, dryRun, h.actor(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "import": result})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"import": result})
+}
+
+// ExportProducts streams every product that is not archived with its
+// variants and stock, one row per variant, as CSV (the default) or JSON
+// Lines. The output can be edited and imported again. CSV cells starting
+// with = + - or @ get a leading quote so spreadsheets do not evaluate them.
+func (h *ProductHandler) ExportProducts(c *gin.Context) {
+	format := c.DefaultQuery("format", formatCSV)
+	out := bufio.NewWriter(c.Writer)
+
+	var write func(model.CatalogRow) error
+	var flush func() error
+	switch format {
+	case formatCSV:
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		w := csv.NewWriter(out)
+		write = func(row model.CatalogRow) error {
+			if err := w.Write(csvRecord(row)); err != nil {
+				return err
+			}
+			return w.Error()
+		}
+		flush = func() error {
+			w.Flush()
+			if err := w.Error(); err != nil {
+				return err
+			}
+			return out.Flush()
+		}
+		_ = w.Write(model.CatalogColumns)
+	case formatNDJSON:
+		c.Header("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(out)
+		write = func(row model.CatalogRow) error {
+			return enc.Encode(row)
+		}
+		flush = out.Flush
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or ndjson"})
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="products.%s"`, format))
+	c.Status(http.StatusOK)
+
+	// The status goes out with the first rows, so a failure can only cut the
+	// export short
+	err := h.service.ExportCatalog(write)
+	if flushErr := flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		_ = c.Error(err)
+	}
+}
+
+// csvRows reads the header of a CSV import and returns a reader for the
+// rows after it.
+func csvRows(body io.Reader) (service.CatalogRowReader, error) {
+	r := csv.NewReader(body)
+	r.TrimLeadingSpace = true
+
+	header, err := r.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New("csv file is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid csv header: %w", err)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if !knownColumn(name) {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+		if _, dup := columns[name]; dup {
+			return nil, fmt.Errorf("duplicate column %q", name)
+		}
+		columns[name] = i
+	}
+	if _, ok := columns["sku"]; !ok {
+		return nil, errors.New("csv header must include sku")
+	}
+
+	return func() (model.CatalogRow, int, error) {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return model.CatalogRow{}, 0, io.EOF
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return model.CatalogRow{}, parseErr.StartLine, &service.RowError{Line: parseErr.StartLine, Message: parseErr.Err.Error()}
+		}
+		if err != nil {
+			return model.CatalogRow{}, 0, err
+		}
+
+		line, _ := r.FieldPos(0)
+		cell := func(name string) string {
+			if i, ok := columns[name]; ok {
+				return unescapeCell(strings.TrimSpace(record[i]))
+			}
+			return ""
+		}
+		row, err := parseCSVRow(cell)
+		if err != nil {
+			return row, line, &service.RowError{Line: line, SKU: row.SKU, Message: err.Error()}
+		}
+		return row, line, nil
+	}, nil
+}
+
+func knownColumn(name string) bool {
+	for _, column := range model.CatalogColumns {
+		if column == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCSVRow converts the cells of a CSV record; blank cells stay nil.
+func parseCSVRow(cell func(string) string) (model.CatalogRow, error) {
+	row := model.CatalogRow{SKU: cell("sku"), ParentSKU: cell("parent_sku")}
+	if v := cell("name"); v != "" {
+		row.Name = &v
+	}
+	if v := cell("description"); v != "" {
+		row.Description = &v
+	}
+	if v := cell("status"); v != "" {
+		row.Status = &v
+	}
+
+	var err error
+	if row.Price, err = parseCell(cell("price"), "price", parseFloat); err != nil {
+		return row, err
+	}
+	if row.VariantPrice, err = parseCell(cell("variant_price"), "variant_price", parseFloat); err != nil {
+		return row, err
+	}
+	if row.CategoryID, err = parseCell(cell("category_id"), "category_id", strconv.Atoi); err != nil {
+		return row, err
+	}
+	if row.Quantity, err = parseCell(cell("quantity"), "quantity", strconv.Atoi); err != nil {
+		return row, err
+	}
+	if v := cell("options"); v != "" {
+		if err := json.Unmarshal([]byte(v), &row.Options); err != nil {
+			return row, errors.New(`options must be a JSON object of strings, e.g. {"size": "M"}`)
+		}
+	}
+	return row, nil
+}
+
+func parseFloat(s string) (float64, error) {
+	return strconv.ParseFloat(s, 64)
+}
+
+func parseCell[T any](v, name string, parse func(string) (T, error)) (*T, error) {
+	if v == "" {
+		return nil, nil
+	}
+	parsed, err := parse(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return &parsed, nil
+}
+
+// ndjsonRows reads one JSON object per line; blank lines are skipped.
+func ndjsonRows(body io.Reader) service.CatalogRowReader {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxNDJSONLine)
+	line := 0
+
+	return func() (model.CatalogRow, int, error) {
+		for scanner.Scan() {
+			line++
+			data := bytes.TrimSpace(scanner.Bytes())
+			if len(data) == 0 {
+				continue
+			}
+
+			var row model.CatalogRow
+			dec := json.NewDecoder(bytes.NewReader(data))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&row); err != nil {
+				return row, line, &service.RowError{Line: line, Message: "invalid JSON: " + err.Error()}
+			}
+			return row, line, nil
+		}
+		if err := scanner.Err(); err != nil {
+			return model.CatalogRow{}, line, fmt.Errorf("failed to read line %d: %w", line+1, err)
+		}
+		return model.CatalogRow{}, line, io.EOF
+	}
+}
+
+// csvRecord writes a row in model.CatalogColumns order.
+func csvRecord(row model.CatalogRow) []string {
+	str := func(v *string) string {
+		if v == nil {
+			return ""
+		}
+		return escapeCell(*v)
+	}
+	num := func(v *float64) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*v, 'f', -1, 64)
+	}
+	integer := func(v *int) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.Itoa(*v)
+	}
+	options := ""
+	if len(row.Options) > 0 {
+		data, _ := json.Marshal(row.Options)
+		options = string(data)
+	}
+
+	return []string{
+		escapeCell(row.SKU), escapeCell(row.ParentSKU), str(row.Name), str(row.Description), num(row.Price),
+		integer(row.CategoryID), str(row.Status), options, num(row.VariantPrice), integer(row.Quantity),
+	}
+}
+
+// formulaCell reports whether spreadsheets would run v as a formula once
+// any quotes escaping it are removed.
+func formulaCell(v string) bool {
+	v = strings.TrimLeft(v, "'")
+	return v != "" && strings.ContainsRune("=+-@", rune(v[0]))
+}
+
+// escapeCell prefixes cells a spreadsheet would evaluate with a quote, so an
+// exported name like =HYPERLINK(...) opens as text.
+func escapeCell(v string) string {
+	if formulaCell(v) {
+		return "'" + v
+	}
+	return v
+}
+
+// unescapeCell undoes escapeCell on import.
+func unescapeCell(v string) string {
+	if strings.HasPrefix(v, "'") && formulaCell(v) {
+		return v[1:]
+	}
+	return v
+}
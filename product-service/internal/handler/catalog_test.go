@@ -0,0 +1,194 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/hero/microservice/product-service/internal/model"
+	"github.com/hero/microservice/product-service/internal/service"
+)
+
+func TestEscapeCell(t *testing.T) {
+	tests := []struct {
+		value, escaped string
+	}{
+		{"=HYPERLINK(\"http://x\")", "'=HYPERLINK(\"http://x\")"},
+		{"+1", "'+1"},
+		{"-SKU", "'-SKU"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"'=already quoted", "''=already quoted"},
+		{"'Tis the season", "'Tis the season"},
+		{"Shirt", "Shirt"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := escapeCell(tt.value); got != tt.escaped {
+			t.Errorf("escapeCell(%q) = %q, want %q", tt.value, got, tt.escaped)
+		}
+		if got := unescapeCell(tt.escaped); got != tt.value {
+			t.Errorf("unescapeCell(%q) = %q, want %q", tt.escaped, got, tt.value)
+		}
+	}
+}
+
+func TestCSVRecordEscapesText(t *testing.T) {
+	name, price, quantity := "=cmd|' /C calc'!A0", 9.5, 3
+	record := csvRecord(model.CatalogRow{SKU: "@SKU", ParentSKU: "-P", Name: &name, Price: &price, Quantity: &quantity})
+
+	want := []string{"'@SKU", "'-P", "'" + name, "", "9.5", "", "", "", "", "3"}
+	for i := range want {
+		if record[i] != want[i] {
+			t.Errorf("%s = %q, want %q", model.CatalogColumns[i], record[i], want[i])
+		}
+	}
+}
+
+// readAll drains next, returning the rows and the errors in order.
+func readAll(t *testing.T, next service.CatalogRowReader) ([]model.CatalogRow, []error) {
+	t.Helper()
+	var rows []model.CatalogRow
+	var errs []error
+	for i := 0; i < 100; i++ {
+		row, _, err := next()
+		if errors.Is(err, io.EOF) {
+			return rows, errs
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		rows = append(rows, row)
+	}
+	t.Fatal("reader never returned io.EOF")
+	return nil, nil
+}
+
+func TestCSVRowsHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		ok   bool
+	}{
+		{"sku only", "sku\nA\n", true},
+		{"any order and case", "Quantity, SKU ,name\n1,A,Shirt\n", true},
+		{"byte order mark", "\ufeffsku,name\nA,Shirt\n", true},
+		{"empty", "", false},
+		{"no sku", "name,price\nShirt,1\n", false},
+		{"unknown column", "sku,colour\nA,red\n", false},
+		{"duplicate column", "sku,name,Name\nA,B,C\n", false},
+	}
+	for _, tt := range tests {
+		next, err := csvRows(strings.NewReader(tt.body))
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: csvRows = %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if tt.ok {
+			if rows, errs := readAll(t, next); len(rows) != 1 || rows[0].SKU != "A" || len(errs) != 0 {
+				t.Errorf("%s: rows = %+v, errors = %v", tt.name, rows, errs)
+			}
+		}
+	}
+}
+
+func TestCSVRowsReportsBadRows(t *testing.T) {
+	body := "sku,name,price,quantity,options\n" +
+		"A,Shirt,9.5,3,\"{\"\"size\"\": \"\"M\"\"}\"\n" +
+		"B,Hat\n" +
+		"C,Cap,cheap,1,\n" +
+		"'=D,Scarf,,,\n"
+	next, err := csvRows(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []int
+	var rows []model.CatalogRow
+	for {
+		row, line, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var rowErr *service.RowError
+		if err != nil && !errors.As(err, &rowErr) {
+			t.Fatalf("line %d: %v, want a *service.RowError", line, err)
+		}
+		if err != nil {
+			lines = append(lines, rowErr.Line)
+			continue
+		}
+		rows = append(rows, row)
+	}
+
+	// B has too few fields and C an invalid price; the rest goes on
+	if len(lines) != 2 || lines[0] != 3 || lines[1] != 4 {
+		t.Errorf("rejected lines = %v, want [3 4]", lines)
+	}
+	if len(rows) != 2 || rows[0].Options["size"] != "M" || *rows[0].Quantity != 3 || rows[1].SKU != "=D" {
+		t.Errorf("rows = %+v", rows)
+	}
+}
+
+func TestParseCSVRow(t *testing.T) {
+	cells := func(values map[string]string) func(string) string {
+		return func(name string) string { return values[name] }
+	}
+
+	row, err := parseCSVRow(cells(map[string]string{
+		"sku": "A", "parent_sku": "P", "name": "Shirt", "price": "9.5", "category_id": "2",
+		"status": "draft", "options": `{"size":"M"}`, "variant_price": "0", "quantity": "4",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row.SKU != "A" || row.ParentSKU != "P" || *row.Name != "Shirt" || *row.Price != 9.5 || *row.CategoryID != 2 ||
+		*row.Status != "draft" || row.Options["size"] != "M" || *row.VariantPrice != 0 || *row.Quantity != 4 {
+		t.Errorf("row = %+v", row)
+	}
+
+	blank, err := parseCSVRow(cells(map[string]string{"sku": "A"}))
+	if err != nil || blank.Name != nil || blank.Price != nil || blank.Quantity != nil || blank.Options != nil {
+		t.Errorf("blank cells = %+v, %v, want nil fields", blank, err)
+	}
+
+	for column, value := range map[string]string{
+		"price": "free", "variant_price": "1,5", "category_id": "2.5", "quantity": "many", "options": `["M"]`,
+	} {
+		if _, err := parseCSVRow(cells(map[string]string{"sku": "A", column: value})); err == nil {
+			t.Errorf("%s %q parsed, want an error", column, value)
+		}
+	}
+}
+
+func TestNDJSONRows(t *testing.T) {
+	body := `{"sku":"A","name":"Shirt","quantity":2}` + "\n" +
+		"\n" +
+		`{"sku":"B","colour":"red"}` + "\n" +
+		`{"sku":` + "\n" +
+		`{"sku":"C","options":{"size":"L"}}`
+	rows, errs := readAll(t, ndjsonRows(strings.NewReader(body)))
+
+	if len(rows) != 2 || rows[0].SKU != "A" || *rows[0].Quantity != 2 || rows[1].Options["size"] != "L" {
+		t.Errorf("rows = %+v", rows)
+	}
+	var rowErr *service.RowError
+	if len(errs) != 2 || !errors.As(errs[0], &rowErr) || rowErr.Line != 3 || !errors.As(errs[1], &rowErr) || rowErr.Line != 4 {
+		t.Errorf("errors = %v, want row errors on lines 3 and 4", errs)
+	}
+}
+
+func TestNDJSONRowsStopsOnOversizeLine(t *testing.T) {
+	body := `{"sku":"A"}` + "\n" + `{"sku":"` + strings.Repeat("x", maxNDJSONLine) + `"}` + "\n"
+	next := ndjsonRows(strings.NewReader(body))
+
+	if row, _, err := next(); err != nil || row.SKU != "A" {
+		t.Fatalf("first row = %+v, %v", row, err)
+	}
+	_, _, err := next()
+	var rowErr *service.RowError
+	if err == nil || errors.Is(err, io.EOF) || errors.As(err, &rowErr) {
+		t.Errorf("oversize line: err = %v, want an error that stops the import", err)
+	}
+}
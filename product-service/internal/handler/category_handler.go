@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hero/microservice/pkg/ginauth"
+	"github.com/hero/microservice/product-service/internal/model"
+	"github.com/hero/microservice/product-service/internal/service"
+)
+
+type CategoryHandler struct {
+	service service.CategoryService
+}
+
+func NewCategoryHandler(service service.CategoryService) *CategoryHandler {
+	return &CategoryHandler{service: service}
+}
+
+func categoryID(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid category id"})
+		return 0, false
+	}
+	return id, true
+}
+
+func (h *CategoryHandler) ListCategories(c *gin.Context) {
+	categories, err := h.service.ListCategories()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"categories": categories})
+}
+
+func (h *CategoryHandler) GetCategory(c *gin.Context) {
+	id, ok := categoryID(c)
+	if !ok {
+		return
+	}
+
+	category, err := h.service.GetCategory(id)
+	if err != nil {
+		h.categoryError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"category": category})
+}
+
+func (h *CategoryHandler) CreateCategory(c *gin.Context) {
+	var input model.CreateCategoryInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	category, err := h.service.CreateCategory(input)
+	if err != nil {
+		h.categoryError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"category": category})
+}
+
+func (h *CategoryHandler) UpdateCategory(c *gin.Context) {
+	id, ok := categoryID(c)
+	if !ok {
+		return
+	}
+
+	var input model.UpdateCategoryInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	category, err := h.service.UpdateCategory(id, input)
+	if err != nil {
+		h.categoryError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"category": category})
+}
+
+func (h *CategoryHandler) DeleteCategory(c *gin.Context) {
+	id, ok := categoryID(c)
+	if !ok {
+		return
+	}
+
+	if err := h.service.DeleteCategory(id); err != nil {
+		h.categoryError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "category deleted"})
+}
+
+func (h *CategoryHandler) categoryError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrCategoryNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrBlankName),
+		errors.Is(err, service.ErrParentNotFound),
+		errors.Is(err, service.ErrCategoryCycle),
+		errors.Is(err, service.ErrInvalidSlug):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrSlugTaken),
+		errors.Is(err, service.ErrNameTaken),
+		errors.Is(err, service.ErrCategoryNotEmpty):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func (h *CategoryHandler) RegisterRoutes(r *gin.Engine) {
+	categories := r.Group("/api/categories")
+	{
+		categories.GET("", h.ListCategories)
+		categories.GET("/:id", h.GetCategory)
+	}
+
+	admin := categories.Group("", ginauth.RequireRole("admin"))
+	{
+		admin.POST("", h.CreateCategory)
+		admin.PUT("/:id", h.UpdateCategory)
+		admin.DELETE("/:id", h.DeleteCategory)
+	}
+}
@@ -1,14 +1,28 @@
 package handler
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/hero/microservice/pkg/ginauth"
 	"github.com/hero/microservice/product-service/internal/model"
 	"github.com/hero/microservice/product-service/internal/service"
 )
 
+const (
+	defaultProductLimit = 20
+	maxProductLimit     = 100
+	maxSearchLen        = 200
+
+	defaultMovementLimit = 50
+	maxMovementLimit     = 200
+)
+
 type ProductHandler struct {
 	service service.ProductService
 }
@@ -17,6 +31,13 @@ func NewProductHandler(service service.ProductService) *ProductHandler {
 	return &ProductHandler{service: service}
 }
 
+// actor is the user id recorded with stock movements; RequireRole on the
+// admin routes guarantees a principal.
+func (h *ProductHandler) actor(c *gin.Context) string {
+	p, _ := ginauth.Principal(c)
+	return p.UserID
+}
+
 func (h *ProductHandler) CreateProduct(c *gin.Context) {
 	var input model.CreateProductInput
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -24,23 +45,140 @@ func (h *ProductHandler) CreateProduct(c *gin.Context) {
 		return
 	}
 
-	product, err := h.service.CreateProduct(input)
+	product, err := h.service.CreateProduct(input, h.actor(c))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		h.productError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusCreated, gin.H{"product": product})
 }
 
+// ListProducts searches the catalog. Query parameters:
+//
+//	q            full-text search over name and description
+//	category_id, min_price, max_price
+//	             prices, and the price sort, are the default variant's
+//	in_stock     true or false
+//	include      "stock" adds each product's quantity
+//	sort         relevance, created_at, price or name, "-" prefix for
+//	             descending; defaults to -relevance with q, else -created_at
+//	limit, cursor
+//
+// When more products follow, the response carries next_cursor and a Link
+// header pointing at the next page.
 func (h *ProductHandler) ListProducts(c *gin.Context) {
-	products, err := h.service.GetAllProducts()
+	query, ok := h.listQuery(c)
+	if !ok {
+		return
+	}
+
+	page, err := h.service.ListProducts(query, c.Query("cursor"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		switch {
+		case errors.Is(err, service.ErrInvalidSort),
+			errors.Is(err, service.ErrSortNeedsTerm),
+			errors.Is(err, service.ErrInvalidCursor):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"products": products})
+	var nextCursor *string
+	if page.NextCursor != "" {
+		nextCursor = &page.NextCursor
+		next := *c.Request.URL
+		params := next.Query()
+		params.Set("cursor", page.NextCursor)
+		next.RawQuery = params.Encode()
+		c.Header("Link", fmt.Sprintf(`<%s>; rel="next"`, next.RequestURI()))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"products":    page.Products,
+		"limit":       query.Limit,
+		"next_cursor": nextCursor,
+	})
+}
+
+// listQuery reads the ListProducts parameters, writing a 400 response and
+// returning false when one is malformed.
+func (h *ProductHandler) listQuery(c *gin.Context) (model.ProductListQuery, bool) {
+	query := model.ProductListQuery{
+		Filter: model.ProductFilter{Search: strings.TrimSpace(c.Query("q"))},
+		Sort:   model.ProductSortCreatedAt,
+		Desc:   true,
+		Limit:  defaultProductLimit,
+	}
+	invalid := func(msg string) (model.ProductListQuery, bool) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return query, false
+	}
+
+	if len(query.Filter.Search) > maxSearchLen {
+		return invalid(fmt.Sprintf("q cannot be longer than %d characters", maxSearchLen))
+	}
+	if query.Filter.Search != "" {
+		query.Sort = model.ProductSortRelevance
+	}
+	if v := c.Query("sort"); v != "" {
+		query.Desc = strings.HasPrefix(v, "-")
+		query.Sort = strings.TrimPrefix(v, "-")
+	}
+
+	if v := c.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxProductLimit {
+			return invalid(fmt.Sprintf("limit must be between 1 and %d", maxProductLimit))
+		}
+		query.Limit = limit
+	}
+
+	if v := c.Query("category_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return invalid("invalid category_id")
+		}
+		query.Filter.CategoryID = &id
+	}
+
+	if v := c.Query("min_price"); v != "" {
+		price, err := strconv.ParseFloat(v, 64)
+		if err != nil || price < 0 {
+			return invalid("min_price must be a non-negative number")
+		}
+		query.Filter.MinPrice = &price
+	}
+	if v := c.Query("max_price"); v != "" {
+		price, err := strconv.ParseFloat(v, 64)
+		if err != nil || price < 0 {
+			return invalid("max_price must be a non-negative number")
+		}
+		query.Filter.MaxPrice = &price
+	}
+	if f := query.Filter; f.MinPrice != nil && f.MaxPrice != nil && *f.MinPrice > *f.MaxPrice {
+		return invalid("min_price cannot exceed max_price")
+	}
+
+	if v := c.Query("in_stock"); v != "" {
+		inStock, err := strconv.ParseBool(v)
+		if err != nil {
+			return invalid("in_stock must be true or false")
+		}
+		query.Filter.InStock = &inStock
+	}
+
+	switch v := c.Query("include"); v {
+	case "":
+	case "stock":
+		query.WithStock = true
+	default:
+		return invalid("include must be stock")
+	}
+
+	return query, true
 }
 
 func (h *ProductHandler) GetProduct(c *gin.Context) {
@@ -59,6 +197,24 @@ func (h *ProductHandler) GetProduct(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"product": product})
 }
 
+// ArchiveProduct is the product DELETE: the product is archived rather
+// than removed, so orders that reference it keep their history.
+func (h *ProductHandler) ArchiveProduct(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid product id"})
+		return
+	}
+
+	product, err := h.service.ArchiveProduct(id)
+	if err != nil {
+		h.productError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"product": product})
+}
+
 func (h *ProductHandler) UpdateProduct(c *gin.Context) {
 	id, err := uuid.Parse(c.Param("id"))
 	if err != nil {
@@ -74,7 +230,7 @@ func (h *ProductHandler) UpdateProduct(c *gin.Context) {
 
 	product, err := h.service.UpdateProduct(id, input)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		h.productError(c, err)
 		return
 	}
 
@@ -94,22 +250,237 @@ func (h *ProductHandler) UpdateStock(c *gin.Context) {
 		return
 	}
 
-	inv, err := h.service.UpdateStock(id, input)
+	inv, err := h.service.UpdateStock(id, input, h.actor(c))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		h.productError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"inventory": inv})
+}
+
+func (h *ProductHandler) ListVariants(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid product id"})
+		return
+	}
+
+	variants, err := h.service.ListVariants(id)
+	if err != nil {
+		h.productError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"variants": variants})
+}
+
+func (h *ProductHandler) CreateVariant(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid product id"})
+		return
+	}
+
+	var input model.CreateVariantInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	variant, err := h.service.CreateVariant(id, input, h.actor(c))
+	if err != nil {
+		h.productError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"variant": variant})
+}
+
+func (h *ProductHandler) UpdateVariant(c *gin.Context) {
+	id, variantID, ok := h.variantParams(c)
+	if !ok {
+		return
+	}
+
+	var input model.UpdateVariantInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	variant, err := h.service.UpdateVariant(id, variantID, input)
+	if err != nil {
+		h.productError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"variant": variant})
+}
+
+func (h *ProductHandler) UpdateVariantStock(c *gin.Context) {
+	id, variantID, ok := h.variantParams(c)
+	if !ok {
+		return
+	}
+
+	var input model.UpdateStockInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	inv, err := h.service.UpdateVariantStock(id, variantID, input, h.actor(c))
+	if err != nil {
+		h.productError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"inventory": inv})
 }
 
+// ListMovements returns the product's stock ledger, newest first. Query
+// parameters:
+//
+//	variant_id   only this variant's movements
+//	reason       restock, order, cancel or adjustment
+//	limit, before
+//
+// When more movements follow, the response carries next_before, the value
+// of before for the next page.
+func (h *ProductHandler) ListMovements(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid product id"})
+		return
+	}
+
+	query := model.MovementQuery{Reason: c.Query("reason"), Limit: defaultMovementLimit}
+	invalid := func(msg string) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+	}
+	if v := c.Query("variant_id"); v != "" {
+		if query.VariantID, err = uuid.Parse(v); err != nil {
+			invalid("invalid variant_id")
+			return
+		}
+	}
+	switch query.Reason {
+	case "", model.MovementRestock, model.MovementOrder, model.MovementCancel, model.MovementAdjustment:
+	default:
+		invalid("reason must be restock, order, cancel or adjustment")
+		return
+	}
+	if v := c.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxMovementLimit {
+			invalid(fmt.Sprintf("limit must be between 1 and %d", maxMovementLimit))
+			return
+		}
+		query.Limit = limit
+	}
+	if v := c.Query("before"); v != "" {
+		if query.Before, err = strconv.ParseInt(v, 10, 64); err != nil || query.Before < 1 {
+			invalid("before must be a movement id")
+			return
+		}
+	}
+
+	page, err := h.service.ListMovements(id, query)
+	if err != nil {
+		h.productError(c, err)
+		return
+	}
+
+	var nextBefore *int64
+	if page.NextBefore != 0 {
+		nextBefore = &page.NextBefore
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"movements":   page.Movements,
+		"limit":       query.Limit,
+		"next_before": nextBefore,
+	})
+}
+
+// variantParams reads the product and variant ids from the path, writing a
+// 400 response and returning false when one is malformed.
+func (h *ProductHandler) variantParams(c *gin.Context) (uuid.UUID, uuid.UUID, bool) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid product id"})
+		return uuid.Nil, uuid.Nil, false
+	}
+	variantID, err := uuid.Parse(c.Param("variantId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid variant id"})
+		return uuid.Nil, uuid.Nil, false
+	}
+	return id, variantID, true
+}
+
+// LookupProducts serves authoritative price and stock for a batch of
+// products to other services. It is not exposed through the gateway.
+func (h *ProductHandler) LookupProducts(c *gin.Context) {
+	var ids []uuid.UUID
+	for _, raw := range strings.Split(c.Query("ids"), ",") {
+		if raw == "" {
+			continue
+		}
+		id, err := uuid.Parse(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid product id: " + raw})
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	products, err := h.service.LookupProducts(ids)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"products": products})
+}
+
+func (h *ProductHandler) productError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrProductNotFound), errors.Is(err, service.ErrVariantNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrCategoryNotFound), errors.Is(err, service.ErrBlankSKU):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrSKUTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
 func (h *ProductHandler) RegisterRoutes(r *gin.Engine) {
 	products := r.Group("/api/products")
 	{
-		products.POST("", h.CreateProduct)
 		products.GET("", h.ListProducts)
 		products.GET("/:id", h.GetProduct)
-		products.PUT("/:id", h.UpdateProduct)
-		products.PUT("/:id/stock", h.UpdateStock)
+		products.GET("/:id/variants", h.ListVariants)
+	}
+
+	admin := products.Group("", ginauth.RequireRole("admin"))
+	{
+		admin.POST("", h.CreateProduct)
+		admin.POST("/import", h.ImportProducts)
+		admin.GET("/export", h.ExportProducts)
+		admin.PUT("/:id", h.UpdateProduct)
+		admin.PUT("/:id/stock", h.UpdateStock)
+		admin.DELETE("/:id", h.ArchiveProduct)
+		admin.POST("/:id/variants", h.CreateVariant)
+		admin.PUT("/:id/variants/:variantId", h.UpdateVariant)
+		admin.PUT("/:id/variants/:variantId/stock", h.UpdateVariantStock)
+		admin.GET("/:id/movements", h.ListMovements)
+	}
+
+	internal := r.Group("/internal/products")
+	{
+		internal.GET("", h.LookupProducts)
 	}
 }
@@ -0,0 +1,24 @@
+package model
+
+// CatalogRow is one variant in a catalog import or export, together with
+// the fields of its product. Rows are matched by SKU: an unknown SKU is a
+// new product, or a new variant of the product whose variant has
+// ParentSKU. Fields left nil keep their current value.
+type CatalogRow struct {
+	SKU          string         `json:"sku"`
+	ParentSKU    string         `json:"parent_sku,omitempty"`
+	Name         *string        `json:"name,omitempty"`
+	Description  *string        `json:"description,omitempty"`
+	Price        *float64       `json:"price,omitempty"`
+	CategoryID   *int           `json:"category_id,omitempty"`
+	Status       *string        `json:"status,omitempty"`
+	Options      VariantOptions `json:"options,omitempty"`
+	VariantPrice *float64       `json:"variant_price,omitempty"`
+	Quantity     *int           `json:"quantity,omitempty"`
+}
+
+// CatalogColumns are the CSV columns of a CatalogRow, in export order.
+var CatalogColumns = []string{
+	"sku", "parent_sku", "name", "description", "price", "category_id",
+	"status", "options", "variant_price", "quantity",
+}
@@ -0,0 +1,65 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Reasons for a change of stock.
+const (
+	MovementRestock    = "restock"
+	MovementOrder      = "order"
+	MovementCancel     = "cancel"
+	MovementAdjustment = "adjustment"
+)
+
+// ActorSystem records changes made by the service itself, such as
+// reservations for orders.
+const ActorSystem = "system"
+
+// InventoryMovement is one entry of the append-only stock ledger, written
+// in the same transaction as the change. A variant's deltas add up to its
+// quantity. ReferenceID names the order or other cause of the change and
+// Actor the user who made it.
+type InventoryMovement struct {
+	ID            int64     `gorm:"primaryKey" json:"id"`
+	ProductID     uuid.UUID `gorm:"type:uuid;not null" json:"product_id"`
+	VariantID     uuid.UUID `gorm:"type:uuid;not null" json:"variant_id"`
+	Delta         int       `gorm:"not null" json:"delta"`
+	QuantityAfter int       `gorm:"not null" json:"quantity_after"`
+	Reason        string    `gorm:"type:varchar(20);not null" json:"reason"`
+	ReferenceID   string    `gorm:"type:varchar(100);not null;default:''" json:"reference_id,omitempty"`
+	Actor         string    `gorm:"type:varchar(100);not null" json:"actor"`
+	CreatedAt     time.Time `gorm:"default:now()" json:"created_at"`
+}
+
+func (InventoryMovement) TableName() string {
+	return "product_schema.inventory_movements"
+}
+
+// StockChange says why and by whom stock is changed.
+type StockChange struct {
+	Reason      string
+	ReferenceID string
+	Actor       string
+}
+
+// MovementQuery selects a product's movements, newest first. Zero fields
+// match all; Before is the id the page starts below.
+type MovementQuery struct {
+	VariantID uuid.UUID
+	Reason    string
+	Before    int64
+	Limit     int
+}
+
+// StockDrift is a variant whose stored quantity differs from the sum of
+// its ledger.
+type StockDrift struct {
+	ProductID      uuid.UUID `json:"product_id"`
+	VariantID      uuid.UUID `json:"variant_id"`
+	SKU            string    `json:"sku"`
+	Quantity       int       `json:"quantity"`
+	LedgerQuantity int       `json:"ledger_quantity"`
+}
@@ -1,38 +1,118 @@
 package model
 
 import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// Category is a node in the category tree. Top-level categories have no
+// ParentID. Slug is unique across the whole tree.
 type Category struct {
-	ID   int    `gorm:"primaryKey" json:"id"`
-	Name string `gorm:"type:varchar(100);uniqueIndex;not null" json:"name"`
+	ID        int       `gorm:"primaryKey" json:"id"`
+	Name      string    `gorm:"type:varchar(100);not null" json:"name"`
+	Slug      string    `gorm:"type:varchar(120);uniqueIndex;not null" json:"slug"`
+	ParentID  *int      `json:"parent_id"`
+	CreatedAt time.Time `gorm:"default:now()" json:"created_at"`
+	UpdatedAt time.Time `gorm:"default:now()" json:"updated_at"`
 }
 
 func (Category) TableName() string {
 	return "product_schema.categories"
 }
 
+// Only active products are listed and can be ordered. Drafts are not yet
+// on sale; archived products are discontinued but kept for order history.
+const (
+	ProductStatusActive   = "active"
+	ProductStatusDraft    = "draft"
+	ProductStatusArchived = "archived"
+)
+
 type Product struct {
-	ID          uuid.UUID `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
-	Name        string    `gorm:"type:varchar(200);not null" json:"name"`
-	Description string    `gorm:"type:text" json:"description"`
-	Price       float64   `gorm:"type:decimal(10,2);not null" json:"price"`
-	CategoryID  *int      `gorm:"index" json:"category_id"`
-	Category    *Category `gorm:"foreignKey:CategoryID" json:"category,omitempty"`
-	CreatedAt   time.Time `gorm:"default:now()" json:"created_at"`
-	UpdatedAt   time.Time `gorm:"default:now()" json:"updated_at"`
+	ID          uuid.UUID  `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
+	Name        string     `gorm:"type:varchar(200);not null" json:"name"`
+	Description string     `gorm:"type:text" json:"description"`
+	Price       float64    `gorm:"type:decimal(10,2);not null" json:"price"`
+	CategoryID  *int       `gorm:"index" json:"category_id"`
+	Category    *Category  `gorm:"foreignKey:CategoryID" json:"category,omitempty"`
+	Status      string     `gorm:"type:varchar(20);not null;default:'active'" json:"status"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+	CreatedAt   time.Time  `gorm:"default:now()" json:"created_at"`
+	UpdatedAt   time.Time  `gorm:"default:now()" json:"updated_at"`
+
+	Variants []ProductVariant `gorm:"foreignKey:ProductID" json:"variants,omitempty"`
 }
 
 func (Product) TableName() string {
 	return "product_schema.products"
 }
 
+// VariantOptions are the attributes that tell a product's variants apart,
+// e.g. {"size": "M", "color": "red"}. Stored as JSONB.
+type VariantOptions map[string]string
+
+func (o VariantOptions) Value() (driver.Value, error) {
+	if o == nil {
+		return "{}", nil
+	}
+	data, err := json.Marshal(o)
+	return string(data), err
+}
+
+func (o *VariantOptions) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	case nil:
+		*o = VariantOptions{}
+		return nil
+	default:
+		return errors.New("unsupported type for variant options")
+	}
+	return json.Unmarshal(data, o)
+}
+
+// ProductVariant is one purchasable version of a product with its own SKU
+// and inventory. Every product has exactly one default variant, used when
+// an order or cart does not name one. Price overrides the product's price
+// when set.
+type ProductVariant struct {
+	ID        uuid.UUID      `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
+	ProductID uuid.UUID      `gorm:"type:uuid;not null" json:"product_id"`
+	SKU       string         `gorm:"column:sku;type:varchar(64);uniqueIndex;not null" json:"sku"`
+	Options   VariantOptions `gorm:"type:jsonb;not null;default:'{}'" json:"options"`
+	Price     *float64       `gorm:"type:decimal(10,2)" json:"price,omitempty"`
+	IsDefault bool           `gorm:"not null;default:false" json:"is_default"`
+	// Quantity is read from the variant's inventory row
+	Quantity  int       `gorm:"->" json:"quantity"`
+	CreatedAt time.Time `gorm:"default:now()" json:"created_at"`
+	UpdatedAt time.Time `gorm:"default:now()" json:"updated_at"`
+}
+
+func (ProductVariant) TableName() string {
+	return "product_schema.product_variants"
+}
+
+// EffectivePrice is what the variant sells for given its product's price.
+func (v ProductVariant) EffectivePrice(productPrice float64) float64 {
+	if v.Price != nil {
+		return *v.Price
+	}
+	return productPrice
+}
+
+// Inventory is the stock of one variant.
 type Inventory struct {
 	ID        int       `gorm:"primaryKey" json:"id"`
-	ProductID uuid.UUID `gorm:"type:uuid;uniqueIndex" json:"product_id"`
+	ProductID uuid.UUID `gorm:"type:uuid;index" json:"product_id"`
+	VariantID uuid.UUID `gorm:"type:uuid;uniqueIndex" json:"variant_id"`
 	Quantity  int       `gorm:"not null;default:0" json:"quantity"`
 	UpdatedAt time.Time `gorm:"default:now()" json:"updated_at"`
 }
@@ -41,12 +121,68 @@ func (Inventory) TableName() string {
 	return "product_schema.inventory"
 }
 
+const (
+	ReservationReserved = "reserved"
+	ReservationReleased = "released"
+)
+
+// StockReservation records stock held for an order so it can be released
+// exactly once if the order is cancelled.
+type StockReservation struct {
+	ID        int       `gorm:"primaryKey" json:"id"`
+	OrderID   uuid.UUID `gorm:"type:uuid;not null" json:"order_id"`
+	ProductID uuid.UUID `gorm:"type:uuid;not null" json:"product_id"`
+	VariantID uuid.UUID `gorm:"type:uuid;not null" json:"variant_id"`
+	Quantity  int       `gorm:"not null" json:"quantity"`
+	Status    string    `gorm:"type:varchar(20);not null;default:'reserved'" json:"status"`
+	CreatedAt time.Time `gorm:"default:now()" json:"created_at"`
+	UpdatedAt time.Time `gorm:"default:now()" json:"updated_at"`
+}
+
+func (StockReservation) TableName() string {
+	return "product_schema.stock_reservations"
+}
+
+// ReservationItem is one order line to reserve. A nil VariantID means the
+// product's default variant.
+type ReservationItem struct {
+	ProductID uuid.UUID `json:"product_id"`
+	VariantID uuid.UUID `json:"variant_id"`
+	Quantity  int       `json:"quantity"`
+}
+
+// ProductStock is the read model served to other services that need
+// authoritative pricing and availability.
+// Quantity is the total over all variants; each VariantStock carries its
+// own effective price and quantity.
+type ProductStock struct {
+	ID       uuid.UUID      `json:"id"`
+	Name     string         `json:"name"`
+	Price    float64        `json:"price"`
+	Quantity int            `json:"quantity"`
+	Status   string         `json:"status"`
+	Variants []VariantStock `gorm:"-" json:"variants"`
+}
+
+type VariantStock struct {
+	ID        uuid.UUID      `json:"id"`
+	ProductID uuid.UUID      `json:"-"`
+	SKU       string         `gorm:"column:sku" json:"sku"`
+	Options   VariantOptions `json:"options"`
+	Price     float64        `json:"price"`
+	Quantity  int            `json:"quantity"`
+	IsDefault bool           `json:"is_default"`
+}
+
 type CreateProductInput struct {
 	Name        string  `json:"name" binding:"required"`
 	Description string  `json:"description"`
 	Price       float64 `json:"price" binding:"required,gt=0"`
 	CategoryID  *int    `json:"category_id"`
 	Quantity    int     `json:"quantity" binding:"min=0"`
+	Status      string  `json:"status" binding:"omitempty,oneof=active draft"`
+	// SKU of the default variant; generated from the product id if empty
+	SKU string `json:"sku" binding:"omitempty,max=64"`
 }
 
 type UpdateProductInput struct {
@@ -54,8 +190,109 @@ type UpdateProductInput struct {
 	Description string  `json:"description"`
 	Price       float64 `json:"price" binding:"omitempty,gt=0"`
 	CategoryID  *int    `json:"category_id"`
+	// Status active or draft also restores an archived product
+	Status string `json:"status" binding:"omitempty,oneof=active draft"`
 }
 
+// UpdateStockInput sets a variant's quantity. Reason is restock or
+// adjustment, the default; Reference is recorded with the movement, e.g. a
+// purchase order number.
 type UpdateStockInput struct {
-	Quantity int `json:"quantity" binding:"required,min=0"`
+	Quantity  int    `json:"quantity" binding:"required,min=0"`
+	Reason    string `json:"reason" binding:"omitempty,oneof=restock adjustment"`
+	Reference string `json:"reference" binding:"max=100"`
+}
+
+type CreateVariantInput struct {
+	SKU      string         `json:"sku" binding:"required,max=64"`
+	Options  VariantOptions `json:"options"`
+	Price    *float64       `json:"price" binding:"omitempty,gt=0"`
+	Quantity int            `json:"quantity" binding:"min=0"`
+}
+
+// UpdateVariantInput changes only the fields that are set. Price 0 drops
+// the override so the variant sells at the product's price.
+type UpdateVariantInput struct {
+	SKU     string         `json:"sku" binding:"omitempty,max=64"`
+	Options VariantOptions `json:"options"`
+	Price   *float64       `json:"price" binding:"omitempty,gte=0"`
+}
+
+// Orders a product listing can be sorted in. Ties are broken by id.
+// ProductSortRelevance needs a search term.
+const (
+	ProductSortRelevance = "relevance"
+	ProductSortCreatedAt = "created_at"
+	ProductSortPrice     = "price"
+	ProductSortName      = "name"
+)
+
+// ProductFilter narrows a listing of active products; nil and empty fields
+// match all. Search is matched against name and description.
+type ProductFilter struct {
+	Search     string
+	CategoryID *int
+	MinPrice   *float64
+	MaxPrice   *float64
+	InStock    *bool
+}
+
+// ProductCursor is the position of the last product on a page, in the
+// sort the page was listed in. The next page starts after it.
+type ProductCursor struct {
+	Sort      string    `json:"s"`
+	Desc      bool      `json:"d"`
+	Search    string    `json:"q,omitempty"`
+	Rank      float64   `json:"r,omitempty"`
+	CreatedAt time.Time `json:"c"`
+	Price     float64   `json:"p,omitempty"`
+	Name      string    `json:"n,omitempty"`
+	ID        uuid.UUID `json:"id"`
+}
+
+type ProductListQuery struct {
+	Filter    ProductFilter
+	Sort      string
+	Desc      bool
+	Limit     int
+	WithStock bool
+	After     *ProductCursor
+}
+
+// ProductListing is a product as listed in the catalog. EffectivePrice is
+// its default variant's price, which price filters and sorting use.
+// Quantity is set when stock was requested.
+type ProductListing struct {
+	Product
+	EffectivePrice float64 `gorm:"->" json:"effective_price"`
+	Quantity       *int    `gorm:"->" json:"quantity,omitempty"`
+	Rank           float64 `gorm:"->" json:"-"`
+}
+
+// CategoryStats is a category with the number of products filed directly
+// under it and under it or any of its descendants.
+type CategoryStats struct {
+	Category
+	ProductCount      int64 `json:"product_count"`
+	TotalProductCount int64 `json:"total_product_count"`
+}
+
+// CategoryDetail is a category with its direct children.
+type CategoryDetail struct {
+	CategoryStats
+	Children []CategoryStats `json:"children"`
+}
+
+type CreateCategoryInput struct {
+	Name     string `json:"name" binding:"required,max=100"`
+	Slug     string `json:"slug" binding:"omitempty,max=120"`
+	ParentID *int   `json:"parent_id"`
+}
+
+// UpdateCategoryInput changes only the fields that are set. ParentID 0
+// moves the category to the top level.
+type UpdateCategoryInput struct {
+	Name     string `json:"name" binding:"omitempty,max=100"`
+	Slug     string `json:"slug" binding:"omitempty,max=120"`
+	ParentID *int   `json:"parent_id"`
 }
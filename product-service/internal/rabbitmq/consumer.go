@@ -1,114 +1,131 @@
 package rabbitmq
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"log"
 
 	"github.com/google/uuid"
+	"github.com/hero/microservice/pkg/events"
+	"github.com/hero/microservice/pkg/idempotency"
+	"github.com/hero/microservice/pkg/messaging"
+	"github.com/hero/microservice/product-service/internal/model"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-type OrderCreatedData struct {
-	OrderID string `json:"order_id"`
-	UserID  string `json:"user_id"`
-	Items   []struct {
-		ProductID string `json:"product_id"`
-		Quantity  int    `json:"quantity"`
-	} `json:"items"`
-}
-
-type OrderEvent struct {
-	Event string           `json:"event"`
-	Data  OrderCreatedData `json:"data"`
-}
+type ReserveHandler func(eventID, correlationID string, orderID uuid.UUID, items []model.ReservationItem) error
 
-type StockHandler func(productID uuid.UUID, quantity int) error
+type ReleaseHandler func(eventID, correlationID string, orderID uuid.UUID) error
 
 type Consumer struct {
-	conn    *amqp.Connection
-	channel *amqp.Channel
+	mq        *messaging.Client
+	processed *idempotency.Store
 }
 
-func NewConsumer(host, port, user, password string) (*Consumer, error) {
-	url := fmt.Sprintf("amqp://%s:%s@%s:%s/", user, password, host, port)
-
-	conn, err := amqp.Dial(url)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to RabbitMQ: %w", err)
+func NewConsumer(mq *messaging.Client, processed *idempotency.Store) (*Consumer, error) {
+	queues := []messaging.Queue{
+		{Name: "order.created.product", Exchange: "order.exchange", RoutingKey: events.TypeOrderCreated},
+		{Name: "order.cancelled.product", Exchange: "order.exchange", RoutingKey: events.TypeOrderCancelled},
 	}
 
-	ch, err := conn.Channel()
-	if err != nil {
-		conn.Close()
-		return nil, fmt.Errorf("failed to open channel: %w", err)
+	for _, q := range queues {
+		if err := mq.DeclareQueue(q); err != nil {
+			return nil, err
+		}
 	}
 
-	// Declare order exchange (to bind to it)
-	err = ch.ExchangeDeclare("order.exchange", "topic", true, false, false, false, nil)
-	if err != nil {
-		ch.Close()
-		conn.Close()
-		return nil, fmt.Errorf("failed to declare exchange: %w", err)
-	}
+	return &Consumer{mq: mq, processed: processed}, nil
+}
 
-	// Declare queue and bind
-	_, err = ch.QueueDeclare("order.created.product", true, false, false, false, nil)
-	if err != nil {
-		ch.Close()
-		conn.Close()
-		return nil, fmt.Errorf("failed to declare queue: %w", err)
+// once skips events already known as processed and remembers the ones fn
+// handles. The handler's own ClaimEvent is what guarantees exactly once.
+func (c *Consumer) once(env *events.Envelope, fn func() error) error {
+	ctx := context.Background()
+	if c.processed.Seen(ctx, env.ID) {
+		log.Printf("Skipping already processed %s event %s", env.Type, env.ID)
+		return nil
 	}
-
-	err = ch.QueueBind("order.created.product", "order.created", "order.exchange", false, nil)
-	if err != nil {
-		ch.Close()
-		conn.Close()
-		return nil, fmt.Errorf("failed to bind queue: %w", err)
+	if err := fn(); err != nil {
+		return err
 	}
-
-	log.Println("RabbitMQ consumer connected")
-	return &Consumer{conn: conn, channel: ch}, nil
+	c.processed.Remember(ctx, env.ID)
+	return nil
 }
 
-func (c *Consumer) ConsumeOrderCreated(handler StockHandler) {
-	msgs, err := c.channel.Consume("order.created.product", "", true, false, false, false, nil)
+// decode parses the envelope and payload. Malformed messages will never
+// succeed, so they skip the retries.
+func decode(msg amqp.Delivery, v interface{}) (*events.Envelope, error) {
+	env, err := events.Decode(msg.Body)
 	if err != nil {
-		log.Printf("Failed to consume: %v", err)
-		return
+		return nil, messaging.Permanent(err)
+	}
+	if err := env.DecodeData(v); err != nil {
+		return nil, messaging.Permanent(err)
 	}
+	return env, nil
+}
 
-	go func() {
-		for msg := range msgs {
-			var event OrderEvent
-			if err := json.Unmarshal(msg.Body, &event); err != nil {
-				log.Printf("Failed to unmarshal order event: %v", err)
-				continue
-			}
+func (c *Consumer) ConsumeOrderCreated(handler ReserveHandler) error {
+	return c.mq.Consume("order.created.product", func(msg amqp.Delivery) error {
+		var data events.OrderCreated
+		env, err := decode(msg, &data)
+		if err != nil {
+			return err
+		}
 
-			log.Printf("Received order.created: order_id=%s", event.Data.OrderID)
+		log.Printf("Received order.created: order_id=%s", data.OrderID)
+
+		orderID, err := uuid.Parse(data.OrderID)
+		if err != nil {
+			return messaging.Permanent(fmt.Errorf("invalid order_id: %s", data.OrderID))
+		}
 
-			for _, item := range event.Data.Items {
-				productID, err := uuid.Parse(item.ProductID)
-				if err != nil {
-					log.Printf("Invalid product_id: %s", item.ProductID)
+		items := make([]model.ReservationItem, 0, len(data.Items))
+		for _, item := range data.Items {
+			productID, err := uuid.Parse(item.ProductID)
+			if err != nil {
+				log.Printf("Invalid product_id: %s", item.ProductID)
+				continue
+			}
+			reservation := model.ReservationItem{ProductID: productID, Quantity: item.Quantity}
+			if item.VariantID != "" {
+				if reservation.VariantID, err = uuid.Parse(item.VariantID); err != nil {
+					log.Printf("Invalid variant_id: %s", item.VariantID)
 					continue
 				}
-				if err := handler(productID, item.Quantity); err != nil {
-					log.Printf("Failed to decrement stock for product %s: %v", item.ProductID, err)
-				}
 			}
+			items = append(items, reservation)
 		}
-	}()
 
-	log.Println("Consuming order.created events...")
+		return c.once(env, func() error {
+			if err := handler(env.ID, env.CorrelationID, orderID, items); err != nil {
+				return fmt.Errorf("failed to reserve stock for order %s: %w", data.OrderID, err)
+			}
+			return nil
+		})
+	})
 }
 
-func (c *Consumer) Close() {
-	if c.channel != nil {
-		c.channel.Close()
-	}
-	if c.conn != nil {
-		c.conn.Close()
-	}
+func (c *Consumer) ConsumeOrderCancelled(handler ReleaseHandler) error {
+	return c.mq.Consume("order.cancelled.product", func(msg amqp.Delivery) error {
+		var data events.OrderCancelled
+		env, err := decode(msg, &data)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Received order.cancelled: order_id=%s", data.OrderID)
+
+		orderID, err := uuid.Parse(data.OrderID)
+		if err != nil {
+			return messaging.Permanent(fmt.Errorf("invalid order_id: %s", data.OrderID))
+		}
+
+		return c.once(env, func() error {
+			if err := handler(env.ID, env.CorrelationID, orderID); err != nil {
+				return fmt.Errorf("failed to release stock for order %s: %w", data.OrderID, err)
+			}
+			return nil
+		})
+	})
 }
@@ -0,0 +1,130 @@
+package repository
+
+import (
+	"github.com/hero/microservice/product-service/internal/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type CategoryRepository interface {
+	Create(category *model.Category) error
+	GetByID(id int) (*model.Category, error)
+	LockByID(id int) (*model.Category, error)
+	GetAll() ([]model.Category, error)
+	SlugTaken(slug string, exceptID int) (bool, error)
+	NameTaken(parentID *int, name string, exceptID int) (bool, error)
+	Update(category *model.Category) error
+	Delete(id int) error
+	CountProducts() (map[int]int64, error)
+	CountChildren(id int) (int64, error)
+	LockTree() error
+	Transaction(fn func(repo CategoryRepository) error) error
+}
+
+type categoryRepository struct {
+	db *gorm.DB
+}
+
+func NewCategoryRepository(db *gorm.DB) CategoryRepository {
+	return &categoryRepository{db: db}
+}
+
+func (r *categoryRepository) Create(category *model.Category) error {
+	return r.db.Create(category).Error
+}
+
+func (r *categoryRepository) GetByID(id int) (*model.Category, error) {
+	var category model.Category
+	if err := r.db.Where("id = ?", id).First(&category).Error; err != nil {
+		return nil, err
+	}
+	return &category, nil
+}
+
+// LockByID loads the category and locks it until the surrounding
+// transaction ends. Product writes that file a product under it wait.
+func (r *categoryRepository) LockByID(id int) (*model.Category, error) {
+	var category model.Category
+	err := r.db.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", id).First(&category).Error
+	if err != nil {
+		return nil, err
+	}
+	return &category, nil
+}
+
+func (r *categoryRepository) GetAll() ([]model.Category, error) {
+	categories := []model.Category{}
+	err := r.db.Order("name, id").Find(&categories).Error
+	return categories, err
+}
+
+func (r *categoryRepository) SlugTaken(slug string, exceptID int) (bool, error) {
+	var count int64
+	err := r.db.Model(&model.Category{}).Where("slug = ? AND id <> ?", slug, exceptID).Count(&count).Error
+	return count > 0, err
+}
+
+// NameTaken reports whether a category other than exceptID under parentID
+// is called name; a nil parentID means the top level.
+func (r *categoryRepository) NameTaken(parentID *int, name string, exceptID int) (bool, error) {
+	var count int64
+	err := r.db.Model(&model.Category{}).
+		Where("parent_id IS NOT DISTINCT FROM ? AND name = ? AND id <> ?", parentID, name, exceptID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+func (r *categoryRepository) Update(category *model.Category) error {
+	return r.db.Model(category).Clauses(clause.Returning{}).Updates(map[string]interface{}{
+		"name":       category.Name,
+		"slug":       category.Slug,
+		"parent_id":  category.ParentID,
+		"updated_at": gorm.Expr("NOW()"),
+	}).Error
+}
+
+func (r *categoryRepository) Delete(id int) error {
+	return r.db.Delete(&model.Category{}, id).Error
+}
+
+// CountProducts returns the number of products filed directly under each
+// category that has any. Archived products are not counted; deleting their
+// category leaves them uncategorised.
+func (r *categoryRepository) CountProducts() (map[int]int64, error) {
+	var rows []struct {
+		CategoryID int
+		Count      int64
+	}
+	err := r.db.Table("product_schema.products").
+		Select("category_id, COUNT(*) AS count").
+		Where("category_id IS NOT NULL AND status <> ?", model.ProductStatusArchived).
+		Group("category_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[int]int64, len(rows))
+	for _, row := range rows {
+		counts[row.CategoryID] = row.Count
+	}
+	return counts, nil
+}
+
+func (r *categoryRepository) CountChildren(id int) (int64, error) {
+	var count int64
+	err := r.db.Model(&model.Category{}).Where("parent_id = ?", id).Count(&count).Error
+	return count, err
+}
+
+// LockTree serialises changes to the category tree until the surrounding
+// transaction ends, so concurrent moves cannot form a cycle.
+func (r *categoryRepository) LockTree() error {
+	return r.db.Exec("SELECT pg_advisory_xact_lock(hashtext('product_schema.categories'))").Error
+}
+
+func (r *categoryRepository) Transaction(fn func(repo CategoryRepository) error) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		return fn(&categoryRepository{db: tx})
+	})
+}
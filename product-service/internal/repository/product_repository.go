@@ -1,37 +1,150 @@
 package repository
 
 import (
+	"errors"
+	"fmt"
+
 	"github.com/google/uuid"
+	"github.com/hero/microservice/pkg/events"
+	"github.com/hero/microservice/pkg/idempotency"
+	"github.com/hero/microservice/pkg/outbox"
 	"github.com/hero/microservice/product-service/internal/model"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// ErrInsufficientStock is returned when a decrement would take inventory
+// below zero. The row is left untouched.
+var ErrInsufficientStock = errors.New("insufficient stock")
+
+// ErrInvalidAmount rejects a stock increment or decrement that is not
+// positive, which would move stock the wrong way.
+var ErrInvalidAmount = errors.New("stock amount must be positive")
+
 type ProductRepository interface {
 	Create(product *model.Product) error
-	GetAll() ([]model.Product, error)
+	List(query model.ProductListQuery) ([]model.ProductListing, error)
 	GetByID(id uuid.UUID) (*model.Product, error)
+	GetWithStock(ids []uuid.UUID) ([]model.ProductStock, error)
+	ListForExport(after uuid.UUID, limit int) ([]model.Product, error)
+	LockCategory(id int) (*model.Category, error)
 	Update(product *model.Product) error
+	Archive(id uuid.UUID) (bool, error)
+	CreateVariant(variant *model.ProductVariant) error
+	GetVariants(productID uuid.UUID) ([]model.ProductVariant, error)
+	GetVariant(productID, variantID uuid.UUID) (*model.ProductVariant, error)
+	GetDefaultVariant(productID uuid.UUID) (*model.ProductVariant, error)
+	GetVariantBySKU(sku string) (*model.ProductVariant, error)
+	UpdateVariant(variant *model.ProductVariant) error
+	SKUTaken(sku string, exceptID uuid.UUID) (bool, error)
 	CreateInventory(inv *model.Inventory) error
-	GetStock(productID uuid.UUID) (*model.Inventory, error)
-	UpdateStock(productID uuid.UUID, quantity int) error
-	DecrementStock(productID uuid.UUID, amount int) (*model.Inventory, error)
+	GetStock(variantID uuid.UUID) (*model.Inventory, error)
+	LockStock(variantID uuid.UUID) (*model.Inventory, error)
+	UpdateStock(variantID uuid.UUID, quantity int) error
+	DecrementStock(variantID uuid.UUID, amount int) (*model.Inventory, error)
+	IncrementStock(variantID uuid.UUID, amount int) (*model.Inventory, error)
+	HasReservation(orderID uuid.UUID) (bool, error)
+	CreateReservation(reservation *model.StockReservation) error
+	GetActiveReservations(orderID uuid.UUID) ([]model.StockReservation, error)
+	MarkReservationsReleased(orderID uuid.UUID) error
+	AddMovement(movement *model.InventoryMovement) error
+	ListMovements(productID uuid.UUID, query model.MovementQuery) ([]model.InventoryMovement, error)
+	StockDrift() ([]model.StockDrift, error)
+	AddEvent(eventType string, data interface{}, opts ...events.Option) error
+	ClaimEvent(eventID, eventType string) (bool, error)
+	Transaction(fn func(repo ProductRepository) error) error
 }
 
 type productRepository struct {
-	db *gorm.DB
+	db        *gorm.DB
+	events    *outbox.Outbox
+	processed *idempotency.Store
 }
 
-func NewProductRepository(db *gorm.DB) ProductRepository {
-	return &productRepository{db: db}
+func NewProductRepository(db *gorm.DB, events *outbox.Outbox, processed *idempotency.Store) ProductRepository {
+	return &productRepository{db: db, events: events, processed: processed}
 }
 
 func (r *productRepository) Create(product *model.Product) error {
 	return r.db.Create(product).Error
 }
 
-func (r *productRepository) GetAll() ([]model.Product, error) {
-	var products []model.Product
-	err := r.db.Preload("Category").Find(&products).Error
+// searchQuery parses the search term the way a web search box would:
+// quoted phrases, "or", and "-" to exclude a word.
+const searchQuery = "websearch_to_tsquery('english', ?)"
+
+// effectivePrice is what a listed product sells for: its default variant's
+// price, falling back to the product's.
+const effectivePrice = "COALESCE(dv.price, p.price)"
+
+// List returns up to query.Limit active products matching the filter, in sort
+// order after query.After. query.Sort must be one of the ProductSort
+// orders, and ProductSortRelevance requires a search term.
+func (r *productRepository) List(query model.ProductListQuery) ([]model.ProductListing, error) {
+	db := r.db.Table("product_schema.products AS p").Where("p.status = ?", model.ProductStatusActive).
+		Joins("LEFT JOIN product_schema.product_variants dv ON dv.product_id = p.id AND dv.is_default")
+	columns, columnArgs := "p.*, "+effectivePrice+" AS effective_price", []interface{}{}
+	f := query.Filter
+
+	if f.Search != "" {
+		db = db.Where("p.search_vector @@ "+searchQuery, f.Search)
+		columns += ", ts_rank(p.search_vector, " + searchQuery + ") AS rank"
+		columnArgs = append(columnArgs, f.Search)
+	}
+	if f.CategoryID != nil {
+		db = db.Where("p.category_id = ?", *f.CategoryID)
+	}
+	if f.MinPrice != nil {
+		db = db.Where(effectivePrice+" >= ?", *f.MinPrice)
+	}
+	if f.MaxPrice != nil {
+		db = db.Where(effectivePrice+" <= ?", *f.MaxPrice)
+	}
+	if query.WithStock || f.InStock != nil {
+		// Stock is the total over the product's variants
+		db = db.Joins("LEFT JOIN (SELECT product_id, SUM(quantity) AS quantity FROM product_schema.inventory GROUP BY product_id) i ON i.product_id = p.id")
+		if query.WithStock {
+			columns += ", COALESCE(i.quantity, 0) AS quantity"
+		}
+		if f.InStock != nil {
+			if *f.InStock {
+				db = db.Where("i.quantity > 0")
+			} else {
+				db = db.Where("COALESCE(i.quantity, 0) = 0")
+			}
+		}
+	}
+	db = db.Select(columns, columnArgs...)
+
+	dir, cmp := "ASC", ">"
+	if query.Desc {
+		dir, cmp = "DESC", "<"
+	}
+	key, order := "p."+query.Sort, fmt.Sprintf("p.%s %s, p.id %s", query.Sort, dir, dir)
+	switch query.Sort {
+	case model.ProductSortRelevance:
+		key, order = "ts_rank(p.search_vector, "+searchQuery+")", fmt.Sprintf("rank %s, p.id %s", dir, dir)
+	case model.ProductSortPrice:
+		key, order = effectivePrice, fmt.Sprintf("effective_price %s, p.id %s", dir, dir)
+	}
+
+	if after := query.After; after != nil {
+		var keyArgs []interface{}
+		switch query.Sort {
+		case model.ProductSortRelevance:
+			keyArgs = []interface{}{f.Search, after.Rank}
+		case model.ProductSortPrice:
+			keyArgs = []interface{}{after.Price}
+		case model.ProductSortName:
+			keyArgs = []interface{}{after.Name}
+		default:
+			keyArgs = []interface{}{after.CreatedAt}
+		}
+		db = db.Where(fmt.Sprintf("(%s, p.id) %s (?, ?)", key, cmp), append(keyArgs, after.ID)...)
+	}
+
+	products := []model.ProductListing{}
+	err := db.Preload("Category").Order(order).Limit(query.Limit).Find(&products).Error
 	return products, err
 }
 
@@ -44,40 +157,318 @@ func (r *productRepository) GetByID(id uuid.UUID) (*model.Product, error) {
 	return &product, nil
 }
 
+// GetWithStock returns the products with their total stock and each
+// variant's effective price and stock.
+func (r *productRepository) GetWithStock(ids []uuid.UUID) ([]model.ProductStock, error) {
+	var rows []model.ProductStock
+	err := r.db.Table("product_schema.products p").
+		Select("p.id, p.name, p.price, p.status, COALESCE(SUM(i.quantity), 0) AS quantity").
+		Joins("LEFT JOIN product_schema.inventory i ON i.product_id = p.id").
+		Where("p.id IN ?", ids).
+		Group("p.id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var variants []model.VariantStock
+	err = r.db.Table("product_schema.product_variants v").
+		Select("v.id, v.product_id, v.sku, v.options, COALESCE(v.price, p.price) AS price, "+
+			"COALESCE(i.quantity, 0) AS quantity, v.is_default").
+		Joins("JOIN product_schema.products p ON p.id = v.product_id").
+		Joins("LEFT JOIN product_schema.inventory i ON i.variant_id = v.id").
+		Where("v.product_id IN ?", ids).
+		Order("v.is_default DESC, v.created_at, v.id").
+		Scan(&variants).Error
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[uuid.UUID]int, len(rows))
+	for i := range rows {
+		rows[i].Variants = []model.VariantStock{}
+		index[rows[i].ID] = i
+	}
+	for _, v := range variants {
+		if i, ok := index[v.ProductID]; ok {
+			rows[i].Variants = append(rows[i].Variants, v)
+		}
+	}
+	return rows, nil
+}
+
+// ListForExport returns up to limit products that are not archived, in id
+// order after the given id, with their variants and stock.
+func (r *productRepository) ListForExport(after uuid.UUID, limit int) ([]model.Product, error) {
+	products := []model.Product{}
+	err := r.db.Where("status <> ? AND id > ?", model.ProductStatusArchived, after).
+		Order("id").Limit(limit).Find(&products).Error
+	if err != nil || len(products) == 0 {
+		return products, err
+	}
+
+	ids := make([]uuid.UUID, len(products))
+	index := make(map[uuid.UUID]int, len(products))
+	for i, product := range products {
+		ids[i] = product.ID
+		index[product.ID] = i
+	}
+
+	var variants []model.ProductVariant
+	err = r.variants().Where("v.product_id IN ?", ids).
+		Order("v.is_default DESC, v.created_at, v.id").
+		Find(&variants).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, variant := range variants {
+		i := index[variant.ProductID]
+		products[i].Variants = append(products[i].Variants, variant)
+	}
+	return products, nil
+}
+
+// LockCategory loads the category a product is being filed under and holds
+// a share lock on it, so it cannot be deleted before the transaction ends.
+func (r *productRepository) LockCategory(id int) (*model.Category, error) {
+	var category model.Category
+	err := r.db.Clauses(clause.Locking{Strength: "SHARE"}).Where("id = ?", id).First(&category).Error
+	if err != nil {
+		return nil, err
+	}
+	return &category, nil
+}
+
 func (r *productRepository) Update(product *model.Product) error {
-	return r.db.Save(product).Error
+	return r.db.Omit(clause.Associations).Save(product).Error
+}
+
+// Archive marks the product archived unless it already is, and reports
+// whether it changed.
+func (r *productRepository) Archive(id uuid.UUID) (bool, error) {
+	result := r.db.Model(&model.Product{}).
+		Where("id = ? AND status <> ?", id, model.ProductStatusArchived).
+		Updates(map[string]interface{}{
+			"status":     model.ProductStatusArchived,
+			"deleted_at": gorm.Expr("NOW()"),
+			"updated_at": gorm.Expr("NOW()"),
+		})
+	return result.RowsAffected > 0, result.Error
+}
+
+func (r *productRepository) CreateVariant(variant *model.ProductVariant) error {
+	return r.db.Create(variant).Error
+}
+
+// variants selects variants together with their stock.
+func (r *productRepository) variants() *gorm.DB {
+	return r.db.Table("product_schema.product_variants AS v").
+		Select("v.*, COALESCE(i.quantity, 0) AS quantity").
+		Joins("LEFT JOIN product_schema.inventory i ON i.variant_id = v.id")
+}
+
+// GetVariants returns the product's variants, default first.
+func (r *productRepository) GetVariants(productID uuid.UUID) ([]model.ProductVariant, error) {
+	variants := []model.ProductVariant{}
+	err := r.variants().Where("v.product_id = ?", productID).
+		Order("v.is_default DESC, v.created_at, v.id").
+		Find(&variants).Error
+	return variants, err
+}
+
+func (r *productRepository) GetVariant(productID, variantID uuid.UUID) (*model.ProductVariant, error) {
+	var variant model.ProductVariant
+	err := r.variants().Where("v.product_id = ? AND v.id = ?", productID, variantID).First(&variant).Error
+	if err != nil {
+		return nil, err
+	}
+	return &variant, nil
+}
+
+func (r *productRepository) GetDefaultVariant(productID uuid.UUID) (*model.ProductVariant, error) {
+	var variant model.ProductVariant
+	err := r.variants().Where("v.product_id = ? AND v.is_default", productID).First(&variant).Error
+	if err != nil {
+		return nil, err
+	}
+	return &variant, nil
+}
+
+func (r *productRepository) GetVariantBySKU(sku string) (*model.ProductVariant, error) {
+	var variant model.ProductVariant
+	err := r.variants().Where("v.sku = ?", sku).First(&variant).Error
+	if err != nil {
+		return nil, err
+	}
+	return &variant, nil
+}
+
+func (r *productRepository) UpdateVariant(variant *model.ProductVariant) error {
+	return r.db.Save(variant).Error
+}
+
+// SKUTaken reports whether another variant than exceptID uses sku.
+func (r *productRepository) SKUTaken(sku string, exceptID uuid.UUID) (bool, error) {
+	var count int64
+	err := r.db.Model(&model.ProductVariant{}).Where("sku = ? AND id <> ?", sku, exceptID).Count(&count).Error
+	return count > 0, err
 }
 
 func (r *productRepository) CreateInventory(inv *model.Inventory) error {
 	return r.db.Create(inv).Error
 }
 
-func (r *productRepository) GetStock(productID uuid.UUID) (*model.Inventory, error) {
+func (r *productRepository) GetStock(variantID uuid.UUID) (*model.Inventory, error) {
 	var inv model.Inventory
-	err := r.db.Where("product_id = ?", productID).First(&inv).Error
+	err := r.db.Where("variant_id = ?", variantID).First(&inv).Error
 	if err != nil {
 		return nil, err
 	}
 	return &inv, nil
 }
 
-func (r *productRepository) UpdateStock(productID uuid.UUID, quantity int) error {
-	return r.db.Model(&model.Inventory{}).Where("product_id = ?", productID).
-		Update("quantity", quantity).Error
+// LockStock loads the variant's inventory row for update, so its quantity
+// cannot change until the transaction ends.
+func (r *productRepository) LockStock(variantID uuid.UUID) (*model.Inventory, error) {
+	var inv model.Inventory
+	err := r.db.Clauses(clause.Locking{Strength: "UPDATE"}).Where("variant_id = ?", variantID).First(&inv).Error
+	if err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+func (r *productRepository) UpdateStock(variantID uuid.UUID, quantity int) error {
+	return r.db.Model(&model.Inventory{}).Where("variant_id = ?", variantID).
+		Updates(map[string]interface{}{
+			"quantity":   quantity,
+			"updated_at": gorm.Expr("NOW()"),
+		}).Error
+}
+
+// DecrementStock subtracts amount in a single conditional UPDATE, so
+// concurrent callers can never oversell or lose each other's writes.
+func (r *productRepository) DecrementStock(variantID uuid.UUID, amount int) (*model.Inventory, error) {
+	if amount <= 0 {
+		return nil, ErrInvalidAmount
+	}
+	var inv model.Inventory
+	result := r.db.Model(&inv).Clauses(clause.Returning{}).
+		Where("variant_id = ? AND quantity >= ?", variantID, amount).
+		Updates(map[string]interface{}{
+			"quantity":   gorm.Expr("quantity - ?", amount),
+			"updated_at": gorm.Expr("NOW()"),
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		// Tell a missing inventory row apart from a short one
+		if _, err := r.GetStock(variantID); err != nil {
+			return nil, err
+		}
+		return nil, ErrInsufficientStock
+	}
+	return &inv, nil
 }
 
-func (r *productRepository) DecrementStock(productID uuid.UUID, amount int) (*model.Inventory, error) {
+func (r *productRepository) IncrementStock(variantID uuid.UUID, amount int) (*model.Inventory, error) {
+	if amount <= 0 {
+		return nil, ErrInvalidAmount
+	}
 	var inv model.Inventory
-	err := r.db.Where("product_id = ?", productID).First(&inv).Error
+	err := r.db.Model(&inv).Clauses(clause.Returning{}).
+		Where("variant_id = ?", variantID).
+		Updates(map[string]interface{}{
+			"quantity":   gorm.Expr("quantity + ?", amount),
+			"updated_at": gorm.Expr("NOW()"),
+		}).Error
 	if err != nil {
 		return nil, err
 	}
+	return &inv, nil
+}
 
-	inv.Quantity -= amount
-	if inv.Quantity < 0 {
-		inv.Quantity = 0
+func (r *productRepository) HasReservation(orderID uuid.UUID) (bool, error) {
+	var count int64
+	err := r.db.Model(&model.StockReservation{}).Where("order_id = ?", orderID).Count(&count).Error
+	return count > 0, err
+}
+
+func (r *productRepository) CreateReservation(reservation *model.StockReservation) error {
+	return r.db.Create(reservation).Error
+}
+
+func (r *productRepository) GetActiveReservations(orderID uuid.UUID) ([]model.StockReservation, error) {
+	var reservations []model.StockReservation
+	err := r.db.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("order_id = ? AND status = ?", orderID, model.ReservationReserved).
+		Order("variant_id").
+		Find(&reservations).Error
+	return reservations, err
+}
+
+func (r *productRepository) MarkReservationsReleased(orderID uuid.UUID) error {
+	return r.db.Model(&model.StockReservation{}).
+		Where("order_id = ? AND status = ?", orderID, model.ReservationReserved).
+		Updates(map[string]interface{}{
+			"status":     model.ReservationReleased,
+			"updated_at": gorm.Expr("NOW()"),
+		}).Error
+}
+
+func (r *productRepository) AddMovement(movement *model.InventoryMovement) error {
+	return r.db.Create(movement).Error
+}
+
+// ListMovements returns a page of the product's stock movements, newest
+// first.
+func (r *productRepository) ListMovements(productID uuid.UUID, query model.MovementQuery) ([]model.InventoryMovement, error) {
+	db := r.db.Where("product_id = ?", productID)
+	if query.VariantID != uuid.Nil {
+		db = db.Where("variant_id = ?", query.VariantID)
+	}
+	if query.Reason != "" {
+		db = db.Where("reason = ?", query.Reason)
 	}
+	if query.Before > 0 {
+		db = db.Where("id < ?", query.Before)
+	}
+
+	var movements []model.InventoryMovement
+	err := db.Order("id DESC").Limit(query.Limit).Find(&movements).Error
+	return movements, err
+}
+
+// StockDrift compares every variant's quantity with the sum of its ledger
+// and returns those that differ.
+func (r *productRepository) StockDrift() ([]model.StockDrift, error) {
+	var drift []model.StockDrift
+	err := r.db.Table("product_schema.inventory AS i").
+		Select("i.product_id, i.variant_id, v.sku, i.quantity, COALESCE(m.total, 0) AS ledger_quantity").
+		Joins("JOIN product_schema.product_variants v ON v.id = i.variant_id").
+		Joins("LEFT JOIN (SELECT variant_id, SUM(delta) AS total FROM product_schema.inventory_movements GROUP BY variant_id) m ON m.variant_id = i.variant_id").
+		Where("i.quantity <> COALESCE(m.total, 0)").
+		Order("i.product_id, v.sku").
+		Scan(&drift).Error
+	return drift, err
+}
+
+// AddEvent queues an event in the outbox; inside Transaction it commits
+// atomically with the rest of the writes.
+func (r *productRepository) AddEvent(eventType string, data interface{}, opts ...events.Option) error {
+	return r.events.Add(r.db, eventType, data, opts...)
+}
+
+// ClaimEvent records a consumed event and reports false if it was already
+// processed. Call it inside Transaction with the handler's writes.
+func (r *productRepository) ClaimEvent(eventID, eventType string) (bool, error) {
+	return r.processed.Claim(r.db, eventID, eventType)
+}
 
-	err = r.db.Save(&inv).Error
-	return &inv, err
+func (r *productRepository) Transaction(fn func(repo ProductRepository) error) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		return fn(&productRepository{db: tx, events: r.events, processed: r.processed})
+	})
 }
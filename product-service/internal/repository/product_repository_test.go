@@ -0,0 +1,281 @@
+package repository
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/hero/microservice/pkg/idempotency"
+	"github.com/hero/microservice/pkg/outbox"
+	"github.com/hero/microservice/product-service/internal/model"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// openTestDB connects to a Postgres initialised with init.sql, e.g.
+// TEST_DATABASE_DSN="host=localhost user=svc_product password=svc_product_pass dbname=microservice_db sslmode=disable"
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN not set, skipping Postgres test")
+	}
+
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("failed to connect to database: %v", err)
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("failed to get sql.DB: %v", err)
+	}
+	sqlDB.SetMaxOpenConns(32)
+
+	return db
+}
+
+func TestDecrementStockConcurrent(t *testing.T) {
+	db := openTestDB(t)
+	repo := NewProductRepository(db, outbox.New("product_schema", "product.exchange", "product-service"), idempotency.NewStore("product_schema", nil))
+
+	const (
+		initialStock = 500
+		workers      = 32
+		perWorker    = 25 // workers*perWorker attempts oversubscribe the stock
+	)
+
+	product := &model.Product{ID: uuid.New(), Name: "concurrency-test", Price: 1}
+	if err := repo.Create(product); err != nil {
+		t.Fatalf("failed to create product: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Where("id = ?", product.ID).Delete(&model.Product{})
+	})
+
+	variant := &model.ProductVariant{ID: uuid.New(), ProductID: product.ID, SKU: "SKU-" + product.ID.String(), IsDefault: true}
+	if err := repo.CreateVariant(variant); err != nil {
+		t.Fatalf("failed to create variant: %v", err)
+	}
+	if err := repo.CreateInventory(&model.Inventory{ProductID: product.ID, VariantID: variant.ID, Quantity: initialStock}); err != nil {
+		t.Fatalf("failed to create inventory: %v", err)
+	}
+
+	var succeeded, rejected atomic.Int64
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				inv, err := repo.DecrementStock(variant.ID, 1)
+				switch {
+				case errors.Is(err, ErrInsufficientStock):
+					rejected.Add(1)
+				case err != nil:
+					t.Errorf("unexpected error: %v", err)
+					return
+				case inv.Quantity < 0:
+					t.Errorf("quantity went negative: %d", inv.Quantity)
+					return
+				default:
+					succeeded.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	inv, err := repo.GetStock(variant.ID)
+	if err != nil {
+		t.Fatalf("failed to read stock: %v", err)
+	}
+
+	if inv.Quantity != 0 {
+		t.Errorf("final quantity = %d, want 0", inv.Quantity)
+	}
+	if succeeded.Load() != initialStock {
+		t.Errorf("successful decrements = %d, want %d", succeeded.Load(), initialStock)
+	}
+	if want := int64(workers*perWorker - initialStock); rejected.Load() != want {
+		t.Errorf("rejected decrements = %d, want %d", rejected.Load(), want)
+	}
+}
+
+func TestDecrementStockMissingInventory(t *testing.T) {
+	db := openTestDB(t)
+	repo := NewProductRepository(db, outbox.New("product_schema", "product.exchange", "product-service"), idempotency.NewStore("product_schema", nil))
+
+	_, err := repo.DecrementStock(uuid.New(), 1)
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("err = %v, want gorm.ErrRecordNotFound", err)
+	}
+}
+
+func TestStockRejectsNonPositiveAmount(t *testing.T) {
+	db := openTestDB(t)
+	repo := NewProductRepository(db, outbox.New("product_schema", "product.exchange", "product-service"), idempotency.NewStore("product_schema", nil))
+
+	product := &model.Product{ID: uuid.New(), Name: "amount-test", Price: 1}
+	if err := repo.Create(product); err != nil {
+		t.Fatalf("failed to create product: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Where("id = ?", product.ID).Delete(&model.Product{})
+	})
+	variant := &model.ProductVariant{ID: uuid.New(), ProductID: product.ID, SKU: "SKU-" + product.ID.String(), IsDefault: true}
+	if err := repo.CreateVariant(variant); err != nil {
+		t.Fatalf("failed to create variant: %v", err)
+	}
+	if err := repo.CreateInventory(&model.Inventory{ProductID: product.ID, VariantID: variant.ID, Quantity: 10}); err != nil {
+		t.Fatalf("failed to create inventory: %v", err)
+	}
+
+	for _, amount := range []int{0, -5} {
+		if _, err := repo.DecrementStock(variant.ID, amount); !errors.Is(err, ErrInvalidAmount) {
+			t.Errorf("DecrementStock(%d) = %v, want ErrInvalidAmount", amount, err)
+		}
+		if _, err := repo.IncrementStock(variant.ID, amount); !errors.Is(err, ErrInvalidAmount) {
+			t.Errorf("IncrementStock(%d) = %v, want ErrInvalidAmount", amount, err)
+		}
+	}
+
+	inv, err := repo.GetStock(variant.ID)
+	if err != nil {
+		t.Fatalf("failed to read stock: %v", err)
+	}
+	if inv.Quantity != 10 {
+		t.Errorf("quantity = %d, want 10", inv.Quantity)
+	}
+}
+
+func TestStockDrift(t *testing.T) {
+	db := openTestDB(t)
+	repo := NewProductRepository(db, outbox.New("product_schema", "product.exchange", "product-service"), idempotency.NewStore("product_schema", nil))
+
+	product := &model.Product{ID: uuid.New(), Name: "ledger-test", Price: 1}
+	if err := repo.Create(product); err != nil {
+		t.Fatalf("failed to create product: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Where("id = ?", product.ID).Delete(&model.Product{})
+	})
+
+	variant := &model.ProductVariant{ID: uuid.New(), ProductID: product.ID, SKU: "SKU-" + product.ID.String(), IsDefault: true}
+	if err := repo.CreateVariant(variant); err != nil {
+		t.Fatalf("failed to create variant: %v", err)
+	}
+	if err := repo.CreateInventory(&model.Inventory{ProductID: product.ID, VariantID: variant.ID, Quantity: 5}); err != nil {
+		t.Fatalf("failed to create inventory: %v", err)
+	}
+
+	drifted := func() *model.StockDrift {
+		t.Helper()
+		drift, err := repo.StockDrift()
+		if err != nil {
+			t.Fatalf("failed to compute drift: %v", err)
+		}
+		for i := range drift {
+			if drift[i].VariantID == variant.ID {
+				return &drift[i]
+			}
+		}
+		return nil
+	}
+	record := func(delta, after int, reason string) {
+		t.Helper()
+		err := repo.AddMovement(&model.InventoryMovement{
+			ProductID: product.ID, VariantID: variant.ID, Delta: delta, QuantityAfter: after,
+			Reason: reason, Actor: model.ActorSystem,
+		})
+		if err != nil {
+			t.Fatalf("failed to add movement: %v", err)
+		}
+	}
+
+	record(3, 3, model.MovementRestock)
+	if d := drifted(); d == nil || d.Quantity != 5 || d.LedgerQuantity != 3 {
+		t.Fatalf("drift = %+v, want quantity 5 against ledger 3", d)
+	}
+
+	record(2, 5, model.MovementAdjustment)
+	if d := drifted(); d != nil {
+		t.Fatalf("drift = %+v, want none once the ledger adds up", d)
+	}
+
+	movements, err := repo.ListMovements(product.ID, model.MovementQuery{Limit: 10})
+	if err != nil {
+		t.Fatalf("failed to list movements: %v", err)
+	}
+	if len(movements) != 2 || movements[0].Reason != model.MovementAdjustment {
+		t.Fatalf("movements = %+v, want the adjustment first", movements)
+	}
+}
+
+func TestListUsesDefaultVariantPrice(t *testing.T) {
+	db := openTestDB(t)
+	repo := NewProductRepository(db, outbox.New("product_schema", "product.exchange", "product-service"), idempotency.NewStore("product_schema", nil))
+
+	// A unique word keeps other products out of the listing
+	word := "pricetest" + uuid.NewString()[:8]
+	create := func(price float64, variantPrice *float64) uuid.UUID {
+		t.Helper()
+		product := &model.Product{ID: uuid.New(), Name: word, Price: price, Status: model.ProductStatusActive}
+		if err := repo.Create(product); err != nil {
+			t.Fatalf("failed to create product: %v", err)
+		}
+		t.Cleanup(func() {
+			db.Where("id = ?", product.ID).Delete(&model.Product{})
+		})
+		variant := &model.ProductVariant{ID: uuid.New(), ProductID: product.ID, SKU: "SKU-" + product.ID.String(), Price: variantPrice, IsDefault: true}
+		if err := repo.CreateVariant(variant); err != nil {
+			t.Fatalf("failed to create variant: %v", err)
+		}
+		return product.ID
+	}
+	overridden := create(10, ptr(30.0))
+	plain := create(20, nil)
+
+	list := func(query model.ProductListQuery) []uuid.UUID {
+		t.Helper()
+		query.Filter.Search = word
+		if query.Sort == "" {
+			query.Sort = model.ProductSortPrice
+		}
+		query.Limit = 10
+		products, err := repo.List(query)
+		if err != nil {
+			t.Fatalf("failed to list products: %v", err)
+		}
+		ids := make([]uuid.UUID, len(products))
+		for i, p := range products {
+			ids[i] = p.ID
+		}
+		return ids
+	}
+
+	if got := list(model.ProductListQuery{}); !slices.Equal(got, []uuid.UUID{plain, overridden}) {
+		t.Errorf("by price = %v, want %v", got, []uuid.UUID{plain, overridden})
+	}
+	if got := list(model.ProductListQuery{Filter: model.ProductFilter{MinPrice: ptr(25.0)}}); !slices.Equal(got, []uuid.UUID{overridden}) {
+		t.Errorf("min_price 25 = %v, want %v", got, []uuid.UUID{overridden})
+	}
+	if got := list(model.ProductListQuery{Filter: model.ProductFilter{MaxPrice: ptr(15.0)}}); len(got) != 0 {
+		t.Errorf("max_price 15 = %v, want none", got)
+	}
+	after := &model.ProductCursor{Sort: model.ProductSortPrice, Price: 20, ID: plain}
+	if got := list(model.ProductListQuery{After: after}); !slices.Equal(got, []uuid.UUID{overridden}) {
+		t.Errorf("after %s = %v, want %v", plain, got, []uuid.UUID{overridden})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,494 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/hero/microservice/pkg/events"
+	"github.com/hero/microservice/product-service/internal/model"
+	"github.com/hero/microservice/product-service/internal/repository"
+	"gorm.io/gorm"
+)
+
+const (
+	// importBatchSize rows are applied per transaction
+	importBatchSize = 100
+	// maxImportErrors caps the row errors listed in an ImportResult
+	maxImportErrors = 1000
+	exportBatchSize = 500
+	maxSKULen       = 64
+	maxNameLen      = 200
+)
+
+// errDryRun rolls back a dry-run batch after it was applied.
+var errDryRun = errors.New("dry run")
+
+// RowError rejects one row of an import; the rest of the import goes on.
+// Line is where the row starts in the uploaded file.
+type RowError struct {
+	Line    int    `json:"line"`
+	SKU     string `json:"sku,omitempty"`
+	Message string `json:"error"`
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// ImportResult summarises an import. ID is the reference of the stock
+// movements it made. Failed counts every rejected row; Errors lists the
+// first maxImportErrors of them.
+type ImportResult struct {
+	ID        string     `json:"id"`
+	DryRun    bool       `json:"dry_run"`
+	Rows      int        `json:"rows"`
+	Created   int        `json:"created"`
+	Updated   int        `json:"updated"`
+	Unchanged int        `json:"unchanged"`
+	Failed    int        `json:"failed"`
+	Errors    []RowError `json:"errors"`
+}
+
+func (r *ImportResult) fail(err RowError) {
+	r.Failed++
+	if len(r.Errors) < maxImportErrors {
+		r.Errors = append(r.Errors, err)
+	}
+}
+
+// CatalogRowReader returns the next row of an import and the line it
+// starts on, or io.EOF after the last row. A *RowError rejects that row
+// only; any other error stops the import.
+type CatalogRowReader func() (model.CatalogRow, int, error)
+
+const (
+	rowCreated = iota
+	rowUpdated
+	rowUnchanged
+)
+
+type importRow struct {
+	line int
+	row  model.CatalogRow
+}
+
+// catalogImport is the state of one import across its batches.
+type catalogImport struct {
+	id     string
+	actor  string
+	dryRun bool
+	// simulated holds the SKUs a dry run created in earlier batches, which
+	// were rolled back, so later rows can still refer to them
+	simulated map[string]bool
+}
+
+// ImportCatalog upserts products and variants by SKU, reading rows as it
+// goes. Each batch of rows is one transaction; rows that fail validation
+// are reported and skipped, and an error in a batch stops the import with
+// the earlier batches committed. A dry run applies every batch and rolls
+// it back.
+func (s *productService) ImportCatalog(next CatalogRowReader, dryRun bool, actor string) (*ImportResult, error) {
+	imp := &catalogImport{id: "import:" + uuid.NewString(), actor: actor, dryRun: dryRun, simulated: map[string]bool{}}
+	result := &ImportResult{ID: imp.id, DryRun: dryRun, Errors: []RowError{}}
+
+	batch := make([]importRow, 0, importBatchSize)
+	for {
+		row, line, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var rowErr *RowError
+		if errors.As(err, &rowErr) {
+			result.Rows++
+			result.fail(*rowErr)
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+
+		result.Rows++
+		batch = append(batch, importRow{line: line, row: row})
+		if len(batch) == importBatchSize {
+			if err := s.importBatch(imp, batch, result); err != nil {
+				return result, err
+			}
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		if err := s.importBatch(imp, batch, result); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+func (s *productService) importBatch(imp *catalogImport, batch []importRow, result *ImportResult) error {
+	var outcomes []int
+	var rowErrs []RowError
+	touched := map[uuid.UUID]bool{}
+
+	err := s.repo.Transaction(func(repo repository.ProductRepository) error {
+		for _, r := range batch {
+			outcome, productID, err := imp.apply(repo, r.row)
+			var rowErr *RowError
+			if errors.As(err, &rowErr) {
+				rowErr.Line, rowErr.SKU = r.line, r.row.SKU
+				rowErrs = append(rowErrs, *rowErr)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("line %d: %w", r.line, err)
+			}
+			outcomes = append(outcomes, outcome)
+			if productID != uuid.Nil {
+				touched[productID] = true
+			}
+		}
+		if imp.dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		return errors.New("failed to import batch: " + err.Error())
+	}
+
+	for _, outcome := range outcomes {
+		switch outcome {
+		case rowCreated:
+			result.Created++
+		case rowUpdated:
+			result.Updated++
+		default:
+			result.Unchanged++
+		}
+	}
+	for _, rowErr := range rowErrs {
+		result.fail(rowErr)
+	}
+	if !imp.dryRun {
+		for id := range touched {
+			s.invalidateCache(id)
+		}
+	}
+	return nil
+}
+
+func invalidRow(format string, args ...interface{}) error {
+	return &RowError{Message: fmt.Sprintf(format, args...)}
+}
+
+// validateRow checks what a row can be checked for without the catalog.
+func validateRow(row model.CatalogRow) error {
+	switch {
+	case row.SKU == "":
+		return invalidRow("sku is required")
+	case len(row.SKU) > maxSKULen:
+		return invalidRow("sku cannot be longer than %d characters", maxSKULen)
+	case row.Name != nil && strings.TrimSpace(*row.Name) == "":
+		return invalidRow("name cannot be blank")
+	case row.Name != nil && len(*row.Name) > maxNameLen:
+		return invalidRow("name cannot be longer than %d characters", maxNameLen)
+	case row.Price != nil && *row.Price <= 0:
+		return invalidRow("price must be greater than 0")
+	case row.Status != nil && *row.Status != model.ProductStatusActive && *row.Status != model.ProductStatusDraft:
+		return invalidRow("status must be active or draft")
+	case row.VariantPrice != nil && *row.VariantPrice < 0:
+		return invalidRow("variant_price cannot be negative")
+	case row.Quantity != nil && *row.Quantity < 0:
+		return invalidRow("quantity cannot be negative")
+	}
+	return nil
+}
+
+// findBySKU returns the variant with the SKU, or nil if there is none.
+func findBySKU(repo repository.ProductRepository, sku string) (*model.ProductVariant, error) {
+	variant, err := repo.GetVariantBySKU(sku)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return variant, err
+}
+
+// apply upserts one row. Every check that can reject the row runs before
+// the first write, so a *RowError leaves the batch untouched.
+func (imp *catalogImport) apply(repo repository.ProductRepository, row model.CatalogRow) (int, uuid.UUID, error) {
+	row.SKU, row.ParentSKU = strings.TrimSpace(row.SKU), strings.TrimSpace(row.ParentSKU)
+	if row.ParentSKU == row.SKU {
+		row.ParentSKU = ""
+	}
+	if err := validateRow(row); err != nil {
+		return 0, uuid.Nil, err
+	}
+
+	variant, err := findBySKU(repo, row.SKU)
+	if err != nil {
+		return 0, uuid.Nil, err
+	}
+	var parent *model.ProductVariant
+	if row.ParentSKU != "" {
+		if parent, err = findBySKU(repo, row.ParentSKU); err != nil {
+			return 0, uuid.Nil, err
+		}
+		if parent == nil && !imp.simulated[row.ParentSKU] {
+			return 0, uuid.Nil, invalidRow("parent_sku %s not found", row.ParentSKU)
+		}
+		if parent != nil && variant != nil && parent.ProductID != variant.ProductID {
+			return 0, uuid.Nil, invalidRow("sku belongs to a different product than parent_sku %s", row.ParentSKU)
+		}
+	}
+	if variant == nil && parent == nil && row.ParentSKU == "" && !imp.simulated[row.SKU] && (row.Name == nil || row.Price == nil) {
+		return 0, uuid.Nil, invalidRow("name and price are required for a new product")
+	}
+	if err := checkCategory(repo, row.CategoryID); err != nil {
+		if errors.Is(err, ErrCategoryNotFound) {
+			return 0, uuid.Nil, invalidRow("category %d not found", *row.CategoryID)
+		}
+		return 0, uuid.Nil, err
+	}
+
+	// A dry run rolled back the products these rows refer to
+	if variant == nil && imp.simulated[row.SKU] {
+		return rowUpdated, uuid.Nil, nil
+	}
+	if variant == nil && parent == nil && row.ParentSKU != "" {
+		imp.simulated[row.SKU] = true
+		return rowCreated, uuid.Nil, nil
+	}
+
+	if variant == nil && parent == nil {
+		product, err := importProduct(repo, row, imp.stockChange(model.MovementRestock))
+		if err != nil {
+			return 0, uuid.Nil, err
+		}
+		imp.created(row.SKU)
+		return rowCreated, product.ID, nil
+	}
+
+	var productID uuid.UUID
+	if variant != nil {
+		productID = variant.ProductID
+	} else {
+		productID = parent.ProductID
+	}
+	product, err := repo.GetByID(productID)
+	if err != nil {
+		return 0, uuid.Nil, err
+	}
+	changed, err := importProductFields(repo, product, row)
+	if err != nil {
+		return 0, uuid.Nil, err
+	}
+
+	if variant == nil {
+		variant = &model.ProductVariant{
+			ID:        uuid.New(),
+			ProductID: product.ID,
+			SKU:       row.SKU,
+			Options:   row.Options,
+			Price:     priceOverride(row.VariantPrice),
+		}
+		if variant.Options == nil {
+			variant.Options = model.VariantOptions{}
+		}
+		if err := createVariant(repo, variant, valueOr(row.Quantity, 0), imp.stockChange(model.MovementRestock)); err != nil {
+			return 0, uuid.Nil, err
+		}
+		imp.created(row.SKU)
+		return rowCreated, product.ID, nil
+	}
+
+	variantChanged, err := importVariantFields(repo, product, variant, row, imp.stockChange(model.MovementAdjustment))
+	if err != nil {
+		return 0, uuid.Nil, err
+	}
+	if changed || variantChanged {
+		return rowUpdated, product.ID, nil
+	}
+	return rowUnchanged, uuid.Nil, nil
+}
+
+// stockChange attributes a change of stock to the import.
+func (imp *catalogImport) stockChange(reason string) model.StockChange {
+	return model.StockChange{Reason: reason, ReferenceID: imp.id, Actor: imp.actor}
+}
+
+func (imp *catalogImport) created(sku string) {
+	if imp.dryRun {
+		imp.simulated[sku] = true
+	}
+}
+
+// importProduct creates the product of a row with the row's variant as
+// its default.
+func importProduct(repo repository.ProductRepository, row model.CatalogRow, change model.StockChange) (*model.Product, error) {
+	product := &model.Product{
+		ID:          uuid.New(),
+		Name:        strings.TrimSpace(*row.Name),
+		Description: valueOr(row.Description, ""),
+		Price:       *row.Price,
+		CategoryID:  row.CategoryID,
+		Status:      valueOr(row.Status, model.ProductStatusActive),
+	}
+	if err := repo.Create(product); err != nil {
+		return nil, err
+	}
+
+	variant := &model.ProductVariant{
+		ID:        uuid.New(),
+		ProductID: product.ID,
+		SKU:       row.SKU,
+		Options:   row.Options,
+		Price:     priceOverride(row.VariantPrice),
+		IsDefault: true,
+	}
+	if variant.Options == nil {
+		variant.Options = model.VariantOptions{}
+	}
+	if err := createVariant(repo, variant, valueOr(row.Quantity, 0), change); err != nil {
+		return nil, err
+	}
+
+	return product, repo.AddEvent(events.TypeProductCreated, events.ProductCreated{
+		ProductID:   product.ID.String(),
+		ProductName: product.Name,
+		Price:       product.Price,
+	})
+}
+
+// importProductFields applies the row's product columns and reports
+// whether the product changed.
+func importProductFields(repo repository.ProductRepository, product *model.Product, row model.CatalogRow) (bool, error) {
+	oldPrice := product.Price
+	changed := false
+	if row.Name != nil && strings.TrimSpace(*row.Name) != product.Name {
+		product.Name, changed = strings.TrimSpace(*row.Name), true
+	}
+	if row.Description != nil && *row.Description != product.Description {
+		product.Description, changed = *row.Description, true
+	}
+	if row.Price != nil && *row.Price != product.Price {
+		product.Price, changed = *row.Price, true
+	}
+	if row.CategoryID != nil && (product.CategoryID == nil || *product.CategoryID != *row.CategoryID) {
+		product.CategoryID, product.Category, changed = row.CategoryID, nil, true
+	}
+	if row.Status != nil && *row.Status != product.Status {
+		product.Status, product.DeletedAt, changed = *row.Status, nil, true
+	}
+	if !changed {
+		return false, nil
+	}
+
+	if err := repo.Update(product); err != nil {
+		return false, err
+	}
+	return true, productPriceEvents(repo, product, oldPrice)
+}
+
+// importVariantFields applies the row's variant columns and reports
+// whether the variant or its stock changed.
+func importVariantFields(repo repository.ProductRepository, product *model.Product, variant *model.ProductVariant, row model.CatalogRow, change model.StockChange) (bool, error) {
+	oldPrice := variant.EffectivePrice(product.Price)
+	changed := false
+	if row.Options != nil && !maps.Equal(row.Options, variant.Options) {
+		variant.Options, changed = row.Options, true
+	}
+	if row.VariantPrice != nil {
+		price := priceOverride(row.VariantPrice)
+		if (price == nil) != (variant.Price == nil) || (price != nil && *price != *variant.Price) {
+			variant.Price, changed = price, true
+		}
+	}
+	if changed {
+		if err := repo.UpdateVariant(variant); err != nil {
+			return false, err
+		}
+		if err := variantPriceEvent(repo, product, variant, oldPrice); err != nil {
+			return false, err
+		}
+	}
+
+	if row.Quantity != nil && *row.Quantity != variant.Quantity {
+		if _, err := writeStock(repo, product.ID, variant.ID, *row.Quantity, change); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// priceOverride turns a variant_price column into a variant's price
+// override; 0 means none.
+func priceOverride(price *float64) *float64 {
+	if price == nil || *price == 0 {
+		return nil
+	}
+	p := *price
+	return &p
+}
+
+func valueOr[T any](v *T, fallback T) T {
+	if v == nil {
+		return fallback
+	}
+	return *v
+}
+
+// ExportCatalog passes write one row per variant of every product that is
+// not archived. Products are read in batches, so a long export is not one
+// consistent snapshot.
+func (s *productService) ExportCatalog(write func(model.CatalogRow) error) error {
+	after := uuid.Nil
+	for {
+		products, err := s.repo.ListForExport(after, exportBatchSize)
+		if err != nil {
+			return errors.New("failed to export products: " + err.Error())
+		}
+
+		for i := range products {
+			product := &products[i]
+			parentSKU := ""
+			for _, variant := range product.Variants {
+				if variant.IsDefault {
+					parentSKU = variant.SKU
+				}
+			}
+			for _, variant := range product.Variants {
+				if err := write(catalogRow(product, variant, parentSKU)); err != nil {
+					return err
+				}
+			}
+		}
+
+		if len(products) < exportBatchSize {
+			return nil
+		}
+		after = products[len(products)-1].ID
+	}
+}
+
+func catalogRow(product *model.Product, variant model.ProductVariant, parentSKU string) model.CatalogRow {
+	quantity := variant.Quantity
+	row := model.CatalogRow{
+		SKU:          variant.SKU,
+		Name:         &product.Name,
+		Description:  &product.Description,
+		Price:        &product.Price,
+		CategoryID:   product.CategoryID,
+		Status:       &product.Status,
+		Options:      variant.Options,
+		VariantPrice: variant.Price,
+		Quantity:     &quantity,
+	}
+	if !variant.IsDefault {
+		row.ParentSKU = parentSKU
+	}
+	return row
+}
@@ -0,0 +1,228 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/hero/microservice/pkg/events"
+	"github.com/hero/microservice/product-service/internal/model"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// rowsOf reads rows as an import would, numbering lines from 2 after a
+// header.
+func rowsOf(rows ...model.CatalogRow) CatalogRowReader {
+	i := 0
+	return func() (model.CatalogRow, int, error) {
+		if i == len(rows) {
+			return model.CatalogRow{}, 0, io.EOF
+		}
+		i++
+		return rows[i-1], i + 1, nil
+	}
+}
+
+func newImport(dryRun bool) *catalogImport {
+	return &catalogImport{id: "import:test", actor: "admin-1", dryRun: dryRun, simulated: map[string]bool{}}
+}
+
+func TestValidateRow(t *testing.T) {
+	tests := []struct {
+		name string
+		row  model.CatalogRow
+		ok   bool
+	}{
+		{"minimal", model.CatalogRow{SKU: "A"}, true},
+		{"full", model.CatalogRow{SKU: "A", Name: ptr("Shirt"), Price: ptr(9.5), Status: ptr(model.ProductStatusDraft), VariantPrice: ptr(0.0), Quantity: ptr(0)}, true},
+		{"missing sku", model.CatalogRow{}, false},
+		{"long sku", model.CatalogRow{SKU: strings.Repeat("A", maxSKULen+1)}, false},
+		{"blank name", model.CatalogRow{SKU: "A", Name: ptr("  ")}, false},
+		{"zero price", model.CatalogRow{SKU: "A", Price: ptr(0.0)}, false},
+		{"archived", model.CatalogRow{SKU: "A", Status: ptr(model.ProductStatusArchived)}, false},
+		{"negative variant price", model.CatalogRow{SKU: "A", VariantPrice: ptr(-1.0)}, false},
+		{"negative quantity", model.CatalogRow{SKU: "A", Quantity: ptr(-1)}, false},
+	}
+	for _, tt := range tests {
+		err := validateRow(tt.row)
+		var rowErr *RowError
+		switch {
+		case tt.ok && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case !tt.ok && !errors.As(err, &rowErr):
+			t.Errorf("%s: err = %v, want *RowError", tt.name, err)
+		}
+	}
+}
+
+func TestApplyNewProduct(t *testing.T) {
+	repo := newFakeProductRepo()
+	imp := newImport(false)
+
+	outcome, productID, err := imp.apply(repo, model.CatalogRow{SKU: " SHIRT ", Name: ptr("Shirt"), Price: ptr(20.0), Quantity: ptr(5)})
+	if err != nil || outcome != rowCreated {
+		t.Fatalf("apply = %d, %v, want created", outcome, err)
+	}
+	product := repo.products[productID]
+	variant, _ := repo.GetVariantBySKU("SHIRT")
+	if product.Name != "Shirt" || product.Price != 20 || product.Status != model.ProductStatusActive {
+		t.Errorf("product = %+v", product)
+	}
+	if variant == nil || !variant.IsDefault || variant.ProductID != productID || variant.Quantity != 5 {
+		t.Fatalf("variant = %+v, want the default variant with 5 in stock", variant)
+	}
+	want := model.InventoryMovement{ID: 1, ProductID: productID, VariantID: variant.ID, Delta: 5, QuantityAfter: 5,
+		Reason: model.MovementRestock, ReferenceID: "import:test", Actor: "admin-1"}
+	if len(repo.movements) != 1 || repo.movements[0] != want {
+		t.Errorf("movements = %+v, want %+v", repo.movements, want)
+	}
+	if len(repo.events) != 1 || repo.events[0] != events.TypeProductCreated {
+		t.Errorf("events = %v", repo.events)
+	}
+}
+
+func TestApplyNewVariant(t *testing.T) {
+	repo := newFakeProductRepo()
+	product, _ := repo.addProduct("SHIRT", 20, 1)
+
+	row := model.CatalogRow{SKU: "SHIRT-L", ParentSKU: "SHIRT", Options: model.VariantOptions{"size": "L"}, VariantPrice: ptr(22.0), Quantity: ptr(3)}
+	outcome, productID, err := newImport(false).apply(repo, row)
+	if err != nil || outcome != rowCreated || productID != product.ID {
+		t.Fatalf("apply = %d, %s, %v, want created under %s", outcome, productID, err, product.ID)
+	}
+	variant, _ := repo.GetVariantBySKU("SHIRT-L")
+	if variant == nil || variant.IsDefault || variant.ProductID != product.ID || variant.Options["size"] != "L" ||
+		variant.Price == nil || *variant.Price != 22 || variant.Quantity != 3 {
+		t.Errorf("variant = %+v", variant)
+	}
+	if len(repo.products) != 1 {
+		t.Errorf("products = %d, want the existing one only", len(repo.products))
+	}
+}
+
+func TestApplyUpdate(t *testing.T) {
+	repo := newFakeProductRepo()
+	product, variant := repo.addProduct("SHIRT", 20, 4)
+
+	outcome, productID, err := newImport(false).apply(repo, model.CatalogRow{SKU: "SHIRT", Price: ptr(25.0), Quantity: ptr(10)})
+	if err != nil || outcome != rowUpdated || productID != product.ID {
+		t.Fatalf("apply = %d, %v, want updated", outcome, err)
+	}
+	if got := repo.products[product.ID].Price; got != 25 {
+		t.Errorf("price = %v, want 25", got)
+	}
+	if got := repo.stock[variant.ID].Quantity; got != 10 {
+		t.Errorf("quantity = %d, want 10", got)
+	}
+	if len(repo.movements) != 1 || repo.movements[0].Delta != 6 || repo.movements[0].Reason != model.MovementAdjustment {
+		t.Errorf("movements = %+v, want one adjustment of +6", repo.movements)
+	}
+	if !slices.Contains(repo.events, events.TypeProductPriceChanged) || !slices.Contains(repo.events, events.TypeInventoryUpdated) {
+		t.Errorf("events = %v", repo.events)
+	}
+}
+
+func TestApplyUnchanged(t *testing.T) {
+	repo := newFakeProductRepo()
+	repo.addProduct("SHIRT", 20, 4)
+
+	outcome, productID, err := newImport(false).apply(repo, model.CatalogRow{SKU: "SHIRT", Name: ptr("SHIRT"), Price: ptr(20.0), Quantity: ptr(4)})
+	if err != nil || outcome != rowUnchanged || productID != uuid.Nil {
+		t.Fatalf("apply = %d, %s, %v, want unchanged", outcome, productID, err)
+	}
+	if len(repo.movements) != 0 || len(repo.events) != 0 {
+		t.Errorf("movements = %+v, events = %v, want none", repo.movements, repo.events)
+	}
+}
+
+func TestApplyRejectsRow(t *testing.T) {
+	tests := []struct {
+		name string
+		row  model.CatalogRow
+	}{
+		{"invalid", model.CatalogRow{SKU: "NEW", Name: ptr("New"), Price: ptr(-1.0)}},
+		{"new product without a price", model.CatalogRow{SKU: "NEW", Name: ptr("New")}},
+		{"unknown parent", model.CatalogRow{SKU: "NEW", ParentSKU: "MISSING"}},
+		{"parent of another product", model.CatalogRow{SKU: "SHIRT", ParentSKU: "HAT"}},
+		{"unknown category", model.CatalogRow{SKU: "SHIRT", CategoryID: ptr(7)}},
+	}
+	for _, tt := range tests {
+		repo := newFakeProductRepo()
+		repo.addProduct("SHIRT", 20, 1)
+		repo.addProduct("HAT", 10, 1)
+		before := len(repo.variants)
+
+		_, _, err := newImport(false).apply(repo, tt.row)
+		var rowErr *RowError
+		if !errors.As(err, &rowErr) {
+			t.Errorf("%s: err = %v, want *RowError", tt.name, err)
+		}
+		if len(repo.variants) != before || len(repo.events) != 0 {
+			t.Errorf("%s: the rejected row changed the catalog", tt.name)
+		}
+	}
+}
+
+func TestDryRunSimulatesAcrossBatches(t *testing.T) {
+	repo := newFakeProductRepo()
+	svc := newTestService(repo)
+
+	// The product is created and rolled back in the first batch; the rows
+	// after it in the second batch still refer to it
+	rows := []model.CatalogRow{{SKU: "NEW", Name: ptr("New"), Price: ptr(5.0)}}
+	for len(rows) < importBatchSize {
+		rows = append(rows, model.CatalogRow{SKU: "NEW"})
+	}
+	rows = append(rows,
+		model.CatalogRow{SKU: "NEW-L", ParentSKU: "NEW", Options: model.VariantOptions{"size": "L"}},
+		model.CatalogRow{SKU: "NEW", Price: ptr(6.0)},
+		model.CatalogRow{SKU: "OTHER-L", ParentSKU: "OTHER"},
+	)
+
+	result, err := svc.ImportCatalog(rowsOf(rows...), true, "admin-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.DryRun || result.Rows != len(rows) || result.Created != 2 || result.Updated != 1 ||
+		result.Unchanged != importBatchSize-1 || result.Failed != 1 {
+		t.Errorf("result = %+v", result)
+	}
+	if len(result.Errors) != 1 || result.Errors[0].Line != len(rows)+1 || result.Errors[0].SKU != "OTHER-L" {
+		t.Errorf("errors = %+v, want OTHER-L on line %d", result.Errors, len(rows)+1)
+	}
+	if len(repo.products) != 0 || len(repo.variants) != 0 || len(repo.movements) != 0 || len(repo.events) != 0 {
+		t.Errorf("the dry run left %d products, %d movements, %d events", len(repo.products), len(repo.movements), len(repo.events))
+	}
+}
+
+func TestImportCommitsAndReportsRowErrors(t *testing.T) {
+	repo := newFakeProductRepo()
+	svc := newTestService(repo)
+
+	next := rowsOf(
+		model.CatalogRow{SKU: "NEW", Name: ptr("New"), Price: ptr(5.0), Quantity: ptr(2)},
+		model.CatalogRow{SKU: "BAD", Name: ptr("Bad")},
+		model.CatalogRow{SKU: "NEW-L", ParentSKU: "NEW", Quantity: ptr(1)},
+	)
+	result, err := svc.ImportCatalog(next, false, "admin-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Created != 2 || result.Failed != 1 || len(result.Errors) != 1 || result.Errors[0].Line != 3 {
+		t.Errorf("result = %+v", result)
+	}
+	if len(repo.variants) != 2 || len(repo.movements) != 2 {
+		t.Errorf("variants = %d, movements = %d, want 2 each", len(repo.variants), len(repo.movements))
+	}
+	for _, m := range repo.movements {
+		if m.ReferenceID != result.ID || m.Actor != "admin-1" {
+			t.Errorf("movement = %+v, want reference %s by admin-1", m, result.ID)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hero/microservice/product-service/internal/model"
+	"github.com/hero/microservice/product-service/internal/repository"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrCategoryNotFound = errors.New("category not found")
+	ErrBlankName        = errors.New("name cannot be blank")
+	ErrParentNotFound   = errors.New("parent category not found")
+	ErrCategoryCycle    = errors.New("a category cannot be moved under itself or its descendants")
+	ErrInvalidSlug      = errors.New("slug may only contain lowercase letters, digits and single hyphens")
+	ErrSlugTaken        = errors.New("slug is already in use")
+	ErrNameTaken        = errors.New("a category with this name already exists under the same parent")
+	ErrCategoryNotEmpty = errors.New("category still has products or subcategories")
+)
+
+var (
+	slugPattern  = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+	slugSeparate = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// slugify derives a URL slug from a category name, e.g. "Home & Garden"
+// becomes "home-garden".
+func slugify(name string) string {
+	slug := strings.Trim(slugSeparate.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if slug == "" {
+		return "category"
+	}
+	return slug
+}
+
+type CategoryService interface {
+	ListCategories() ([]model.CategoryStats, error)
+	GetCategory(id int) (*model.CategoryDetail, error)
+	CreateCategory(input model.CreateCategoryInput) (*model.Category, error)
+	UpdateCategory(id int, input model.UpdateCategoryInput) (*model.Category, error)
+	DeleteCategory(id int) error
+}
+
+type categoryService struct {
+	repo repository.CategoryRepository
+}
+
+func NewCategoryService(repo repository.CategoryRepository) CategoryService {
+	return &categoryService{repo: repo}
+}
+
+// ListCategories returns every category with its product counts, ordered
+// by name. The tree is small enough to count in one pass.
+func (s *categoryService) ListCategories() ([]model.CategoryStats, error) {
+	categories, err := s.repo.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	counts, err := s.repo.CountProducts()
+	if err != nil {
+		return nil, errors.New("failed to count products: " + err.Error())
+	}
+
+	stats := make([]model.CategoryStats, len(categories))
+	index := make(map[int]int, len(categories))
+	for i, category := range categories {
+		stats[i] = model.CategoryStats{Category: category, ProductCount: counts[category.ID]}
+		index[category.ID] = i
+	}
+
+	// Add each category's own products to it and all of its ancestors
+	for _, category := range categories {
+		n := counts[category.ID]
+		seen := map[int]bool{}
+		for id := &category.ID; id != nil && !seen[*id]; {
+			seen[*id] = true
+			i, ok := index[*id]
+			if !ok {
+				break
+			}
+			stats[i].TotalProductCount += n
+			id = stats[i].ParentID
+		}
+	}
+	return stats, nil
+}
+
+func (s *categoryService) GetCategory(id int) (*model.CategoryDetail, error) {
+	stats, err := s.ListCategories()
+	if err != nil {
+		return nil, err
+	}
+
+	var detail *model.CategoryDetail
+	children := []model.CategoryStats{}
+	for _, category := range stats {
+		if category.ID == id {
+			detail = &model.CategoryDetail{CategoryStats: category}
+		}
+		if category.ParentID != nil && *category.ParentID == id {
+			children = append(children, category)
+		}
+	}
+	if detail == nil {
+		return nil, ErrCategoryNotFound
+	}
+	detail.Children = children
+	return detail, nil
+}
+
+func (s *categoryService) CreateCategory(input model.CreateCategoryInput) (*model.Category, error) {
+	category := &model.Category{Name: strings.TrimSpace(input.Name), ParentID: input.ParentID}
+	if category.Name == "" {
+		return nil, ErrBlankName
+	}
+
+	err := s.repo.Transaction(func(repo repository.CategoryRepository) error {
+		if err := repo.LockTree(); err != nil {
+			return err
+		}
+		if category.ParentID != nil {
+			if _, err := getCategory(repo, *category.ParentID, ErrParentNotFound); err != nil {
+				return err
+			}
+		}
+
+		if err := checkName(repo, category, 0); err != nil {
+			return err
+		}
+
+		slug, err := chooseSlug(repo, input.Slug, category.Name, 0)
+		if err != nil {
+			return err
+		}
+		category.Slug = slug
+
+		return repo.Create(category)
+	})
+	if err != nil {
+		return nil, categoryError("failed to create category", err)
+	}
+	return category, nil
+}
+
+func (s *categoryService) UpdateCategory(id int, input model.UpdateCategoryInput) (*model.Category, error) {
+	var category *model.Category
+	err := s.repo.Transaction(func(repo repository.CategoryRepository) error {
+		if err := repo.LockTree(); err != nil {
+			return err
+		}
+
+		var err error
+		if category, err = getCategory(repo, id, ErrCategoryNotFound); err != nil {
+			return err
+		}
+
+		if name := strings.TrimSpace(input.Name); name != "" {
+			category.Name = name
+		}
+		if input.Slug != "" {
+			if category.Slug, err = chooseSlug(repo, input.Slug, category.Name, id); err != nil {
+				return err
+			}
+		}
+		if input.ParentID != nil {
+			if *input.ParentID == 0 {
+				category.ParentID = nil
+			} else {
+				if err := checkParent(repo, id, *input.ParentID); err != nil {
+					return err
+				}
+				category.ParentID = input.ParentID
+			}
+		}
+		if err := checkName(repo, category, id); err != nil {
+			return err
+		}
+
+		return repo.Update(category)
+	})
+	if err != nil {
+		return nil, categoryError("failed to update category", err)
+	}
+	return category, nil
+}
+
+// DeleteCategory removes a category that has no products and no
+// subcategories.
+func (s *categoryService) DeleteCategory(id int) error {
+	err := s.repo.Transaction(func(repo repository.CategoryRepository) error {
+		if err := repo.LockTree(); err != nil {
+			return err
+		}
+		// Waits for products being filed under it, and blocks new ones
+		if _, err := repo.LockByID(id); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrCategoryNotFound
+			}
+			return err
+		}
+
+		counts, err := repo.CountProducts()
+		if err != nil {
+			return err
+		}
+		children, err := repo.CountChildren(id)
+		if err != nil {
+			return err
+		}
+		if counts[id] > 0 || children > 0 {
+			return fmt.Errorf("%w: %d products, %d subcategories", ErrCategoryNotEmpty, counts[id], children)
+		}
+
+		return repo.Delete(id)
+	})
+	if err != nil {
+		return categoryError("failed to delete category", err)
+	}
+	return nil
+}
+
+func getCategory(repo repository.CategoryRepository, id int, notFound error) (*model.Category, error) {
+	category, err := repo.GetByID(id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, notFound
+		}
+		return nil, err
+	}
+	return category, nil
+}
+
+// checkParent verifies parentID exists and is not id or one of its
+// descendants.
+func checkParent(repo repository.CategoryRepository, id, parentID int) error {
+	for ancestor := &parentID; ancestor != nil; {
+		if *ancestor == id {
+			return ErrCategoryCycle
+		}
+		category, err := getCategory(repo, *ancestor, ErrParentNotFound)
+		if err != nil {
+			return err
+		}
+		ancestor = category.ParentID
+	}
+	return nil
+}
+
+// checkName rejects a name a sibling of the category already has, which
+// the database would refuse. exceptID is the category being updated.
+func checkName(repo repository.CategoryRepository, category *model.Category, exceptID int) error {
+	taken, err := repo.NameTaken(category.ParentID, category.Name, exceptID)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrNameTaken
+	}
+	return nil
+}
+
+// chooseSlug validates a requested slug, or derives one from name and
+// numbers it until it is free. exceptID is the category being updated.
+func chooseSlug(repo repository.CategoryRepository, requested, name string, exceptID int) (string, error) {
+	if requested != "" {
+		if !slugPattern.MatchString(requested) {
+			return "", ErrInvalidSlug
+		}
+		taken, err := repo.SlugTaken(requested, exceptID)
+		if err != nil {
+			return "", err
+		}
+		if taken {
+			return "", ErrSlugTaken
+		}
+		return requested, nil
+	}
+
+	base := slugify(name)
+	for n := 1; ; n++ {
+		slug := base
+		if n > 1 {
+			slug = fmt.Sprintf("%s-%d", base, n)
+		}
+		taken, err := repo.SlugTaken(slug, exceptID)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return slug, nil
+		}
+	}
+}
+
+// categoryError keeps the errors callers branch on and wraps the rest.
+func categoryError(msg string, err error) error {
+	for _, known := range []error{
+		ErrCategoryNotFound, ErrBlankName, ErrParentNotFound, ErrCategoryCycle,
+		ErrInvalidSlug, ErrSlugTaken, ErrNameTaken, ErrCategoryNotEmpty,
+	} {
+		if errors.Is(err, known) {
+			return err
+		}
+	}
+	return errors.New(msg + ": " + err.Error())
+}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hero/microservice/product-service/internal/model"
+	"github.com/hero/microservice/product-service/internal/repository"
+	"gorm.io/gorm"
+)
+
+type fakeCategoryRepo struct {
+	repository.CategoryRepository
+	categories map[int]model.Category
+}
+
+func newFakeCategoryRepo(categories ...model.Category) *fakeCategoryRepo {
+	repo := &fakeCategoryRepo{categories: map[int]model.Category{}}
+	for _, category := range categories {
+		repo.categories[category.ID] = category
+	}
+	return repo
+}
+
+func (r *fakeCategoryRepo) Transaction(fn func(repo repository.CategoryRepository) error) error {
+	return fn(r)
+}
+
+func (r *fakeCategoryRepo) LockTree() error { return nil }
+
+func (r *fakeCategoryRepo) GetByID(id int) (*model.Category, error) {
+	category, ok := r.categories[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &category, nil
+}
+
+func (r *fakeCategoryRepo) SlugTaken(slug string, exceptID int) (bool, error) {
+	for _, category := range r.categories {
+		if category.Slug == slug && category.ID != exceptID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *fakeCategoryRepo) NameTaken(parentID *int, name string, exceptID int) (bool, error) {
+	for _, category := range r.categories {
+		sameParent := (category.ParentID == nil) == (parentID == nil) &&
+			(parentID == nil || *category.ParentID == *parentID)
+		if sameParent && category.Name == name && category.ID != exceptID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *fakeCategoryRepo) Create(category *model.Category) error {
+	category.ID = len(r.categories) + 1
+	r.categories[category.ID] = *category
+	return nil
+}
+
+func (r *fakeCategoryRepo) Update(category *model.Category) error {
+	r.categories[category.ID] = *category
+	return nil
+}
+
+func TestCategoryNamesAreUniqueAmongSiblings(t *testing.T) {
+	clothing, shoes := 1, 2
+	repo := newFakeCategoryRepo(
+		model.Category{ID: clothing, Name: "Clothing", Slug: "clothing"},
+		model.Category{ID: shoes, Name: "Shoes", Slug: "shoes"},
+		model.Category{ID: 3, Name: "Sale", Slug: "clothing-sale", ParentID: &clothing},
+	)
+	svc := NewCategoryService(repo)
+
+	tests := []struct {
+		name string
+		run  func() error
+		want error
+	}{
+		{"top-level duplicate", func() error {
+			_, err := svc.CreateCategory(model.CreateCategoryInput{Name: " Shoes "})
+			return err
+		}, ErrNameTaken},
+		{"sibling duplicate", func() error {
+			_, err := svc.CreateCategory(model.CreateCategoryInput{Name: "Sale", ParentID: &clothing})
+			return err
+		}, ErrNameTaken},
+		{"same name under another parent", func() error {
+			_, err := svc.CreateCategory(model.CreateCategoryInput{Name: "Sale", ParentID: &shoes})
+			return err
+		}, nil},
+		{"rename onto a sibling", func() error {
+			_, err := svc.UpdateCategory(shoes, model.UpdateCategoryInput{Name: "Clothing"})
+			return err
+		}, ErrNameTaken},
+		{"move next to a namesake", func() error {
+			top := 0
+			_, err := svc.UpdateCategory(3, model.UpdateCategoryInput{Name: "Shoes", ParentID: &top})
+			return err
+		}, ErrNameTaken},
+		{"keep its own name", func() error {
+			_, err := svc.UpdateCategory(shoes, model.UpdateCategoryInput{Name: "Shoes", Slug: "footwear"})
+			return err
+		}, nil},
+	}
+	for _, tt := range tests {
+		if err := tt.run(); !errors.Is(err, tt.want) || (tt.want == nil && err != nil) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
@@ -2,14 +2,18 @@ package service
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/hero/microservice/pkg/events"
 	"github.com/hero/microservice/product-service/internal/model"
-	"github.com/hero/microservice/product-service/internal/rabbitmq"
 	"github.com/hero/microservice/product-service/internal/repository"
 	"github.com/redis/go-redis/v9"
 	"gorm.io/gorm"
@@ -17,23 +21,75 @@ import (
 
 const productCacheTTL = 10 * time.Minute
 
+var (
+	ErrProductNotFound = errors.New("product not found")
+	ErrVariantNotFound = errors.New("variant not found")
+	ErrBlankSKU        = errors.New("sku cannot be blank")
+	ErrSKUTaken        = errors.New("sku is already in use")
+	ErrInvalidSort     = errors.New("sort must be relevance, created_at, price or name, optionally prefixed with -")
+	ErrSortNeedsTerm   = errors.New("sorting by relevance needs a search term")
+	ErrInvalidCursor   = errors.New("invalid cursor")
+)
+
+// ProductPage is one page of a product listing. NextCursor is empty on the
+// last page.
+type ProductPage struct {
+	Products   []model.ProductListing
+	NextCursor string
+}
+
+// MovementPage is one page of a product's stock movements. NextBefore is
+// zero on the last page.
+type MovementPage struct {
+	Movements  []model.InventoryMovement
+	NextBefore int64
+}
+
+// InsufficientStockError reports the first line of an order that could not
+// be reserved.
+type InsufficientStockError struct {
+	ProductID uuid.UUID
+	VariantID uuid.UUID
+	Requested int
+	Available int
+}
+
+func (e *InsufficientStockError) Error() string {
+	return fmt.Sprintf("insufficient stock for product %s: requested %d, available %d",
+		e.ProductID, e.Requested, e.Available)
+}
+
+func (e *InsufficientStockError) Unwrap() error {
+	return repository.ErrInsufficientStock
+}
+
 type ProductService interface {
-	CreateProduct(input model.CreateProductInput) (*model.Product, error)
-	GetAllProducts() ([]model.Product, error)
+	CreateProduct(input model.CreateProductInput, actor string) (*model.Product, error)
+	ListProducts(query model.ProductListQuery, cursor string) (*ProductPage, error)
 	GetProduct(id uuid.UUID) (*model.Product, error)
+	LookupProducts(ids []uuid.UUID) ([]model.ProductStock, error)
 	UpdateProduct(id uuid.UUID, input model.UpdateProductInput) (*model.Product, error)
-	UpdateStock(id uuid.UUID, input model.UpdateStockInput) (*model.Inventory, error)
-	DecrementStock(productID uuid.UUID, amount int) error
+	UpdateStock(id uuid.UUID, input model.UpdateStockInput, actor string) (*model.Inventory, error)
+	ArchiveProduct(id uuid.UUID) (*model.Product, error)
+	ListVariants(productID uuid.UUID) ([]model.ProductVariant, error)
+	CreateVariant(productID uuid.UUID, input model.CreateVariantInput, actor string) (*model.ProductVariant, error)
+	UpdateVariant(productID, variantID uuid.UUID, input model.UpdateVariantInput) (*model.ProductVariant, error)
+	UpdateVariantStock(productID, variantID uuid.UUID, input model.UpdateStockInput, actor string) (*model.Inventory, error)
+	ListMovements(productID uuid.UUID, query model.MovementQuery) (*MovementPage, error)
+	ImportCatalog(next CatalogRowReader, dryRun bool, actor string) (*ImportResult, error)
+	ExportCatalog(write func(model.CatalogRow) error) error
+	ReserveStock(eventID, correlationID string, orderID uuid.UUID, items []model.ReservationItem) error
+	ReleaseStock(eventID, correlationID string, orderID uuid.UUID) error
+	ReconcileStock(fix bool) ([]model.StockDrift, error)
 }
 
 type productService struct {
-	repo      repository.ProductRepository
-	publisher *rabbitmq.Publisher
-	rdb       *redis.Client
+	repo repository.ProductRepository
+	rdb  *redis.Client
 }
 
-func NewProductService(repo repository.ProductRepository, publisher *rabbitmq.Publisher, rdb *redis.Client) ProductService {
-	return &productService{repo: repo, publisher: publisher, rdb: rdb}
+func NewProductService(repo repository.ProductRepository, rdb *redis.Client) ProductService {
+	return &productService{repo: repo, rdb: rdb}
 }
 
 func (s *productService) cacheKey(id uuid.UUID) string {
@@ -64,40 +120,122 @@ func (s *productService) invalidateCache(id uuid.UUID) {
 	s.rdb.Del(context.Background(), s.cacheKey(id))
 }
 
-func (s *productService) CreateProduct(input model.CreateProductInput) (*model.Product, error) {
+// defaultSKU is the SKU of a default variant created without one.
+func defaultSKU(productID uuid.UUID) string {
+	return "SKU-" + strings.ToUpper(strings.ReplaceAll(productID.String(), "-", ""))
+}
+
+func (s *productService) CreateProduct(input model.CreateProductInput, actor string) (*model.Product, error) {
 	product := &model.Product{
 		ID:          uuid.New(),
 		Name:        input.Name,
 		Description: input.Description,
 		Price:       input.Price,
 		CategoryID:  input.CategoryID,
+		Status:      model.ProductStatusActive,
 	}
-
-	if err := s.repo.Create(product); err != nil {
-		return nil, errors.New("failed to create product: " + err.Error())
+	if input.Status != "" {
+		product.Status = input.Status
 	}
-
-	inv := &model.Inventory{
+	variant := &model.ProductVariant{
+		ID:        uuid.New(),
 		ProductID: product.ID,
-		Quantity:  input.Quantity,
+		SKU:       strings.TrimSpace(input.SKU),
+		Options:   model.VariantOptions{},
+		IsDefault: true,
 	}
-	if err := s.repo.CreateInventory(inv); err != nil {
-		return nil, errors.New("failed to create inventory: " + err.Error())
+	if variant.SKU == "" {
+		variant.SKU = defaultSKU(product.ID)
 	}
 
-	s.cacheProduct(product)
+	err := s.repo.Transaction(func(repo repository.ProductRepository) error {
+		if err := checkCategory(repo, product.CategoryID); err != nil {
+			return err
+		}
+		if err := repo.Create(product); err != nil {
+			return err
+		}
+		if err := createVariant(repo, variant, input.Quantity, model.StockChange{Reason: model.MovementRestock, Actor: actor}); err != nil {
+			return err
+		}
 
-	s.publisher.Publish("product.created", map[string]interface{}{
-		"product_id":   product.ID.String(),
-		"product_name": product.Name,
-		"price":        product.Price,
+		return repo.AddEvent(events.TypeProductCreated, events.ProductCreated{
+			ProductID:   product.ID.String(),
+			ProductName: product.Name,
+			Price:       product.Price,
+		})
 	})
+	if err != nil {
+		return nil, productError("failed to create product", err)
+	}
+
+	product.Variants = []model.ProductVariant{*variant}
+	s.cacheProduct(product)
 
 	return product, nil
 }
 
-func (s *productService) GetAllProducts() ([]model.Product, error) {
-	return s.repo.GetAll()
+// ListProducts returns the page of products after cursor, which must come
+// from a listing with the same sort and search term.
+func (s *productService) ListProducts(query model.ProductListQuery, cursor string) (*ProductPage, error) {
+	switch query.Sort {
+	case model.ProductSortRelevance:
+		if query.Filter.Search == "" {
+			return nil, ErrSortNeedsTerm
+		}
+	case model.ProductSortCreatedAt, model.ProductSortPrice, model.ProductSortName:
+	default:
+		return nil, ErrInvalidSort
+	}
+	if cursor != "" {
+		after, err := decodeCursor(cursor)
+		if err != nil || after.Sort != query.Sort || after.Desc != query.Desc || after.Search != query.Filter.Search {
+			return nil, ErrInvalidCursor
+		}
+		query.After = after
+	}
+
+	// One extra row tells whether another page follows
+	limit := query.Limit
+	query.Limit++
+	products, err := s.repo.List(query)
+	if err != nil {
+		return nil, errors.New("failed to list products: " + err.Error())
+	}
+
+	page := &ProductPage{Products: products}
+	if len(products) > limit {
+		page.Products = products[:limit]
+		last := page.Products[limit-1]
+		page.NextCursor = encodeCursor(model.ProductCursor{
+			Sort:      query.Sort,
+			Desc:      query.Desc,
+			Search:    query.Filter.Search,
+			Rank:      last.Rank,
+			CreatedAt: last.CreatedAt,
+			Price:     last.EffectivePrice,
+			Name:      last.Name,
+			ID:        last.ID,
+		})
+	}
+	return page, nil
+}
+
+func encodeCursor(c model.ProductCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (*model.ProductCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var c model.ProductCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
 }
 
 func (s *productService) GetProduct(id uuid.UUID) (*model.Product, error) {
@@ -109,24 +247,35 @@ func (s *productService) GetProduct(id uuid.UUID) (*model.Product, error) {
 	product, err := s.repo.GetByID(id)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, errors.New("product not found")
+			return nil, ErrProductNotFound
 		}
 		return nil, err
 	}
+	if product.Variants, err = s.repo.GetVariants(id); err != nil {
+		return nil, errors.New("failed to get variants: " + err.Error())
+	}
 
 	s.cacheProduct(product)
 	return product, nil
 }
 
+func (s *productService) LookupProducts(ids []uuid.UUID) ([]model.ProductStock, error) {
+	if len(ids) == 0 {
+		return []model.ProductStock{}, nil
+	}
+	return s.repo.GetWithStock(ids)
+}
+
 func (s *productService) UpdateProduct(id uuid.UUID, input model.UpdateProductInput) (*model.Product, error) {
 	product, err := s.repo.GetByID(id)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, errors.New("product not found")
+			return nil, ErrProductNotFound
 		}
 		return nil, err
 	}
 
+	oldPrice := product.Price
 	if input.Name != "" {
 		product.Name = input.Name
 	}
@@ -139,63 +288,643 @@ func (s *productService) UpdateProduct(id uuid.UUID, input model.UpdateProductIn
 	if input.CategoryID != nil {
 		product.CategoryID = input.CategoryID
 	}
+	if input.Status != "" {
+		product.Status = input.Status
+		product.DeletedAt = nil
+	}
 
-	if err := s.repo.Update(product); err != nil {
-		return nil, errors.New("failed to update product: " + err.Error())
+	err = s.repo.Transaction(func(repo repository.ProductRepository) error {
+		if input.CategoryID != nil {
+			if err := checkCategory(repo, input.CategoryID); err != nil {
+				return err
+			}
+			product.Category = nil
+		}
+		if err := repo.Update(product); err != nil {
+			return err
+		}
+		return productPriceEvents(repo, product, oldPrice)
+	})
+	if err != nil {
+		return nil, productError("failed to update product", err)
 	}
 
 	s.invalidateCache(id)
-	s.cacheProduct(product)
 
-	return product, nil
+	return s.GetProduct(id)
 }
 
-func (s *productService) UpdateStock(id uuid.UUID, input model.UpdateStockInput) (*model.Inventory, error) {
-	if err := s.repo.UpdateStock(id, input.Quantity); err != nil {
-		return nil, errors.New("failed to update stock: " + err.Error())
-	}
+// ArchiveProduct takes the product off sale. It stays readable by id so
+// past orders can still refer to it. Archiving twice is a no-op.
+func (s *productService) ArchiveProduct(id uuid.UUID) (*model.Product, error) {
+	err := s.repo.Transaction(func(repo repository.ProductRepository) error {
+		product, err := repo.GetByID(id)
+		if err != nil {
+			return err
+		}
 
-	inv, err := s.repo.GetStock(id)
+		archived, err := repo.Archive(id)
+		if err != nil || !archived {
+			return err
+		}
+
+		return repo.AddEvent(events.TypeProductArchived, events.ProductArchived{
+			ProductID:   id.String(),
+			ProductName: product.Name,
+		})
+	})
 	if err != nil {
-		return nil, err
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrProductNotFound
+		}
+		return nil, errors.New("failed to archive product: " + err.Error())
 	}
 
 	s.invalidateCache(id)
 
-	s.publisher.Publish("inventory.updated", map[string]interface{}{
-		"product_id":         id.String(),
-		"quantity_remaining": inv.Quantity,
-		"is_low_stock":       inv.Quantity < 10,
+	return s.GetProduct(id)
+}
+
+// checkCategory verifies the category a product is filed under exists and
+// keeps it from being deleted until the transaction ends.
+func checkCategory(repo repository.ProductRepository, id *int) error {
+	if id == nil {
+		return nil
+	}
+	if _, err := repo.LockCategory(*id); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrCategoryNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// UpdateStock sets the stock of the product's default variant.
+func (s *productService) UpdateStock(id uuid.UUID, input model.UpdateStockInput, actor string) (*model.Inventory, error) {
+	return s.setStock(id, uuid.Nil, input, actor)
+}
+
+func (s *productService) UpdateVariantStock(productID, variantID uuid.UUID, input model.UpdateStockInput, actor string) (*model.Inventory, error) {
+	return s.setStock(productID, variantID, input, actor)
+}
+
+func (s *productService) setStock(productID, variantID uuid.UUID, input model.UpdateStockInput, actor string) (*model.Inventory, error) {
+	change := model.StockChange{Reason: input.Reason, ReferenceID: input.Reference, Actor: actor}
+	if change.Reason == "" {
+		change.Reason = model.MovementAdjustment
+	}
+	var inv *model.Inventory
+
+	err := s.repo.Transaction(func(repo repository.ProductRepository) error {
+		variant, err := findVariant(repo, productID, variantID)
+		if err != nil {
+			return err
+		}
+		inv, err = writeStock(repo, productID, variant.ID, input.Quantity, change)
+		return err
 	})
+	if err != nil {
+		return nil, productError("failed to update stock", err)
+	}
 
+	s.invalidateCache(productID)
 	return inv, nil
 }
 
-func (s *productService) DecrementStock(productID uuid.UUID, amount int) error {
-	inv, err := s.repo.DecrementStock(productID, amount)
+// ListVariants returns the product's variants, default first.
+func (s *productService) ListVariants(productID uuid.UUID) ([]model.ProductVariant, error) {
+	product, err := s.GetProduct(productID)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return product.Variants, nil
+}
+
+// ListMovements returns the product's stock ledger, newest first, one
+// page at a time.
+func (s *productService) ListMovements(productID uuid.UUID, query model.MovementQuery) (*MovementPage, error) {
+	if _, err := s.repo.GetByID(productID); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrProductNotFound
+		}
+		return nil, err
+	}
+	if query.VariantID != uuid.Nil {
+		if _, err := findVariant(s.repo, productID, query.VariantID); err != nil {
+			return nil, productError("failed to list movements", err)
+		}
+	}
+
+	// Fetch one extra to learn whether another page follows
+	limit := query.Limit
+	query.Limit++
+	movements, err := s.repo.ListMovements(productID, query)
+	if err != nil {
+		return nil, errors.New("failed to list movements: " + err.Error())
+	}
+
+	page := &MovementPage{Movements: movements}
+	if len(movements) > limit {
+		page.Movements = movements[:limit]
+		page.NextBefore = page.Movements[limit-1].ID
+	}
+	return page, nil
+}
+
+func (s *productService) CreateVariant(productID uuid.UUID, input model.CreateVariantInput, actor string) (*model.ProductVariant, error) {
+	variant := &model.ProductVariant{
+		ID:        uuid.New(),
+		ProductID: productID,
+		SKU:       strings.TrimSpace(input.SKU),
+		Options:   input.Options,
+		Price:     input.Price,
+	}
+	if variant.SKU == "" {
+		return nil, ErrBlankSKU
+	}
+	if variant.Options == nil {
+		variant.Options = model.VariantOptions{}
+	}
+
+	err := s.repo.Transaction(func(repo repository.ProductRepository) error {
+		if _, err := repo.GetByID(productID); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrProductNotFound
+			}
+			return err
+		}
+		return createVariant(repo, variant, input.Quantity, model.StockChange{Reason: model.MovementRestock, Actor: actor})
+	})
+	if err != nil {
+		return nil, productError("failed to create variant", err)
 	}
 
 	s.invalidateCache(productID)
+	return variant, nil
+}
 
-	s.publisher.Publish("inventory.updated", map[string]interface{}{
-		"product_id":         productID.String(),
-		"quantity_remaining": inv.Quantity,
-		"is_low_stock":       inv.Quantity < 10,
+// UpdateVariant changes a variant's SKU, options or price override. A
+// change of the price it sells at is published like a product price change.
+func (s *productService) UpdateVariant(productID, variantID uuid.UUID, input model.UpdateVariantInput) (*model.ProductVariant, error) {
+	var variant *model.ProductVariant
+
+	err := s.repo.Transaction(func(repo repository.ProductRepository) error {
+		product, err := repo.GetByID(productID)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrProductNotFound
+			}
+			return err
+		}
+		if variant, err = findVariant(repo, productID, variantID); err != nil {
+			return err
+		}
+		oldPrice := variant.EffectivePrice(product.Price)
+
+		if sku := strings.TrimSpace(input.SKU); sku != "" && sku != variant.SKU {
+			taken, err := repo.SKUTaken(sku, variant.ID)
+			if err != nil {
+				return err
+			}
+			if taken {
+				return ErrSKUTaken
+			}
+			variant.SKU = sku
+		}
+		if input.Options != nil {
+			variant.Options = input.Options
+		}
+		if input.Price != nil {
+			if *input.Price == 0 {
+				variant.Price = nil
+			} else {
+				price := *input.Price
+				variant.Price = &price
+			}
+		}
+
+		if err := repo.UpdateVariant(variant); err != nil {
+			return err
+		}
+		return variantPriceEvent(repo, product, variant, oldPrice)
 	})
+	if err != nil {
+		return nil, productError("failed to update variant", err)
+	}
 
-	if inv.Quantity == 0 {
-		product, _ := s.repo.GetByID(productID)
-		name := productID.String()
-		if product != nil {
-			name = product.Name
+	s.invalidateCache(productID)
+	return variant, nil
+}
+
+// productPriceEvents publishes the product's new price for every variant
+// that sells at it. Carts hold the price seen when the item was added.
+func productPriceEvents(repo repository.ProductRepository, product *model.Product, oldPrice float64) error {
+	if product.Price == oldPrice {
+		return nil
+	}
+	variants, err := repo.GetVariants(product.ID)
+	if err != nil {
+		return err
+	}
+	for i := range variants {
+		if variants[i].Price != nil {
+			continue
+		}
+		if err := variantPriceEvent(repo, product, &variants[i], oldPrice); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// variantPriceEvent publishes the price the variant sells at if it is no
+// longer oldPrice.
+func variantPriceEvent(repo repository.ProductRepository, product *model.Product, variant *model.ProductVariant, oldPrice float64) error {
+	newPrice := variant.EffectivePrice(product.Price)
+	if newPrice == oldPrice {
+		return nil
+	}
+	return repo.AddEvent(events.TypeProductPriceChanged, events.ProductPriceChanged{
+		ProductID:      product.ID.String(),
+		ProductName:    product.Name,
+		OldPrice:       oldPrice,
+		NewPrice:       newPrice,
+		VariantID:      variant.ID.String(),
+		DefaultVariant: variant.IsDefault,
+	})
+}
+
+// writeStock sets the variant's stock, records the difference in the
+// ledger and publishes the new level.
+func writeStock(repo repository.ProductRepository, productID, variantID uuid.UUID, quantity int, change model.StockChange) (*model.Inventory, error) {
+	old, err := repo.LockStock(variantID)
+	if err != nil {
+		return nil, err
+	}
+	if err := repo.UpdateStock(variantID, quantity); err != nil {
+		return nil, err
+	}
+	inv, err := repo.GetStock(variantID)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordMovement(repo, inv, quantity-old.Quantity, change); err != nil {
+		return nil, err
+	}
+
+	return inv, repo.AddEvent(events.TypeInventoryUpdated, events.InventoryUpdated{
+		ProductID:         productID.String(),
+		VariantID:         variantID.String(),
+		QuantityRemaining: inv.Quantity,
+		IsLowStock:        inv.Quantity < 10,
+	})
+}
+
+// createVariant stores the variant with an inventory row holding quantity.
+func createVariant(repo repository.ProductRepository, variant *model.ProductVariant, quantity int, change model.StockChange) error {
+	taken, err := repo.SKUTaken(variant.SKU, variant.ID)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrSKUTaken
+	}
+	if err := repo.CreateVariant(variant); err != nil {
+		return err
+	}
+
+	inv := &model.Inventory{
+		ProductID: variant.ProductID,
+		VariantID: variant.ID,
+		Quantity:  quantity,
+	}
+	if err := repo.CreateInventory(inv); err != nil {
+		return errors.New("failed to create inventory: " + err.Error())
+	}
+	if err := recordMovement(repo, inv, quantity, change); err != nil {
+		return err
+	}
+	variant.Quantity = quantity
+	return nil
+}
+
+// recordMovement appends a change of delta that left inv to the ledger.
+// Changes of nothing are not recorded.
+func recordMovement(repo repository.ProductRepository, inv *model.Inventory, delta int, change model.StockChange) error {
+	if delta == 0 {
+		return nil
+	}
+	if err := repo.AddMovement(&model.InventoryMovement{
+		ProductID:     inv.ProductID,
+		VariantID:     inv.VariantID,
+		Delta:         delta,
+		QuantityAfter: inv.Quantity,
+		Reason:        change.Reason,
+		ReferenceID:   change.ReferenceID,
+		Actor:         change.Actor,
+	}); err != nil {
+		return errors.New("failed to record stock movement: " + err.Error())
+	}
+	return nil
+}
+
+// findVariant loads one of the product's variants; uuid.Nil stands for
+// the default variant.
+func findVariant(repo repository.ProductRepository, productID, variantID uuid.UUID) (*model.ProductVariant, error) {
+	var variant *model.ProductVariant
+	var err error
+	if variantID == uuid.Nil {
+		variant, err = repo.GetDefaultVariant(productID)
+	} else {
+		variant, err = repo.GetVariant(productID, variantID)
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if variantID == uuid.Nil {
+			return nil, ErrProductNotFound
+		}
+		return nil, ErrVariantNotFound
+	}
+	return variant, err
+}
+
+// productError keeps the errors callers branch on and wraps the rest.
+func productError(msg string, err error) error {
+	for _, known := range []error{
+		ErrProductNotFound, ErrVariantNotFound, ErrCategoryNotFound, ErrBlankSKU, ErrSKUTaken,
+	} {
+		if errors.Is(err, known) {
+			return err
+		}
+	}
+	return errors.New(msg + ": " + err.Error())
+}
+
+// ReserveStock takes stock for every line of an order in one transaction and
+// replies to the order saga with inventory.reserved or
+// inventory.reservation_failed. eventID is the order.created event being
+// handled; a redelivery of it changes nothing. The replies carry its
+// correlationID.
+func (s *productService) ReserveStock(eventID, correlationID string, orderID uuid.UUID, items []model.ReservationItem) error {
+	correlation := events.WithCorrelationID(correlationID)
+
+	// A line that is not positive would add stock instead of taking it
+	for _, item := range items {
+		if item.Quantity <= 0 {
+			log.Printf("Reservation failed for order %s: invalid quantity %d for product %s", orderID, item.Quantity, item.ProductID)
+			return s.failReservation(eventID, reservationFailed(orderID, item.ProductID, item.VariantID, item.Quantity, 0, "invalid_quantity"), correlation)
+		}
+	}
+
+	var updated []model.Inventory
+	alreadyReserved := false
+
+	err := s.repo.Transaction(func(repo repository.ProductRepository) error {
+		fresh, err := repo.ClaimEvent(eventID, events.TypeOrderCreated)
+		if err != nil {
+			return err
+		}
+		exists, err := repo.HasReservation(orderID)
+		if err != nil {
+			return err
+		}
+		if !fresh || exists {
+			alreadyReserved = true
+			return nil
+		}
+
+		// Lines without a variant take the default one; a variant that does
+		// not exist has no stock to give
+		for i, item := range items {
+			variant, err := findVariant(repo, item.ProductID, item.VariantID)
+			if errors.Is(err, ErrProductNotFound) || errors.Is(err, ErrVariantNotFound) {
+				return &InsufficientStockError{ProductID: item.ProductID, VariantID: item.VariantID, Requested: item.Quantity}
+			}
+			if err != nil {
+				return err
+			}
+			items[i].VariantID = variant.ID
 		}
-		s.publisher.Publish("product.out_of_stock", map[string]interface{}{
-			"product_id":   productID.String(),
-			"product_name": name,
+
+		// Lock rows in a stable order so concurrent reservations cannot deadlock
+		sort.Slice(items, func(i, j int) bool {
+			return items[i].VariantID.String() < items[j].VariantID.String()
 		})
+
+		for _, item := range items {
+			inv, err := repo.DecrementStock(item.VariantID, item.Quantity)
+			switch {
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				return &InsufficientStockError{ProductID: item.ProductID, VariantID: item.VariantID, Requested: item.Quantity}
+			case errors.Is(err, repository.ErrInsufficientStock):
+				stockErr := &InsufficientStockError{ProductID: item.ProductID, VariantID: item.VariantID, Requested: item.Quantity}
+				if current, err := repo.GetStock(item.VariantID); err == nil {
+					stockErr.Available = current.Quantity
+				}
+				return stockErr
+			case err != nil:
+				return err
+			}
+
+			if err := recordMovement(repo, inv, -item.Quantity, model.StockChange{
+				Reason:      model.MovementOrder,
+				ReferenceID: orderID.String(),
+				Actor:       model.ActorSystem,
+			}); err != nil {
+				return err
+			}
+
+			if err := repo.CreateReservation(&model.StockReservation{
+				OrderID:   orderID,
+				ProductID: item.ProductID,
+				VariantID: item.VariantID,
+				Quantity:  item.Quantity,
+				Status:    model.ReservationReserved,
+			}); err != nil {
+				return err
+			}
+
+			if err := stockEvents(repo, inv, correlation); err != nil {
+				return err
+			}
+			updated = append(updated, *inv)
+		}
+
+		reserved := make([]events.StockItem, len(items))
+		for i, item := range items {
+			reserved[i] = events.StockItem{
+				ProductID: item.ProductID.String(),
+				VariantID: item.VariantID.String(),
+				Quantity:  item.Quantity,
+			}
+		}
+		return repo.AddEvent(events.TypeInventoryReserved, events.InventoryReserved{
+			OrderID: orderID.String(),
+			Items:   reserved,
+		}, correlation)
+	})
+
+	var stockErr *InsufficientStockError
+	switch {
+	case errors.As(err, &stockErr):
+		// The reservation rolled back, so the event is claimed again together
+		// with the failure reply
+		log.Printf("Reservation failed for order %s: %v", orderID, stockErr)
+		failed := reservationFailed(orderID, stockErr.ProductID, stockErr.VariantID, stockErr.Requested, stockErr.Available, "insufficient_stock")
+		return s.failReservation(eventID, failed, correlation)
+	case err != nil:
+		return err
+	case alreadyReserved:
+		log.Printf("Stock already reserved for order %s, skipping", orderID)
+		return nil
 	}
 
+	for _, inv := range updated {
+		s.invalidateCache(inv.ProductID)
+	}
 	return nil
 }
+
+func reservationFailed(orderID, productID, variantID uuid.UUID, requested, available int, reason string) events.ReservationFailed {
+	failed := events.ReservationFailed{
+		OrderID:   orderID.String(),
+		ProductID: productID.String(),
+		Requested: requested,
+		Available: available,
+		Reason:    reason,
+	}
+	if variantID != uuid.Nil {
+		failed.VariantID = variantID.String()
+	}
+	return failed
+}
+
+// failReservation replies inventory.reservation_failed to the order.created
+// event, claiming it in the same transaction. A failed reservation rolled
+// back its own claim.
+func (s *productService) failReservation(eventID string, failed events.ReservationFailed, opts ...events.Option) error {
+	return s.repo.Transaction(func(repo repository.ProductRepository) error {
+		fresh, err := repo.ClaimEvent(eventID, events.TypeOrderCreated)
+		if err != nil || !fresh {
+			return err
+		}
+		return repo.AddEvent(events.TypeReservationFailed, failed, opts...)
+	})
+}
+
+// ReleaseStock is the saga compensation for a cancelled order: reserved
+// quantities go back into inventory. Releasing twice is a no-op.
+func (s *productService) ReleaseStock(eventID, correlationID string, orderID uuid.UUID) error {
+	correlation := events.WithCorrelationID(correlationID)
+	var updated []model.Inventory
+
+	err := s.repo.Transaction(func(repo repository.ProductRepository) error {
+		fresh, err := repo.ClaimEvent(eventID, events.TypeOrderCancelled)
+		if err != nil || !fresh {
+			return err
+		}
+
+		reservations, err := repo.GetActiveReservations(orderID)
+		if err != nil {
+			return err
+		}
+
+		for _, r := range reservations {
+			if r.Quantity <= 0 {
+				return fmt.Errorf("reservation %d of order %s holds invalid quantity %d", r.ID, orderID, r.Quantity)
+			}
+			inv, err := repo.IncrementStock(r.VariantID, r.Quantity)
+			if err != nil {
+				return err
+			}
+			if err := recordMovement(repo, inv, r.Quantity, model.StockChange{
+				Reason:      model.MovementCancel,
+				ReferenceID: orderID.String(),
+				Actor:       model.ActorSystem,
+			}); err != nil {
+				return err
+			}
+			if err := stockEvents(repo, inv, correlation); err != nil {
+				return err
+			}
+			updated = append(updated, *inv)
+		}
+
+		return repo.MarkReservationsReleased(orderID)
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(updated) > 0 {
+		log.Printf("Released stock reservation for order %s", orderID)
+	}
+	for _, inv := range updated {
+		s.invalidateCache(inv.ProductID)
+	}
+	return nil
+}
+
+// ReconcileStock reports every variant whose quantity is not the sum of
+// its ledger. With fix, the quantity is reset to what the ledger says.
+func (s *productService) ReconcileStock(fix bool) ([]model.StockDrift, error) {
+	drift, err := s.repo.StockDrift()
+	if err != nil {
+		return nil, errors.New("failed to compare stock with the ledger: " + err.Error())
+	}
+	if !fix {
+		return drift, nil
+	}
+
+	for _, d := range drift {
+		err := s.repo.Transaction(func(repo repository.ProductRepository) error {
+			inv, err := repo.LockStock(d.VariantID)
+			if err != nil {
+				return err
+			}
+			// Every write moves quantity and ledger together, so the gap
+			// found above still holds under the lock
+			quantity := inv.Quantity - (d.Quantity - d.LedgerQuantity)
+			if quantity < 0 {
+				return fmt.Errorf("ledger adds up to %d", quantity)
+			}
+			if err := repo.UpdateStock(d.VariantID, quantity); err != nil {
+				return err
+			}
+			inv.Quantity = quantity
+			return stockEvents(repo, inv)
+		})
+		if err != nil {
+			return drift, fmt.Errorf("failed to fix stock of %s: %w", d.SKU, err)
+		}
+		s.invalidateCache(d.ProductID)
+	}
+	return drift, nil
+}
+
+// stockEvents queues the inventory events for a stock change in the same
+// transaction that made it.
+func stockEvents(repo repository.ProductRepository, inv *model.Inventory, opts ...events.Option) error {
+	err := repo.AddEvent(events.TypeInventoryUpdated, events.InventoryUpdated{
+		ProductID:         inv.ProductID.String(),
+		VariantID:         inv.VariantID.String(),
+		QuantityRemaining: inv.Quantity,
+		IsLowStock:        inv.Quantity < 10,
+	}, opts...)
+	if err != nil || inv.Quantity > 0 {
+		return err
+	}
+
+	outOfStock := events.ProductOutOfStock{
+		ProductID:   inv.ProductID.String(),
+		ProductName: inv.ProductID.String(),
+		VariantID:   inv.VariantID.String(),
+	}
+	if product, _ := repo.GetByID(inv.ProductID); product != nil {
+		outOfStock.ProductName = product.Name
+	}
+	if variant, _ := repo.GetVariant(inv.ProductID, inv.VariantID); variant != nil {
+		outOfStock.SKU = variant.SKU
+	}
+	return repo.AddEvent(events.TypeProductOutOfStock, outOfStock, opts...)
+}
@@ -0,0 +1,458 @@
+package service
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/hero/microservice/pkg/events"
+	"github.com/hero/microservice/product-service/internal/model"
+	"github.com/hero/microservice/product-service/internal/repository"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// catalogState is everything fakeProductRepo stores, copied on Transaction
+// so a failed transaction can be rolled back.
+type catalogState struct {
+	products     map[uuid.UUID]model.Product
+	variants     map[uuid.UUID]model.ProductVariant
+	stock        map[uuid.UUID]model.Inventory
+	categories   map[int]bool
+	reservations []model.StockReservation
+	movements    []model.InventoryMovement
+	events       []string
+	claimed      map[string]bool
+}
+
+func (s catalogState) clone() catalogState {
+	return catalogState{
+		products:     maps.Clone(s.products),
+		variants:     maps.Clone(s.variants),
+		stock:        maps.Clone(s.stock),
+		categories:   maps.Clone(s.categories),
+		reservations: slices.Clone(s.reservations),
+		movements:    slices.Clone(s.movements),
+		events:       slices.Clone(s.events),
+		claimed:      maps.Clone(s.claimed),
+	}
+}
+
+// fakeProductRepo keeps the catalog in memory. Methods the tests do not use
+// panic through the nil embedded interface.
+type fakeProductRepo struct {
+	repository.ProductRepository
+	catalogState
+}
+
+func newFakeProductRepo() *fakeProductRepo {
+	return &fakeProductRepo{catalogState: catalogState{
+		products:   map[uuid.UUID]model.Product{},
+		variants:   map[uuid.UUID]model.ProductVariant{},
+		stock:      map[uuid.UUID]model.Inventory{},
+		categories: map[int]bool{},
+		claimed:    map[string]bool{},
+	}}
+}
+
+// newTestService returns a service over repo whose cache is unreachable;
+// invalidating it fails quietly as it does when Redis is down.
+func newTestService(repo repository.ProductRepository) *productService {
+	rdb := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1, DialerRetries: 1})
+	return &productService{repo: repo, rdb: rdb}
+}
+
+// addProduct stores a product with a default variant holding quantity.
+func (r *fakeProductRepo) addProduct(sku string, price float64, quantity int) (model.Product, model.ProductVariant) {
+	product := model.Product{ID: uuid.New(), Name: sku, Price: price, Status: model.ProductStatusActive}
+	variant := model.ProductVariant{ID: uuid.New(), ProductID: product.ID, SKU: sku, Options: model.VariantOptions{}, IsDefault: true}
+	r.products[product.ID] = product
+	r.variants[variant.ID] = variant
+	r.stock[variant.ID] = model.Inventory{ProductID: product.ID, VariantID: variant.ID, Quantity: quantity}
+	variant.Quantity = quantity
+	return product, variant
+}
+
+func (r *fakeProductRepo) Transaction(fn func(repo repository.ProductRepository) error) error {
+	saved := r.catalogState.clone()
+	if err := fn(r); err != nil {
+		r.catalogState = saved
+		return err
+	}
+	return nil
+}
+
+func (r *fakeProductRepo) Create(product *model.Product) error {
+	r.products[product.ID] = *product
+	return nil
+}
+
+func (r *fakeProductRepo) GetByID(id uuid.UUID) (*model.Product, error) {
+	product, ok := r.products[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &product, nil
+}
+
+func (r *fakeProductRepo) Update(product *model.Product) error {
+	r.products[product.ID] = *product
+	return nil
+}
+
+func (r *fakeProductRepo) LockCategory(id int) (*model.Category, error) {
+	if !r.categories[id] {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &model.Category{ID: id}, nil
+}
+
+func (r *fakeProductRepo) withQuantity(variant model.ProductVariant) *model.ProductVariant {
+	variant.Quantity = r.stock[variant.ID].Quantity
+	return &variant
+}
+
+func (r *fakeProductRepo) CreateVariant(variant *model.ProductVariant) error {
+	r.variants[variant.ID] = *variant
+	return nil
+}
+
+func (r *fakeProductRepo) GetVariants(productID uuid.UUID) ([]model.ProductVariant, error) {
+	var variants []model.ProductVariant
+	for _, variant := range r.variants {
+		if variant.ProductID == productID {
+			variants = append(variants, *r.withQuantity(variant))
+		}
+	}
+	return variants, nil
+}
+
+func (r *fakeProductRepo) GetVariant(productID, variantID uuid.UUID) (*model.ProductVariant, error) {
+	variant, ok := r.variants[variantID]
+	if !ok || variant.ProductID != productID {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return r.withQuantity(variant), nil
+}
+
+func (r *fakeProductRepo) GetDefaultVariant(productID uuid.UUID) (*model.ProductVariant, error) {
+	for _, variant := range r.variants {
+		if variant.ProductID == productID && variant.IsDefault {
+			return r.withQuantity(variant), nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *fakeProductRepo) GetVariantBySKU(sku string) (*model.ProductVariant, error) {
+	for _, variant := range r.variants {
+		if variant.SKU == sku {
+			return r.withQuantity(variant), nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *fakeProductRepo) UpdateVariant(variant *model.ProductVariant) error {
+	r.variants[variant.ID] = *variant
+	return nil
+}
+
+func (r *fakeProductRepo) SKUTaken(sku string, exceptID uuid.UUID) (bool, error) {
+	for _, variant := range r.variants {
+		if variant.SKU == sku && variant.ID != exceptID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *fakeProductRepo) CreateInventory(inv *model.Inventory) error {
+	r.stock[inv.VariantID] = *inv
+	return nil
+}
+
+func (r *fakeProductRepo) GetStock(variantID uuid.UUID) (*model.Inventory, error) {
+	inv, ok := r.stock[variantID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &inv, nil
+}
+
+func (r *fakeProductRepo) LockStock(variantID uuid.UUID) (*model.Inventory, error) {
+	return r.GetStock(variantID)
+}
+
+func (r *fakeProductRepo) UpdateStock(variantID uuid.UUID, quantity int) error {
+	inv, ok := r.stock[variantID]
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+	inv.Quantity = quantity
+	r.stock[variantID] = inv
+	return nil
+}
+
+func (r *fakeProductRepo) DecrementStock(variantID uuid.UUID, amount int) (*model.Inventory, error) {
+	if amount <= 0 {
+		return nil, repository.ErrInvalidAmount
+	}
+	inv, ok := r.stock[variantID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	if inv.Quantity < amount {
+		return nil, repository.ErrInsufficientStock
+	}
+	inv.Quantity -= amount
+	r.stock[variantID] = inv
+	return &inv, nil
+}
+
+func (r *fakeProductRepo) IncrementStock(variantID uuid.UUID, amount int) (*model.Inventory, error) {
+	if amount <= 0 {
+		return nil, repository.ErrInvalidAmount
+	}
+	inv, ok := r.stock[variantID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	inv.Quantity += amount
+	r.stock[variantID] = inv
+	return &inv, nil
+}
+
+func (r *fakeProductRepo) HasReservation(orderID uuid.UUID) (bool, error) {
+	for _, reservation := range r.reservations {
+		if reservation.OrderID == orderID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *fakeProductRepo) CreateReservation(reservation *model.StockReservation) error {
+	r.reservations = append(r.reservations, *reservation)
+	return nil
+}
+
+func (r *fakeProductRepo) GetActiveReservations(orderID uuid.UUID) ([]model.StockReservation, error) {
+	var active []model.StockReservation
+	for _, reservation := range r.reservations {
+		if reservation.OrderID == orderID && reservation.Status == model.ReservationReserved {
+			active = append(active, reservation)
+		}
+	}
+	return active, nil
+}
+
+func (r *fakeProductRepo) MarkReservationsReleased(orderID uuid.UUID) error {
+	for i := range r.reservations {
+		if r.reservations[i].OrderID == orderID {
+			r.reservations[i].Status = model.ReservationReleased
+		}
+	}
+	return nil
+}
+
+func (r *fakeProductRepo) AddMovement(movement *model.InventoryMovement) error {
+	movement.ID = int64(len(r.movements) + 1)
+	r.movements = append(r.movements, *movement)
+	return nil
+}
+
+func (r *fakeProductRepo) AddEvent(eventType string, data interface{}, opts ...events.Option) error {
+	r.events = append(r.events, eventType)
+	return nil
+}
+
+func (r *fakeProductRepo) ClaimEvent(eventID, eventType string) (bool, error) {
+	if r.claimed[eventID] {
+		return false, nil
+	}
+	r.claimed[eventID] = true
+	return true, nil
+}
+
+// List returns every product by effective price, ignoring the filter.
+func (r *fakeProductRepo) List(query model.ProductListQuery) ([]model.ProductListing, error) {
+	var listings []model.ProductListing
+	for _, product := range r.products {
+		variant, _ := r.GetDefaultVariant(product.ID)
+		listings = append(listings, model.ProductListing{Product: product, EffectivePrice: variant.EffectivePrice(product.Price)})
+	}
+	slices.SortFunc(listings, func(a, b model.ProductListing) int {
+		return cmp.Compare(a.EffectivePrice, b.EffectivePrice)
+	})
+	if len(listings) > query.Limit {
+		listings = listings[:query.Limit]
+	}
+	return listings, nil
+}
+
+// ledger sums the variant's movements, which must equal its stock.
+func (r *fakeProductRepo) ledger(variantID uuid.UUID) int {
+	sum := 0
+	for _, m := range r.movements {
+		if m.VariantID == variantID {
+			sum += m.Delta
+		}
+	}
+	return sum
+}
+
+func TestStockChangesBalanceTheLedger(t *testing.T) {
+	repo := newFakeProductRepo()
+	svc := newTestService(repo)
+	orderID := uuid.New()
+
+	product, err := svc.CreateProduct(model.CreateProductInput{Name: "Shirt", Price: 20, Quantity: 5, SKU: "SHIRT"}, "admin-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	variantID := product.Variants[0].ID
+
+	steps := []struct {
+		name string
+		run  func() error
+		want model.InventoryMovement
+	}{
+		{"create", func() error { return nil },
+			model.InventoryMovement{Delta: 5, QuantityAfter: 5, Reason: model.MovementRestock, Actor: "admin-1"}},
+		{"restock", func() error {
+			_, err := svc.UpdateStock(product.ID, model.UpdateStockInput{Quantity: 12, Reason: model.MovementRestock, Reference: "PO-7"}, "admin-2")
+			return err
+		}, model.InventoryMovement{Delta: 7, QuantityAfter: 12, Reason: model.MovementRestock, ReferenceID: "PO-7", Actor: "admin-2"}},
+		{"adjust", func() error {
+			_, err := svc.UpdateStock(product.ID, model.UpdateStockInput{Quantity: 11}, "admin-2")
+			return err
+		}, model.InventoryMovement{Delta: -1, QuantityAfter: 11, Reason: model.MovementAdjustment, Actor: "admin-2"}},
+		{"reserve", func() error {
+			return svc.ReserveStock("evt-1", "corr-1", orderID, []model.ReservationItem{{ProductID: product.ID, Quantity: 4}})
+		}, model.InventoryMovement{Delta: -4, QuantityAfter: 7, Reason: model.MovementOrder, ReferenceID: orderID.String(), Actor: model.ActorSystem}},
+		{"release", func() error {
+			return svc.ReleaseStock("evt-2", "corr-1", orderID)
+		}, model.InventoryMovement{Delta: 4, QuantityAfter: 11, Reason: model.MovementCancel, ReferenceID: orderID.String(), Actor: model.ActorSystem}},
+	}
+	for i, step := range steps {
+		if err := step.run(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if len(repo.movements) != i+1 {
+			t.Fatalf("%s: %d movements, want %d", step.name, len(repo.movements), i+1)
+		}
+		got := repo.movements[i]
+		want := step.want
+		want.ID, want.ProductID, want.VariantID = got.ID, product.ID, variantID
+		if got != want {
+			t.Errorf("%s: movement = %+v, want %+v", step.name, got, want)
+		}
+		if stock, sum := repo.stock[variantID].Quantity, repo.ledger(variantID); stock != sum || stock != want.QuantityAfter {
+			t.Errorf("%s: stock = %d, ledger = %d, want %d", step.name, stock, sum, want.QuantityAfter)
+		}
+	}
+
+	// Setting the stock it already has records nothing
+	if _, err := svc.UpdateStock(product.ID, model.UpdateStockInput{Quantity: 11}, "admin-2"); err != nil || len(repo.movements) != len(steps) {
+		t.Errorf("unchanged stock: err = %v, movements = %d", err, len(repo.movements))
+	}
+}
+
+func TestFailedReservationRecordsNoMovement(t *testing.T) {
+	repo := newFakeProductRepo()
+	svc := newTestService(repo)
+	shirt, err := svc.CreateProduct(model.CreateProductInput{Name: "Shirt", Price: 20, Quantity: 5}, "admin-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hat, err := svc.CreateProduct(model.CreateProductInput{Name: "Hat", Price: 10, Quantity: 1}, "admin-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	movements := slices.Clone(repo.movements)
+
+	// Whichever line is taken first is put back when the other falls short
+	items := []model.ReservationItem{{ProductID: shirt.ID, Quantity: 2}, {ProductID: hat.ID, Quantity: 3}}
+	if err := svc.ReserveStock("evt-1", "corr-1", uuid.New(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(repo.movements, movements) {
+		t.Errorf("movements = %+v, want only the opening balances %+v", repo.movements, movements)
+	}
+	for _, p := range []*model.Product{shirt, hat} {
+		variantID := p.Variants[0].ID
+		if stock, sum := repo.stock[variantID].Quantity, repo.ledger(variantID); stock != p.Variants[0].Quantity || sum != stock {
+			t.Errorf("%s: stock = %d, ledger = %d, want %d", p.Name, stock, sum, p.Variants[0].Quantity)
+		}
+	}
+	if len(repo.reservations) != 0 {
+		t.Errorf("reservations = %+v, want none", repo.reservations)
+	}
+	if !slices.Contains(repo.events, events.TypeReservationFailed) || slices.Contains(repo.events, events.TypeInventoryReserved) {
+		t.Errorf("events = %v, want inventory.reservation_failed only", repo.events)
+	}
+}
+
+func TestReserveStockRejectsNonPositiveQuantity(t *testing.T) {
+	repo := newFakeProductRepo()
+	svc := newTestService(repo)
+	_, shirt := repo.addProduct("SHIRT", 20, 5)
+
+	for i, quantity := range []int{0, -3} {
+		items := []model.ReservationItem{{ProductID: shirt.ProductID, Quantity: quantity}}
+		if err := svc.ReserveStock(fmt.Sprintf("evt-%d", i), "corr-1", uuid.New(), items); err != nil {
+			t.Fatalf("quantity %d: %v", quantity, err)
+		}
+	}
+
+	if got := repo.stock[shirt.ID].Quantity; got != 5 {
+		t.Errorf("stock = %d, want 5", got)
+	}
+	if len(repo.movements) != 0 || len(repo.reservations) != 0 {
+		t.Errorf("movements = %+v, reservations = %+v, want none", repo.movements, repo.reservations)
+	}
+	if want := []string{events.TypeReservationFailed, events.TypeReservationFailed}; !slices.Equal(repo.events, want) {
+		t.Errorf("events = %v, want %v", repo.events, want)
+	}
+}
+
+func TestListProductsCursor(t *testing.T) {
+	repo := newFakeProductRepo()
+	svc := newTestService(repo)
+	_, overridden := repo.addProduct("OVERRIDDEN", 10, 1)
+	repo.addProduct("PLAIN", 20, 1)
+	overridden.Price = ptr(30.0)
+	repo.variants[overridden.ID] = overridden
+
+	query := model.ProductListQuery{Filter: model.ProductFilter{Search: "shirt"}, Sort: model.ProductSortPrice, Limit: 1}
+	page, err := svc.ListProducts(query, "")
+	if err != nil || page.NextCursor == "" {
+		t.Fatalf("first page = %+v, %v, want a next cursor", page, err)
+	}
+	after, err := decodeCursor(page.NextCursor)
+	if err != nil || after.Price != 20 || after.Search != "shirt" {
+		t.Errorf("cursor = %+v, %v, want the default variant's price 20 and the search term", after, err)
+	}
+
+	tests := []struct {
+		name  string
+		query model.ProductListQuery
+		want  error
+	}{
+		{"same listing", query, nil},
+		{"another search term", model.ProductListQuery{Filter: model.ProductFilter{Search: "hat"}, Sort: model.ProductSortPrice, Limit: 1}, ErrInvalidCursor},
+		{"no search term", model.ProductListQuery{Sort: model.ProductSortPrice, Limit: 1}, ErrInvalidCursor},
+		{"another sort", model.ProductListQuery{Filter: query.Filter, Sort: model.ProductSortName, Limit: 1}, ErrInvalidCursor},
+		{"descending", model.ProductListQuery{Filter: query.Filter, Sort: model.ProductSortPrice, Desc: true, Limit: 1}, ErrInvalidCursor},
+	}
+	for _, tt := range tests {
+		if _, err := svc.ListProducts(tt.query, page.NextCursor); err != tt.want {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
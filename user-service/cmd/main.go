@@ -1,16 +1,24 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/hero/microservice/pkg/cache"
+	"github.com/hero/microservice/pkg/ginauth"
+	"github.com/hero/microservice/pkg/identity"
+	"github.com/hero/microservice/pkg/messaging"
+	"github.com/hero/microservice/pkg/outbox"
 	"github.com/hero/microservice/user-service/internal/handler"
-	"github.com/hero/microservice/user-service/internal/rabbitmq"
+	"github.com/hero/microservice/user-service/internal/password"
 	"github.com/hero/microservice/user-service/internal/repository"
 	"github.com/hero/microservice/user-service/internal/service"
+	"github.com/hero/microservice/user-service/internal/token"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
@@ -33,17 +41,21 @@ func main() {
 	}
 	log.Println("Database connected")
 
-	// RabbitMQ publisher
-	publisher, err := rabbitmq.NewPublisher(
+	// RabbitMQ
+	mq, err := messaging.Dial(messaging.URL(
 		getEnv("RABBITMQ_HOST", "localhost"),
 		getEnv("RABBITMQ_PORT", "5672"),
 		getEnv("RABBITMQ_USER", "guest"),
 		getEnv("RABBITMQ_PASSWORD", "guest"),
-	)
+	))
 	if err != nil {
 		log.Fatal("Failed to connect to RabbitMQ: ", err)
 	}
-	defer publisher.Close()
+	defer mq.Close()
+
+	if err := mq.DeclareExchange("user.exchange"); err != nil {
+		log.Fatal("Failed to declare RabbitMQ topology: ", err)
+	}
 
 	// Redis
 	rdb, err := cache.NewRedisClient(
@@ -55,14 +67,40 @@ func main() {
 	}
 	defer rdb.Close()
 
+	// Password hashing policy
+	bcryptCost, _ := strconv.Atoi(getEnv("BCRYPT_COST", strconv.Itoa(password.DefaultCost)))
+	hasher := password.NewHasher(bcryptCost)
+
+	// JWT access tokens (AUTH_MODE=jwt), otherwise opaque Redis sessions
+	var tokens *token.Issuer
+	if getEnv("AUTH_MODE", "session") == "jwt" {
+		accessTTL, err := time.ParseDuration(getEnv("JWT_ACCESS_TTL", "15m"))
+		if err != nil {
+			log.Fatal("Invalid JWT_ACCESS_TTL: ", err)
+		}
+		tokens, err = token.NewIssuer(getEnv("JWT_PRIVATE_KEY_PATH", ""), accessTTL)
+		if err != nil {
+			log.Fatal("Failed to load JWT signing key: ", err)
+		}
+		log.Println("Auth mode: jwt")
+	}
+
+	// Events are written to the outbox with each change and relayed to RabbitMQ
+	eventOutbox := outbox.New(getEnv("DB_SCHEMA", "user_schema"), "user.exchange", "user-service")
+	go outbox.NewRelay(db, eventOutbox, mq).Run(context.Background())
+
 	// Wire layers
-	userRepo := repository.NewUserRepository(db)
-	userService := service.NewUserService(userRepo, publisher, rdb)
-	userHandler := handler.NewUserHandler(userService)
+	userRepo := repository.NewUserRepository(db, eventOutbox)
+	userService := service.NewUserService(userRepo, rdb, hasher, tokens)
+	userHandler := handler.NewUserHandler(userService, tokens)
 
 	// Gin router
 	r := gin.Default()
 
+	// Trust only the identity asserted and signed by the gateway
+	signer := identity.NewSigner(mustEnv("IDENTITY_SECRET"), time.Minute)
+	r.Use(ginauth.Identity(signer))
+
 	r.GET("/health", func(c *gin.Context) {
 		c.JSON(200, gin.H{"service": "user-service", "status": "running"})
 	})
@@ -82,3 +120,12 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+// mustEnv reads a setting that has no safe default, such as a secret.
+func mustEnv(key string) string {
+	val := os.Getenv(key)
+	if val == "" {
+		log.Fatalf("%s must be set", key)
+	}
+	return val
+}
@@ -1,20 +1,25 @@
 package handler
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/hero/microservice/pkg/carttoken"
+	"github.com/hero/microservice/pkg/ginauth"
 	"github.com/hero/microservice/user-service/internal/model"
 	"github.com/hero/microservice/user-service/internal/service"
+	"github.com/hero/microservice/user-service/internal/token"
 )
 
 type UserHandler struct {
 	service service.UserService
+	tokens  *token.Issuer
 }
 
-func NewUserHandler(service service.UserService) *UserHandler {
-	return &UserHandler{service: service}
+func NewUserHandler(service service.UserService, tokens *token.Issuer) *UserHandler {
+	return &UserHandler{service: service, tokens: tokens}
 }
 
 func (h *UserHandler) Register(c *gin.Context) {
@@ -25,6 +30,10 @@ func (h *UserHandler) Register(c *gin.Context) {
 	}
 
 	user, err := h.service.Register(input)
+	if errors.Is(err, service.ErrPasswordTooLong) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -40,13 +49,50 @@ func (h *UserHandler) Login(c *gin.Context) {
 		return
 	}
 
+	input.CartToken = c.GetHeader(carttoken.Header)
+
 	resp, err := h.service.Login(input)
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"user": resp.User, "token": resp.Token})
+	c.JSON(http.StatusOK, resp)
+}
+
+func (h *UserHandler) Refresh(c *gin.Context) {
+	var input model.RefreshInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp, err := h.service.Refresh(input.RefreshToken)
+	if err != nil {
+		if errors.Is(err, service.ErrRefreshUnsupported) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func (h *UserHandler) JWKS(c *gin.Context) {
+	if h.tokens == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "jwt auth mode is disabled"})
+		return
+	}
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, h.tokens.JWKS())
+}
+
+// canAccess allows callers to manage their own profile and admins any.
+func (h *UserHandler) canAccess(c *gin.Context, id uuid.UUID) bool {
+	p, ok := ginauth.Principal(c)
+	return ok && (p.IsAdmin() || p.UserID == id.String())
 }
 
 func (h *UserHandler) GetProfile(c *gin.Context) {
@@ -56,6 +102,11 @@ func (h *UserHandler) GetProfile(c *gin.Context) {
 		return
 	}
 
+	if !h.canAccess(c, id) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return
+	}
+
 	user, err := h.service.GetProfile(id)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
@@ -72,6 +123,11 @@ func (h *UserHandler) UpdateProfile(c *gin.Context) {
 		return
 	}
 
+	if !h.canAccess(c, id) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return
+	}
+
 	var input model.UpdateInput
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -141,15 +197,88 @@ func (h *UserHandler) GetMe(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"user": user})
 }
 
+func (h *UserHandler) GetUserRoles(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	roles, err := h.service.GetUserRoles(id)
+	if err != nil {
+		h.roleError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user_id": id, "roles": roles})
+}
+
+func (h *UserHandler) GrantRole(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	var input model.RoleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	roles, err := h.service.GrantRole(id, input.Role)
+	if err != nil {
+		h.roleError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user_id": id, "roles": roles})
+}
+
+func (h *UserHandler) RevokeRole(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	roles, err := h.service.RevokeRole(id, c.Param("role"))
+	if err != nil {
+		h.roleError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user_id": id, "roles": roles})
+}
+
+func (h *UserHandler) roleError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrUserNotFound), errors.Is(err, service.ErrRoleNotFound), errors.Is(err, service.ErrRoleNotHeld):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
 func (h *UserHandler) RegisterRoutes(r *gin.Engine) {
+	r.GET("/.well-known/jwks.json", h.JWKS)
+
 	users := r.Group("/api/users")
 	{
 		users.POST("/register", h.Register)
 		users.POST("/login", h.Login)
+		users.POST("/refresh", h.Refresh)
 		users.POST("/logout", h.Logout)
 		users.GET("/me", h.GetMe)
-		users.GET("/:id", h.GetProfile)
-		users.PUT("/:id", h.UpdateProfile)
-		users.DELETE("/:id", h.DeleteUser)
+		users.GET("/:id", ginauth.RequireUser(), h.GetProfile)
+		users.PUT("/:id", ginauth.RequireUser(), h.UpdateProfile)
+	}
+
+	admin := users.Group("", ginauth.RequireRole("admin"))
+	{
+		admin.DELETE("/:id", h.DeleteUser)
+		admin.GET("/:id/roles", h.GetUserRoles)
+		admin.POST("/:id/roles", h.GrantRole)
+		admin.DELETE("/:id/roles/:role", h.RevokeRole)
 	}
 }
@@ -11,6 +11,7 @@ type User struct {
 	Username     string    `gorm:"type:varchar(100);uniqueIndex;not null" json:"username"`
 	Email        string    `gorm:"type:varchar(255);uniqueIndex;not null" json:"email"`
 	PasswordHash string    `gorm:"type:varchar(255);not null" json:"-"`
+	Roles        []string  `gorm:"-" json:"roles,omitempty"`
 	CreatedAt    time.Time `gorm:"default:now()" json:"created_at"`
 	UpdatedAt    time.Time `gorm:"default:now()" json:"updated_at"`
 }
@@ -41,12 +42,14 @@ func (UserRole) TableName() string {
 type RegisterInput struct {
 	Username string `json:"username" binding:"required,min=3,max=100"`
 	Email    string `json:"email" binding:"required,email"`
-	Password string `json:"password" binding:"required,min=6"`
+	Password string `json:"password" binding:"required,min=6,max=72"`
 }
 
 type LoginInput struct {
 	Email    string `json:"email" binding:"required,email"`
 	Password string `json:"password" binding:"required"`
+	// CartToken identifies the guest cart to merge, forwarded by the gateway
+	CartToken string `json:"-"`
 }
 
 type UpdateInput struct {
@@ -54,7 +57,18 @@ type UpdateInput struct {
 	Email    string `json:"email" binding:"omitempty,email"`
 }
 
+type RoleInput struct {
+	Role string `json:"role" binding:"required"`
+}
+
+type RefreshInput struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
 type LoginResponse struct {
-	User  *User  `json:"user"`
-	Token string `json:"token"`
+	User         *User  `json:"user"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	TokenType    string `json:"token_type,omitempty"`
+	ExpiresIn    int    `json:"expires_in,omitempty"`
 }
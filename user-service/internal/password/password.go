@@ -0,0 +1,76 @@
+package password
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DefaultCost is the bcrypt work factor applied to new hashes. Raising it
+// makes existing hashes report NeedsRehash on the next successful login.
+const DefaultCost = 12
+
+// MaxBytes is the longest password bcrypt accepts, in bytes rather than
+// characters.
+const MaxBytes = 72
+
+var ErrMismatch = errors.New("password does not match")
+
+type Hasher struct {
+	cost int
+}
+
+func NewHasher(cost int) *Hasher {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		cost = DefaultCost
+	}
+	return &Hasher{cost: cost}
+}
+
+// Hash returns a modular-crypt bcrypt string ($2a$<cost>$...), so the
+// algorithm and cost travel with the stored value.
+func (h *Hasher) Hash(plain string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(plain), h.cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Verify checks plain against stored in constant time. Stored values that
+// are not bcrypt hashes are treated as legacy plaintext rows (see init.sql).
+func (h *Hasher) Verify(stored, plain string) error {
+	if !isBcrypt(stored) {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(plain)) != 1 {
+			return ErrMismatch
+		}
+		return nil
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(plain))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrMismatch
+	}
+	return err
+}
+
+// NeedsRehash reports whether stored was produced under a weaker policy
+// than the current one (legacy plaintext or a lower bcrypt cost).
+func (h *Hasher) NeedsRehash(stored string) bool {
+	if !isBcrypt(stored) {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(stored))
+	if err != nil {
+		return true
+	}
+	return cost < h.cost
+}
+
+func isBcrypt(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") ||
+		strings.HasPrefix(stored, "$2b$") ||
+		strings.HasPrefix(stored, "$2y$")
+}
@@ -0,0 +1,86 @@
+package password
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHashAndVerify(t *testing.T) {
+	h := NewHasher(bcrypt.MinCost)
+	hash, err := h.Hash("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isBcrypt(hash) || hash == "s3cret" {
+		t.Fatalf("Hash = %q, want a bcrypt hash", hash)
+	}
+
+	tests := []struct {
+		name   string
+		stored string
+		plain  string
+		want   error
+	}{
+		{"bcrypt match", hash, "s3cret", nil},
+		{"bcrypt mismatch", hash, "S3cret", ErrMismatch},
+		{"legacy plaintext match", "password123", "password123", nil},
+		{"legacy plaintext mismatch", "password123", "password124", ErrMismatch},
+		{"legacy plaintext prefix", "password123", "password", ErrMismatch},
+	}
+	for _, tt := range tests {
+		if err := h.Verify(tt.stored, tt.plain); !errors.Is(err, tt.want) || (tt.want == nil && err != nil) {
+			t.Errorf("%s: Verify = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestHashRejectsOverlongPassword(t *testing.T) {
+	h := NewHasher(bcrypt.MinCost)
+	if _, err := h.Hash(strings.Repeat("a", MaxBytes)); err != nil {
+		t.Errorf("%d bytes: %v", MaxBytes, err)
+	}
+	// 25 characters, 75 bytes
+	if _, err := h.Hash(strings.Repeat("€", 25)); err == nil {
+		t.Error("75 bytes hashed, want an error")
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	weak, err := NewHasher(bcrypt.MinCost).Hash("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	strong, err := NewHasher(bcrypt.MinCost + 1).Hash("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		cost   int
+		stored string
+		want   bool
+	}{
+		{"legacy plaintext", bcrypt.MinCost, "password123", true},
+		{"same cost", bcrypt.MinCost, weak, false},
+		{"higher cost", bcrypt.MinCost, strong, false},
+		{"cost raised", bcrypt.MinCost + 1, weak, true},
+		{"malformed hash", bcrypt.MinCost, "$2a$xx$broken", true},
+	}
+	for _, tt := range tests {
+		if got := NewHasher(tt.cost).NeedsRehash(tt.stored); got != tt.want {
+			t.Errorf("%s: NeedsRehash = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNewHasherFallsBackToDefaultCost(t *testing.T) {
+	for _, cost := range []int{0, bcrypt.MinCost - 1, bcrypt.MaxCost + 1} {
+		if h := NewHasher(cost); h.cost != DefaultCost {
+			t.Errorf("NewHasher(%d).cost = %d, want %d", cost, h.cost, DefaultCost)
+		}
+	}
+}
@@ -1,86 +0,0 @@
-package rabbitmq
-
-import (
-	"encoding/json"
-	"fmt"
-	"log"
-	"time"
-
-	amqp "github.com/rabbitmq/amqp091-go"
-)
-
-type Publisher struct {
-	conn    *amqp.Connection
-	channel *amqp.Channel
-}
-
-type Event struct {
-	Event     string      `json:"event"`
-	Timestamp time.Time   `json:"timestamp"`
-	Data      interface{} `json:"data"`
-}
-
-func NewPublisher(host, port, user, password string) (*Publisher, error) {
-	url := fmt.Sprintf("amqp://%s:%s@%s:%s/", user, password, host, port)
-
-	conn, err := amqp.Dial(url)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to RabbitMQ: %w", err)
-	}
-
-	ch, err := conn.Channel()
-	if err != nil {
-		conn.Close()
-		return nil, fmt.Errorf("failed to open channel: %w", err)
-	}
-
-	// Declare user exchange
-	err = ch.ExchangeDeclare("user.exchange", "topic", true, false, false, false, nil)
-	if err != nil {
-		ch.Close()
-		conn.Close()
-		return nil, fmt.Errorf("failed to declare exchange: %w", err)
-	}
-
-	log.Println("RabbitMQ publisher connected")
-	return &Publisher{conn: conn, channel: ch}, nil
-}
-
-func (p *Publisher) Publish(routingKey string, data interface{}) error {
-	event := Event{
-		Event:     routingKey,
-		Timestamp: time.Now().UTC(),
-		Data:      data,
-	}
-
-	body, err := json.Marshal(event)
-	if err != nil {
-		return fmt.Errorf("failed to marshal event: %w", err)
-	}
-
-	err = p.channel.Publish(
-		"user.exchange",
-		routingKey,
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        body,
-		},
-	)
-	if err != nil {
-		return fmt.Errorf("failed to publish message: %w", err)
-	}
-
-	log.Printf("Published event: %s", routingKey)
-	return nil
-}
-
-func (p *Publisher) Close() {
-	if p.channel != nil {
-		p.channel.Close()
-	}
-	if p.conn != nil {
-		p.conn.Close()
-	}
-}
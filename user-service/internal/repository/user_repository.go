@@ -2,8 +2,11 @@ package repository
 
 import (
 	"github.com/google/uuid"
+	"github.com/hero/microservice/pkg/events"
+	"github.com/hero/microservice/pkg/outbox"
 	"github.com/hero/microservice/user-service/internal/model"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type UserRepository interface {
@@ -11,15 +14,23 @@ type UserRepository interface {
 	GetByID(id uuid.UUID) (*model.User, error)
 	GetByEmail(email string) (*model.User, error)
 	Update(user *model.User) error
+	UpdatePasswordHash(id uuid.UUID, hash string) error
 	Delete(id uuid.UUID) error
+	GetRoleByName(name string) (*model.Role, error)
+	GetRoleNames(userID uuid.UUID) ([]string, error)
+	AddUserRole(userID uuid.UUID, roleID int) error
+	RemoveUserRole(userID uuid.UUID, roleID int) (bool, error)
+	AddEvent(eventType string, data interface{}, opts ...events.Option) error
+	Transaction(fn func(repo UserRepository) error) error
 }
 
 type userRepository struct {
-	db *gorm.DB
+	db     *gorm.DB
+	events *outbox.Outbox
 }
 
-func NewUserRepository(db *gorm.DB) UserRepository {
-	return &userRepository{db: db}
+func NewUserRepository(db *gorm.DB, events *outbox.Outbox) UserRepository {
+	return &userRepository{db: db, events: events}
 }
 
 func (r *userRepository) Create(user *model.User) error {
@@ -48,6 +59,52 @@ func (r *userRepository) Update(user *model.User) error {
 	return r.db.Save(user).Error
 }
 
+func (r *userRepository) UpdatePasswordHash(id uuid.UUID, hash string) error {
+	return r.db.Model(&model.User{}).Where("id = ?", id).
+		Updates(map[string]interface{}{"password_hash": hash, "updated_at": gorm.Expr("NOW()")}).Error
+}
+
 func (r *userRepository) Delete(id uuid.UUID) error {
 	return r.db.Where("id = ?", id).Delete(&model.User{}).Error
 }
+
+func (r *userRepository) GetRoleByName(name string) (*model.Role, error) {
+	var role model.Role
+	err := r.db.Where("name = ?", name).First(&role).Error
+	if err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+func (r *userRepository) GetRoleNames(userID uuid.UUID) ([]string, error) {
+	var names []string
+	err := r.db.Model(&model.Role{}).
+		Joins("JOIN user_schema.user_roles ur ON ur.role_id = user_schema.roles.id").
+		Where("ur.user_id = ?", userID).
+		Order("user_schema.roles.name").
+		Pluck("user_schema.roles.name", &names).Error
+	return names, err
+}
+
+func (r *userRepository) AddUserRole(userID uuid.UUID, roleID int) error {
+	return r.db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&model.UserRole{UserID: userID, RoleID: roleID}).Error
+}
+
+func (r *userRepository) RemoveUserRole(userID uuid.UUID, roleID int) (bool, error) {
+	result := r.db.Where("user_id = ? AND role_id = ?", userID, roleID).Delete(&model.UserRole{})
+	return result.RowsAffected > 0, result.Error
+}
+
+// AddEvent queues an event in the outbox; inside Transaction it commits
+// atomically with the rest of the writes.
+func (r *userRepository) AddEvent(eventType string, data interface{}, opts ...events.Option) error {
+	return r.events.Add(r.db, eventType, data, opts...)
+}
+
+func (r *userRepository) Transaction(fn func(repo UserRepository) error) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		return fn(&userRepository{db: tx, events: r.events})
+	})
+}
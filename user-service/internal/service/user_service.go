@@ -2,57 +2,118 @@ package service
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/hero/microservice/pkg/carttoken"
+	"github.com/hero/microservice/pkg/events"
 	"github.com/hero/microservice/user-service/internal/model"
-	"github.com/hero/microservice/user-service/internal/rabbitmq"
+	"github.com/hero/microservice/user-service/internal/password"
 	"github.com/hero/microservice/user-service/internal/repository"
+	"github.com/hero/microservice/user-service/internal/token"
 	"github.com/redis/go-redis/v9"
 	"gorm.io/gorm"
 )
 
-const sessionTTL = 24 * time.Hour
+const (
+	sessionTTL      = 24 * time.Hour
+	refreshTokenTTL = 30 * 24 * time.Hour
+	defaultRole     = "user"
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrRoleNotFound = errors.New("role not found")
+	ErrRoleNotHeld  = errors.New("user does not have this role")
+
+	ErrPasswordTooLong = errors.New("password must be at most 72 bytes")
+
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	ErrRefreshUnsupported  = errors.New("token refresh requires jwt auth mode")
+)
 
 type UserService interface {
 	Register(input model.RegisterInput) (*model.User, error)
 	Login(input model.LoginInput) (*model.LoginResponse, error)
+	Refresh(refreshToken string) (*model.LoginResponse, error)
 	Logout(token string) error
 	ValidateSession(token string) (*model.User, error)
 	GetProfile(id uuid.UUID) (*model.User, error)
 	UpdateProfile(id uuid.UUID, input model.UpdateInput) (*model.User, error)
 	DeleteUser(id uuid.UUID) error
+	GetUserRoles(id uuid.UUID) ([]string, error)
+	GrantRole(id uuid.UUID, role string) ([]string, error)
+	RevokeRole(id uuid.UUID, role string) ([]string, error)
 }
 
 type userService struct {
-	repo      repository.UserRepository
-	publisher *rabbitmq.Publisher
-	rdb       *redis.Client
+	repo   repository.UserRepository
+	rdb    *redis.Client
+	hasher *password.Hasher
+	tokens *token.Issuer
 }
 
-func NewUserService(repo repository.UserRepository, publisher *rabbitmq.Publisher, rdb *redis.Client) UserService {
-	return &userService{repo: repo, publisher: publisher, rdb: rdb}
+// NewUserService wires the user service. A nil tokens issuer keeps the
+// classic opaque Redis sessions; a non-nil one switches Login to JWT mode.
+func NewUserService(repo repository.UserRepository, rdb *redis.Client, hasher *password.Hasher, tokens *token.Issuer) UserService {
+	return &userService{repo: repo, rdb: rdb, hasher: hasher, tokens: tokens}
+}
+
+type refreshRecord struct {
+	UserID    string `json:"user_id"`
+	SessionID string `json:"session_id"`
 }
 
 func (s *userService) Register(input model.RegisterInput) (*model.User, error) {
+	// The binding counts characters; bcrypt counts bytes
+	if len(input.Password) > password.MaxBytes {
+		return nil, ErrPasswordTooLong
+	}
+
+	hash, err := s.hasher.Hash(input.Password)
+	if err != nil {
+		return nil, errors.New("failed to hash password: " + err.Error())
+	}
+
 	user := &model.User{
 		ID:           uuid.New(),
 		Username:     input.Username,
 		Email:        input.Email,
-		PasswordHash: input.Password,
+		PasswordHash: hash,
 	}
 
-	if err := s.repo.Create(user); err != nil {
-		return nil, errors.New("failed to create user: " + err.Error())
-	}
+	err = s.repo.Transaction(func(repo repository.UserRepository) error {
+		if err := repo.Create(user); err != nil {
+			return err
+		}
+
+		// Every account starts with the default role
+		if role, err := repo.GetRoleByName(defaultRole); err != nil {
+			log.Printf("Default role %q unavailable for user %s: %v", defaultRole, user.ID, err)
+		} else if err := repo.AddUserRole(user.ID, role.ID); err != nil {
+			return err
+		} else {
+			user.Roles = []string{role.Name}
+		}
 
-	s.publisher.Publish("user.registered", map[string]interface{}{
-		"user_id":  user.ID.String(),
-		"username": user.Username,
-		"email":    user.Email,
+		return repo.AddEvent(events.TypeUserRegistered, events.UserRegistered{
+			UserID:   user.ID.String(),
+			Username: user.Username,
+			Email:    user.Email,
+		})
 	})
+	if err != nil {
+		return nil, errors.New("failed to create user: " + err.Error())
+	}
 
 	return user, nil
 }
@@ -66,19 +127,122 @@ func (s *userService) Login(input model.LoginInput) (*model.LoginResponse, error
 		return nil, err
 	}
 
-	if user.PasswordHash != input.Password {
-		return nil, errors.New("invalid email or password")
+	if err := s.hasher.Verify(user.PasswordHash, input.Password); err != nil {
+		if errors.Is(err, password.ErrMismatch) {
+			return nil, errors.New("invalid email or password")
+		}
+		return nil, err
+	}
+
+	// Upgrade legacy or weaker hashes now that we have the plaintext
+	if s.hasher.NeedsRehash(user.PasswordHash) {
+		s.rehash(user, input.Password)
+	}
+
+	roles, err := s.repo.GetRoleNames(user.ID)
+	if err != nil {
+		return nil, errors.New("failed to load roles: " + err.Error())
+	}
+	user.Roles = roles
+
+	// Lets order-service merge the guest cart into the user's
+	loggedIn := events.UserLoggedIn{UserID: user.ID.String()}
+	if carttoken.Valid(input.CartToken) {
+		loggedIn.CartToken = input.CartToken
+	}
+	if err := s.repo.AddEvent(events.TypeUserLoggedIn, loggedIn); err != nil {
+		log.Printf("Failed to queue user.logged_in for user %s: %v", user.ID, err)
+	}
+
+	if s.tokens != nil {
+		return s.issueTokens(user, uuid.New().String())
 	}
 
 	// Create session token
+	ctx := context.Background()
 	token := uuid.New().String()
 	userJSON, _ := json.Marshal(user)
-	s.rdb.Set(context.Background(), "session:"+token, userJSON, sessionTTL)
+	s.rdb.Set(ctx, "session:"+token, userJSON, sessionTTL)
+
+	// Index the session so role changes can be pushed into it
+	s.rdb.SAdd(ctx, s.sessionIndexKey(user.ID), token)
+	s.rdb.Expire(ctx, s.sessionIndexKey(user.ID), sessionTTL)
 
 	return &model.LoginResponse{User: user, Token: token}, nil
 }
 
+func (s *userService) rehash(user *model.User, plain string) {
+	hash, err := s.hasher.Hash(plain)
+	if err != nil {
+		log.Printf("Failed to rehash password for user %s: %v", user.ID, err)
+		return
+	}
+	if err := s.repo.UpdatePasswordHash(user.ID, hash); err != nil {
+		log.Printf("Failed to store rehashed password for user %s: %v", user.ID, err)
+		return
+	}
+	user.PasswordHash = hash
+}
+
+func (s *userService) Refresh(refreshToken string) (*model.LoginResponse, error) {
+	if s.tokens == nil {
+		return nil, ErrRefreshUnsupported
+	}
+
+	ctx := context.Background()
+	hash := hashToken(refreshToken)
+
+	// Refresh tokens are single use: take it out of Redis as we read it
+	val, err := s.rdb.GetDel(ctx, "refresh:"+hash).Result()
+	if err == redis.Nil {
+		// A rotated token coming back means it leaked, so end the session
+		if sid, err := s.rdb.Get(ctx, "refresh_used:"+hash).Result(); err == nil {
+			log.Printf("Refresh token reuse detected for session %s, revoking", sid)
+			s.revokeSession(sid)
+		}
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, errors.New("failed to refresh token")
+	}
+
+	var rec refreshRecord
+	if err := json.Unmarshal([]byte(val), &rec); err != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+	s.rdb.Set(ctx, "refresh_used:"+hash, rec.SessionID, refreshTokenTTL)
+
+	if s.isRevoked(rec.SessionID) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	userID, err := uuid.Parse(rec.UserID)
+	if err != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+	user, err := s.GetProfile(userID)
+	if err != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	// Pick up role changes made since the last token was issued
+	if user.Roles, err = s.repo.GetRoleNames(user.ID); err != nil {
+		return nil, errors.New("failed to load roles: " + err.Error())
+	}
+
+	return s.issueTokens(user, rec.SessionID)
+}
+
 func (s *userService) Logout(token string) error {
+	if s.isJWT(token) {
+		claims, err := s.tokens.Parse(token)
+		if err != nil {
+			return errors.New("invalid token")
+		}
+		s.revokeSession(claims.SessionID)
+		return nil
+	}
+
 	result := s.rdb.Del(context.Background(), "session:"+token)
 	if result.Err() != nil {
 		return errors.New("failed to logout")
@@ -87,6 +251,23 @@ func (s *userService) Logout(token string) error {
 }
 
 func (s *userService) ValidateSession(token string) (*model.User, error) {
+	if s.isJWT(token) {
+		claims, err := s.tokens.Parse(token)
+		if err != nil || s.isRevoked(claims.SessionID) {
+			return nil, errors.New("invalid or expired session")
+		}
+		userID, err := uuid.Parse(claims.Subject)
+		if err != nil {
+			return nil, errors.New("invalid or expired session")
+		}
+		user, err := s.GetProfile(userID)
+		if err != nil {
+			return nil, err
+		}
+		user.Roles = claims.Roles
+		return user, nil
+	}
+
 	val, err := s.rdb.Get(context.Background(), "session:"+token).Result()
 	if err == redis.Nil {
 		return nil, errors.New("invalid or expired session")
@@ -103,11 +284,76 @@ func (s *userService) ValidateSession(token string) (*model.User, error) {
 	return &user, nil
 }
 
+func (s *userService) issueTokens(user *model.User, sessionID string) (*model.LoginResponse, error) {
+	access, err := s.tokens.Issue(user.ID.String(), user.Roles, sessionID)
+	if err != nil {
+		return nil, errors.New("failed to issue access token: " + err.Error())
+	}
+
+	refresh, err := s.newRefreshToken(user.ID, sessionID)
+	if err != nil {
+		return nil, errors.New("failed to issue refresh token: " + err.Error())
+	}
+
+	return &model.LoginResponse{
+		User:         user,
+		Token:        access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(s.tokens.AccessTTL().Seconds()),
+	}, nil
+}
+
+func (s *userService) newRefreshToken(userID uuid.UUID, sessionID string) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	raw := base64.RawURLEncoding.EncodeToString(buf)
+	hash := hashToken(raw)
+
+	data, _ := json.Marshal(refreshRecord{UserID: userID.String(), SessionID: sessionID})
+
+	ctx := context.Background()
+	if err := s.rdb.Set(ctx, "refresh:"+hash, data, refreshTokenTTL).Err(); err != nil {
+		return "", err
+	}
+	// Track the live refresh token so logout can delete it
+	s.rdb.Set(ctx, "refresh_session:"+sessionID, hash, refreshTokenTTL)
+
+	return raw, nil
+}
+
+// revokeSession adds the session to the deny-list checked by the gateway
+// for as long as any access token carrying it can still be valid.
+func (s *userService) revokeSession(sessionID string) {
+	ctx := context.Background()
+	s.rdb.Set(ctx, "revoked_session:"+sessionID, "1", s.tokens.AccessTTL())
+
+	if hash, err := s.rdb.GetDel(ctx, "refresh_session:"+sessionID).Result(); err == nil {
+		s.rdb.Del(ctx, "refresh:"+hash)
+	}
+}
+
+func (s *userService) isRevoked(sessionID string) bool {
+	n, err := s.rdb.Exists(context.Background(), "revoked_session:"+sessionID).Result()
+	return err != nil || n > 0
+}
+
+func (s *userService) isJWT(token string) bool {
+	return s.tokens != nil && strings.Count(token, ".") == 2
+}
+
+func hashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
 func (s *userService) GetProfile(id uuid.UUID) (*model.User, error) {
 	user, err := s.repo.GetByID(id)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, errors.New("user not found")
+			return nil, ErrUserNotFound
 		}
 		return nil, err
 	}
@@ -118,7 +364,7 @@ func (s *userService) UpdateProfile(id uuid.UUID, input model.UpdateInput) (*mod
 	user, err := s.repo.GetByID(id)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, errors.New("user not found")
+			return nil, ErrUserNotFound
 		}
 		return nil, err
 	}
@@ -130,16 +376,20 @@ func (s *userService) UpdateProfile(id uuid.UUID, input model.UpdateInput) (*mod
 		user.Email = input.Email
 	}
 
-	if err := s.repo.Update(user); err != nil {
+	err = s.repo.Transaction(func(repo repository.UserRepository) error {
+		if err := repo.Update(user); err != nil {
+			return err
+		}
+		return repo.AddEvent(events.TypeUserUpdated, events.UserUpdated{
+			UserID:   user.ID.String(),
+			Username: user.Username,
+			Email:    user.Email,
+		})
+	})
+	if err != nil {
 		return nil, errors.New("failed to update user: " + err.Error())
 	}
 
-	s.publisher.Publish("user.updated", map[string]interface{}{
-		"user_id":  user.ID.String(),
-		"username": user.Username,
-		"email":    user.Email,
-	})
-
 	return user, nil
 }
 
@@ -147,18 +397,149 @@ func (s *userService) DeleteUser(id uuid.UUID) error {
 	_, err := s.repo.GetByID(id)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return errors.New("user not found")
+			return ErrUserNotFound
 		}
 		return err
 	}
 
-	if err := s.repo.Delete(id); err != nil {
+	err = s.repo.Transaction(func(repo repository.UserRepository) error {
+		if err := repo.Delete(id); err != nil {
+			return err
+		}
+		return repo.AddEvent(events.TypeUserDeleted, events.UserDeleted{UserID: id.String()})
+	})
+	if err != nil {
 		return errors.New("failed to delete user: " + err.Error())
 	}
 
-	s.publisher.Publish("user.deleted", map[string]interface{}{
-		"user_id": id.String(),
+	return nil
+}
+
+func (s *userService) GetUserRoles(id uuid.UUID) ([]string, error) {
+	if _, err := s.GetProfile(id); err != nil {
+		return nil, err
+	}
+	return s.repo.GetRoleNames(id)
+}
+
+func (s *userService) GrantRole(id uuid.UUID, roleName string) ([]string, error) {
+	role, err := s.lookupRole(id, roleName)
+	if err != nil {
+		return nil, err
+	}
+
+	var roles []string
+	err = s.repo.Transaction(func(repo repository.UserRepository) error {
+		if err := repo.AddUserRole(id, role.ID); err != nil {
+			return err
+		}
+		roles, err = rolesChanged(repo, id, events.TypeRoleGranted, role.Name)
+		return err
 	})
+	if err != nil {
+		return nil, errors.New("failed to grant role: " + err.Error())
+	}
 
-	return nil
+	s.refreshSessions(id, roles)
+	return roles, nil
+}
+
+func (s *userService) RevokeRole(id uuid.UUID, roleName string) ([]string, error) {
+	role, err := s.lookupRole(id, roleName)
+	if err != nil {
+		return nil, err
+	}
+
+	var roles []string
+	err = s.repo.Transaction(func(repo repository.UserRepository) error {
+		removed, err := repo.RemoveUserRole(id, role.ID)
+		if err != nil {
+			return err
+		}
+		if !removed {
+			return ErrRoleNotHeld
+		}
+		roles, err = rolesChanged(repo, id, events.TypeRoleRevoked, role.Name)
+		return err
+	})
+	if errors.Is(err, ErrRoleNotHeld) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errors.New("failed to revoke role: " + err.Error())
+	}
+
+	s.refreshSessions(id, roles)
+	return roles, nil
+}
+
+func (s *userService) lookupRole(userID uuid.UUID, roleName string) (*model.Role, error) {
+	if _, err := s.GetProfile(userID); err != nil {
+		return nil, err
+	}
+
+	role, err := s.repo.GetRoleByName(roleName)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrRoleNotFound
+		}
+		return nil, err
+	}
+	return role, nil
+}
+
+// rolesChanged reloads the user's roles inside the role-change transaction
+// and queues the matching event.
+func rolesChanged(repo repository.UserRepository, id uuid.UUID, eventType, roleName string) ([]string, error) {
+	roles, err := repo.GetRoleNames(id)
+	if err != nil {
+		return nil, err
+	}
+	if roles == nil {
+		roles = []string{}
+	}
+
+	err = repo.AddEvent(eventType, events.RoleChanged{
+		UserID: id.String(),
+		Role:   roleName,
+		Roles:  roles,
+	})
+	return roles, err
+}
+
+func (s *userService) sessionIndexKey(userID uuid.UUID) string {
+	return fmt.Sprintf("user_sessions:%s", userID.String())
+}
+
+// refreshSessions rewrites the roles cached in every live session of the
+// user so the gateway enforces the new grants without a re-login.
+func (s *userService) refreshSessions(userID uuid.UUID, roles []string) {
+	ctx := context.Background()
+	indexKey := s.sessionIndexKey(userID)
+
+	tokens, err := s.rdb.SMembers(ctx, indexKey).Result()
+	if err != nil {
+		log.Printf("Failed to list sessions for user %s: %v", userID, err)
+		return
+	}
+
+	for _, token := range tokens {
+		val, err := s.rdb.Get(ctx, "session:"+token).Result()
+		if err == redis.Nil {
+			s.rdb.SRem(ctx, indexKey, token)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		var user model.User
+		if err := json.Unmarshal([]byte(val), &user); err != nil {
+			continue
+		}
+		user.Roles = roles
+
+		data, _ := json.Marshal(user)
+		s.rdb.SetArgs(ctx, "session:"+token, data, redis.SetArgs{KeepTTL: true})
+	}
 }
@@ -0,0 +1,19 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hero/microservice/user-service/internal/model"
+	"github.com/hero/microservice/user-service/internal/password"
+)
+
+func TestRegisterRejectsPasswordOverBcryptLimit(t *testing.T) {
+	svc := &userService{hasher: password.NewHasher(password.DefaultCost)}
+
+	// 72 characters pass the binding but take 144 bytes
+	input := model.RegisterInput{Username: "zoe", Email: "zoe@example.com", Password: strings.Repeat("é", 72)}
+	if _, err := svc.Register(input); err != ErrPasswordTooLong {
+		t.Errorf("Register = %v, want ErrPasswordTooLong", err)
+	}
+}
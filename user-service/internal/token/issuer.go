@@ -0,0 +1,143 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const IssuerName = "user-service"
+
+type Claims struct {
+	Roles     []string `json:"roles"`
+	SessionID string   `json:"sid"`
+	jwt.RegisteredClaims
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// Issuer signs RS256 access tokens. The public half is published as a
+// JWKS document so the gateway can verify tokens without calling us.
+type Issuer struct {
+	key       *rsa.PrivateKey
+	keyID     string
+	accessTTL time.Duration
+}
+
+// NewIssuer loads a PEM encoded RSA private key from keyPath. With an
+// empty path an ephemeral key is generated, which invalidates all issued
+// tokens on restart and is only suitable for local development.
+func NewIssuer(keyPath string, accessTTL time.Duration) (*Issuer, error) {
+	var key *rsa.PrivateKey
+	var err error
+
+	if keyPath == "" {
+		log.Println("JWT_PRIVATE_KEY_PATH not set, generating ephemeral signing key")
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		key, err = loadPrivateKey(keyPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Issuer{key: key, keyID: keyID(&key.PublicKey), accessTTL: accessTTL}, nil
+}
+
+func (i *Issuer) AccessTTL() time.Duration {
+	return i.accessTTL
+}
+
+func (i *Issuer) Issue(userID string, roles []string, sessionID string) (string, error) {
+	now := time.Now()
+	claims := Claims{
+		Roles:     roles,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    IssuerName,
+			Subject:   userID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(i.accessTTL)),
+		},
+	}
+
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	tok.Header["kid"] = i.keyID
+	return tok.SignedString(i.key)
+}
+
+func (i *Issuer) Parse(raw string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		return &i.key.PublicKey, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}), jwt.WithIssuer(IssuerName))
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (i *Issuer) JWKS() JWKSet {
+	pub := i.key.PublicKey
+	return JWKSet{Keys: []JWK{{
+		Kty: "RSA",
+		Use: "sig",
+		Alg: jwt.SigningMethodRS256.Alg(),
+		Kid: i.keyID,
+		N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}}}
+}
+
+func loadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("signing key is not PEM encoded")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("signing key is not an RSA key")
+	}
+	return key, nil
+}
+
+func keyID(pub *rsa.PublicKey) string {
+	sum := sha256.Sum256(x509.MarshalPKCS1PublicKey(pub))
+	return base64.RawURLEncoding.EncodeToString(sum[:8])
+}